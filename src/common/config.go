@@ -0,0 +1,252 @@
+package common
+
+import (
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "reflect"
+    "sort"
+    "strings"
+    "encoding/json"
+)
+
+// Checker validates a decoded conf, every problem goes to e
+type Checker interface {
+    Check(e *ConfigError)
+}
+
+// ConfigError lists every problem found in a conf file
+type ConfigError struct {
+    File     string
+    Problems []string
+    paths    map[string]bool
+    nulls    map[string]bool // dropped by checkValue
+}
+
+// Add records a problem of key path, only the first one per path is kept,
+// e.g. a key of wrong type is not reported again as missing. Keys inside
+// a null value are not reported at all.
+func (e *ConfigError) Add(path, format string, args ...interface{}) {
+    if e.paths == nil {
+        e.paths = make(map[string]bool)
+    }
+    if e.paths[path] {
+        return
+    }
+    for i := range path {
+        if (path[i] == '.' || path[i] == '[') && e.nulls[path[:i]] {
+            return
+        }
+    }
+    e.paths[path] = true
+    e.Problems = append(e.Problems, path + ": " + fmt.Sprintf(format, args...))
+}
+
+func (e *ConfigError) Error() string {
+    return fmt.Sprintf("conf[%s] has %d problems:\n  %s", e.File, len(e.Problems),
+    strings.Join(e.Problems, "\n  "))
+}
+
+// LoadConf decodes fileName into conf strictly: unknown keys and wrong
+// value types are errors, keys tagged `deprecated:"reason"` are accepted
+// and returned as warnings. conf holds defaults before the call, keys
+// absent in the file keep them. All problems are returned in one error.
+func LoadConf(fileName string, conf Checker) ([]string, error) {
+    content, err := ioutil.ReadFile(fileName)
+    if err != nil {
+        return nil, fmt.Errorf("read conf[%s] err[%s]", fileName, err)
+    }
+
+    dec := json.NewDecoder(bytes.NewReader(content))
+    dec.UseNumber()
+    var raw interface{}
+    if err := dec.Decode(&raw); err != nil {
+        return nil, fmt.Errorf("conf[%s] is not valid json err[%s]", fileName, err)
+    }
+
+    e := &ConfigError{File: fileName}
+    var warnings []string
+    checkValue(raw, reflect.TypeOf(conf), "", e, &warnings)
+
+    // free form values(e.g. predicate value) keep numbers as json.Number,
+    // type errors are already reported by checkValue, decoding goes on
+    // so Check can report the rest. Nulls checkValue dropped are decoded
+    // as absent, Check never sees a nil map value or slice item.
+    content, _ = json.Marshal(raw)
+    dec = json.NewDecoder(bytes.NewReader(content))
+    dec.UseNumber()
+    dec.Decode(conf)
+
+    conf.Check(e)
+    if len(e.Problems) > 0 {
+        return warnings, e
+    }
+    return warnings, nil
+}
+
+func joinPath(path, key string) string {
+    if path == "" {
+        return key
+    }
+    return path + "." + key
+}
+
+type confField struct {
+    typ        reflect.Type
+    deprecated string
+}
+
+// json keys of a struct, embedded structs are flattened like encoding/json
+func structFields(t reflect.Type, fields map[string]confField) {
+    for i := 0; i < t.NumField(); i++ {
+        f := t.Field(i)
+        tag := f.Tag.Get("json")
+        if tag == "-" {
+            continue
+        }
+        name := strings.Split(tag, ",")[0]
+        if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+            structFields(f.Type, fields)
+            continue
+        }
+        if f.PkgPath != "" {
+            continue
+        }
+        if name == "" {
+            name = f.Name
+        }
+        fields[name] = confField{typ: f.Type, deprecated: f.Tag.Get("deprecated")}
+    }
+}
+
+// nullable types take json null as a value, null of others is a problem
+func nullable(t reflect.Type) bool {
+    for t.Kind() == reflect.Ptr {
+        t = t.Elem()
+    }
+    return t.Kind() == reflect.Interface
+}
+
+func isStruct(t reflect.Type) bool {
+    for t.Kind() == reflect.Ptr {
+        t = t.Elem()
+    }
+    return t.Kind() == reflect.Struct
+}
+
+// checkValue reports problems of v decoded into t. A reported null is
+// dropped from its object, or replaced by {} in an array of objects so
+// later items keep their index.
+func checkValue(v interface{}, t reflect.Type, path string, e *ConfigError, warnings *[]string) {
+    for t.Kind() == reflect.Ptr {
+        t = t.Elem()
+    }
+    if v == nil {
+        if !nullable(t) {
+            e.Add(path, "null value, remove the key to use default")
+            if e.nulls == nil {
+                e.nulls = make(map[string]bool)
+            }
+            e.nulls[path] = true
+        }
+        return
+    }
+
+    switch t.Kind() {
+    case reflect.Struct:
+        obj, ok := v.(map[string]interface{})
+        if !ok {
+            e.Add(path, "want object, got %s", jsonKind(v))
+            return
+        }
+        fields := make(map[string]confField)
+        structFields(t, fields)
+
+        for _, key := range sortedKeys(obj) {
+            f, ok := fields[key]
+            if !ok {
+                e.Add(joinPath(path, key), "unknown key")
+                continue
+            }
+            if f.deprecated != "" {
+                *warnings = append(*warnings, fmt.Sprintf("%s: deprecated, %s", joinPath(path, key), f.deprecated))
+            }
+            checkValue(obj[key], f.typ, joinPath(path, key), e, warnings)
+            if obj[key] == nil && !nullable(f.typ) {
+                delete(obj, key)
+            }
+        }
+    case reflect.Map:
+        obj, ok := v.(map[string]interface{})
+        if !ok {
+            e.Add(path, "want object, got %s", jsonKind(v))
+            return
+        }
+        for _, key := range sortedKeys(obj) {
+            checkValue(obj[key], t.Elem(), joinPath(path, key), e, warnings)
+            if obj[key] == nil && !nullable(t.Elem()) {
+                delete(obj, key)
+            }
+        }
+    case reflect.Slice:
+        arr, ok := v.([]interface{})
+        if !ok {
+            e.Add(path, "want array, got %s", jsonKind(v))
+            return
+        }
+        for i, item := range arr {
+            checkValue(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), e, warnings)
+            if item == nil && isStruct(t.Elem()) {
+                arr[i] = map[string]interface{}{}
+            }
+        }
+    case reflect.String:
+        if _, ok := v.(string); !ok {
+            e.Add(path, "want string, got %s", jsonKind(v))
+        }
+    case reflect.Bool:
+        if _, ok := v.(bool); !ok {
+            e.Add(path, "want bool, got %s", jsonKind(v))
+        }
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        n, ok := v.(json.Number)
+        if !ok {
+            e.Add(path, "want integer, got %s", jsonKind(v))
+            return
+        }
+        if _, err := n.Int64(); err != nil {
+            e.Add(path, "want integer, got %s", n)
+        }
+    case reflect.Float32, reflect.Float64:
+        if _, ok := v.(json.Number); !ok {
+            e.Add(path, "want number, got %s", jsonKind(v))
+        }
+    }
+}
+
+// problems are reported in key order
+func sortedKeys(obj map[string]interface{}) []string {
+    keys := make([]string, 0, len(obj))
+    for key := range obj {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+func jsonKind(v interface{}) string {
+    switch v.(type) {
+    case map[string]interface{}:
+        return "object"
+    case []interface{}:
+        return "array"
+    case string:
+        return "string"
+    case bool:
+        return "bool"
+    case json.Number:
+        return "number"
+    }
+    return "null"
+}
@@ -0,0 +1,148 @@
+package common
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+type testInner struct {
+    Name  string `json:"name"`
+    Count int    `json:"count"`
+}
+
+type testConf struct {
+    Inner   testInner             `json:"inner"`
+    Items   []testInner           `json:"items"`
+    Refs    []*testInner          `json:"refs"`
+    Topics  map[string]*testInner `json:"topics"`
+    Rate    float64               `json:"rate"`
+    Enable  bool                  `json:"enable"`
+    Value   interface{}           `json:"value"`
+    OldTick int                   `json:"tick_sec" deprecated:"never used, remove it"`
+}
+
+// Check fails counts below zero, so checks run after type errors
+func (c *testConf) Check(e *ConfigError) {
+    if c.Inner.Count < 0 {
+        e.Add("inner.count", "must not be negative")
+    }
+    if c.Inner.Name == "" {
+        e.Add("inner.name", "required")
+    }
+    for name, topic := range c.Topics {
+        if topic.Count < 0 {
+            e.Add("topics." + name + ".count", "must not be negative")
+        }
+    }
+    for i, ref := range c.Refs {
+        if ref.Name == "" {
+            e.Add(fmt.Sprintf("refs[%d].name", i), "required")
+        }
+    }
+}
+
+func loadTestConf(t *testing.T, content string) (*testConf, []string, error) {
+    path := filepath.Join(t.TempDir(), "conf.json")
+    if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+    conf := &testConf{Inner: testInner{Name: "default", Count: 1}}
+    warnings, err := LoadConf(path, conf)
+    return conf, warnings, err
+}
+
+func TestLoadConfDefaults(t *testing.T) {
+    conf, warnings, err := loadTestConf(t, `{"inner": {"count": 5}, "value": {"any": [1, "x"]}, "rate": 0.5}`)
+    if err != nil || len(warnings) != 0 {
+        t.Fatalf("warnings %v err[%v]", warnings, err)
+    }
+    if conf.Inner.Name != "default" || conf.Inner.Count != 5 || conf.Rate != 0.5 {
+        t.Fatalf("conf %+v", conf)
+    }
+}
+
+func TestLoadConfUnknownKey(t *testing.T) {
+    _, _, err := loadTestConf(t, `{"inner": {"cuont": 5}, "items": [{"name": "a"}, {"nmae": "b"}],
+        "topics": {"t": {"x": 1}}, "enable": true}`)
+    ce, ok := err.(*ConfigError)
+    if !ok {
+        t.Fatalf("err[%v] is not ConfigError", err)
+    }
+    want := []string{
+        "inner.cuont: unknown key",
+        "items[1].nmae: unknown key",
+        "topics.t.x: unknown key",
+    }
+    if strings.Join(ce.Problems, "\n") != strings.Join(want, "\n") {
+        t.Fatalf("problems %q", ce.Problems)
+    }
+}
+
+func TestLoadConfDeprecatedKey(t *testing.T) {
+    conf, warnings, err := loadTestConf(t, `{"tick_sec": 20}`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(warnings) != 1 || warnings[0] != "tick_sec: deprecated, never used, remove it" {
+        t.Fatalf("warnings %q", warnings)
+    }
+    if conf.OldTick != 20 {
+        t.Fatalf("deprecated key not decoded, got %d", conf.OldTick)
+    }
+}
+
+// every problem is listed once, a wrong type is not reported again by Check
+func TestLoadConfAllProblems(t *testing.T) {
+    _, _, err := loadTestConf(t, `{"inner": {"name": 1, "count": -1}, "enable": "yes", "rate": "x",
+        "items": {}, "topics": {"t": null}}`)
+    ce, ok := err.(*ConfigError)
+    if !ok {
+        t.Fatalf("err[%v] is not ConfigError", err)
+    }
+    want := "conf[" + ce.File + "] has 6 problems:\n" +
+        "  enable: want bool, got string\n" +
+        "  inner.name: want string, got number\n" +
+        "  items: want array, got object\n" +
+        "  rate: want number, got string\n" +
+        "  topics.t: null value, remove the key to use default\n" +
+        "  inner.count: must not be negative"
+    if ce.Error() != want {
+        t.Fatalf("got\n%s\nwant\n%s", ce.Error(), want)
+    }
+}
+
+// nulls are reported and dropped before Check, which would deref them
+func TestLoadConfNulls(t *testing.T) {
+    conf, _, err := loadTestConf(t, `{"topics": {"t": null, "u": {"count": -1}}, "refs": [null, {"name": ""}],
+        "inner": {"name": null}, "value": null}`)
+    ce, ok := err.(*ConfigError)
+    if !ok {
+        t.Fatalf("err[%v] is not ConfigError", err)
+    }
+    want := []string{
+        "inner.name: null value, remove the key to use default",
+        "refs[0]: null value, remove the key to use default",
+        "topics.t: null value, remove the key to use default",
+        "topics.u.count: must not be negative",
+        "refs[1].name: required",
+    }
+    if strings.Join(ce.Problems, "\n") != strings.Join(want, "\n") {
+        t.Fatalf("problems %q", ce.Problems)
+    }
+    if _, ok := conf.Topics["t"]; ok || conf.Inner.Name != "default" || len(conf.Refs) != 2 {
+        t.Fatalf("conf %+v", conf)
+    }
+}
+
+func TestLoadConfInvalidJSON(t *testing.T) {
+    _, _, err := loadTestConf(t, `{"inner": `)
+    if err == nil || !strings.Contains(err.Error(), "not valid json") {
+        t.Fatalf("err[%v]", err)
+    }
+    if _, err := LoadConf("/nonexistent/conf.json", &testConf{}); err == nil {
+        t.Fatal("missing file loaded")
+    }
+}
@@ -24,10 +24,27 @@ func ReadConf(fileName string) (*sj.Json, error) {
     return ctx, nil
 }
 
-func InitLog(ctx *sj.Json) error {
-    logDir := ctx.Get("log").Get("log_dir").MustString()                       
-    logName := ctx.Get("log").Get("log_name").MustString()                     
-    logLevel := ctx.Get("log").Get("log_level").MustInt()                      
+// LogConfig is the "log" conf section, log_level 0(ALL) - 6(OFF)
+type LogConfig struct {
+    LogDir   string `json:"log_dir"`
+    LogName  string `json:"log_name"`
+    LogLevel int    `json:"log_level"`
+}
+
+func (c *LogConfig) Check(e *ConfigError) {
+    if c.LogDir == "" {
+        e.Add("log.log_dir", "required")
+    }
+    if c.LogName == "" {
+        e.Add("log.log_name", "required")
+    }
+    if c.LogLevel < 0 || c.LogLevel > 6 {
+        e.Add("log.log_level", "%d out of range 0-6", c.LogLevel)
+    }
+}
+
+func InitLog(conf *LogConfig) error {
+    logDir, logName, logLevel := conf.LogDir, conf.LogName, conf.LogLevel
     if logLevel < 0 {                                                           
         logLevel = 0                                                            
     }                                                                                                 
@@ -0,0 +1,538 @@
+package compact
+
+import (
+    "util"
+    "util/segment"
+    "logger"
+    "bytes"
+    "fmt"
+    "hash"
+    "io"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+    "compress/gzip"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+)
+
+// Options of a compaction run over one catalog
+type Options struct {
+    Topics   []string      // empty means all topics
+    Bucket   time.Duration // segments whose first msg is in one bucket are merged, default 1 hour
+    MinAge   time.Duration // only segments finished longer ago
+    MaxBytes int64         // stop adding segments to a merge past this size on disk, 0 no limit
+    MinFiles int           // buckets with fewer segments are left alone, default 2
+    Keyring  *util.Keyring // decrypts inputs, encrypts merges of encrypted inputs
+    DryRun   bool          // only plan, Result.Output is nil
+}
+
+// Result of one merge
+type Result struct {
+    Inputs  []*util.CatalogEntry
+    Output  *util.CatalogEntry // appended to catalog, nil if failed, skipped or dry run
+    Skipped error              // an input is being played or gone, tried again next run
+    Err     error
+}
+
+// segments merged together share all of key
+type groupKey struct {
+    dir       string
+    topic     string
+    channel   string
+    idc       string
+    codec     string
+    encrypted bool
+    bucket    int64
+}
+
+// empty segments have no msg time
+func entryTime(e *util.CatalogEntry) int64 {
+    if e.FirstTime != 0 {
+        return e.FirstTime
+    }
+    return e.CreateTime
+}
+
+// Plan groups finished segments still in place into merges, every merge
+// is in record order
+func Plan(entries []*util.CatalogEntry, opts *Options, now time.Time) [][]*util.CatalogEntry {
+    bucket := opts.Bucket
+    if bucket <= 0 {
+        bucket = time.Hour
+    }
+    minFiles := opts.MinFiles
+    if minFiles < 2 {
+        minFiles = 2
+    }
+    topics := make(map[string]bool)
+    for _, topic := range opts.Topics {
+        topics[topic] = true
+    }
+
+    groups := make(map[groupKey][]*util.CatalogEntry)
+    for _, e := range entries {
+        if len(topics) > 0 && !topics[e.Topic] {
+            continue
+        }
+        if now.Sub(time.Unix(0, e.CreateTime)) < opts.MinAge {
+            continue
+        }
+        // played segments are in done/, deleted ones are gone
+        if fi, err := os.Stat(e.Path); err != nil || fi.IsDir() {
+            continue
+        }
+
+        key := groupKey{
+            dir: filepath.Dir(e.Path),
+            topic: e.Topic,
+            channel: e.Channel,
+            idc: e.IDC,
+            codec: e.Codec,
+            encrypted: e.KeyID != "",
+            bucket: entryTime(e) / int64(bucket),
+        }
+        groups[key] = append(groups[key], e)
+    }
+
+    var ret [][]*util.CatalogEntry
+    for _, group := range groups {
+        sort.SliceStable(group, func(i, j int) bool {
+            if entryTime(group[i]) != entryTime(group[j]) {
+                return entryTime(group[i]) < entryTime(group[j])
+            }
+            if group[i].FirstSeq != group[j].FirstSeq {
+                return group[i].FirstSeq < group[j].FirstSeq
+            }
+            return group[i].Path < group[j].Path
+        })
+
+        var merge []*util.CatalogEntry
+        var size int64
+        for _, e := range group {
+            if opts.MaxBytes > 0 && len(merge) > 0 && size + e.CompressedBytes > opts.MaxBytes {
+                if len(merge) >= minFiles {
+                    ret = append(ret, merge)
+                }
+                merge, size = nil, 0
+            }
+            merge = append(merge, e)
+            size += e.CompressedBytes
+        }
+        if len(merge) >= minFiles {
+            ret = append(ret, merge)
+        }
+    }
+
+    sort.Slice(ret, func(i, j int) bool {
+        di, dj := filepath.Dir(ret[i][0].Path), filepath.Dir(ret[j][0].Path)
+        if di != dj {
+            return di < dj
+        }
+        return entryTime(ret[i][0]) < entryTime(ret[j][0])
+    })
+    return ret
+}
+
+// MergedName is the name of the first input with its msg count replaced
+// by count, e.g. backup.log.2017-03-26-10-00-00.000_5.gz -> ..._120.gz
+func MergedName(first *util.CatalogEntry, count uint64) (string, error) {
+    dir, base := filepath.Split(first.Path)
+    old := strconv.FormatUint(first.MsgCount, 10)
+
+    // the last occurrence not inside a longer number, msg-num comes after time-pattern
+    for end := len(base); end > 0; {
+        idx := strings.LastIndex(base[:end], old)
+        if idx == -1 {
+            break
+        }
+        after := idx + len(old)
+        if (idx == 0 || !isDigit(base[idx - 1])) && (after == len(base) || !isDigit(base[after])) {
+            return filepath.Join(dir, base[:idx] + strconv.FormatUint(count, 10) + base[after:]), nil
+        }
+        end = idx
+    }
+    return "", fmt.Errorf("no msg count %s in name[%s]", old, base)
+}
+
+func isDigit(c byte) bool {
+    return c >= '0' && c <= '9'
+}
+
+// countWriter counts and hashes what goes to disk, for the catalog entry
+type countWriter struct {
+    w      io.Writer
+    hasher hash.Hash
+    size   int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+    n, err := c.w.Write(p)
+    c.hasher.Write(p[:n])
+    c.size += int64(n)
+    return n, err
+}
+
+// digest of records, the merged segment must read back the same
+type digest struct {
+    hasher hash.Hash
+    count  uint64
+    meta   [20]byte
+}
+
+func newDigest() *digest {
+    return &digest{hasher: sha256.New()}
+}
+
+func (d *digest) add(rec *segment.Record) {
+    binary.BigEndian.PutUint64(d.meta[0:], uint64(rec.Timestamp))
+    binary.BigEndian.PutUint64(d.meta[8:], rec.Seq)
+    binary.BigEndian.PutUint32(d.meta[16:], uint32(len(rec.Body)))
+    d.hasher.Write(d.meta[:])
+    d.hasher.Write(rec.Body)
+    d.count++
+}
+
+// Merge writes inputs into one segment next to them, verifies it and
+// renames it in place. Inputs are not touched, the caller locks them and
+// commits the returned entry to catalog before removing them.
+func Merge(inputs []*util.CatalogEntry, keyring *util.Keyring) (*util.CatalogEntry, error) {
+    first := inputs[0]
+    var keyID string
+    if first.KeyID != "" {
+        if keyring == nil {
+            return nil, fmt.Errorf("inputs encrypted by key[%s], key file required", first.KeyID)
+        }
+        keyID = keyring.CurrentID()
+    }
+
+    temp := tempName(first.Path)
+    fp, err := os.OpenFile(temp, os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0666)
+    if err != nil {
+        return nil, err
+    }
+
+    out := &countWriter{w: fp, hasher: sha256.New()}
+    written, rawBytes, err := writeMerged(inputs, keyring, out)
+    if err == nil {
+        err = fp.Sync()
+    }
+    if cerr := fp.Close(); err == nil {
+        err = cerr
+    }
+    if err == nil {
+        if err = verify(temp, keyring, written); err != nil {
+            err = fmt.Errorf("verify merged[%s] err[%s]", temp, err)
+        }
+    }
+
+    // retention ages segments by mtime, merging must not restart it
+    if err == nil {
+        var latest time.Time
+        for _, in := range inputs {
+            if fi, serr := os.Stat(in.Path); serr == nil && fi.ModTime().After(latest) {
+                latest = fi.ModTime()
+            }
+        }
+        if !latest.IsZero() {
+            os.Chtimes(temp, latest, latest)
+        }
+    }
+
+    var final string
+    if err == nil {
+        final, err = MergedName(first, written.count)
+    }
+    if err == nil {
+        if _, serr := os.Stat(final); serr == nil {
+            err = fmt.Errorf("merged name[%s] exists", final)
+        }
+    }
+    if err == nil {
+        err = util.AtomicRename(temp, final)
+    }
+    if err != nil {
+        os.Remove(temp)
+        return nil, err
+    }
+
+    entry := &util.CatalogEntry{
+        Path: final,
+        Topic: first.Topic,
+        Channel: first.Channel,
+        IDC: first.IDC,
+        MsgCount: written.count,
+        RawBytes: rawBytes,
+        CompressedBytes: out.size,
+        Codec: first.Codec,
+        Checksum: hex.EncodeToString(out.hasher.Sum(nil)),
+        KeyID: keyID,
+        CreateTime: time.Now().UnixNano(),
+    }
+    for _, in := range inputs {
+        if in.FirstTime != 0 && (entry.FirstTime == 0 || in.FirstTime < entry.FirstTime) {
+            entry.FirstTime = in.FirstTime
+        }
+        if in.LastTime > entry.LastTime {
+            entry.LastTime = in.LastTime
+        }
+        if in.FirstSeq != 0 && entry.FirstSeq == 0 {
+            entry.FirstSeq = in.FirstSeq
+        }
+        if in.LastSeq != 0 {
+            entry.LastSeq = in.LastSeq
+        }
+        entry.Replaces = append(entry.Replaces, in.Path)
+    }
+    return entry, nil
+}
+
+// writeMerged copies records of inputs in order to out, encrypted and
+// compressed like the first input
+func writeMerged(inputs []*util.CatalogEntry, keyring *util.Keyring, out io.Writer) (*digest, int64, error) {
+    first := inputs[0]
+    sink := out
+    var encryptWriter io.WriteCloser
+    if first.KeyID != "" {
+        var err error
+        if encryptWriter, err = util.NewEncryptWriter(out, keyring); err != nil {
+            return nil, 0, err
+        }
+        sink = encryptWriter
+    }
+    var gzipWriter *gzip.Writer
+    if first.Codec == segment.CodecGzip {
+        gzipWriter = gzip.NewWriter(sink)
+        sink = gzipWriter
+    }
+
+    written := newDigest()
+    var w *segment.Writer
+    var flags byte
+    for _, in := range inputs {
+        file, err := segment.Open(in.Path, keyring)
+        if err != nil {
+            return nil, 0, err
+        }
+        file.SetPooled(true)
+
+        if w == nil {
+            flags = headerFlags(file.Header)
+            meta := map[string]string{}
+            if file.Header != nil {
+                for k, v := range file.Header.Meta {
+                    meta[k] = v
+                }
+            }
+            meta["compacted"] = strconv.Itoa(len(inputs))
+            w = segment.NewWriter(sink, segment.NewHeader(flags | segment.FlagCRC, meta))
+            err = w.WriteHeader()
+        } else if headerFlags(file.Header) != flags {
+            // e.g. record_timestamp changed between rotations
+            err = fmt.Errorf("record format differs from [%s]", first.Path)
+        }
+        if err == nil {
+            err = copyRecords(file, w, written)
+        }
+        file.Close()
+        if err != nil {
+            return nil, 0, fmt.Errorf("segment[%s]: %s", in.Path, err)
+        }
+    }
+
+    if gzipWriter != nil {
+        if err := gzipWriter.Close(); err != nil {
+            return nil, 0, err
+        }
+    }
+    if encryptWriter != nil {
+        if err := encryptWriter.Close(); err != nil {
+            return nil, 0, err
+        }
+    }
+    return written, w.Offset(), nil
+}
+
+func headerFlags(h *segment.Header) byte {
+    if h == nil {
+        return 0
+    }
+    return h.Flags
+}
+
+func copyRecords(file *segment.File, w *segment.Writer, written *digest) error {
+    for {
+        rec, err := file.Next()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        written.add(rec)
+        _, err = w.Write(rec)
+        rec.Release()
+        if err != nil {
+            return err
+        }
+    }
+}
+
+// verify reads the merged segment back, crc of every record is checked
+// by the reader
+func verify(path string, keyring *util.Keyring, written *digest) error {
+    file, err := segment.Open(path, keyring)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    file.SetPooled(true)
+
+    read := newDigest()
+    for {
+        rec, err := file.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return err
+        }
+        read.add(rec)
+        rec.Release()
+    }
+
+    if read.count != written.count {
+        return fmt.Errorf("read %d records, wrote %d", read.count, written.count)
+    }
+    if !bytes.Equal(read.hasher.Sum(nil), written.hasher.Sum(nil)) {
+        return fmt.Errorf("records differ from inputs")
+    }
+    return nil
+}
+
+// msg-num keeps play, retention and verify away until renamed
+const tempSuffix = ".compact.msg-num"
+
+func tempName(path string) string {
+    return path + tempSuffix
+}
+
+// removeStaleTemps removes merged files a crash left in dirs, only those
+// no merge can be writing: of an input locked by the caller, or of an
+// input already gone, which no merge can lock
+func removeStaleTemps(dirs map[string]bool, locked []*util.CatalogEntry) {
+    var stale []string
+    for _, in := range locked {
+        stale = append(stale, tempName(in.Path))
+    }
+    for dir := range dirs {
+        temps, _ := filepath.Glob(filepath.Join(dir, "*" + tempSuffix))
+        for _, temp := range temps {
+            if _, err := os.Stat(strings.TrimSuffix(temp, tempSuffix)); os.IsNotExist(err) {
+                stale = append(stale, temp)
+            }
+        }
+    }
+
+    for _, temp := range stale {
+        if err := os.Remove(temp); err == nil {
+            logger.Infof("Compact remove stale temp[%s]\n", temp)
+        } else if !os.IsNotExist(err) {
+            logger.Errorf("Compact remove stale temp[%s] err[%s]\n", temp, err)
+        }
+    }
+}
+
+// lockInputs takes exclusive locks on all inputs, none if any is being
+// played or already moved to done
+func lockInputs(inputs []*util.CatalogEntry) ([]*util.SegmentLock, error) {
+    var locks []*util.SegmentLock
+    for _, in := range inputs {
+        lock, err := util.LockSegment(in.Path, true)
+        if err != nil {
+            unlockInputs(locks)
+            return nil, err
+        }
+        locks = append(locks, lock)
+    }
+    return locks, nil
+}
+
+func unlockInputs(locks []*util.SegmentLock) {
+    for _, lock := range locks {
+        lock.Unlock()
+    }
+}
+
+// Compact merges small segments of catalog. The catalog line of a merge
+// is its commit point: before it the merged file is removed on error,
+// after it inputs are hidden from catalog readers and removed. Inputs are
+// locked against play from merging until removed, a merge with any input
+// being played is skipped, so a play never replays records twice.
+func Compact(catalog *util.Catalog, opts *Options) ([]*Result, error) {
+    entries, err := util.ReadCatalog(catalog.Path())
+    if err != nil {
+        return nil, err
+    }
+
+    if !opts.DryRun {
+        dirs := make(map[string]bool)
+        for _, e := range entries {
+            dirs[filepath.Dir(e.Path)] = true
+        }
+        removeStaleTemps(dirs, nil)
+    }
+
+    var ret []*Result
+    for _, inputs := range Plan(entries, opts, time.Now()) {
+        r := &Result{Inputs: inputs}
+        ret = append(ret, r)
+        if opts.DryRun {
+            continue
+        }
+
+        start := time.Now()
+        locks, err := lockInputs(inputs)
+        if err != nil {
+            r.Skipped = err
+            util.IncrStat("compact_skipped", 1)
+            logger.Infof("Compact [%s] and %d more skipped[%s]\n", inputs[0].Path, len(inputs) - 1, err)
+            continue
+        }
+        removeStaleTemps(nil, inputs)
+        output, err := Merge(inputs, opts.Keyring)
+        if err != nil {
+            unlockInputs(locks)
+            r.Err = err
+            logger.Errorf("Compact [%s] and %d more err[%s]\n", inputs[0].Path, len(inputs) - 1, err)
+            continue
+        }
+        if err := catalog.Append(output); err != nil {
+            unlockInputs(locks)
+            r.Err = err
+            os.Remove(output.Path)
+            continue
+        }
+        r.Output = output
+
+        var size int64
+        for _, in := range inputs {
+            size += in.CompressedBytes
+            if err := os.Remove(in.Path); err != nil && !os.IsNotExist(err) {
+                logger.Errorf("Compact remove input[%s] err[%s]\n", in.Path, err)
+            }
+        }
+        unlockInputs(locks)
+        util.IncrStat("compact_merged_files", int64(len(inputs)))
+        util.IncrStat("compact_output_files", 1)
+        util.IncrStat("compact_saved_bytes", size - output.CompressedBytes)
+        logger.Infof("Compact %d segments[%s ...] into[%s] msgs[%d] size[%d -> %d] in %s\n",
+        len(inputs), inputs[0].Path, output.Path, output.MsgCount, size, output.CompressedBytes,
+        time.Since(start))
+    }
+    return ret, nil
+}
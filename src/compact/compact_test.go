@@ -0,0 +1,447 @@
+package compact
+
+import (
+    "util"
+    "util/segment"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+    "compress/gzip"
+    "crypto/sha256"
+    "encoding/hex"
+)
+
+var now = time.Date(2017, 3, 26, 12, 0, 0, 0, time.UTC)
+
+func testKeyring(t *testing.T) *util.Keyring {
+    path := filepath.Join(t.TempDir(), "key.json")
+    key := `{"current": "k1", "keys": {"k1": "` + strings.Repeat("ab", 32) + `"}}`
+    if err := os.WriteFile(path, []byte(key), 0600); err != nil {
+        t.Fatal(err)
+    }
+    k, err := util.LoadKeyring(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return k
+}
+
+// writeInput writes a finished segment like record does and returns its
+// catalog entry, record i of bodies has timestamp first + i seconds
+func writeInput(t *testing.T, path string, keyring *util.Keyring, gz bool, first time.Time,
+    bodies ...string) *util.CatalogEntry {
+    if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+        t.Fatal(err)
+    }
+    fp, err := os.Create(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    h := sha256.New()
+    var sink io.Writer = io.MultiWriter(fp, h)
+    var closers []io.Closer
+    e := &util.CatalogEntry{Path: path, Topic: "t", Channel: "backup", Codec: segment.CodecNone,
+        MsgCount: uint64(len(bodies)), CreateTime: first.UnixNano()}
+    if keyring != nil {
+        ew, err := util.NewEncryptWriter(sink, keyring)
+        if err != nil {
+            t.Fatal(err)
+        }
+        sink, e.KeyID = ew, keyring.CurrentID()
+        closers = append(closers, ew)
+    }
+    if gz {
+        gw := gzip.NewWriter(sink)
+        sink, e.Codec = gw, segment.CodecGzip
+        closers = append(closers, gw)
+    }
+
+    w := segment.NewWriter(sink, segment.NewHeader(segment.FlagCRC | segment.FlagTimestamp,
+        map[string]string{"topic": "t"}))
+    if err := w.WriteHeader(); err != nil {
+        t.Fatal(err)
+    }
+    for i, body := range bodies {
+        ts := first.Add(time.Duration(i) * time.Second).UnixNano()
+        if _, err := w.Write(&segment.Record{Timestamp: ts, Body: []byte(body)}); err != nil {
+            t.Fatal(err)
+        }
+        if i == 0 {
+            e.FirstTime = ts
+        }
+        e.LastTime = ts
+    }
+    for i := len(closers) - 1; i >= 0; i-- {
+        closers[i].Close()
+    }
+    fp.Close()
+
+    fi, _ := os.Stat(path)
+    e.CompressedBytes = fi.Size()
+    e.Checksum = hex.EncodeToString(h.Sum(nil))
+    return e
+}
+
+// entry of an empty file, Plan only stats it
+func planEntry(t *testing.T, path string, first time.Time, size int64) *util.CatalogEntry {
+    if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(path, nil, 0666); err != nil {
+        t.Fatal(err)
+    }
+    return &util.CatalogEntry{Path: path, Topic: "t", Codec: segment.CodecGzip, MsgCount: 1,
+        FirstTime: first.UnixNano(), CreateTime: first.UnixNano(), CompressedBytes: size}
+}
+
+func readBodies(t *testing.T, path string, keyring *util.Keyring) []string {
+    file, err := segment.Open(path, keyring)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+    var ret []string
+    for {
+        rec, err := file.Next()
+        if err == io.EOF {
+            return ret
+        }
+        if err != nil {
+            t.Fatal(err)
+        }
+        ret = append(ret, string(rec.Body))
+    }
+}
+
+func paths(merge []*util.CatalogEntry) string {
+    var ret []string
+    for _, e := range merge {
+        ret = append(ret, filepath.Base(e.Path))
+    }
+    return strings.Join(ret, ",")
+}
+
+func TestPlan(t *testing.T) {
+    dir := t.TempDir()
+    at := func(m int) time.Time { return now.Add(-3 * time.Hour).Add(time.Duration(m) * time.Minute) }
+    e := func(name string, m int) *util.CatalogEntry {
+        return planEntry(t, filepath.Join(dir, "t", "backup", name), at(m), 10)
+    }
+
+    entries := []*util.CatalogEntry{e("c", 20), e("a", 0), e("b", 10)}
+    // next bucket, alone
+    entries = append(entries, e("d", 70))
+    // other topic
+    other := e("o1", 1)
+    other.Topic = "other"
+    entries = append(entries, other)
+    // same bucket but not groupable with a, b, c
+    plain := e("p", 2)
+    plain.Codec = segment.CodecNone
+    encrypted := e("k", 3)
+    encrypted.KeyID = "k1"
+    otherDir := planEntry(t, filepath.Join(dir, "t", "backup2", "x"), at(4), 10)
+    entries = append(entries, plain, encrypted, otherDir)
+    // too young
+    young := planEntry(t, filepath.Join(dir, "t", "backup", "y"), now.Add(-time.Minute), 10)
+    young.FirstTime = at(5).UnixNano()
+    // played or removed
+    gone := e("g", 6)
+    os.Remove(gone.Path)
+    entries = append(entries, young, gone)
+
+    got := Plan(entries, &Options{Topics: []string{"t"}, MinAge: time.Hour}, now)
+    if len(got) != 1 || paths(got[0]) != "a,b,c" {
+        t.Fatalf("plan %d merges, first[%s]", len(got), paths(got[0]))
+    }
+
+    // all topics, two merges in dir and time order
+    other2 := e("o2", 2)
+    other2.Topic = "other"
+    got = Plan(append(entries, other2), &Options{MinAge: time.Hour}, now)
+    if len(got) != 2 || paths(got[0]) != "a,b,c" || paths(got[1]) != "o1,o2" {
+        t.Fatalf("plan %d merges", len(got))
+    }
+
+    // three of a bucket are needed
+    if got = Plan(entries, &Options{MinAge: time.Hour, MinFiles: 4}, now); len(got) != 0 {
+        t.Fatalf("plan %d merges, want none", len(got))
+    }
+}
+
+func TestPlanMaxBytes(t *testing.T) {
+    dir := t.TempDir()
+    var entries []*util.CatalogEntry
+    for i, size := range []int64{40, 40, 40, 100, 10, 10} {
+        path := filepath.Join(dir, fmt.Sprintf("s%d", i))
+        entries = append(entries, planEntry(t, path, now.Add(-time.Hour).Add(time.Duration(i) * time.Second), size))
+    }
+
+    // s3 alone is past the limit, merges never skip over it
+    got := Plan(entries, &Options{MaxBytes: 100}, now)
+    if len(got) != 2 || paths(got[0]) != "s0,s1" || paths(got[1]) != "s4,s5" {
+        for _, merge := range got {
+            t.Logf("merge[%s]", paths(merge))
+        }
+        t.Fatalf("plan %d merges", len(got))
+    }
+}
+
+func TestMergedName(t *testing.T) {
+    cases := []struct {
+        path  string
+        count uint64
+        want  string
+    }{
+        {"/d/backup.log.2017-03-26-10-00-00.000_5.gz", 120, "/d/backup.log.2017-03-26-10-00-00.000_120.gz"},
+        // count is in the time too, only the last whole number is replaced
+        {"/d/backup.log.2015-05-25-05-05-05.005_5.gz", 7, "/d/backup.log.2015-05-25-05-05-05.005_7.gz"},
+        {"/d/backup.log.2017-03-26-10-00-00.000_10", 300, "/d/backup.log.2017-03-26-10-00-00.000_300"},
+        {"/d/x_1.1_1.gz", 2, "/d/x_1.1_2.gz"},
+        {"/d/5", 6, "/d/6"},
+    }
+    for _, c := range cases {
+        n, _ := countOf(c.path)
+        got, err := MergedName(&util.CatalogEntry{Path: c.path, MsgCount: n}, c.count)
+        if err != nil || got != c.want {
+            t.Fatalf("MergedName(%s, %d) = %s, %v, want %s", c.path, c.count, got, err, c.want)
+        }
+    }
+
+    // 5 only inside longer numbers
+    for _, path := range []string{"/d/backup.log.2017-03-26-10-00-00.000_15.gz", "/d/backup.log_55", "/d/x"} {
+        if got, err := MergedName(&util.CatalogEntry{Path: path, MsgCount: 5}, 9); err == nil {
+            t.Fatalf("MergedName(%s) = %s, want err", path, got)
+        }
+    }
+}
+
+// msg count of a test name, the number after the last _
+func countOf(path string) (uint64, error) {
+    base := strings.TrimSuffix(filepath.Base(path), ".gz")
+    var n uint64
+    _, err := fmt.Sscanf(base[strings.LastIndex(base, "_") + 1:], "%d", &n)
+    return n, err
+}
+
+func TestMergeRoundTrip(t *testing.T) {
+    keyring := testKeyring(t)
+    cases := []struct {
+        name    string
+        keyring *util.Keyring
+        gz      bool
+    }{
+        {"plain", nil, false},
+        {"gzip", nil, true},
+        {"encrypted", keyring, false},
+        {"encrypted gzip", keyring, true},
+    }
+    for _, c := range cases {
+        dir := t.TempDir()
+        first := now.Add(-3 * time.Hour)
+        inputs := []*util.CatalogEntry{
+            writeInput(t, filepath.Join(dir, "backup.log.a_2.gz"), c.keyring, c.gz, first, "a1", "a2"),
+            writeInput(t, filepath.Join(dir, "backup.log.b_1.gz"), c.keyring, c.gz, first.Add(time.Minute), "b1"),
+            writeInput(t, filepath.Join(dir, "backup.log.c_3.gz"), c.keyring, c.gz, first.Add(2 * time.Minute), "c1", "c2", "c3"),
+        }
+
+        out, err := Merge(inputs, keyring)
+        if err != nil {
+            t.Fatalf("%s: merge err[%s]", c.name, err)
+        }
+        if out.Path != filepath.Join(dir, "backup.log.a_6.gz") || out.MsgCount != 6 {
+            t.Fatalf("%s: merged %s msgs %d", c.name, out.Path, out.MsgCount)
+        }
+        if got := strings.Join(readBodies(t, out.Path, keyring), ","); got != "a1,a2,b1,c1,c2,c3" {
+            t.Fatalf("%s: merged records[%s]", c.name, got)
+        }
+        if paths(inputs) != strings.Join(func() []string {
+            var ret []string
+            for _, p := range out.Replaces {
+                ret = append(ret, filepath.Base(p))
+            }
+            return ret
+        }(), ",") {
+            t.Fatalf("%s: replaces %v", c.name, out.Replaces)
+        }
+        if out.FirstTime != inputs[0].FirstTime || out.LastTime != inputs[2].LastTime {
+            t.Fatalf("%s: merged time [%d, %d]", c.name, out.FirstTime, out.LastTime)
+        }
+        if out.Codec != inputs[0].Codec || (out.KeyID != "") != (c.keyring != nil) {
+            t.Fatalf("%s: merged codec[%s] key[%s]", c.name, out.Codec, out.KeyID)
+        }
+
+        content, _ := os.ReadFile(out.Path)
+        sum := sha256.Sum256(content)
+        if out.Checksum != hex.EncodeToString(sum[:]) || out.CompressedBytes != int64(len(content)) {
+            t.Fatalf("%s: checksum or size not of file on disk", c.name)
+        }
+        for _, in := range inputs {
+            if _, err := os.Stat(in.Path); err != nil {
+                t.Fatalf("%s: input touched by merge err[%s]", c.name, err)
+            }
+        }
+        if m, _ := filepath.Glob(filepath.Join(dir, "*msg-num")); len(m) != 0 {
+            t.Fatalf("%s: temp left %v", c.name, m)
+        }
+    }
+}
+
+func TestMergeErrors(t *testing.T) {
+    keyring := testKeyring(t)
+    dir := t.TempDir()
+    first := now.Add(-3 * time.Hour)
+    a := writeInput(t, filepath.Join(dir, "a_1"), keyring, false, first, "a")
+    b := writeInput(t, filepath.Join(dir, "b_1"), keyring, false, first, "b")
+    if _, err := Merge([]*util.CatalogEntry{a, b}, nil); err == nil {
+        t.Fatal("merged encrypted inputs without key")
+    }
+
+    // record format changed between rotations
+    c := writeInput(t, filepath.Join(dir, "c_1"), nil, false, first, "c")
+    fp, _ := os.Create(filepath.Join(dir, "d_1"))
+    w := segment.NewWriter(fp, segment.NewHeader(segment.FlagCRC, nil))
+    w.WriteHeader()
+    w.Write(&segment.Record{Body: []byte("d")})
+    fp.Close()
+    d := &util.CatalogEntry{Path: filepath.Join(dir, "d_1"), MsgCount: 1, Codec: segment.CodecNone}
+    if _, err := Merge([]*util.CatalogEntry{c, d}, nil); err == nil || !strings.Contains(err.Error(), "format differs") {
+        t.Fatalf("merge of different formats err[%v]", err)
+    }
+
+    // merged name taken
+    e := writeInput(t, filepath.Join(dir, "e_1"), nil, false, first, "e")
+    os.WriteFile(filepath.Join(dir, "c_2"), nil, 0666)
+    if _, err := Merge([]*util.CatalogEntry{c, e}, nil); err == nil || !strings.Contains(err.Error(), "exists") {
+        t.Fatalf("merge onto existing name err[%v]", err)
+    }
+    if m, _ := filepath.Glob(filepath.Join(dir, "*msg-num")); len(m) != 0 {
+        t.Fatalf("temp left %v", m)
+    }
+}
+
+func compactDir(t *testing.T) (*util.Catalog, []*util.CatalogEntry) {
+    dir := t.TempDir()
+    catalog := util.GetCatalog(filepath.Join(dir, util.DefaultCatalogName))
+    first := time.Now().Add(-3 * time.Hour).Truncate(time.Hour)
+    var inputs []*util.CatalogEntry
+    for i, name := range []string{"backup.log.a_1.gz", "backup.log.b_1.gz"} {
+        e := writeInput(t, filepath.Join(dir, "t", "backup", name), nil, true,
+            first.Add(time.Duration(i) * time.Minute), name)
+        if err := catalog.Append(e); err != nil {
+            t.Fatal(err)
+        }
+        inputs = append(inputs, e)
+    }
+    return catalog, inputs
+}
+
+func TestCompact(t *testing.T) {
+    catalog, inputs := compactDir(t)
+    results, err := Compact(catalog, &Options{MinAge: time.Hour})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(results) != 1 || results[0].Err != nil || results[0].Skipped != nil || results[0].Output == nil {
+        t.Fatalf("results %d %+v", len(results), results[0])
+    }
+    for _, in := range inputs {
+        if _, err := os.Stat(in.Path); !os.IsNotExist(err) {
+            t.Fatalf("input[%s] not removed", in.Path)
+        }
+    }
+
+    entries, err := util.ReadCatalog(catalog.Path())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(entries) != 1 || entries[0].Path != results[0].Output.Path || entries[0].MsgCount != 2 {
+        t.Fatalf("catalog %d entries", len(entries))
+    }
+
+    // nothing left to merge
+    if results, _ = Compact(catalog, &Options{MinAge: time.Hour}); len(results) != 0 {
+        t.Fatalf("second run %d results", len(results))
+    }
+}
+
+func TestCompactSkipsPlaying(t *testing.T) {
+    catalog, inputs := compactDir(t)
+
+    // play is reading the second input
+    lock, err := util.LockSegment(inputs[1].Path, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    results, err := Compact(catalog, &Options{MinAge: time.Hour})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(results) != 1 || !errors.Is(results[0].Skipped, util.ErrSegmentLocked) || results[0].Output != nil {
+        t.Fatalf("results %d %+v", len(results), results[0])
+    }
+    for _, in := range inputs {
+        if _, err := os.Stat(in.Path); err != nil {
+            t.Fatalf("input of skipped merge err[%s]", err)
+        }
+        // the first input was locked and must be unlocked again
+        l, err := util.LockSegment(in.Path, false)
+        if err != nil {
+            t.Fatal(err)
+        }
+        l.Unlock()
+    }
+    if m, _ := filepath.Glob(filepath.Join(filepath.Dir(inputs[0].Path), "*msg-num")); len(m) != 0 {
+        t.Fatalf("temp left %v", m)
+    }
+
+    // played and moved to done, the next run leaves it alone
+    lock.Unlock()
+    done := filepath.Join(filepath.Dir(inputs[1].Path), "done")
+    os.MkdirAll(done, 0770)
+    os.Rename(inputs[1].Path, filepath.Join(done, filepath.Base(inputs[1].Path) + ".done"))
+    if results, _ = Compact(catalog, &Options{MinAge: time.Hour}); len(results) != 0 {
+        t.Fatalf("run after play %d results", len(results))
+    }
+
+    // dry run plans without locking or merging
+    other, _ := compactDir(t)
+    results, _ = Compact(other, &Options{MinAge: time.Hour, DryRun: true})
+    if len(results) != 1 || results[0].Output != nil || results[0].Skipped != nil {
+        t.Fatalf("dry run %d results", len(results))
+    }
+}
+
+// temps left by a crash neither block the next merge of the same inputs
+// nor stay around when their input is gone
+func TestCompactStaleTemps(t *testing.T) {
+    catalog, inputs := compactDir(t)
+    dir := filepath.Dir(inputs[0].Path)
+    for _, temp := range []string{tempName(inputs[0].Path), filepath.Join(dir, "gone" + tempSuffix)} {
+        if err := os.WriteFile(temp, []byte("half merged"), 0666); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // a temp of an existing segment may be in use, kept until it is locked
+    playing := filepath.Join(dir, "playing")
+    os.WriteFile(playing, nil, 0666)
+    os.WriteFile(tempName(playing), nil, 0666)
+
+    results, err := Compact(catalog, &Options{MinAge: time.Hour})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(results) != 1 || results[0].Err != nil || results[0].Output == nil {
+        t.Fatalf("results %d %+v", len(results), results[0])
+    }
+    m, _ := filepath.Glob(filepath.Join(dir, "*" + tempSuffix))
+    if len(m) != 1 || m[0] != tempName(playing) {
+        t.Fatalf("temps left %v", m)
+    }
+}
@@ -14,35 +14,46 @@ import (
 )
 
 var conf = flag.String("f", "etc/play.json", "conf path")
+var checkConf = flag.Bool("check-config", false, "validate conf, print problems and exit")
 
 // play program will dump data in disk to nsqd,
 // data in disk format is: header(len(raw data), bigendia) + raw_data
 func main() {
-    if len(os.Args) != 3 {
-        fmt.Fprintf(os.Stderr, "Usage: %s -f conf_path\n", os.Args[0])
+    flag.Parse()
+    if len(os.Args) < 3 || flag.NArg() != 0 {
+        fmt.Fprintf(os.Stderr, "Usage: %s -f conf_path [--check-config]\n", os.Args[0])
         os.Exit(-1)
     }
 
-    flag.Parse()
     logger.Debugf("Got conf path: [%s]\n", *conf)
 
-    ctx, err := common.ReadConf(*conf)
+    cfg := play.NewConfig()
+    warnings, err := common.LoadConf(*conf, cfg)
+    if *checkConf {
+        for _, w := range warnings {
+            fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+        }
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "%s\n", err)
+            os.Exit(1)
+        }
+        fmt.Printf("conf[%s] ok\n", *conf)
+        return
+    }
     if err != nil {
-        logger.Errorf("Parse conf[%s] err[%s], please check!!!\n", *conf, err)
+        logger.Errorf("%s, please check!!!\n", err)
         os.Exit(-2)
     }
 
-    if ctx == nil {
-        logger.Errorf("Conf[%s] to Json is nil, please Check!!!\n", *conf)
-        return;
-    }
-
-    if err := util.InitMisc(ctx); err != nil {
+    if err := util.InitMisc(cfg.Main.PidFile, &cfg.MiscConfig); err != nil {
         logger.Errorf("initMisc err[%s]\n", err)
         return
     }
+    for _, w := range warnings {
+        logger.Warnf("conf[%s] %s\n", *conf, w)
+    }
 
-    play.Main(ctx)
+    play.Main(cfg)
 
     logger.Debugf("record process end\n")
 }
@@ -0,0 +1,12 @@
+package main
+
+import (
+    "os"
+    "vcr"
+)
+
+// vcr is the command line tool for the backup archive,
+// usage: vcr command [options]
+func main() {
+    os.Exit(vcr.Main(os.Args[1:]))
+}
@@ -0,0 +1,173 @@
+package play
+
+import (
+    "util"
+    "common"
+    "fmt"
+    "regexp"
+)
+
+// Config is play conf file, defaults come from NewConfig
+type Config struct {
+    util.MiscConfig
+    Main       MainConfig       `json:"main"`
+    Encryption EncryptionConfig `json:"encryption"`
+}
+
+type MainConfig struct {
+    Name        string               `json:"name"`         // default DefaultPlay
+    PidFile     string               `json:"pid_file"`
+    NSQ         NSQConfig            `json:"nsq"`
+    MonitorInfo []*MonitorInfoConfig `json:"monitor_info"` // required
+    CatalogName string               `json:"catalog_name"` // default util.DefaultCatalogName
+
+    // copied from record conf, play reads segment format from header
+    TickSec              int    `json:"tick_sec" deprecated:"never used by play, remove it"`
+    IsGz                 bool   `json:"is_gz" deprecated:"play detects gzip itself, remove it"`
+    TimePattern          string `json:"time-pattern" deprecated:"never used by play, remove it"`
+    MaxBlockPerFile      int    `json:"max-block-per-file" deprecated:"never used by play, remove it"`
+    MaxSizePerFileM      int    `json:"max-size-per-file-m" deprecated:"never used by play, remove it"`
+    MaxTimeRollingMinute int    `json:"max-time-rolling-minute" deprecated:"never used by play, remove it"`
+    FileNamePattern      string `json:"file_name_pattern" deprecated:"never used by play, remove it"`
+    UselessTail          int    `json:"useless_tail" deprecated:"never used by play, remove it"`
+}
+
+type NSQConfig struct {
+    NSQDAddrs   []string `json:"nsqd_addrs"` // required unless every monitor_info has its own or target_idc
+    NSQConf     string   `json:"nsq_conf"`   // nsq.json holding nsqd_address of idcs, default util.DefaultNSQConf
+    TargetIDC   string   `json:"target_idc"` // publish to nsqd_address of this idc if no nsqd_addrs
+    Client      util.NSQClientConfig `json:"client"` // tls, auth, compression of producers
+
+    Channel     string   `json:"channel" deprecated:"play only publishes, remove it"`
+    MaxInFlight int      `json:"max-in-flight" deprecated:"play only publishes, remove it"`
+    TimeoutSec  int      `json:"timeout_sec" deprecated:"never used by play, remove it"`
+}
+
+// MonitorInfoConfig is one item of monitor_info, replays recorded topic
+// in monitor_dirs to target_topic on nsqd_addrs
+type MonitorInfoConfig struct {
+    Topic       string       `json:"topic"`        // required
+    MonitorDirs []string     `json:"monitor_dirs"` // required
+    Rules       *RulesConfig `json:"rules"`        // nil publishes all as is
+    TargetTopic string       `json:"target_topic"` // default topic
+    Rate        int          `json:"rate"`         // msgs per second of this entry, 0 no limit
+    NSQDAddrs   []string     `json:"nsqd_addrs"`   // default nsqd of target_idc, then main.nsq
+    TargetIDC   string       `json:"target_idc"`   // publish to nsqd_address of this idc in main.nsq.nsq_conf
+    Merge       string       `json:"merge"`        // timestamp or seq replays dirs as one ordered stream
+    Client      *util.NSQClientConfig `json:"client"` // replaces main.nsq.client for this entry
+}
+
+// target topic and nsqd of an entry, nsqd are taken from the first set of
+// entry nsqd_addrs, entry target_idc, main nsqd_addrs and main target_idc
+func (mi *MonitorInfoConfig) Target(main *MainConfig) (string, []string, error) {
+    topic := mi.TargetTopic
+    if topic == "" {
+        topic = mi.Topic
+    }
+
+    switch {
+    case len(mi.NSQDAddrs) > 0:
+        return topic, mi.NSQDAddrs, nil
+    case mi.TargetIDC != "":
+        addrs, err := util.GetNSQDAddrs(main.NSQ.NSQConf, mi.TargetIDC)
+        return topic, addrs, err
+    case len(main.NSQ.NSQDAddrs) > 0:
+        return topic, main.NSQ.NSQDAddrs, nil
+    case main.NSQ.TargetIDC != "":
+        addrs, err := util.GetNSQDAddrs(main.NSQ.NSQConf, main.NSQ.TargetIDC)
+        return topic, addrs, err
+    }
+    return topic, nil, fmt.Errorf("no nsqd_addrs or target_idc")
+}
+
+type EncryptionConfig struct {
+    KeyFile string `json:"key_file"` // empty means no encrypted segments
+}
+
+func NewConfig() *Config {
+    return &Config{
+        MiscConfig: util.DefaultMiscConfig(),
+        Main: MainConfig{
+            Name: "DefaultPlay",
+            CatalogName: util.DefaultCatalogName,
+        },
+    }
+}
+
+func (c *Config) Check(e *common.ConfigError) {
+    c.MiscConfig.Check(e)
+
+    for i, mi := range c.Main.MonitorInfo {
+        if _, _, err := mi.Target(&c.Main); err != nil {
+            e.Add(fmt.Sprintf("main.monitor_info[%d]", i), "target nsqd %s", err)
+        }
+    }
+    for i, addr := range c.Main.NSQ.NSQDAddrs {
+        if addr == "" {
+            e.Add(fmt.Sprintf("main.nsq.nsqd_addrs[%d]", i), "empty addr")
+        }
+    }
+    c.Main.NSQ.Client.Check("main.nsq.client", e)
+    if c.Main.CatalogName == "" {
+        e.Add("main.catalog_name", "must not be empty")
+    }
+
+    if len(c.Main.MonitorInfo) == 0 {
+        e.Add("main.monitor_info", "required")
+    }
+    for i, mi := range c.Main.MonitorInfo {
+        path := fmt.Sprintf("main.monitor_info[%d]", i)
+        if mi.Topic == "" {
+            e.Add(path + ".topic", "required")
+        }
+        if len(mi.MonitorDirs) == 0 {
+            e.Add(path + ".monitor_dirs", "required")
+        }
+        if mi.Rules != nil {
+            mi.Rules.check(path + ".rules", e)
+        }
+        switch mi.Merge {
+        case "", MergeTimestamp, MergeSeq:
+        default:
+            e.Add(path + ".merge", "invalid merge[%s], want %s or %s", mi.Merge, MergeTimestamp, MergeSeq)
+        }
+        if mi.Client != nil {
+            mi.Client.Check(path + ".client", e)
+        }
+        if mi.Rate < 0 {
+            e.Add(path + ".rate", "must not be negative")
+        }
+        if mi.NSQDAddrs != nil && len(mi.NSQDAddrs) == 0 {
+            e.Add(path + ".nsqd_addrs", "must not be empty, remove it to use main.nsq.nsqd_addrs")
+        }
+        for j, addr := range mi.NSQDAddrs {
+            if addr == "" {
+                e.Add(fmt.Sprintf("%s.nsqd_addrs[%d]", path, j), "empty addr")
+            }
+        }
+    }
+
+    if c.Encryption.KeyFile != "" {
+        if _, err := util.LoadKeyring(c.Encryption.KeyFile); err != nil {
+            e.Add("encryption.key_file", "%s", err)
+        }
+    }
+}
+
+func (c *RulesConfig) check(path string, e *common.ConfigError) {
+    if _, err := util.NewPredicates(c.Include); err != nil {
+        e.Add(path + ".include", "%s", err)
+    }
+    if _, err := util.NewPredicates(c.Exclude); err != nil {
+        e.Add(path + ".exclude", "%s", err)
+    }
+    if _, err := regexp.Compile(c.IncludeRegex); err != nil {
+        e.Add(path + ".include_regex", "%s", err)
+    }
+    if _, err := regexp.Compile(c.ExcludeRegex); err != nil {
+        e.Add(path + ".exclude_regex", "%s", err)
+    }
+    if _, ok := timeUnits[c.ShiftTime.Unit]; !ok && c.ShiftTime.Unit != "" {
+        e.Add(path + ".shift_time.unit", "invalid unit[%s], want s ms us or ns", c.ShiftTime.Unit)
+    }
+}
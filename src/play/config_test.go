@@ -0,0 +1,123 @@
+package play
+
+import (
+    "common"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+const testPlayConf = `{
+  "main": {
+    "nsq": {"nsqd_addrs": ["127.0.0.1:4150"]},
+    "monitor_info": [
+      {"topic": "test", "monitor_dirs": ["/tmp/data/test/backup"]}
+    ]
+  },
+  "log": {"log_dir": "/tmp", "log_name": "play.log"}
+}`
+
+func loadConf(t *testing.T, content string) (*Config, error) {
+    path := filepath.Join(t.TempDir(), "play.json")
+    if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+    conf := NewConfig()
+    _, err := common.LoadConf(path, conf)
+    return conf, err
+}
+
+func TestLoadSampleConf(t *testing.T) {
+    for _, path := range []string{"../../etc/play.json", "../../etc/ut/play.json"} {
+        if _, err := common.LoadConf(path, NewConfig()); err != nil {
+            t.Fatalf("%s err[%v]", path, err)
+        }
+    }
+}
+
+// a null entry is reported, the rest keep their index
+func TestLoadConfNullMonitorInfo(t *testing.T) {
+    content := strings.Replace(testPlayConf, `"monitor_info": [`, `"monitor_info": [null, {"topic": "x"},`, 1)
+    _, err := loadConf(t, content)
+    ce, ok := err.(*common.ConfigError)
+    if !ok {
+        t.Fatalf("err[%v] is not ConfigError", err)
+    }
+    want := []string{
+        "main.monitor_info[0]: null value, remove the key to use default",
+        "main.monitor_info[1].monitor_dirs: required",
+    }
+    for _, w := range want {
+        if !strings.Contains(ce.Error(), w) {
+            t.Fatalf("problems %q miss %s", ce.Problems, w)
+        }
+    }
+}
+
+func writeNSQConf(t *testing.T) string {
+    path := filepath.Join(t.TempDir(), "nsq.json")
+    content := `{"nsqd_address": {"idc1": ["10.0.1.1:4150"], "idc2": ["10.0.2.1:4150", "10.0.2.2:4150"]}}`
+    if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+// nsqd of an entry come from the first set of entry nsqd_addrs, entry
+// target_idc, main nsqd_addrs and main target_idc
+func TestMonitorInfoTarget(t *testing.T) {
+    nsqConf := writeNSQConf(t)
+    cases := []struct {
+        entry MonitorInfoConfig
+        main  NSQConfig
+        topic string
+        addrs string
+    }{
+        {MonitorInfoConfig{Topic: "a", NSQDAddrs: []string{"e:4150"}, TargetIDC: "idc1"},
+            NSQConfig{NSQDAddrs: []string{"m:4150"}, TargetIDC: "idc2"}, "a", "e:4150"},
+        {MonitorInfoConfig{Topic: "a", TargetTopic: "b", TargetIDC: "idc1"},
+            NSQConfig{NSQDAddrs: []string{"m:4150"}, TargetIDC: "idc2"}, "b", "10.0.1.1:4150"},
+        {MonitorInfoConfig{Topic: "a"},
+            NSQConfig{NSQDAddrs: []string{"m:4150"}, TargetIDC: "idc2"}, "a", "m:4150"},
+        {MonitorInfoConfig{Topic: "a"},
+            NSQConfig{TargetIDC: "idc2"}, "a", "10.0.2.1:4150,10.0.2.2:4150"},
+    }
+    for i, c := range cases {
+        c.main.NSQConf = nsqConf
+        topic, addrs, err := c.entry.Target(&MainConfig{NSQ: c.main})
+        if err != nil || topic != c.topic || strings.Join(addrs, ",") != c.addrs {
+            t.Fatalf("case %d: got %s %v err[%v], want %s %s", i, topic, addrs, err, c.topic, c.addrs)
+        }
+    }
+
+    if _, _, err := (&MonitorInfoConfig{Topic: "a"}).Target(&MainConfig{}); err == nil {
+        t.Fatal("no nsqd got no err")
+    }
+}
+
+// target_idc publishes to nsqd_address of that idc in nsq_conf
+func TestTargetIDC(t *testing.T) {
+    nsqConf := writeNSQConf(t)
+    content := strings.Replace(testPlayConf, `"nsqd_addrs": ["127.0.0.1:4150"]`,
+        `"nsq_conf": "` + nsqConf + `", "target_idc": "idc2"`, 1)
+    content = strings.Replace(content, `"monitor_dirs": ["/tmp/data/test/backup"]}`,
+        `"monitor_dirs": ["/tmp/data/test/backup"]}, {"topic": "b", "monitor_dirs": ["/tmp/b"], "target_idc": "idc1"}`, 1)
+    conf, err := loadConf(t, content)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i, want := range []string{"10.0.2.1:4150,10.0.2.2:4150", "10.0.1.1:4150"} {
+        _, addrs, err := conf.Main.MonitorInfo[i].Target(&conf.Main)
+        if err != nil || strings.Join(addrs, ",") != want {
+            t.Fatalf("entry %d addrs %v err[%v], want %s", i, addrs, err, want)
+        }
+    }
+
+    // an idc missing in nsq_conf fails at load
+    _, err = loadConf(t, strings.Replace(content, `"target_idc": "idc1"`, `"target_idc": "idc9"`, 1))
+    if err == nil || !strings.Contains(err.Error(), "main.monitor_info[1]: target nsqd") ||
+        !strings.Contains(err.Error(), "idc[idc9]") {
+        t.Fatalf("err[%v]", err)
+    }
+}
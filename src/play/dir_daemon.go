@@ -2,6 +2,7 @@ package play
 
 import (
     "util"
+    "util/segment"
     "fmt"
     "time"
     "logger"
@@ -10,15 +11,13 @@ import (
     "path/filepath"
     "sort"
     "io"
-    "bufio"
-    "compress/gzip"
-    "encoding/binary"
 )
 
 // every DirDaemon monitor a dir for a topic
 // monitor dirdaemon
 type DirDaemon struct {
-    topic             string
+    topic             string // recorded topic
+    targetTopic       string // publish to
     dirname           string
     lastProcessFile   string
     checkInterval     time.Duration // default 30s
@@ -27,18 +26,29 @@ type DirDaemon struct {
 
     isGz              bool
     validFilePattern  string
+    catalogName       string // find segments from catalog if exists
+    keyring           *util.Keyring // decrypt encrypted segments
+    transformer       *Transformer // replay rules, nil if none
+    limiter           <-chan time.Time // one tick per msg, nil no limit
+    lastPublish       time.Time // end of the last memory wait
 }
 
 // TODO: valid file check
-func NewDirDaemon(topic, dirname string, notify chan bool,
+func NewDirDaemon(topic, targetTopic, dirname, catalogName string, keyring *util.Keyring,
+                transformer *Transformer, limiter <-chan time.Time, notify chan bool,
                 msgChan chan *util.Message) *DirDaemon {
     dirDaemon := &DirDaemon{
         topic: topic,
+        targetTopic: targetTopic,
         dirname: dirname,
         checkInterval: 30 * time.Second,
         msgChan: msgChan,
         lastProcessFile: "",
         notify: notify,
+        catalogName: catalogName,
+        keyring: keyring,
+        transformer: transformer,
+        limiter: limiter,
     }
 
     return dirDaemon
@@ -88,7 +98,18 @@ func (d *DirDaemon) coreProcess() error {
     return nil
 }
 
+// getFileList finds segments of the topic from the catalog, the dir is
+// only scanned when there is no catalog
 func (d *DirDaemon) getFileList() ([]string, error) {
+    if d.catalogName != "" {
+        if catalog := util.FindCatalog(d.dirname, d.catalogName); catalog != "" {
+            return d.getFileListFromCatalog(catalog)
+        }
+    }
+    return d.scanDir()
+}
+
+func (d *DirDaemon) scanDir() ([]string, error) {
     // TODO: wheather hold a mutex lock
     dirFp, err := os.Open(d.dirname)
     if err != nil {
@@ -140,6 +161,69 @@ func (d *DirDaemon) getFileList() ([]string, error) {
     return ret, nil
 }
 
+// getFileListFromCatalog returns unplayed segments of the topic in name
+// order, which is record order. A segment moved to done/ was played, one
+// neither in place nor in done/ is reported and skipped.
+func (d *DirDaemon) getFileListFromCatalog(catalog string) ([]string, error) {
+    entries, err := util.ReadCatalog(catalog)
+    if err != nil {
+        logger.Errorf("%s read catalog[%s] err[%s]\n", d, catalog, err)
+        return nil, err
+    }
+
+    dirname, err := filepath.Abs(d.dirname)
+    if err != nil {
+        return nil, err
+    }
+
+    // a catalog copied along with the archive keeps the paths of the
+    // recorder, then its entries of the topic are looked up by name here
+    var own, moved []string
+    for _, e := range entries {
+        if e.Topic != d.topic {
+            continue
+        }
+        path, err := filepath.Abs(e.Path)
+        if err != nil {
+            continue
+        }
+        if filepath.Dir(path) == dirname {
+            own = append(own, filepath.Base(path))
+        } else {
+            moved = append(moved, filepath.Base(path))
+        }
+    }
+    names := own
+    if len(own) == 0 {
+        names = moved
+    }
+
+    var ret []string
+    seen := make(map[string]bool)
+    for _, name := range names {
+        if seen[name] {
+            continue
+        }
+        seen[name] = true
+
+        path := filepath.Join(d.dirname, name)
+        if fi, err := os.Stat(path); err == nil {
+            if fi.Size() > 0 {
+                ret = append(ret, name)
+            }
+            continue
+        }
+        if _, err := os.Stat(filepath.Join(d.dirname, "done", name + ".done")); err == nil {
+            continue
+        }
+        logger.Warnf("%s segment[%s] in catalog[%s] is gone, skip\n", d, path, catalog)
+    }
+
+    sort.Strings(ret)
+    logger.Debugf("%s get %d files from catalog[%s] this time\n", d, len(ret), catalog)
+    return ret, nil
+}
+
 // TODO
 func validFile(fileName string) bool {
     return true
@@ -150,29 +234,32 @@ func (d *DirDaemon) parseFile(fileName string) error {
     fullPath := filepath.Join(d.dirname, fileName)
     logger.Debugf("Now parse file[%s]\n", fullPath)
 
-    fp, err := os.OpenFile(fullPath, os.O_RDONLY, 0600)
+    // held until moved to done, so compaction never merges it meanwhile
+    lock, err := util.LockSegment(fullPath, false)
     if err != nil {
-        logger.Errorf("Open file[%s] err[%s]\n", fullPath, err)
+        if os.IsNotExist(err) {
+            logger.Infof("%s file[%s] is gone, merged by compaction or removed\n", d, fullPath)
+            return nil
+        }
+        logger.Errorf("Lock segment[%s] err[%s]\n", fullPath, err)
         return err
     }
-    defer fp.Close()
+    defer lock.Unlock()
 
-    var reader *bufio.Reader
-    var ioReader io.Reader = fp
-    if strings.HasSuffix(fullPath, ".gz") {
-        greader, err := gzip.NewReader(fp)
-        if err != nil {
-            logger.Errorf("gzip NewReader from file[%s] err[%s]\n", fullPath, err)
-            return err
-        }
-        defer greader.Close()
-        ioReader = greader
+    file, err := segment.Open(fullPath, d.keyring)
+    if err != nil {
+        logger.Errorf("Open segment[%s] err[%s]\n", fullPath, err)
+        return err
+    }
+    defer file.Close()
+    file.SetPooled(true)
+
+    if d.transformer != nil {
+        d.transformer.SetOrigin(file.Header)
     }
 
-    reader = bufio.NewReader(ioReader)
     for {
-        var msgLen uint32
-        err := binary.Read(reader, binary.BigEndian, &msgLen)
+        rec, err := file.Next()
         if err != nil {
             if err == io.EOF {
                 logger.Debugf("Process file[%s] done\n", fullPath)
@@ -182,38 +269,98 @@ func (d *DirDaemon) parseFile(fileName string) error {
             return err
         }
 
-        logger.Debugf("Got msg len[%d] from file[%s]\n", msgLen, fullPath)
-        readBuf := make([]byte, msgLen)
-        _, err = io.ReadFull(reader, readBuf)
-        if err != nil {
-            logger.Errorf("Read msg len[%d] from file[%s] err[%s]\n", msgLen,
-            fullPath, err)
-            return err
+        if !d.publish(rec) {
+            return nil
         }
+    }
 
-        msg := util.NewMessage(readBuf)
-        if msg == nil {
-            logger.Errorf("Convert byte[%v] to Message err\n", readBuf)
-            // TODO:
-            continue
+Finish:
+    d.finishFile(fileName)
+    return nil
+}
+
+// publish sends a recorded msg to output and owns rec, its pooled body
+// goes back after publishing. False if notified to exit.
+func (d *DirDaemon) publish(rec *segment.Record) bool {
+    body := rec.Body
+    if d.transformer != nil {
+        var ok bool
+        if body, ok = d.transformer.Apply(body); !ok {
+            rec.Release()
+            return true
+        }
+    }
+    msg := util.NewMessage(d.targetTopic, body, rec.TakeBuffer())
+
+    if d.limiter != nil {
+        select {
+        case <- d.limiter:
+        case <- d.notify:
+            logger.Debugf("%s Get exit notify while waiting rate\n", d)
+            msg.Release()
+            return false
         }
+    }
 
-        msg.Topic = d.topic
-        SENDLOOP:
-        for {
+    // segment reading pauses while memory is tight
+    if !d.waitMemory() {
+        logger.Debugf("%s Get exit notify while waiting memory\n", d)
+        msg.Release()
+        return false
+    }
+
+    // released by the producer after publish
+    util.AddBuffered(int64(len(msg.RawBytes())))
+    for {
+        select {
+        case d.msgChan <- msg:
+            return true
+        case <- time.After(3 * time.Second):
+            logger.Debugf("%s send msg timeout, retry\n", d)
+        }
+    }
+}
+
+// throttled play keeps a quarter of its rate like record keeps a quarter
+// of max-in-flight, a long gap between msgs does not stall it long
+const maxThrottleWait = time.Second
+
+func throttleWait(level int, busy time.Duration) time.Duration {
+    if level != util.MemThrottled {
+        return 0
+    }
+    if wait := 3 * busy; wait < maxThrottleWait {
+        return wait
+    }
+    return maxThrottleWait
+}
+
+// waitMemory blocks while memory is paused and slows down while it is
+// throttled, false if notified
+func (d *DirDaemon) waitMemory() bool {
+    if !util.WaitMemory(d.notify) {
+        return false
+    }
+
+    now := time.Now()
+    if !d.lastPublish.IsZero() {
+        if wait := throttleWait(util.MemLevel(), now.Sub(d.lastPublish)); wait > 0 {
             select {
-            case d.msgChan <- msg:
-                logger.Debugf("%s Send msg success\n", d)
-                break SENDLOOP
-            case <- time.After(3 * time.Second):
-                logger.Debugf("%s send msg timeout, retry\n", d)
+            case <- time.After(wait):
+            case <- d.notify:
+                return false
             }
+            now = time.Now()
         }
     }
+    d.lastPublish = now
+    return true
+}
 
-Finish:
+// move a replayed file to done dir
+func (d *DirDaemon) finishFile(fileName string) {
+    fullPath := filepath.Join(d.dirname, fileName)
     logger.Debugf("Finish process file[%s]\n", fullPath)
-    // move to done dir
     dstDir := filepath.Join(d.dirname, "done", fileName + ".done")
 
     // mkdir
@@ -227,5 +374,4 @@ Finish:
 
     logger.Debugf("Now move file[%s] to file[%s]\n", fullPath, dstDir)
     util.AtomicRename(fullPath, dstDir)
-    return nil
 }
@@ -0,0 +1,110 @@
+package play
+
+import (
+    "util"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func touch(t *testing.T, path string) {
+    if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(path, []byte("x"), 0666); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestGetFileListFromCatalog(t *testing.T) {
+    root := t.TempDir()
+    dir := filepath.Join(root, "test", "backup")
+    for _, name := range []string{"a_1.gz", "c_1.gz", "b_1.gz", "other_1.gz", "stray_1.gz", "d_msg-num.gz"} {
+        touch(t, filepath.Join(dir, name))
+    }
+    touch(t, filepath.Join(dir, "done", "played_1.gz.done"))
+    catalog := util.GetCatalog(filepath.Join(root, util.DefaultCatalogName))
+    for _, e := range []*util.CatalogEntry{
+        {Path: filepath.Join(dir, "c_1.gz"), Topic: "test"},
+        {Path: filepath.Join(dir, "a_1.gz"), Topic: "test"},
+        {Path: filepath.Join(dir, "other_1.gz"), Topic: "other"},
+        {Path: filepath.Join(dir, "played_1.gz"), Topic: "test"},
+        {Path: filepath.Join(dir, "gone_1.gz"), Topic: "test"},
+        {Path: filepath.Join(dir, "b_1.gz"), Topic: "test"},
+        {Path: filepath.Join(dir, "a_1.gz"), Topic: "test"}, // appended twice
+    } {
+        if err := catalog.Append(e); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    d := NewDirDaemon("test", "test", dir, util.DefaultCatalogName, nil, nil, nil, nil, nil)
+    files, err := d.getFileList()
+    if err != nil {
+        t.Fatal(err)
+    }
+    // stray is not in catalog, played is in done, gone is neither
+    if want := []string{"a_1.gz", "b_1.gz", "c_1.gz"}; !reflect.DeepEqual(files, want) {
+        t.Fatalf("files %v, want %v", files, want)
+    }
+}
+
+// without a catalog the dir is scanned
+func TestGetFileListScanDir(t *testing.T) {
+    dir := filepath.Join(t.TempDir(), "test", "backup")
+    for _, name := range []string{"b_1.gz", "a_1.gz", "c_msg-num.gz"} {
+        touch(t, filepath.Join(dir, name))
+    }
+    touch(t, filepath.Join(dir, "done", "played_1.gz.done"))
+
+    d := NewDirDaemon("test", "test", dir, util.DefaultCatalogName, nil, nil, nil, nil, nil)
+    files, err := d.getFileList()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := []string{"a_1.gz", "b_1.gz"}; !reflect.DeepEqual(files, want) {
+        t.Fatalf("files %v, want %v", files, want)
+    }
+}
+
+func TestGetFileListRelocatedArchive(t *testing.T) {
+    root := t.TempDir()
+    dir := filepath.Join(root, "copy")
+    touch(t, filepath.Join(dir, "a_1.gz"))
+    // catalog copied along keeps the paths of the recorder
+    catalog := util.GetCatalog(filepath.Join(root, util.DefaultCatalogName))
+    if err := catalog.Append(&util.CatalogEntry{Path: "/data1/nsq_backup/test/backup/a_1.gz", Topic: "test"}); err != nil {
+        t.Fatal(err)
+    }
+
+    d := NewDirDaemon("test", "test", dir, util.DefaultCatalogName, nil, nil, nil, nil, nil)
+    files, err := d.getFileList()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := []string{"a_1.gz"}; !reflect.DeepEqual(files, want) {
+        t.Fatalf("files %v, want %v", files, want)
+    }
+}
+
+// throttled play spends three times its busy time waiting, a quarter of
+// the rate, paused is waited by util.WaitMemory before
+func TestThrottleWait(t *testing.T) {
+    for _, c := range []struct {
+        level int
+        busy  time.Duration
+        want  time.Duration
+    }{
+        {util.MemNormal, time.Millisecond, 0},
+        {util.MemThrottled, time.Millisecond, 3 * time.Millisecond},
+        {util.MemThrottled, 0, 0},
+        {util.MemThrottled, time.Minute, maxThrottleWait},
+        {util.MemPaused, time.Millisecond, 0},
+    } {
+        if got := throttleWait(c.level, c.busy); got != c.want {
+            t.Fatalf("level %d busy %s wait %s, want %s", c.level, c.busy, got, c.want)
+        }
+    }
+}
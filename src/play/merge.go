@@ -0,0 +1,211 @@
+package play
+
+import (
+    "util"
+    "util/segment"
+    "logger"
+    "fmt"
+    "io"
+    "os"
+    "time"
+    "path/filepath"
+    "container/heap"
+)
+
+const (
+    MergeTimestamp = "timestamp"
+    MergeSeq       = "seq"
+)
+
+// MergeDaemon replays all monitor dirs of a topic as one stream, records
+// are k-way merged by recorded timestamp or receive sequence. Every dir is
+// expected sorted by the key, which holds for dirs written by record.
+// Merge covers the segments finished at each check, a segment finished
+// later in one dir can hold older records than ones already replayed.
+type MergeDaemon struct {
+    topic         string
+    by            string
+    dirs          []*DirDaemon // file source and output of each dir
+    checkInterval time.Duration
+    notify        chan bool
+}
+
+func NewMergeDaemon(topic, by string, dirs []*DirDaemon, notify chan bool) *MergeDaemon {
+    return &MergeDaemon{
+        topic: topic,
+        by: by,
+        dirs: dirs,
+        checkInterval: 30 * time.Second,
+        notify: notify,
+    }
+}
+
+func (d *MergeDaemon) String() string {
+    return fmt.Sprintf("MergeDaemon:topic{%s}/by{%s}/dirs{%d}", d.topic, d.by, len(d.dirs))
+}
+
+func (d *MergeDaemon) Process() {
+    PROCESSLOOP:
+    for {
+        if !d.coreProcess() {
+            break PROCESSLOOP
+        }
+        select {
+        case <- d.notify:
+            logger.Debugf("%s Get exit notify, now exiting\n", d)
+            break PROCESSLOOP
+        case <- time.After(d.checkInterval):
+            logger.Debugf("%s Sleep %s s, now begin check again\n", d, d.checkInterval)
+        }
+    }
+
+    logger.Debugf("Now exit %s Process\n", d)
+}
+
+// false if notified to exit
+func (d *MergeDaemon) coreProcess() bool {
+    h := &mergeHeap{}
+    for i, dir := range d.dirs {
+        files, err := dir.getFileList()
+        if err != nil {
+            logger.Errorf("%s getFileList err[%s]\n", dir, err)
+            continue
+        }
+        s := &mergeStream{dir: dir, by: d.by, index: i, files: files}
+        if s.advance() {
+            heap.Push(h, s)
+        }
+    }
+    logger.Debugf("%s merge %d dirs\n", d, h.Len())
+
+    for h.Len() > 0 {
+        s := (*h)[0]
+        if !s.dir.publish(s.head) {
+            for _, s := range *h {
+                s.close()
+            }
+            return false
+        }
+        if s.advance() {
+            heap.Fix(h, 0)
+        } else {
+            heap.Pop(h)
+        }
+    }
+    return true
+}
+
+// mergeStream reads the finished segments of one dir in name order
+type mergeStream struct {
+    dir     *DirDaemon
+    by      string
+    index   int // breaks ties, keeps dir order of equal keys
+    files   []string
+    file    string
+    lock    *util.SegmentLock // held until file is moved to done
+    segment *segment.File
+    head    *segment.Record
+    key     uint64
+}
+
+// advance loads the next record into head, a read file is moved to done,
+// a broken one is left for the next check like DirDaemon does
+func (s *mergeStream) advance() bool {
+    for {
+        if s.segment == nil {
+            if len(s.files) == 0 {
+                return false
+            }
+            s.file, s.files = s.files[0], s.files[1:]
+            if !s.open() {
+                continue
+            }
+        }
+
+        rec, err := s.segment.Next()
+        if err == nil {
+            s.head = rec
+            // records without the key stay right after their predecessor
+            switch {
+            case s.by == MergeSeq && rec.Seq != 0:
+                s.key = rec.Seq
+            case s.by == MergeTimestamp && rec.Timestamp != 0:
+                s.key = uint64(rec.Timestamp)
+            }
+            return true
+        }
+
+        fullPath := filepath.Join(s.dir.dirname, s.file)
+        if err == io.EOF {
+            logger.Debugf("Process file[%s] done\n", fullPath)
+            s.dir.finishFile(s.file)
+        } else {
+            logger.Errorf("Process file[%s] err[%s]\n", fullPath, err)
+        }
+        s.close()
+    }
+}
+
+func (s *mergeStream) open() bool {
+    fullPath := filepath.Join(s.dir.dirname, s.file)
+    lock, err := util.LockSegment(fullPath, false)
+    if err != nil {
+        if os.IsNotExist(err) {
+            logger.Infof("%s file[%s] is gone, merged by compaction or removed\n", s.dir, fullPath)
+        } else {
+            logger.Errorf("Lock segment[%s] err[%s]\n", fullPath, err)
+        }
+        return false
+    }
+
+    file, err := segment.Open(fullPath, s.dir.keyring)
+    if err != nil {
+        lock.Unlock()
+        logger.Errorf("Open segment[%s] err[%s]\n", fullPath, err)
+        return false
+    }
+
+    if (s.by == MergeSeq && !file.Header.HasSequence()) ||
+        (s.by == MergeTimestamp && !file.Header.HasTimestamp()) {
+        logger.Warnf("Segment[%s] has no %s, kept in file order\n", fullPath, s.by)
+    }
+    if s.dir.transformer != nil {
+        s.dir.transformer.SetOrigin(file.Header)
+    }
+    // records are owned by publish once popped
+    file.SetPooled(true)
+    s.segment = file
+    s.lock = lock
+    return true
+}
+
+func (s *mergeStream) close() {
+    if s.segment != nil {
+        s.segment.Close()
+        s.segment = nil
+    }
+    s.lock.Unlock()
+    s.lock = nil
+}
+
+type mergeHeap []*mergeStream
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+    if h[i].key != h[j].key {
+        return h[i].key < h[j].key
+    }
+    return h[i].index < h[j].index
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeStream)) }
+
+func (h *mergeHeap) Pop() interface{} {
+    old := *h
+    s := old[len(old) - 1]
+    *h = old[:len(old) - 1]
+    return s
+}
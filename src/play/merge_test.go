@@ -0,0 +1,142 @@
+package play
+
+import (
+    "util"
+    "util/segment"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+    "time"
+)
+
+// writeRecords writes a finished segment, records get timestamp and
+// seq from keys, 0 means the record has none
+func writeRecords(t *testing.T, path string, flags byte, keys ...int64) {
+    if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+        t.Fatal(err)
+    }
+    fp, err := os.Create(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer fp.Close()
+    w := segment.NewWriter(fp, segment.NewHeader(flags, map[string]string{"topic": "test"}))
+    if err := w.WriteHeader(); err != nil {
+        t.Fatal(err)
+    }
+    for _, key := range keys {
+        body := []byte(filepath.Base(filepath.Dir(path)) + ":" + string(rune('0' + key)))
+        if _, err := w.Write(&segment.Record{Timestamp: key, Seq: uint64(key), Body: body}); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+// merge replays dirs by key and returns bodies in publish order
+func merge(t *testing.T, by string, dirs ...string) []string {
+    msgChan := make(chan *util.Message, 100)
+    var daemons []*DirDaemon
+    for _, dir := range dirs {
+        daemons = append(daemons, NewDirDaemon("test", "test", dir, util.DefaultCatalogName,
+            nil, nil, nil, make(chan bool), msgChan))
+    }
+    if !NewMergeDaemon("test", by, daemons, make(chan bool)).coreProcess() {
+        t.Fatal("merge exited")
+    }
+    close(msgChan)
+
+    var ret []string
+    for msg := range msgChan {
+        ret = append(ret, string(msg.RawBytes()))
+        util.AddBuffered(-int64(len(msg.RawBytes())))
+        msg.Release()
+    }
+    return ret
+}
+
+func TestMergeByTimestamp(t *testing.T) {
+    root := t.TempDir()
+    a, b := filepath.Join(root, "a"), filepath.Join(root, "b")
+    flags := segment.FlagTimestamp | segment.FlagSequence
+    writeRecords(t, filepath.Join(a, "backup.log.1_2"), flags, 1, 4)
+    writeRecords(t, filepath.Join(a, "backup.log.2_2"), flags, 5, 8)
+    writeRecords(t, filepath.Join(b, "backup.log.1_3"), flags, 2, 3, 6)
+    writeRecords(t, filepath.Join(b, "backup.log.2_1"), flags, 7)
+
+    got := merge(t, MergeTimestamp, a, b)
+    want := []string{"a:1", "b:2", "b:3", "a:4", "a:5", "b:6", "b:7", "a:8"}
+    if !reflect.DeepEqual(got, want) {
+        t.Fatalf("got %v, want %v", got, want)
+    }
+
+    // every read segment is moved to done
+    for _, path := range []string{
+        filepath.Join(a, "done", "backup.log.1_2.done"),
+        filepath.Join(a, "done", "backup.log.2_2.done"),
+        filepath.Join(b, "done", "backup.log.1_3.done"),
+        filepath.Join(b, "done", "backup.log.2_1.done"),
+    } {
+        if _, err := os.Stat(path); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+// equal keys keep dir order, records without key follow their predecessor
+func TestMergeTiesAndMissingKeys(t *testing.T) {
+    root := t.TempDir()
+    a, b := filepath.Join(root, "a"), filepath.Join(root, "b")
+    writeRecords(t, filepath.Join(a, "backup.log.1_3"), segment.FlagSequence, 2, 0, 5)
+    writeRecords(t, filepath.Join(b, "backup.log.1_3"), segment.FlagSequence, 2, 3, 4)
+
+    got := merge(t, MergeSeq, a, b)
+    want := []string{"a:2", "a:0", "b:2", "b:3", "b:4", "a:5"}
+    if !reflect.DeepEqual(got, want) {
+        t.Fatalf("got %v, want %v", got, want)
+    }
+}
+
+// segments without the key replay in file order
+func TestMergeWithoutKeys(t *testing.T) {
+    root := t.TempDir()
+    a, b := filepath.Join(root, "a"), filepath.Join(root, "b")
+    writeRecords(t, filepath.Join(a, "backup.log.1_2"), 0, 3, 1)
+    writeRecords(t, filepath.Join(b, "backup.log.1_1"), 0, 2)
+
+    got := merge(t, MergeTimestamp, a, b)
+    want := []string{"a:3", "a:1", "b:2"}
+    if !reflect.DeepEqual(got, want) {
+        t.Fatalf("got %v, want %v", got, want)
+    }
+}
+
+// a segment compaction is merging is waited for, and skipped once merged
+// away, its records are replayed from the merged segment next check
+func TestMergeSkipsCompacted(t *testing.T) {
+    root := t.TempDir()
+    a, b := filepath.Join(root, "a"), filepath.Join(root, "b")
+    flags := segment.FlagTimestamp
+    writeRecords(t, filepath.Join(a, "backup.log.1_2"), flags, 1, 3)
+    compacted := filepath.Join(b, "backup.log.1_1")
+    writeRecords(t, compacted, flags, 2)
+
+    lock, err := util.LockSegment(compacted, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    go func() {
+        time.Sleep(50 * time.Millisecond)
+        os.Remove(compacted)
+        lock.Unlock()
+    }()
+
+    got := merge(t, MergeTimestamp, a, b)
+    want := []string{"a:1", "a:3"}
+    if !reflect.DeepEqual(got, want) {
+        t.Fatalf("got %v, want %v", got, want)
+    }
+    if _, err := os.Stat(filepath.Join(b, "done", "backup.log.1_1.done")); !os.IsNotExist(err) {
+        t.Fatalf("compacted segment moved to done err[%v]", err)
+    }
+}
@@ -3,26 +3,28 @@ package play
 import (
     "util"
     "logger"
+    "fmt"
     "sync"
     "os"
+    "strings"
     "time"
     "os/signal"
     "syscall"
 
-    sj      "go-simplejson"
     nsq      "github.com/nsqio/go-nsq"
 )
 
 type Play struct {
     name     string
     notify   chan bool
-    msgChan  chan *util.Message
 
     monitorDirs  []string
-    nsqdAddrs    []string
     topics       []string
-    producers    []*nsq.Producer
+    outputs      []*output
+    limiters     []*time.Ticker // rate of monitor_info entries
     dirDaemons   []*DirDaemon
+    mergeDaemons []*MergeDaemon
+    transformers []*Transformer
     dirDaeWg     *sync.WaitGroup
 
     sig          chan os.Signal // cap systel signal
@@ -30,29 +32,25 @@ type Play struct {
     wg           *sync.WaitGroup
 }
 
-func Main(ctx *sj.Json) {
-    logger.Debugf("Play Main start\n")
-    p := NewPlay(ctx)
-    if p == nil {
-        logger.Debugf("New Play is nil, check your conf")
-        return
-    }
-    signal.Notify(p.sig, syscall.SIGINT, syscall.SIGTERM)
-    p.Process()
-
-    logger.Debugf("Play Main exit\n")
+// output is a set of nsqd producers sharing one msgChan, monitor_info
+// entries with the same nsqd_addrs share an output
+type output struct {
+    nsqdAddrs []string
+    producers []*nsq.Producer
+    msgChan   chan *util.Message
 }
 
-func NewPlay(ctx *sj.Json) *Play {
-    name := ctx.Get("main").Get("name").MustString("DefaultPlay")
-    nsqdAddrs := ctx.Get("main").Get("nsq").Get("nsqd_addrs").MustStringArray()
-    if len(nsqdAddrs) < 1 {
-        logger.Errorf("No nsqd addr found\n")
-        return nil
+func newOutput(name string, nsqdAddrs []string, client *util.NSQClientConfig) *output {
+    o := &output{
+        nsqdAddrs: nsqdAddrs,
+        msgChan: make(chan *util.Message, 5),
     }
 
-    producers := make([]*nsq.Producer, 0, 5)
-    config := nsq.NewConfig()
+    config, err := client.NewConfig()
+    if err != nil {
+        logger.Errorf("%s nsq client err[%s]\n", name, err)
+        return nil
+    }
     for _, nsqdAddr := range nsqdAddrs {
         producer, err := nsq.NewProducer(nsqdAddr, config)
         if err != nil {
@@ -60,34 +58,104 @@ func NewPlay(ctx *sj.Json) *Play {
             return nil
         }
 
-        producers = append(producers, producer)
+        o.producers = append(o.producers, producer)
     }
+    return o
+}
 
-    monitorInfo := ctx.Get("main").Get("monitor_info").MustJsonArray()
-    if len(monitorInfo) < 1 {
+func Main(conf *Config) {
+    logger.Debugf("Play Main start\n")
+    p := NewPlay(conf)
+    if p == nil {
+        logger.Debugf("New Play is nil, check your conf")
+        return
+    }
+    signal.Notify(p.sig, syscall.SIGINT, syscall.SIGTERM)
+    p.Process()
+
+    logger.Debugf("Play Main exit\n")
+}
+
+// NewPlay expects a checked conf, see LoadConf
+func NewPlay(conf *Config) *Play {
+    name := conf.Main.Name
+    if len(conf.Main.MonitorInfo) < 1 {
         logger.Debugf("No monitor_info found\n")
         return nil
     }
 
     play := &Play{
         name: name,
-        nsqdAddrs: nsqdAddrs,
         sig: make(chan os.Signal),
         wg:  new(sync.WaitGroup),
         notify: make(chan bool),
-        msgChan: make(chan *util.Message, 5),
-        producers: producers,
         dirDaeWg: new(sync.WaitGroup),
     }
 
+    var keyring *util.Keyring
+    if conf.Encryption.KeyFile != "" {
+        var err error
+        if keyring, err = util.LoadKeyring(conf.Encryption.KeyFile); err != nil {
+            logger.Errorf("%s load encryption key err[%s]\n", name, err)
+            return nil
+        }
+    }
+
+    outputs := make(map[string]*output)
     var dirDaemons []*DirDaemon
-    for _, mi := range monitorInfo {
-        topic := mi.Get("topic").MustString()
-        monitorDirs := mi.Get("monitor_dirs").MustStringArray()
+    for i, mi := range conf.Main.MonitorInfo {
+        targetTopic, nsqdAddrs, err := mi.Target(&conf.Main)
+        if err != nil {
+            logger.Errorf("%s topic[%s] target nsqd err[%s]\n", name, mi.Topic, err)
+            return nil
+        }
+
+        // an entry with its own client never shares producers
+        client := &conf.Main.NSQ.Client
+        key := strings.Join(nsqdAddrs, ",")
+        if mi.Client != nil {
+            client = mi.Client
+            key = fmt.Sprintf("%s/%d", key, i)
+        }
+        out, ok := outputs[key]
+        if !ok {
+            if out = newOutput(name, nsqdAddrs, client); out == nil {
+                return nil
+            }
+            outputs[key] = out
+            play.outputs = append(play.outputs, out)
+        }
 
-        for _, mdir := range monitorDirs {
-            dirDaemon := NewDirDaemon(topic, mdir, play.notify, play.msgChan)
-            dirDaemons = append(dirDaemons, dirDaemon)
+        transformer, err := NewTransformer(mi.Topic, mi.Rules)
+        if err != nil {
+            logger.Errorf("%s topic[%s] rules err[%s]\n", name, mi.Topic, err)
+            return nil
+        }
+        if transformer != nil {
+            play.transformers = append(play.transformers, transformer)
+        }
+
+        // all dirs of an entry share its rate
+        var limiter <-chan time.Time
+        if mi.Rate > 0 {
+            ticker := time.NewTicker(time.Second / time.Duration(mi.Rate))
+            play.limiters = append(play.limiters, ticker)
+            limiter = ticker.C
+        }
+
+        var entryDaemons []*DirDaemon
+        for _, mdir := range mi.MonitorDirs {
+            dirDaemon := NewDirDaemon(mi.Topic, targetTopic, mdir, conf.Main.CatalogName,
+            keyring, transformer, limiter, play.notify, out.msgChan)
+            entryDaemons = append(entryDaemons, dirDaemon)
+        }
+
+        // merged dirs are only read by the merge daemon
+        if mi.Merge != "" {
+            play.mergeDaemons = append(play.mergeDaemons,
+            NewMergeDaemon(mi.Topic, mi.Merge, entryDaemons, play.notify))
+        } else {
+            dirDaemons = append(dirDaemons, entryDaemons...)
         }
     }
 
@@ -123,39 +191,55 @@ func (p *Play) Process() {
         }(dirDaemon)
     }
 
+    for _, mergeDaemon := range p.mergeDaemons {
+        p.wg.Add(1)
+        p.dirDaeWg.Add(1)
+        go func(mergeDaemon *MergeDaemon){
+            defer p.wg.Done()
+            logger.Debugf("%s start Process\n", mergeDaemon)
+            mergeDaemon.Process()
+            logger.Debugf("%s end Process\n", mergeDaemon)
+            p.dirDaeWg.Done()
+        }(mergeDaemon)
+    }
+
     p.wg.Wait()
     logger.Debugf("%s end Process\n", p.name)
 }
 
 func (p *Play) StartProducers() {
     logger.Debugf("%s Start producers\n", p.name)
-    for _, producer := range p.producers {
-        p.wg.Add(1)
-        go func(producer *nsq.Producer){
-            logger.Debugf("now start producer[%s]\n", producer)
-            PRODUCERLOOP:
-            for {
-                select {
-                case msg, ok := <- p.msgChan:
-                    if !ok {
-                        logger.Debugf("msgChan has been closed, exit\n")
-                        break PRODUCERLOOP
-                    }
-                    logger.Debugf("Send msq to producer[%s]\n", producer)
-                    err := producer.Publish(msg.Topic, msg.RawBytes())
-                    if err != nil {
-                        // TODO: retry
-                        logger.Errorf("Publish to nsqd[%s] err[%s]\n", producer, err)
+    for _, out := range p.outputs {
+        for _, producer := range out.producers {
+            p.wg.Add(1)
+            go func(producer *nsq.Producer, msgChan chan *util.Message){
+                logger.Debugf("now start producer[%s]\n", producer)
+                PRODUCERLOOP:
+                for {
+                    select {
+                    case msg, ok := <- msgChan:
+                        if !ok {
+                            logger.Debugf("msgChan has been closed, exit\n")
+                            break PRODUCERLOOP
+                        }
+                        // synchronous, so the pooled body can go back after
+                        err := producer.Publish(msg.Topic, msg.RawBytes())
+                        util.AddBuffered(-int64(len(msg.RawBytes())))
+                        msg.Release()
+                        if err != nil {
+                            // TODO: retry
+                            logger.Errorf("Publish to nsqd[%s] err[%s]\n", producer, err)
+                            continue
+                        }
+                    case <- time.After(3 * time.Second):
+                        logger.Debugf("After 3s, producer[%s] get nothing\n", producer)
                         continue
                     }
-                case <- time.After(3 * time.Second):
-                    logger.Debugf("After 3s, producer[%s] get nothing\n", producer)
-                    continue
                 }
-            }
-            logger.Debugf("producer[%s] end\n", producer)
-            p.wg.Done()
-        }(producer)
+                logger.Debugf("producer[%s] end\n", producer)
+                p.wg.Done()
+            }(producer, out.msgChan)
+        }
     }
 
     logger.Debugf("%s start Producers success\n", p.name)
@@ -167,5 +251,14 @@ func (p *Play) Close() {
 
     p.dirDaeWg.Wait()
     logger.Debugf("All DirDaemons have exit, now can safely close mysqChan\n")
-    close(p.msgChan)
+    for _, out := range p.outputs {
+        close(out.msgChan)
+    }
+    for _, limiter := range p.limiters {
+        limiter.Stop()
+    }
+
+    for _, transformer := range p.transformers {
+        logger.Infof("%s replay rules report: %s\n", p.name, transformer.Report())
+    }
 }
@@ -0,0 +1,250 @@
+package play
+
+import (
+    "util"
+    "util/segment"
+    "logger"
+    "fmt"
+    "regexp"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+    "encoding/json"
+)
+
+var timeUnits = map[string]time.Duration{
+    "s":  time.Second,
+    "ms": time.Millisecond,
+    "us": time.Microsecond,
+    "ns": time.Nanosecond,
+}
+
+type setField struct {
+    path  []string
+    value interface{}
+}
+
+// RulesConfig filters and rewrites bodies of one monitor_info entry:
+//   "rules": {"include": [predicate], "exclude": [predicate],
+//       "include_regex": "", "exclude_regex": "",
+//       "set": {"env": "staging"}, "drop": ["debug"],
+//       "shift_time": {"fields": ["ts"], "unit": "s", "offset_sec": 0}}
+// include predicates must all match, any matching exclude predicate
+// drops the message. offset_sec 0 means shift by replay offset: time
+// play started minus create time of the first replayed segment.
+type RulesConfig struct {
+    Include      []util.PredicateConfig `json:"include"`
+    Exclude      []util.PredicateConfig `json:"exclude"`
+    IncludeRegex string                 `json:"include_regex"`
+    ExcludeRegex string                 `json:"exclude_regex"`
+    Set          map[string]interface{} `json:"set"`
+    Drop         []string               `json:"drop"`
+    ShiftTime    ShiftTimeConfig        `json:"shift_time"`
+}
+
+type ShiftTimeConfig struct {
+    Fields    []string `json:"fields"`
+    Unit      string   `json:"unit"` // s, ms, us or ns, default s
+    OffsetSec int64    `json:"offset_sec"`
+}
+
+// Transformer applies RulesConfig before messages are published
+type Transformer struct {
+    topic        string
+    include      []*util.Predicate
+    exclude      []*util.Predicate
+    includeRegex *regexp.Regexp
+    excludeRegex *regexp.Regexp
+    set          []setField
+    drop         [][]string
+    shiftFields  [][]string
+    shiftUnit    time.Duration
+
+    offsetOnce   sync.Once
+    offset       int64 // time.Duration, atomic
+    startTime    time.Time
+
+    total        uint64
+    filtered     uint64
+    changed      uint64
+}
+
+// NewTransformer returns nil if no rules configured
+func NewTransformer(topic string, rules *RulesConfig) (*Transformer, error) {
+    if rules == nil {
+        return nil, nil
+    }
+
+    t := &Transformer{topic: topic, startTime: time.Now()}
+    var err error
+    if t.include, err = util.NewPredicates(rules.Include); err != nil {
+        return nil, err
+    }
+    if t.exclude, err = util.NewPredicates(rules.Exclude); err != nil {
+        return nil, err
+    }
+    if rules.IncludeRegex != "" {
+        if t.includeRegex, err = regexp.Compile(rules.IncludeRegex); err != nil {
+            return nil, err
+        }
+    }
+    if rules.ExcludeRegex != "" {
+        if t.excludeRegex, err = regexp.Compile(rules.ExcludeRegex); err != nil {
+            return nil, err
+        }
+    }
+
+    for path, value := range rules.Set {
+        t.set = append(t.set, setField{path: util.SplitPath(path), value: value})
+    }
+    for _, path := range rules.Drop {
+        t.drop = append(t.drop, util.SplitPath(path))
+    }
+
+    shift := rules.ShiftTime
+    for _, path := range shift.Fields {
+        t.shiftFields = append(t.shiftFields, util.SplitPath(path))
+    }
+    unit := shift.Unit
+    if unit == "" {
+        unit = "s"
+    }
+    if t.shiftUnit = timeUnits[unit]; t.shiftUnit == 0 {
+        return nil, fmt.Errorf("shift_time invalid unit[%s]", unit)
+    }
+    if sec := shift.OffsetSec; sec != 0 {
+        t.offsetOnce.Do(func() {
+            atomic.StoreInt64(&t.offset, int64(time.Duration(sec) * time.Second))
+        })
+    }
+
+    logger.Debugf("New Transformer topic[%s] include[%d] exclude[%d] set[%d] drop[%d] shift[%d]\n",
+    topic, len(t.include), len(t.exclude), len(t.set), len(t.drop), len(t.shiftFields))
+    return t, nil
+}
+
+// SetOrigin fixes replay offset with create time of the first segment
+func (t *Transformer) SetOrigin(header *segment.Header) {
+    if header == nil || header.Meta["create_time"] == "" {
+        return
+    }
+    createTime, err := strconv.ParseInt(header.Meta["create_time"], 10, 64)
+    if err != nil {
+        return
+    }
+
+    t.offsetOnce.Do(func() {
+        offset := t.startTime.Sub(time.Unix(0, createTime))
+        atomic.StoreInt64(&t.offset, int64(offset))
+        logger.Infof("Transformer topic[%s] replay offset[%s]\n", t.topic, offset)
+    })
+}
+
+func (t *Transformer) needDoc() bool {
+    return len(t.include) > 0 || len(t.exclude) > 0 || len(t.set) > 0 ||
+        len(t.drop) > 0 || len(t.shiftFields) > 0
+}
+
+// Apply returns body to publish, false means filtered
+func (t *Transformer) Apply(body []byte) ([]byte, bool) {
+    atomic.AddUint64(&t.total, 1)
+
+    if (t.includeRegex != nil && !t.includeRegex.Match(body)) ||
+        (t.excludeRegex != nil && t.excludeRegex.Match(body)) {
+        return t.filter()
+    }
+
+    if !t.needDoc() {
+        return body, true
+    }
+
+    doc, err := util.DecodeJSON(body)
+    if err != nil {
+        // can not check json rules
+        if len(t.include) > 0 {
+            return t.filter()
+        }
+        return body, true
+    }
+
+    for _, p := range t.include {
+        if !p.Match(doc) {
+            return t.filter()
+        }
+    }
+    for _, p := range t.exclude {
+        if p.Match(doc) {
+            return t.filter()
+        }
+    }
+
+    changed := false
+    for _, f := range t.set {
+        changed = util.JSONSet(doc, f.path, f.value) || changed
+    }
+    for _, path := range t.drop {
+        changed = util.JSONDelete(doc, path) || changed
+    }
+    for _, path := range t.shiftFields {
+        changed = t.shift(doc, path) || changed
+    }
+
+    if !changed {
+        return body, true
+    }
+
+    out, err := util.EncodeJSON(doc)
+    if err != nil {
+        logger.Errorf("Transformer topic[%s] encode err[%s], publish raw body\n", t.topic, err)
+        return body, true
+    }
+    atomic.AddUint64(&t.changed, 1)
+    util.IncrStat("play_" + t.topic + "_changed", 1)
+    return out, true
+}
+
+func (t *Transformer) filter() ([]byte, bool) {
+    atomic.AddUint64(&t.filtered, 1)
+    util.IncrStat("play_" + t.topic + "_filtered", 1)
+    return nil, false
+}
+
+// numeric fields are shifted in unit, string fields must be RFC3339
+func (t *Transformer) shift(doc interface{}, path []string) bool {
+    offset := time.Duration(atomic.LoadInt64(&t.offset))
+    if offset == 0 {
+        return false
+    }
+    v, ok := util.JSONGet(doc, path)
+    if !ok {
+        return false
+    }
+
+    switch value := v.(type) {
+    case json.Number:
+        n, err := value.Int64()
+        if err != nil {
+            f, err := value.Float64()
+            if err != nil {
+                return false
+            }
+            shifted := f + float64(offset) / float64(t.shiftUnit)
+            return util.JSONSet(doc, path, json.Number(strconv.FormatFloat(shifted, 'f', -1, 64)))
+        }
+        shifted := n + int64(offset / t.shiftUnit)
+        return util.JSONSet(doc, path, json.Number(strconv.FormatInt(shifted, 10)))
+    case string:
+        tm, err := time.Parse(time.RFC3339Nano, value)
+        if err != nil {
+            return false
+        }
+        return util.JSONSet(doc, path, tm.Add(offset).Format(time.RFC3339Nano))
+    }
+    return false
+}
+
+func (t *Transformer) Report() string {
+    return fmt.Sprintf("topic[%s] total[%d] filtered[%d] changed[%d]", t.topic,
+    atomic.LoadUint64(&t.total), atomic.LoadUint64(&t.filtered), atomic.LoadUint64(&t.changed))
+}
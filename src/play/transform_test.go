@@ -0,0 +1,122 @@
+package play
+
+import (
+    "util/segment"
+    "bytes"
+    "strconv"
+    "testing"
+    "time"
+    "encoding/json"
+)
+
+// rules are decoded like LoadConf does, numbers stay json.Number
+func newTestTransformer(t *testing.T, rules string) *Transformer {
+    var conf RulesConfig
+    dec := json.NewDecoder(bytes.NewReader([]byte(rules)))
+    dec.UseNumber()
+    if err := dec.Decode(&conf); err != nil {
+        t.Fatal(err)
+    }
+    tr, err := NewTransformer("test", &conf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return tr
+}
+
+func TestTransformOps(t *testing.T) {
+    cases := []struct {
+        rules string
+        body  string
+        want  string // empty means filtered
+    }{
+        // include and exclude predicates
+        {`{"include": [{"path": "type", "op": "eq", "value": "order"}]}`, `{"type":"order"}`, `{"type":"order"}`},
+        {`{"include": [{"path": "type", "op": "eq", "value": "order"}]}`, `{"type":"refund"}`, ``},
+        {`{"include": [{"path": "type", "op": "exists"}, {"path": "id", "op": "gt", "value": 1}]}`, `{"type":"x","id":1}`, ``},
+        {`{"exclude": [{"path": "test", "op": "eq", "value": true}]}`, `{"test":true}`, ``},
+        {`{"exclude": [{"path": "test", "op": "eq", "value": true}]}`, `{"test":false}`, `{"test":false}`},
+        // regex on raw body
+        {`{"include_regex": "shop\\d+"}`, `{"shop":"shop12"}`, `{"shop":"shop12"}`},
+        {`{"include_regex": "shop\\d+"}`, `{"shop":"x"}`, ``},
+        {`{"exclude_regex": "^ping"}`, `ping`, ``},
+        {`{"exclude_regex": "^ping"}`, `pong`, `pong`},
+        // json rules on a non json body
+        {`{"include": [{"path": "a", "op": "exists"}]}`, `not json`, ``},
+        {`{"drop": ["a"]}`, `not json`, `not json`},
+        // set and drop
+        {`{"set": {"env": "staging", "user.tier": 2}}`, `{"user":{"id":1}}`, `{"env":"staging","user":{"id":1,"tier":2}}`},
+        {`{"drop": ["debug", "user.token"]}`, `{"debug":1,"user":{"id":1,"token":"t"}}`, `{"user":{"id":1}}`},
+        // nothing changed, the body is published byte for byte
+        {`{"drop": ["debug"]}`, `{"a": 1}`, `{"a": 1}`},
+        // shift by fixed offset, in unit of the field
+        {`{"shift_time": {"fields": ["ts"], "offset_sec": 60}}`, `{"ts":100}`, `{"ts":160}`},
+        {`{"shift_time": {"fields": ["ts"], "unit": "ms", "offset_sec": 60}}`, `{"ts":100}`, `{"ts":60100}`},
+        {`{"shift_time": {"fields": ["ts"], "offset_sec": 60}}`, `{"ts":1.5}`, `{"ts":61.5}`},
+        {`{"shift_time": {"fields": ["at"], "offset_sec": 3600}}`, `{"at":"2017-03-26T10:00:00Z"}`, `{"at":"2017-03-26T11:00:00Z"}`},
+        {`{"shift_time": {"fields": ["at", "none"], "offset_sec": 60}}`, `{"at":"yesterday"}`, `{"at":"yesterday"}`},
+    }
+    for _, c := range cases {
+        tr := newTestTransformer(t, c.rules)
+        out, ok := tr.Apply([]byte(c.body))
+        if ok != (c.want != "") || string(out) != c.want {
+            t.Fatalf("rules %s body %s: got %s %v, want %s", c.rules, c.body, out, ok, c.want)
+        }
+    }
+
+    if tr, err := NewTransformer("test", nil); tr != nil || err != nil {
+        t.Fatalf("no rules got %v err[%v]", tr, err)
+    }
+    for _, rules := range []string{
+        `{"include": [{"path": "a", "op": "like"}]}`,
+        `{"exclude_regex": "("}`,
+        `{"shift_time": {"fields": ["ts"], "unit": "h"}}`,
+    } {
+        var conf RulesConfig
+        json.Unmarshal([]byte(rules), &conf)
+        if _, err := NewTransformer("test", &conf); err == nil {
+            t.Fatalf("rules %s got no err", rules)
+        }
+    }
+}
+
+func originHeader(createTime time.Time) *segment.Header {
+    return segment.NewHeader(0, map[string]string{"create_time": strconv.FormatInt(createTime.UnixNano(), 10)})
+}
+
+// offset 0 shifts by play start minus create time of the first segment,
+// later segments do not move it
+func TestTransformShiftOrigin(t *testing.T) {
+    tr := newTestTransformer(t, `{"shift_time": {"fields": ["ts"]}}`)
+    tr.startTime = time.Unix(1000, 0)
+
+    // no offset before the first segment
+    if out, _ := tr.Apply([]byte(`{"ts":100}`)); string(out) != `{"ts":100}` {
+        t.Fatalf("shifted before origin %s", out)
+    }
+    tr.SetOrigin(nil)
+    tr.SetOrigin(segment.NewHeader(0, map[string]string{"create_time": "x"}))
+    tr.SetOrigin(originHeader(time.Unix(400, 0)))
+    tr.SetOrigin(originHeader(time.Unix(900, 0)))
+    if out, _ := tr.Apply([]byte(`{"ts":100}`)); string(out) != `{"ts":700}` {
+        t.Fatalf("shift by origin %s", out)
+    }
+
+    // a fixed offset is never replaced by the origin
+    tr = newTestTransformer(t, `{"shift_time": {"fields": ["ts"], "offset_sec": 5}}`)
+    tr.startTime = time.Unix(1000, 0)
+    tr.SetOrigin(originHeader(time.Unix(400, 0)))
+    if out, _ := tr.Apply([]byte(`{"ts":100}`)); string(out) != `{"ts":105}` {
+        t.Fatalf("shift by offset_sec %s", out)
+    }
+}
+
+func TestTransformReport(t *testing.T) {
+    tr := newTestTransformer(t, `{"exclude": [{"path": "skip", "op": "exists"}], "set": {"env": "staging"}}`)
+    for _, body := range []string{`{"skip":1}`, `{"a":1}`, `{"env":"prod"}`, `not json`} {
+        tr.Apply([]byte(body))
+    }
+    if got, want := tr.Report(), "topic[test] total[4] filtered[1] changed[2]"; got != want {
+        t.Fatalf("report %s, want %s", got, want)
+    }
+}
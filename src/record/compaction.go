@@ -0,0 +1,120 @@
+package record
+
+import (
+    "util"
+    "common"
+    "compact"
+    "logger"
+    "time"
+)
+
+// Compactor merges small finished segments of the backup topics in the
+// background, the same as `vcr compact` run on every catalog of record
+type Compactor struct {
+    enable        bool
+    checkInterval time.Duration
+    opts          *compact.Options
+    catalogs      []*util.Catalog
+    notify        chan bool
+}
+
+// CompactionConfig is conf section:
+//   "compaction": {"enable": false, "check_interval_s": 600, "bucket_minute": 60,
+//       "min_age_minute": 120, "max_size_m": 300, "min_files": 2}
+type CompactionConfig struct {
+    Enable         bool `json:"enable"`
+    CheckIntervalS int  `json:"check_interval_s"` // default 600
+    BucketMinute   int  `json:"bucket_minute"`    // default 60
+    MinAgeMinute   int  `json:"min_age_minute"`   // default 120
+    MaxSizeM       int  `json:"max_size_m"`       // default 300, 0 no limit
+    MinFiles       int  `json:"min_files"`        // default 2
+}
+
+func (c *CompactionConfig) check(e *common.ConfigError) {
+    if !c.Enable {
+        return
+    }
+    if c.CheckIntervalS <= 0 {
+        e.Add("compaction.check_interval_s", "must be positive")
+    }
+    if c.BucketMinute <= 0 {
+        e.Add("compaction.bucket_minute", "must be positive")
+    }
+    if c.MinAgeMinute < 0 {
+        e.Add("compaction.min_age_minute", "must not be negative")
+    }
+    if c.MaxSizeM < 0 {
+        e.Add("compaction.max_size_m", "must not be negative")
+    }
+    if c.MinFiles < 2 {
+        e.Add("compaction.min_files", "must be at least 2")
+    }
+}
+
+func NewCompactor(conf *CompactionConfig, notify chan bool, dirDaemons []*DirDaemon,
+    keyring *util.Keyring) *Compactor {
+    c := &Compactor{
+        enable: conf.Enable,
+        checkInterval: time.Duration(conf.CheckIntervalS) * time.Second,
+        opts: &compact.Options{
+            Bucket: time.Duration(conf.BucketMinute) * time.Minute,
+            MinAge: time.Duration(conf.MinAgeMinute) * time.Minute,
+            MaxBytes: int64(conf.MaxSizeM) * 1024 * 1024,
+            MinFiles: conf.MinFiles,
+            Keyring: keyring,
+        },
+        notify: notify,
+    }
+
+    // write dirs may be shared by other records, only touch own topics
+    seenTopic := make(map[string]bool)
+    seenCatalog := make(map[*util.Catalog]bool)
+    for _, d := range dirDaemons {
+        if !seenTopic[d.topic] {
+            seenTopic[d.topic] = true
+            c.opts.Topics = append(c.opts.Topics, d.topic)
+        }
+        if d.catalog != nil && !seenCatalog[d.catalog] {
+            seenCatalog[d.catalog] = true
+            c.catalogs = append(c.catalogs, d.catalog)
+        }
+    }
+
+    logger.Debugf("New Compactor enable[%v] bucket[%s] minAge[%s] maxBytes[%d] catalogs[%d]\n",
+    c.enable, c.opts.Bucket, c.opts.MinAge, c.opts.MaxBytes, len(c.catalogs))
+    return c
+}
+
+func (c *Compactor) Process() {
+    if !c.enable {
+        logger.Debugf("Compactor disabled\n")
+        return
+    }
+
+    ticker := time.NewTicker(c.checkInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <- ticker.C:
+            c.coreProcess()
+        case <- c.notify:
+            logger.Debugf("Compactor receive end cmd, exiting...\n")
+            return
+        }
+    }
+}
+
+// a merge in progress delays exit until it is done
+func (c *Compactor) coreProcess() {
+    for _, catalog := range c.catalogs {
+        select {
+        case <- c.notify:
+            return
+        default:
+        }
+
+        if _, err := compact.Compact(catalog, c.opts); err != nil {
+            logger.Errorf("Compactor catalog[%s] err[%s]\n", catalog.Path(), err)
+        }
+    }
+}
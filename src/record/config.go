@@ -0,0 +1,317 @@
+package record
+
+import (
+    "util"
+    "common"
+    "fmt"
+    "reflect"
+    "sort"
+    "strings"
+)
+
+// replaced by the idc consumed in write_dirs and file_name_pattern
+const IDCPlaceholder = "{idc}"
+
+// Config is record conf file, defaults come from NewConfig
+type Config struct {
+    util.MiscConfig
+    Main         MainConfig              `json:"main"`
+    Topics       map[string]*TopicConfig `json:"topics"` // per topic override of main
+    Catalog      CatalogConfig           `json:"catalog"`
+    Encryption   EncryptionConfig        `json:"encryption"`
+    Schedule     ScheduleConfig          `json:"schedule"`
+    RecordFilter FilterConfig            `json:"record_filter"`
+    Redaction    RedactionConfig         `json:"redaction"`
+    Retention    RetentionConfig         `json:"retention"`
+    Ring         RingConfig              `json:"ring"`
+    Dispatch     DispatchConfig          `json:"dispatch"`
+    Pipeline     PipelineConfig          `json:"pipeline"`
+    Compaction   CompactionConfig        `json:"compaction"`
+}
+
+type MainConfig struct {
+    Name                 string    `json:"name"`                    // default DefaultRecord
+    PidFile              string    `json:"pid_file"`
+    NSQ                  NSQConfig `json:"nsq"`
+    WriteDirs            []string  `json:"write_dirs"`              // required
+    IsGz                 bool      `json:"is_gz"`                   // default true
+    RecordCRC            bool      `json:"record_crc"`
+    RecordTimestamp      bool      `json:"record_timestamp"`        // keep nsq timestamp of every msg
+    RecordSeq            bool      `json:"record_seq"`              // keep receive sequence of every msg
+    TimePattern          string    `json:"time-pattern"`            // go time layout, default 2006-01-02-15-04-05.000
+    MaxSizePerFileM      int       `json:"max-size-per-file-m"`     // rotate size, default 300, 0 no limit
+    RotateIntervalS      int       `json:"rotate_interval_s"`       // rotate interval, default 60, 0 no limit
+    FileNamePattern      string    `json:"file_name_pattern"`       // required, must contain time-pattern, may contain {idc}
+
+    // record always rotated every 60s whatever it was, honouring it now
+    // would turn the common 60 into hourly files
+    MaxTimeRollingMinute int       `json:"max-time-rolling-minute" deprecated:"never used by record, rotation is rotate_interval_s(default 60), remove it"`
+    TickSec              int       `json:"tick_sec" deprecated:"never used by record, remove it"`
+    MaxBlockPerFile      int       `json:"max-block-per-file" deprecated:"never used by record, remove it"`
+    UselessTail          int       `json:"useless_tail" deprecated:"never used by record, remove it"`
+}
+
+type NSQConfig struct {
+    util.LookupdConfig
+    BackupTopics []string `json:"backup_topics"` // required
+    Channel      string   `json:"channel"`       // required
+    MaxInFlight  int      `json:"max-in-flight"` // default 1
+    TimeoutSec   int      `json:"timeout_sec"`   // idle log interval, default 3
+    Client       util.NSQClientConfig `json:"client"` // tls, auth, compression of consumers
+}
+
+// TopicConfig overrides main conf for one topic, unset keys use main:
+//   "topics": {"test": {"channel": "backup_test", "write_dirs": ["/data1/nsq_backup/"],
+//       "is_gz": false, "time-pattern": "", "max-size-per-file-m": 100,
+//       "rotate_interval_s": 600, "max-in-flight": 100, "timeout_sec": 3,
+//       "client": {...}}}
+// client replaces main.nsq.client as a whole
+type TopicConfig struct {
+    Channel              *string  `json:"channel"`
+    WriteDirs            []string `json:"write_dirs"`
+    IsGz                 *bool    `json:"is_gz"`
+    TimePattern          *string  `json:"time-pattern"`
+    MaxSizePerFileM      *int     `json:"max-size-per-file-m"`
+    RotateIntervalS      *int     `json:"rotate_interval_s"`
+    MaxInFlight          *int     `json:"max-in-flight"`
+    TimeoutSec           *int     `json:"timeout_sec"`
+    Client               *util.NSQClientConfig `json:"client"`
+}
+
+type CatalogConfig struct {
+    Enable   bool   `json:"enable"`    // default true
+    FileName string `json:"file_name"` // default util.DefaultCatalogName
+}
+
+type EncryptionConfig struct {
+    Enable  bool   `json:"enable"`
+    KeyFile string `json:"key_file"` // required if enable
+}
+
+func NewConfig() *Config {
+    return &Config{
+        MiscConfig: util.DefaultMiscConfig(),
+        Main: MainConfig{
+            Name: "DefaultRecord",
+            NSQ: NSQConfig{MaxInFlight: 1, TimeoutSec: 3},
+            IsGz: true,
+            TimePattern: "2006-01-02-15-04-05.000",
+            MaxSizePerFileM: 300,
+            RotateIntervalS: 60,
+        },
+        Catalog: CatalogConfig{Enable: true, FileName: util.DefaultCatalogName},
+        Retention: RetentionConfig{CheckIntervalS: 300},
+        Ring: RingConfig{
+            CheckIntervalS: 10,
+            TriggerSignal: true,
+            Trigger: RingTriggerConfig{Channel: "nsq_vcr_trigger"},
+        },
+        Dispatch: DispatchConfig{Strategy: DispatchRoundRobin},
+        Pipeline: PipelineConfig{BlockSizeK: 256, Depth: 8, FlushMS: 1000},
+        Compaction: CompactionConfig{CheckIntervalS: 600, BucketMinute: 60, MinAgeMinute: 120,
+            MaxSizeM: 300, MinFiles: 2},
+    }
+}
+
+func (c *Config) Check(e *common.ConfigError) {
+    c.MiscConfig.Check(e)
+    c.Main.check(e)
+    topics := make(map[string]bool)
+    for _, topic := range c.Main.NSQ.BackupTopics {
+        topics[topic] = true
+    }
+
+    if c.Catalog.Enable && c.Catalog.FileName == "" {
+        e.Add("catalog.file_name", "required if enable")
+    }
+
+    if c.Encryption.Enable {
+        if c.Encryption.KeyFile == "" {
+            e.Add("encryption.key_file", "required if enable")
+        } else if _, err := util.LoadKeyring(c.Encryption.KeyFile); err != nil {
+            e.Add("encryption.key_file", "%s", err)
+        }
+    }
+
+    // feature sections are checked by building them
+    if _, err := NewSchedules(&c.Schedule); err != nil {
+        e.Add("schedule", "%s", err)
+    }
+    if _, err := NewRecordFilters(&c.RecordFilter); err != nil {
+        e.Add("record_filter", "%s", err)
+    }
+    if _, err := NewRedactors(&c.Redaction); err != nil {
+        e.Add("redaction", "%s", err)
+    }
+    c.Retention.check(e)
+    c.Ring.check(e)
+    c.Dispatch.check(e)
+    c.Pipeline.check(e)
+    c.Compaction.check(e)
+    if c.Compaction.Enable && !c.Catalog.Enable {
+        e.Add("compaction.enable", "requires catalog.enable, segments to merge are found by catalog")
+    }
+    for _, topic := range topicNames(c.Topics) {
+        c.Topics[topic].check("topics." + topic, e)
+    }
+
+    // clusters must not write the same files
+    if c.Main.NSQ.MultiCluster() && !strings.Contains(c.Main.FileNamePattern, IDCPlaceholder) {
+        for _, topic := range c.Main.NSQ.BackupTopics {
+            for _, dir := range c.TopicMain(topic).WriteDirs {
+                if !strings.Contains(dir, IDCPlaceholder) {
+                    e.Add("main.file_name_pattern", "must contain %s when consuming several idcs, or every write dir must",
+                    IDCPlaceholder)
+                }
+            }
+        }
+    }
+
+    // a typo in a topic name would silently do nothing
+    sections := map[string][]string{
+        "schedule.topics": topicNames(c.Schedule.Topics),
+        "record_filter.topics": topicNames(c.RecordFilter.Topics),
+        "redaction.topics": topicNames(c.Redaction.Topics),
+        "retention.topics": topicNames(c.Retention.Topics),
+        "ring.topics": topicNames(c.Ring.Topics),
+        "dispatch.topics": topicNames(c.Dispatch.Topics),
+        "topics": topicNames(c.Topics),
+    }
+    var names []string
+    for name := range sections {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        for _, topic := range sections[name] {
+            if !topics[topic] {
+                e.Add(name + "." + topic, "not in main.nsq.backup_topics")
+            }
+        }
+    }
+}
+
+func (c *MainConfig) check(e *common.ConfigError) {
+    c.NSQ.LookupdConfig.Check("main.nsq", e)
+    if len(c.NSQ.BackupTopics) == 0 {
+        e.Add("main.nsq.backup_topics", "required")
+    }
+    for i, topic := range c.NSQ.BackupTopics {
+        if topic == "" {
+            e.Add(fmt.Sprintf("main.nsq.backup_topics[%d]", i), "empty topic")
+        }
+    }
+    if c.NSQ.Channel == "" {
+        e.Add("main.nsq.channel", "required")
+    }
+    if c.NSQ.MaxInFlight <= 0 {
+        e.Add("main.nsq.max-in-flight", "must be positive")
+    }
+    if c.NSQ.TimeoutSec <= 0 {
+        e.Add("main.nsq.timeout_sec", "must be positive")
+    }
+    c.NSQ.Client.Check("main.nsq.client", e)
+
+    if len(c.WriteDirs) == 0 {
+        e.Add("main.write_dirs", "required")
+    }
+    for i, dir := range c.WriteDirs {
+        if dir == "" {
+            e.Add(fmt.Sprintf("main.write_dirs[%d]", i), "empty dir")
+        }
+    }
+    if c.TimePattern == "" {
+        e.Add("main.time-pattern", "required")
+    }
+    if c.MaxSizePerFileM < 0 {
+        e.Add("main.max-size-per-file-m", "must not be negative")
+    }
+    if c.RotateIntervalS < 0 {
+        e.Add("main.rotate_interval_s", "must not be negative")
+    }
+    if c.FileNamePattern == "" {
+        e.Add("main.file_name_pattern", "required")
+    } else if !strings.Contains(c.FileNamePattern, "time-pattern") {
+        e.Add("main.file_name_pattern", "must contain time-pattern, or every rotation reuses one file")
+    }
+}
+
+// TopicMain is main conf of a topic with its overrides applied
+func (c *Config) TopicMain(topic string) *MainConfig {
+    main := c.Main
+    t, ok := c.Topics[topic]
+    if !ok {
+        return &main
+    }
+
+    if t.Channel != nil {
+        main.NSQ.Channel = *t.Channel
+    }
+    if t.WriteDirs != nil {
+        main.WriteDirs = t.WriteDirs
+    }
+    if t.IsGz != nil {
+        main.IsGz = *t.IsGz
+    }
+    if t.TimePattern != nil {
+        main.TimePattern = *t.TimePattern
+    }
+    if t.MaxSizePerFileM != nil {
+        main.MaxSizePerFileM = *t.MaxSizePerFileM
+    }
+    if t.RotateIntervalS != nil {
+        main.RotateIntervalS = *t.RotateIntervalS
+    }
+    if t.MaxInFlight != nil {
+        main.NSQ.MaxInFlight = *t.MaxInFlight
+    }
+    if t.TimeoutSec != nil {
+        main.NSQ.TimeoutSec = *t.TimeoutSec
+    }
+    if t.Client != nil {
+        main.NSQ.Client = *t.Client
+    }
+    return &main
+}
+
+func (t *TopicConfig) check(path string, e *common.ConfigError) {
+    if t.Channel != nil && *t.Channel == "" {
+        e.Add(path + ".channel", "must not be empty")
+    }
+    if t.WriteDirs != nil && len(t.WriteDirs) == 0 {
+        e.Add(path + ".write_dirs", "must not be empty")
+    }
+    for i, dir := range t.WriteDirs {
+        if dir == "" {
+            e.Add(fmt.Sprintf("%s.write_dirs[%d]", path, i), "empty dir")
+        }
+    }
+    if t.TimePattern != nil && *t.TimePattern == "" {
+        e.Add(path + ".time-pattern", "must not be empty")
+    }
+    if t.MaxSizePerFileM != nil && *t.MaxSizePerFileM < 0 {
+        e.Add(path + ".max-size-per-file-m", "must not be negative")
+    }
+    if t.RotateIntervalS != nil && *t.RotateIntervalS < 0 {
+        e.Add(path + ".rotate_interval_s", "must not be negative")
+    }
+    if t.MaxInFlight != nil && *t.MaxInFlight <= 0 {
+        e.Add(path + ".max-in-flight", "must be positive")
+    }
+    if t.TimeoutSec != nil && *t.TimeoutSec <= 0 {
+        e.Add(path + ".timeout_sec", "must be positive")
+    }
+    if t.Client != nil {
+        t.Client.Check(path + ".client", e)
+    }
+}
+
+// keys of a topics map section
+func topicNames(topics interface{}) []string {
+    var ret []string
+    for _, key := range reflect.ValueOf(topics).MapKeys() {
+        ret = append(ret, key.String())
+    }
+    sort.Strings(ret)
+    return ret
+}
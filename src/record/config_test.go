@@ -0,0 +1,192 @@
+package record
+
+import (
+    "common"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// the legacy rotation key as deployed configs have it
+const legacyConf = `{
+  "main": {
+    "pid_file": "/tmp/record.pid",
+    "tick_sec": 20,
+    "nsq": {"backup_topics": ["test"], "channel": "backup"},
+    "write_dirs": ["/tmp/data"],
+    "max-time-rolling-minute": 60,
+    "file_name_pattern": "/write_dirs/topic/channel/backup.log.time-pattern_msg-num.gz"
+  },
+  "log": {"log_dir": "/tmp", "log_name": "record.log"}
+}`
+
+func loadConf(t *testing.T, content string) (*Config, []string, error) {
+    path := filepath.Join(t.TempDir(), "record.json")
+    if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+    conf := NewConfig()
+    warnings, err := common.LoadConf(path, conf)
+    return conf, warnings, err
+}
+
+func TestLoadSampleConf(t *testing.T) {
+    for _, path := range []string{"../../etc/record.json", "../../etc/ut/record.json"} {
+        warnings, err := common.LoadConf(path, NewConfig())
+        if err != nil || len(warnings) != 0 {
+            t.Fatalf("%s warnings %v err[%v]", path, warnings, err)
+        }
+    }
+}
+
+// the legacy rolling key never rotated anything, it stays a warning and
+// the interval stays 60s
+func TestLoadLegacyRotateConf(t *testing.T) {
+    conf, warnings, err := loadConf(t, legacyConf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(warnings) != 2 || !strings.HasPrefix(warnings[0], "main.max-time-rolling-minute: deprecated") {
+        t.Fatalf("warnings %q", warnings)
+    }
+    d := NewDirDaemon(make(chan bool), "/tmp/data", "test", "", conf.TopicMain("test"), nil, nil, nil, nil, nil)
+    if d.rotateInterval != time.Minute {
+        t.Fatalf("rotate interval %s", d.rotateInterval)
+    }
+}
+
+func TestTopicRotateInterval(t *testing.T) {
+    content := strings.Replace(legacyConf, `"log"`, `"topics": {"test": {"rotate_interval_s": 600}}, "log"`, 1)
+    conf, _, err := loadConf(t, content)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := conf.TopicMain("test").RotateIntervalS; got != 600 {
+        t.Fatalf("topic rotate_interval_s %d", got)
+    }
+    if got := conf.TopicMain("other").RotateIntervalS; got != 60 {
+        t.Fatalf("default rotate_interval_s %d", got)
+    }
+}
+
+func TestLoadConfProblems(t *testing.T) {
+    content := strings.Replace(legacyConf, `"channel": "backup"`, `"channel": "", "max-in-fligh": 20`, 1)
+    content = strings.Replace(content, `"log"`, `"topics": {"test": {"rotate_interval_s": -1}}, "log"`, 1)
+    _, _, err := loadConf(t, content)
+    for _, want := range []string{
+        "main.nsq.max-in-fligh: unknown key",
+        "main.nsq.channel: required",
+        "topics.test.rotate_interval_s: must not be negative",
+    } {
+        if err == nil || !strings.Contains(err.Error(), want) {
+            t.Fatalf("err[%v] misses %s", err, want)
+        }
+    }
+}
+
+// null entries are reported, not dereferenced by the section checks
+func TestLoadConfNullEntries(t *testing.T) {
+    content := strings.Replace(legacyConf, `"log"`, `"topics": {"test": null},
+        "retention": {"topics": {"test": null}}, "ring": {"topics": {"test": null}},
+        "dispatch": {"topics": {"test": null}}, "log"`, 1)
+    _, _, err := loadConf(t, content)
+    ce, ok := err.(*common.ConfigError)
+    if !ok {
+        t.Fatalf("err[%v] is not ConfigError", err)
+    }
+    want := []string{
+        "dispatch.topics.test: null value, remove the key to use default",
+        "retention.topics.test: null value, remove the key to use default",
+        "ring.topics.test: null value, remove the key to use default",
+        "topics.test: null value, remove the key to use default",
+    }
+    if strings.Join(ce.Problems, "\n") != strings.Join(want, "\n") {
+        t.Fatalf("problems %q", ce.Problems)
+    }
+}
+
+// set keys of a topic override main, unset ones and other topics use main
+func TestTopicMainOverrides(t *testing.T) {
+    content := strings.Replace(legacyConf, `"log"`, `"topics": {"test": {"channel": "backup_test",
+        "write_dirs": ["/data9"], "is_gz": false, "max-in-flight": 50,
+        "client": {"auth_secret": "topic"}}}, "log"`, 1)
+    content = strings.Replace(content, `"backup_topics": ["test"]`, `"backup_topics": ["test", "other"],
+        "max-in-flight": 10, "client": {"auth_secret": "main", "snappy": true}`, 1)
+    conf, _, err := loadConf(t, content)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    m := conf.TopicMain("test")
+    if m.NSQ.Channel != "backup_test" || len(m.WriteDirs) != 1 || m.WriteDirs[0] != "/data9" ||
+        m.IsGz || m.NSQ.MaxInFlight != 50 {
+        t.Fatalf("overridden main %+v", m)
+    }
+    // client is replaced as a whole
+    if m.NSQ.Client.AuthSecret != "topic" || m.NSQ.Client.Snappy {
+        t.Fatalf("overridden client %+v", m.NSQ.Client)
+    }
+    // inherited
+    if m.TimePattern != "2006-01-02-15-04-05.000" || m.NSQ.TimeoutSec != 3 || m.MaxSizePerFileM != 300 ||
+        m.FileNamePattern != conf.Main.FileNamePattern {
+        t.Fatalf("inherited main %+v", m)
+    }
+
+    for _, topic := range []string{"other", "unknown"} {
+        m := conf.TopicMain(topic)
+        if m.NSQ.Channel != "backup" || m.WriteDirs[0] != "/tmp/data" || !m.IsGz || m.NSQ.MaxInFlight != 10 ||
+            m.NSQ.Client.AuthSecret != "main" {
+            t.Fatalf("%s main %+v", topic, m)
+        }
+    }
+    // overrides never leak into main
+    if conf.Main.NSQ.Channel != "backup" || conf.Main.WriteDirs[0] != "/tmp/data" {
+        t.Fatalf("main changed %+v", conf.Main)
+    }
+}
+
+func TestTopicOverrideProblems(t *testing.T) {
+    content := strings.Replace(legacyConf, `"log"`, `"topics": {"test": {"channel": "", "write_dirs": [],
+        "max-in-flight": 0}, "tset": {}}, "log"`, 1)
+    _, _, err := loadConf(t, content)
+    for _, want := range []string{
+        "topics.test.channel: must not be empty",
+        "topics.test.write_dirs: must not be empty",
+        "topics.test.max-in-flight: must be positive",
+        "topics.tset: not in main.nsq.backup_topics",
+    } {
+        if err == nil || !strings.Contains(err.Error(), want) {
+            t.Fatalf("err[%v] misses %s", err, want)
+        }
+    }
+}
+
+// clusters consumed at once must not write the same files
+func TestMultiClusterWriteDirs(t *testing.T) {
+    multi := strings.Replace(legacyConf, `"backup_topics": ["test"]`, `"backup_topics": ["test"], "idcs": ["idc1", "idc2"]`, 1)
+    cases := []struct {
+        content string
+        ok      bool
+    }{
+        {multi, false},
+        {strings.Replace(multi, `"/tmp/data"`, `"/tmp/data/{idc}"`, 1), true},
+        {strings.Replace(multi, `backup.log.time-pattern`, `backup.log.{idc}.time-pattern`, 1), true},
+        // a topic writing elsewhere needs its own dirs per idc too
+        {strings.Replace(strings.Replace(multi, `"/tmp/data"`, `"/tmp/data/{idc}"`, 1),
+            `"log"`, `"topics": {"test": {"write_dirs": ["/data9"]}}, "log"`, 1), false},
+        {strings.Replace(multi, `"idc1", "idc2"`, `"all"`, 1), false},
+        // one cluster
+        {strings.Replace(multi, `"idc1", "idc2"`, `"idc1"`, 1), true},
+    }
+    for i, c := range cases {
+        _, _, err := loadConf(t, c.content)
+        if (err == nil) != c.ok {
+            t.Fatalf("case %d: err[%v], want ok %v", i, err, c.ok)
+        }
+        if err != nil && !strings.Contains(err.Error(), "main.file_name_pattern: must contain {idc}") {
+            t.Fatalf("case %d: err[%v]", i, err)
+        }
+    }
+}
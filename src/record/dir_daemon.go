@@ -2,6 +2,7 @@ package record
 
 import (
     "util"
+    "util/segment"
     "logger"
     "sync"
     "sync/atomic"
@@ -13,6 +14,9 @@ import (
     "time"
     "strings"
     "fmt"
+    "hash"
+    "crypto/sha256"
+    "encoding/hex"
 
     nsq      "github.com/nsqio/go-nsq"
 )
@@ -21,6 +25,7 @@ import (
 // 一个三元组(dirname, topic, channel)决定一个 DirDaemon
 type DirDaemon struct {
     topic      string
+    idc        string // cluster consumed
     channel    string
     consumer   *nsq.Consumer
     timeOut    int // seconds
@@ -29,7 +34,10 @@ type DirDaemon struct {
     maxSizePerFile int
     lookupds   []string
     maxInFlight    int
-    routeChan  chan *nsq.Message
+    client         *util.NSQClientConfig
+    routeChan  chan *inMsg
+    pending    int64   // msgs handed to routeChan and not written yet
+    seq        *uint64 // receive sequence of topic, shared by its daemons
 
     msgHolder  []*util.Message
     content    bytes.Buffer
@@ -47,43 +55,87 @@ type DirDaemon struct {
     filesize     int64
 	lastOpenTime time.Time
 	lastFilename string
+    fileLock     sync.Mutex // protect lastFilename, read by retention
     rotateInterval   time.Duration // default 60s
     rotateSize       int64         // default 300MB = 300 * 1024 * 1024B
     filenameFormat   string
     compressionLevel int // default DefaultCompression
 
+    // manifest of current file, write to catalog when rotate
+    catalog      *util.Catalog
+    firstTime    int64 // first msg timestamp
+    lastTime     int64 // last msg timestamp
+    firstSeq     uint64
+    lastSeq      uint64
+    rawBytes     int64 // bytes before compression
+    rawBase      int64 // bytes already in a plain file reopened to append
+    hasher       hash.Hash
+
+    recordFlags  byte // segment record format, e.g. segment.FlagCRC
+    segWriter    *segment.Writer // frames records onto writer
+
+    keyring       *util.Keyring // encrypt segment if not nil
+    encryptWriter io.WriteCloser
+
+    redactor      *Redactor // mask fields before write if not nil
+    filter        *RecordFilter // only record part of messages if not nil
+
+    schedule      *util.Schedule // timer recording, nil means always
+    flow          *flow // max-in-flight of own consumer
+
+    rotateReq     chan chan bool // rotate now, e.g. ring freeze
+
+    // compression pipeline, nil pool means writing in place
+    pool          *CompressPool
+    blockSize     int
+    flushInterval time.Duration
+    block         *block // batching
+    blocks        chan *block // submitted, in order
+    queued        int64 // uncompressed bytes submitted but not written
+    writerDone    chan struct{}
+    sink          io.Writer // blocks go here, encryption or d
 }
 
-func NewDirDaemon(notify chan bool, dirname, topic, channel, timePattern, filenameFormat string,
-     timeOut, maxSizePerFile, maxInFlight int, isGz bool,
-     lookupds []string) *DirDaemon {
-
-    if dirname == "" || topic == "" || channel == "" || timePattern == "" {
-        logger.Debugf("dirname[%s] topic[%s] channel[%s] or timePattern[%s] is nil\n", 
-        dirname, topic, channel, timePattern)
-        return nil
-    }
-
-    if len(lookupds) == 0 {
-        logger.Errorf("NewDirDaemon got no lookupds, please check!!!\n")
-        return nil
-    }
+// NewDirDaemon only writes, messages come from its own consumer after
+// Subscribe or from a Dispatcher of the topic
+func NewDirDaemon(notify chan bool, dirname, topic, idc string, conf *MainConfig,
+     catalog *util.Catalog, keyring *util.Keyring, redactor *Redactor,
+     filter *RecordFilter, schedule *util.Schedule) *DirDaemon {
 
+    maxSizePerFile := conf.MaxSizePerFileM * 1024 * 1024
     dirDaemon := &DirDaemon{
         topic: topic,
-        channel: channel,
-        timeOut: timeOut,
+        idc: idc,
+        channel: conf.NSQ.Channel,
+        timeOut: conf.NSQ.TimeoutSec,
         dirname: dirname,
-        routeChan: make(chan *nsq.Message),
-        timePattern: timePattern,
+        routeChan: make(chan *inMsg),
+        timePattern: conf.TimePattern,
         maxSizePerFile: maxSizePerFile,
-        isGz: isGz,
+        isGz: conf.IsGz,
         notify: notify,
-        maxInFlight: maxInFlight,
-        filenameFormat: filenameFormat,
-        rotateInterval: 60 * time.Second,
+        maxInFlight: conf.NSQ.MaxInFlight,
+        client: &conf.NSQ.Client,
+        filenameFormat: conf.FileNamePattern,
+        rotateInterval: time.Duration(conf.RotateIntervalS) * time.Second,
         rotateSize: int64(maxSizePerFile),
         compressionLevel: gzip.DefaultCompression,
+        catalog: catalog,
+        keyring: keyring,
+        redactor: redactor,
+        filter: filter,
+        schedule: schedule,
+        rotateReq: make(chan chan bool),
+    }
+
+    if conf.RecordCRC {
+        dirDaemon.recordFlags |= segment.FlagCRC
+    }
+    if conf.RecordTimestamp {
+        dirDaemon.recordFlags |= segment.FlagTimestamp
+    }
+    if conf.RecordSeq {
+        dirDaemon.recordFlags |= segment.FlagSequence
     }
 
     dirDaemon.filenameFormatConv()
@@ -91,36 +143,50 @@ func NewDirDaemon(notify chan bool, dirname, topic, channel, timePattern, filena
     dirDaemon.content.Reset()
     atomic.StoreUint64(&dirDaemon.msgNum, 0)
 
-    config := nsq.NewConfig()
-    config.MaxInFlight = maxInFlight
-    consumer, err := nsq.NewConsumer(topic, channel, config)
+    logger.Debugf("New DirDaemon dirname[%s] topic[%s] channel[%s] success\n",
+    dirname, topic, dirDaemon.channel)
+    return dirDaemon
+}
+
+// Subscribe gives the daemon its own consumer of topic/channel in its idc
+func (d *DirDaemon) Subscribe(connector *util.Connector, seq *uint64) error {
+    d.seq = seq
+    config, err := d.client.NewConfig()
     if err != nil {
-        logger.Errorf("NewDirDaemon NewConsumer err[%s]\n", err)
-        return nil
+        return fmt.Errorf("%s nsq client err[%s]", d, err)
+    }
+    config.MaxInFlight = d.maxInFlight
+    consumer, err := nsq.NewConsumer(d.topic, d.channel, config)
+    if err != nil {
+        return fmt.Errorf("%s NewConsumer err[%s]", d, err)
     }
 
     consumer.AddHandler(nsq.HandlerFunc(func(m *nsq.Message) error {
         m.DisableAutoResponse()
-        dirDaemon.routeChan <- m
+        d.hold(m)
+        d.routeChan <- &inMsg{Message: m, seq: atomic.AddUint64(d.seq, 1)}
         return nil
     }))
 
-    if err := consumer.ConnectToNSQLookupds(lookupds); err != nil {
-        logger.Errorf("NewDirDaemon consumer ConnectToNSQLookupds [%v] err[%s]\n",
-        lookupds, err)
-        return nil
+    // start paused if out of schedule
+    d.flow = newFlow(d, consumer, d.maxInFlight)
+    if d.schedule != nil && !d.schedule.Active(time.Now()) {
+        logger.Infof("%s out of schedule, start paused\n", d)
+        d.flow.setPaused(true)
     }
+    util.OnMemLevel(d.flow.setLevel)
 
-    dirDaemon.consumer = consumer
-
-    logger.Debugf("New DirDaemon dirname[%s] topic[%s] channel[%s] success\n", 
-    dirname, topic, channel)
-    return dirDaemon
+    d.consumer = consumer
+    if err := connector.Connect(d.idc, consumer); err != nil {
+        return fmt.Errorf("%s consumer connect err[%s]", d, err)
+    }
+    return nil
 }
 
 // must call after init
 func (d *DirDaemon) filenameFormatConv() {
     fNameP1 := strings.Replace(d.filenameFormat, "write_dirs", d.dirname, -1)
+    fNameP1 = strings.Replace(fNameP1, IDCPlaceholder, d.idc, -1)
     fNameP2 := strings.Replace(fNameP1, "topic", d.topic, -1)
     fNameP3 := strings.Replace(fNameP2, "channel", d.channel, -1)
     d.filenameFormat = fNameP3
@@ -128,13 +194,29 @@ func (d *DirDaemon) filenameFormatConv() {
 
 // for debug
 func (d *DirDaemon) String() string {
-    return fmt.Sprintf("dir{%s}/topic{%s}/channel{%s}", d.dirname, d.topic, 
-    d.channel)
+    return fmt.Sprintf("dir{%s}/idc{%s}/topic{%s}/channel{%s}", d.dirname, d.idc,
+    d.topic, d.channel)
 }
 
 func (d *DirDaemon) Process() {
     // TODO: can configure
     ticker := time.NewTicker(time.Duration(30) * time.Second)
+
+    var scheduleC <-chan time.Time
+    if d.schedule != nil {
+        scheduleTicker := time.NewTicker(scheduleCheckInterval)
+        defer scheduleTicker.Stop()
+        scheduleC = scheduleTicker.C
+        d.checkSchedule()
+    }
+
+    var flushC <-chan time.Time
+    if d.pool != nil {
+        flushTicker := time.NewTicker(d.flushInterval / 2)
+        defer flushTicker.Stop()
+        flushC = flushTicker.C
+    }
+
     for {
         select {
         case msg := <- d.routeChan:
@@ -156,6 +238,13 @@ func (d *DirDaemon) Process() {
             if d.needsFileRotate() {
                 d.updateFile()
             }
+        case <- scheduleC:
+            d.checkSchedule()
+        case <- flushC:
+            d.checkBlock()
+        case done := <- d.rotateReq:
+            d.updateFile()
+            close(done)
         }
     }
 Exit:
@@ -163,18 +252,66 @@ Exit:
     d.Close()
 }
 
-func (d *DirDaemon) coreProcess(nMsg *nsq.Message) error {
+// Rotate finishes the file being written, false if daemon is exiting
+func (d *DirDaemon) Rotate() bool {
+    done := make(chan bool)
+    select {
+    case d.rotateReq <- done:
+    case <- d.notify:
+        return false
+    }
+
+    <- done
+    return true
+}
+
+// hold counts a msg handed to routeChan until it is written
+func (d *DirDaemon) hold(m *nsq.Message) {
+    atomic.AddInt64(&d.pending, 1)
+    util.AddBuffered(int64(len(m.Body)))
+}
+
+func (d *DirDaemon) release(m *nsq.Message) {
+    atomic.AddInt64(&d.pending, -1)
+    util.AddBuffered(-int64(len(m.Body)))
+}
+
+func (d *DirDaemon) coreProcess(nMsg *inMsg) error {
+    defer d.release(nMsg.Message)
     if d.needsFileRotate() {
         d.updateFile()
     }
 
-    msg := util.NewMessage(nMsg.Body)
-    if msg == nil {
-        logger.Errorf("Receive from nsqd body[%v], cannot decode\n", nMsg.Body)
+    body := nMsg.Body
+    if d.filter != nil && !d.filter.Keep(body) {
+        nMsg.Finish()
+        return nil
+    }
+
+    if d.redactor != nil {
+        var ok bool
+        if body, ok = d.redactor.Redact(body); !ok {
+            logger.Debugf("%s redactor reject msg, skip\n", d)
+            nMsg.Finish()
+            return nil
+        }
     }
 
     atomic.AddUint64(&d.msgNum, 1)
-    _, err := d.writer.Write(msg.Serialize())
+    if d.firstTime == 0 {
+        d.firstTime = nMsg.Timestamp
+    }
+    d.lastTime = nMsg.Timestamp
+    if d.firstSeq == 0 {
+        d.firstSeq = nMsg.seq
+    }
+    d.lastSeq = nMsg.seq
+    _, err := d.segWriter.Write(&segment.Record{
+        Timestamp: nMsg.Timestamp,
+        Seq: nMsg.seq,
+        Body: body,
+    })
+    d.rawBytes = d.rawBase + d.segWriter.Offset()
     if err != nil {
         logger.Fatalf("Error: Writing Message to disk err[%s]\n", err)
         // TODO
@@ -188,6 +325,9 @@ func (d *DirDaemon) coreProcess(nMsg *nsq.Message) error {
 
 func (d *DirDaemon) Write(p []byte) (n int, err error) {
     atomic.AddInt64(&d.filesize, int64(len(p)))
+    if d.hasher != nil {
+        d.hasher.Write(p)
+    }
     return d.out.Write(p)
 }
 
@@ -211,6 +351,24 @@ func (d *DirDaemon) calculateCurrentFilename() string {
     return strings.Replace(d.filenameFormat, "time-pattern", timeStr, -1)
 }
 
+// file being written now, retention must never touch it
+func (d *DirDaemon) currentFile() string {
+    d.fileLock.Lock()
+    defer d.fileLock.Unlock()
+    return d.lastFilename
+}
+
+// dir holding finished segments and the common prefix of their names
+func (d *DirDaemon) segmentDir() (string, string) {
+    dir, base := filepath.Split(d.calculateCurrentFilename())
+    prefix := base
+    if idx := strings.Index(d.filenameFormat, "time-pattern"); idx != -1 {
+        _, formatBase := filepath.Split(d.filenameFormat[:idx])
+        prefix = formatBase
+    }
+    return filepath.Clean(dir), prefix
+}
+
 func (d *DirDaemon) needsFileRotate() bool {
     if d.out == nil {
         return true
@@ -224,9 +382,20 @@ func (d *DirDaemon) needsFileRotate() bool {
         }
     }
 
-    if d.rotateSize > 0 && d.filesize > d.rotateSize {
-        logger.Debugf("%s current %d bytes, need rotate", d.out.Name(), d.filesize)
-        return true
+    if d.rotateSize > 0 {
+        size := atomic.LoadInt64(&d.filesize)
+        if d.pool != nil {
+            // blocks on the way are not in the file yet, count them
+            // uncompressed, a file ends a little early rather than big
+            size += atomic.LoadInt64(&d.queued)
+            if d.block != nil {
+                size += int64(d.block.raw.Len())
+            }
+        }
+        if size > d.rotateSize {
+            logger.Debugf("%s current %d bytes, need rotate", d.out.Name(), size)
+            return true
+        }
     }
 
     return false
@@ -242,7 +411,9 @@ func (d *DirDaemon) updateFile() {
         d.lastFilename)
     }
 
+    d.fileLock.Lock()
     d.lastFilename = filename
+    d.fileLock.Unlock()
     d.lastOpenTime = time.Now()
 
     dir, _ := filepath.Split(filename)
@@ -254,7 +425,7 @@ func (d *DirDaemon) updateFile() {
     }
 
     openFlag := os.O_WRONLY | os.O_CREATE
-    if d.isGz {
+    if d.isGz || d.keyring != nil {
         openFlag |= os.O_EXCL
     } else {
         openFlag |= os.O_APPEND
@@ -276,22 +447,125 @@ func (d *DirDaemon) updateFile() {
 
     // TODO: filesize must zero, check
     d.filesize = fi.Size()
+    d.hasher = sha256.New()
     logger.Debugf("Rotate file[%s] size[%d]\n", d.lastFilename, d.filesize)
 
-    if d.isGz {
-        d.gzipWriter, _ = gzip.NewWriterLevel(d, d.compressionLevel)
+    // appending to an existing plain file must not write header again
+    isNew := d.filesize == 0
+
+    // records -> gzip -> encrypt -> d(count size and checksum) -> file
+    var sink io.Writer = d
+    if d.keyring != nil {
+        d.encryptWriter, err = util.NewEncryptWriter(d, d.keyring)
+        if err != nil {
+            logger.Fatalf("%s new encrypt writer for file[%s] err[%s]\n", d, filename, err)
+        }
+        sink = d.encryptWriter
+    }
+
+    if d.pool != nil {
+        // compressed by blocks, see pipeline.go
+        d.sink = sink
+        d.writer = batch{d}
+    } else if d.isGz {
+        d.gzipWriter, _ = gzip.NewWriterLevel(sink, d.compressionLevel)
         d.writer = d.gzipWriter
     } else {
-        d.writer = d
+        d.writer = sink
+    }
+
+    d.segWriter = segment.NewWriter(d.writer, d.segmentHeader())
+    d.rawBase = 0
+    if isNew {
+        if err := d.segWriter.WriteHeader(); err != nil {
+            logger.Fatalf("%s write segment header err[%s]\n", d, err)
+        }
+        d.rawBytes = d.segWriter.Offset()
+    } else {
+        d.resumeFile(filename)
+    }
+}
+
+// resumeFile accounts what is already in a plain file reopened to append,
+// e.g. left with msg-num by a crash, so its name, catalog msg_count and
+// sha256 cover the whole file
+func (d *DirDaemon) resumeFile(filename string) {
+    fp, err := os.Open(filename)
+    if err != nil {
+        logger.Errorf("%s reopen file[%s] to hash err[%s]\n", d, filename, err)
+        return
+    }
+    _, err = io.Copy(d.hasher, fp)
+    fp.Close()
+    if err != nil {
+        logger.Errorf("%s hash file[%s] err[%s]\n", d, filename, err)
+    }
+    d.rawBase = atomic.LoadInt64(&d.filesize)
+    d.rawBytes = d.rawBase
+
+    file, err := segment.Open(filename, nil)
+    if err != nil {
+        logger.Errorf("%s read existing file[%s] err[%s]\n", d, filename, err)
+        return
+    }
+    defer file.Close()
+    file.SetPooled(true)
+    for {
+        rec, err := file.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            // appending keeps the damage, verify reports it
+            logger.Errorf("%s existing file[%s] err[%s]\n", d, filename, err)
+            break
+        }
+        atomic.AddUint64(&d.msgNum, 1)
+        if d.firstTime == 0 {
+            d.firstTime = rec.Timestamp
+        }
+        d.lastTime = rec.Timestamp
+        if d.firstSeq == 0 {
+            d.firstSeq = rec.Seq
+        }
+        d.lastSeq = rec.Seq
+        rec.Release()
+    }
+    logger.Infof("%s append to file[%s] with %d msgs\n", d, filename, atomic.LoadUint64(&d.msgNum))
+}
+
+func (d *DirDaemon) segmentHeader() *segment.Header {
+    meta := map[string]string{
+        "topic": d.topic,
+        "channel": d.channel,
+        "idc": d.idc,
+        "create_time": fmt.Sprintf("%d", d.lastOpenTime.UnixNano()),
+    }
+    if d.redactor != nil {
+        meta["redaction_version"] = d.redactor.version
     }
+    // readers must know the archive is partial
+    if d.filter != nil {
+        meta["record_filter"] = d.filter.definition
+    }
+
+    return segment.NewHeader(d.recordFlags, meta)
 }
 
 func (d *DirDaemon) rotate() {
     if d.out != nil {
-        d.out.Sync()
+        if d.pool != nil {
+            d.flushBlocks()
+        }
         if d.gzipWriter != nil {
             d.gzipWriter.Close()
+            d.gzipWriter = nil
+        }
+        if d.encryptWriter != nil {
+            d.encryptWriter.Close()
+            d.encryptWriter = nil
         }
+        d.out.Sync()
         d.out.Close()
         d.out = nil
     }
@@ -304,27 +578,76 @@ func (d *DirDaemon) rotate() {
     logger.Debugf("Now %s rename %s to %s\n", d, d.lastFilename, nameWithMsgNum)
     util.AtomicRename(d.lastFilename, nameWithMsgNum)
 
+    if d.catalog != nil && d.lastFilename != "" {
+        d.appendCatalog(filepath.Clean(nameWithMsgNum))
+    }
+
     atomic.StoreUint64(&d.msgNum, 0)
+    d.firstTime = 0
+    d.lastTime = 0
+    d.firstSeq = 0
+    d.lastSeq = 0
+    d.rawBytes = 0
+}
+
+func (d *DirDaemon) appendCatalog(path string) {
+    codec := "none"
+    if d.isGz {
+        codec = "gzip"
+    }
+
+    var checksum string
+    if d.hasher != nil {
+        checksum = hex.EncodeToString(d.hasher.Sum(nil))
+    }
+
+    var keyID string
+    if d.keyring != nil {
+        keyID = d.keyring.CurrentID()
+    }
+
+    entry := &util.CatalogEntry{
+        Path: path,
+        Topic: d.topic,
+        Channel: d.channel,
+        IDC: d.idc,
+        FirstTime: d.firstTime,
+        LastTime: d.lastTime,
+        FirstSeq: d.firstSeq,
+        LastSeq: d.lastSeq,
+        MsgCount: atomic.LoadUint64(&d.msgNum),
+        RawBytes: d.rawBytes,
+        CompressedBytes: atomic.LoadInt64(&d.filesize),
+        Codec: codec,
+        Checksum: checksum,
+        KeyID: keyID,
+        CreateTime: time.Now().UnixNano(),
+    }
+
+    if err := d.catalog.Append(entry); err != nil {
+        logger.Errorf("%s append catalog[%s] entry[%s] err[%s]\n", d,
+        d.catalog.Path(), path, err)
+        return
+    }
+    logger.Debugf("%s append catalog[%s] entry[%+v]\n", d, d.catalog.Path(), entry)
 }
 
 func (d *DirDaemon) Close() {
+    // a shared consumer is stopped by each of its daemons, Stop is idempotent
     d.consumer.Stop()
-    // before close d.routeChan must ensure nsq.consumer stop
-    <- d.consumer.StopChan
+    // handlers block on routeChan, keep writing until the consumer stops
+    for stopped := false; !stopped; {
+        select {
+        case msg := <- d.routeChan:
+            d.coreProcess(msg)
+        case <- d.consumer.StopChan:
+            stopped = true
+        }
+    }
     logger.Debugf("nsq consumer StopChan can read\n")
 
-    // close(d.routeChan)
-
-    // read left msg
-    // for body := range d.routeChan {
-        // msg := util.NewMessage(body)
-        // atomic.AddUint64(&d.msgNum, 1)
-        // if msg == nil {
-            // logger.Errorf("Receive from nsqd body[%v], cannot decode\n", body)
-            // continue
-        // }
-    // }
     d.rotate()
+    d.stopPipeline()
     logger.Debugf("DirDaemon dirname[%s] topic[%s] channel[%s] Exit!\n",
     d.dirname, d.topic, d.channel)
 }
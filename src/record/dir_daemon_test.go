@@ -0,0 +1,96 @@
+package record
+
+import (
+    "util"
+    "util/segment"
+    "io"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+    "crypto/sha256"
+    "encoding/hex"
+    nsq      "github.com/nsqio/go-nsq"
+)
+
+type noopDelegate struct{}
+
+func (noopDelegate) OnFinish(*nsq.Message) {}
+func (noopDelegate) OnRequeue(*nsq.Message, time.Duration, bool) {}
+func (noopDelegate) OnTouch(*nsq.Message) {}
+
+func testMsg(body string, timestamp int64) *inMsg {
+    m := nsq.NewMessage(nsq.MessageID{}, []byte(body))
+    m.Timestamp = timestamp
+    m.Delegate = noopDelegate{}
+    return &inMsg{Message: m}
+}
+
+func readBodies(t *testing.T, path string) []string {
+    file, err := segment.Open(path, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+    var ret []string
+    for {
+        rec, err := file.Next()
+        if err == io.EOF {
+            return ret
+        }
+        if err != nil {
+            t.Fatal(err)
+        }
+        ret = append(ret, string(rec.Body))
+    }
+}
+
+// a plain file left with msg-num by a crash is appended to, its name and
+// catalog entry must cover the records already there
+func TestPlainFileResume(t *testing.T) {
+    dir := t.TempDir()
+    conf := testMainConfig()
+    conf.IsGz = false
+    conf.TimePattern = "resume"
+    conf.FileNamePattern = "/write_dirs/topic/channel/backup.log.time-pattern_msg-num"
+    catalog := util.GetCatalog(filepath.Join(dir, util.DefaultCatalogName))
+    d := NewDirDaemon(make(chan bool), dir, "test", "", conf, catalog, nil, nil, nil, nil)
+
+    segDir := filepath.Join(dir, "test", "backup")
+    os.MkdirAll(segDir, 0770)
+    fp, err := os.Create(filepath.Join(segDir, "backup.log.resume_msg-num"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    w := segment.NewWriter(fp, segment.NewHeader(0, map[string]string{"topic": "test"}))
+    w.WriteHeader()
+    w.Write(&segment.Record{Body: []byte("a")})
+    w.Write(&segment.Record{Body: []byte("b")})
+    fp.Close()
+
+    msg := testMsg("c", 3)
+    d.hold(msg.Message)
+    if err := d.coreProcess(msg); err != nil {
+        t.Fatal(err)
+    }
+    d.rotate()
+
+    path := filepath.Join(segDir, "backup.log.resume_3")
+    if bodies := readBodies(t, path); len(bodies) != 3 || bodies[2] != "c" {
+        t.Fatalf("bodies %v", bodies)
+    }
+    content, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    sum := sha256.Sum256(content)
+
+    entries, err := util.ReadCatalog(catalog.Path())
+    if err != nil || len(entries) != 1 {
+        t.Fatalf("entries %v err %v", entries, err)
+    }
+    e := entries[0]
+    if e.MsgCount != 3 || e.Checksum != hex.EncodeToString(sum[:]) || e.RawBytes != int64(len(content)) {
+        t.Fatalf("entry %+v, file size %d", e, len(content))
+    }
+}
@@ -0,0 +1,210 @@
+package record
+
+import (
+    "util"
+    "common"
+    "logger"
+    "fmt"
+    "time"
+    "hash/fnv"
+    "sync/atomic"
+    nsq      "github.com/nsqio/go-nsq"
+)
+
+const (
+    DispatchRoundRobin  = "round_robin"
+    DispatchLeastLoaded = "least_loaded"
+    DispatchHashKey     = "hash_key"
+)
+
+// DispatchConfig is conf section:
+//   "dispatch": {"enable": false, "strategy": "round_robin", "hash_key": "",
+//       "topics": {"topic": {"strategy": "hash_key", "hash_key": "user.id"}}}
+// with enable every topic has one consumer, its messages are spread to
+// the write dirs instead of one consumer per write dir
+type DispatchConfig struct {
+    Enable   bool                            `json:"enable"`
+    Strategy string                          `json:"strategy"` // default round_robin
+    HashKey  string                          `json:"hash_key"` // json field, required by hash_key
+    Topics   map[string]*DispatchTopicConfig `json:"topics"`
+}
+
+// DispatchTopicConfig overrides strategy for one topic
+type DispatchTopicConfig struct {
+    Strategy string `json:"strategy"`
+    HashKey  string `json:"hash_key"`
+}
+
+func (c *DispatchConfig) check(e *common.ConfigError) {
+    checkStrategy("dispatch", c.Strategy, c.HashKey, e)
+    for _, topic := range topicNames(c.Topics) {
+        t := c.topic(topic)
+        checkStrategy("dispatch.topics." + topic, t.Strategy, t.HashKey, e)
+    }
+}
+
+func checkStrategy(path, strategy, hashKey string, e *common.ConfigError) {
+    switch strategy {
+    case DispatchRoundRobin, DispatchLeastLoaded:
+    case DispatchHashKey:
+        if hashKey == "" {
+            e.Add(path + ".hash_key", "required by strategy %s", DispatchHashKey)
+        }
+    default:
+        e.Add(path + ".strategy", "invalid strategy[%s], want %s %s or %s", strategy,
+        DispatchRoundRobin, DispatchLeastLoaded, DispatchHashKey)
+    }
+}
+
+// strategy of a topic, unset keys use the global ones
+func (c *DispatchConfig) topic(topic string) *DispatchTopicConfig {
+    ret := &DispatchTopicConfig{Strategy: c.Strategy, HashKey: c.HashKey}
+    if t, ok := c.Topics[topic]; ok {
+        if t.Strategy != "" {
+            ret.Strategy = t.Strategy
+        }
+        if t.HashKey != "" {
+            ret.HashKey = t.HashKey
+        }
+    }
+    return ret
+}
+
+// msg with its receive sequence in topic
+type inMsg struct {
+    *nsq.Message
+    seq uint64
+}
+
+// Dispatcher owns the only consumer of a topic and hands every message to
+// one of the topic's daemons, which then only write. Receive sequence is
+// given before dispatching, so total order of a topic can be rebuilt from
+// all write dirs.
+type Dispatcher struct {
+    topic       string
+    consumer    *nsq.Consumer
+    daemons     []*DirDaemon
+    strategy    string
+    hashKey     []string
+    next        uint64 // round robin, start of least loaded scan
+    seq         *uint64
+    notify      chan bool
+
+    schedule    *util.Schedule // timer recording, nil means always
+    flow        *flow
+    maxInFlight int
+}
+
+func NewDispatcher(notify chan bool, topic string, conf *MainConfig,
+    dispatch *DispatchTopicConfig, daemons []*DirDaemon, connector *util.Connector,
+    schedule *util.Schedule, seq *uint64) (*Dispatcher, error) {
+
+    d := &Dispatcher{
+        topic: topic,
+        daemons: daemons,
+        strategy: dispatch.Strategy,
+        seq: seq,
+        notify: notify,
+        schedule: schedule,
+        maxInFlight: conf.NSQ.MaxInFlight,
+    }
+    if dispatch.Strategy == DispatchHashKey {
+        d.hashKey = util.SplitPath(dispatch.HashKey)
+    }
+
+    config, err := conf.NSQ.Client.NewConfig()
+    if err != nil {
+        return nil, fmt.Errorf("%s nsq client err[%s]", d, err)
+    }
+    config.MaxInFlight = d.maxInFlight
+    consumer, err := nsq.NewConsumer(topic, conf.NSQ.Channel, config)
+    if err != nil {
+        return nil, fmt.Errorf("dispatcher topic[%s] NewConsumer err[%s]", topic, err)
+    }
+
+    // a slow dir blocks only the handler writing to it
+    consumer.AddConcurrentHandlers(nsq.HandlerFunc(func(m *nsq.Message) error {
+        m.DisableAutoResponse()
+        msg := &inMsg{Message: m, seq: atomic.AddUint64(d.seq, 1)}
+        daemon := d.pick(m.Body)
+        daemon.hold(m)
+        daemon.routeChan <- msg
+        return nil
+    }), len(daemons))
+
+    d.flow = newFlow(d, consumer, d.maxInFlight)
+    if schedule != nil && !schedule.Active(time.Now()) {
+        logger.Infof("%s out of schedule, start paused\n", d)
+        d.flow.setPaused(true)
+    }
+    util.OnMemLevel(d.flow.setLevel)
+
+    // daemons drain their routeChan until this consumer stops
+    for _, daemon := range daemons {
+        daemon.consumer = consumer
+    }
+    d.consumer = consumer
+
+    if err := connector.Connect(daemons[0].idc, consumer); err != nil {
+        return nil, fmt.Errorf("%s connect err[%s]", d, err)
+    }
+
+    logger.Debugf("New %s strategy[%s] dirs[%d] success\n", d, d.strategy, len(daemons))
+    return d, nil
+}
+
+// for debug
+func (d *Dispatcher) String() string {
+    return fmt.Sprintf("dispatcher{%s}/idc{%s}", d.topic, d.daemons[0].idc)
+}
+
+func (d *Dispatcher) pick(body []byte) *DirDaemon {
+    switch d.strategy {
+    case DispatchLeastLoaded:
+        // scan from a rotating start so ties are spread too
+        n := uint64(len(d.daemons))
+        start := atomic.AddUint64(&d.next, 1)
+        best := d.daemons[start % n]
+        for i := uint64(1); i < n; i++ {
+            daemon := d.daemons[(start + i) % n]
+            if atomic.LoadInt64(&daemon.pending) < atomic.LoadInt64(&best.pending) {
+                best = daemon
+            }
+        }
+        return best
+    case DispatchHashKey:
+        // messages without the key are spread by hash of the whole body
+        h := fnv.New64a()
+        key := body
+        if doc, err := util.DecodeJSON(body); err == nil {
+            if v, ok := util.JSONGet(doc, d.hashKey); ok {
+                key = []byte(util.JSONString(v))
+            }
+        }
+        h.Write(key)
+        return d.daemons[h.Sum64() % uint64(len(d.daemons))]
+    }
+    return d.daemons[atomic.AddUint64(&d.next, 1) % uint64(len(d.daemons))]
+}
+
+// Process keeps schedule until notified, then stops the consumer
+func (d *Dispatcher) Process() {
+    var scheduleC <-chan time.Time
+    if d.schedule != nil {
+        scheduleTicker := time.NewTicker(scheduleCheckInterval)
+        defer scheduleTicker.Stop()
+        scheduleC = scheduleTicker.C
+        applySchedule(d, d.flow, d.schedule)
+    }
+
+    for {
+        select {
+        case <- scheduleC:
+            applySchedule(d, d.flow, d.schedule)
+        case <- d.notify:
+            d.consumer.Stop()
+            logger.Debugf("%s exit\n", d)
+            return
+        }
+    }
+}
@@ -0,0 +1,108 @@
+package record
+
+import (
+    "util"
+    "common"
+    "fmt"
+    "testing"
+)
+
+func testDispatcher(strategy, hashKey string, n int) *Dispatcher {
+    d := &Dispatcher{topic: "test", strategy: strategy}
+    if hashKey != "" {
+        d.hashKey = util.SplitPath(hashKey)
+    }
+    for i := 0; i < n; i++ {
+        d.daemons = append(d.daemons, testDaemon(fmt.Sprintf("/data%d", i), "test"))
+    }
+    return d
+}
+
+func picks(d *Dispatcher, bodies ...string) map[*DirDaemon]int {
+    ret := make(map[*DirDaemon]int)
+    for _, body := range bodies {
+        ret[d.pick([]byte(body))]++
+    }
+    return ret
+}
+
+func TestDispatchRoundRobin(t *testing.T) {
+    d := testDispatcher(DispatchRoundRobin, "", 3)
+    var bodies []string
+    for i := 0; i < 30; i++ {
+        bodies = append(bodies, "x")
+    }
+    got := picks(d, bodies...)
+    for _, daemon := range d.daemons {
+        if n := got[daemon]; n != 10 {
+            t.Fatalf("%s picked %d of 30", daemon, n)
+        }
+    }
+}
+
+func TestDispatchLeastLoaded(t *testing.T) {
+    d := testDispatcher(DispatchLeastLoaded, "", 3)
+    d.daemons[0].pending = 5
+    d.daemons[1].pending = 1
+    d.daemons[2].pending = 3
+    for i := 0; i < 10; i++ {
+        if got := d.pick(nil); got != d.daemons[1] {
+            t.Fatalf("picked %s, want least pending", got)
+        }
+    }
+
+    // ties are spread instead of always the first
+    d.daemons[0].pending, d.daemons[1].pending, d.daemons[2].pending = 0, 0, 0
+    if got := picks(d, "a", "b", "c"); len(got) != 3 {
+        t.Fatalf("ties picked %d daemons of 3", len(got))
+    }
+}
+
+func TestDispatchHashKey(t *testing.T) {
+    d := testDispatcher(DispatchHashKey, "user.id", 4)
+    for id := 0; id < 50; id++ {
+        a := d.pick([]byte(fmt.Sprintf(`{"user":{"id":%d},"event":"a"}`, id)))
+        b := d.pick([]byte(fmt.Sprintf(`{"event":"b","user":{"id":%d}}`, id)))
+        if a != b {
+            t.Fatalf("user %d went to %s and %s", id, a, b)
+        }
+    }
+
+    // spread over all dirs, bodies without the key by the whole body
+    var bodies []string
+    for i := 0; i < 200; i++ {
+        bodies = append(bodies, fmt.Sprintf("plain %d", i))
+    }
+    if got := picks(d, bodies...); len(got) != 4 {
+        t.Fatalf("picked %d daemons of 4", len(got))
+    }
+    if d.pick([]byte("plain 1")) != d.pick([]byte("plain 1")) {
+        t.Fatal("same body went to different dirs")
+    }
+}
+
+func TestDispatchTopicConfig(t *testing.T) {
+    c := &DispatchConfig{
+        Strategy: DispatchRoundRobin,
+        HashKey: "id",
+        Topics: map[string]*DispatchTopicConfig{
+            "a": {Strategy: DispatchHashKey},
+            "b": {Strategy: DispatchHashKey, HashKey: "user.id"},
+        },
+    }
+    for topic, want := range map[string]DispatchTopicConfig{
+        "a": {Strategy: DispatchHashKey, HashKey: "id"},
+        "b": {Strategy: DispatchHashKey, HashKey: "user.id"},
+        "c": {Strategy: DispatchRoundRobin, HashKey: "id"},
+    } {
+        if got := c.topic(topic); *got != want {
+            t.Fatalf("topic %s got %+v", topic, got)
+        }
+    }
+
+    e := &common.ConfigError{}
+    (&DispatchConfig{Strategy: "random", Topics: map[string]*DispatchTopicConfig{"a": {Strategy: DispatchHashKey}}}).check(e)
+    if len(e.Problems) != 2 {
+        t.Fatalf("problems %q", e.Problems)
+    }
+}
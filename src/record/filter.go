@@ -0,0 +1,131 @@
+package record
+
+import (
+    "util"
+    "logger"
+    "fmt"
+    "regexp"
+    "hash/fnv"
+    "sync/atomic"
+    "encoding/json"
+)
+
+// RecordFilter decides which messages of a topic go to disk, skipped
+// messages are still finished. A kept message must match all json
+// predicates, the body regex and size bounds, then pass sampling.
+type RecordFilter struct {
+    topic      string
+    predicates []*util.Predicate
+    regex      *regexp.Regexp
+    minSize    int
+    maxSize    int // 0 no limit
+
+    sampleRate int      // keep 1 in sampleRate, <= 1 keep all
+    sampleKey  []string // sample by hash of this json field
+    sampleNum  uint64
+
+    definition string // conf json, stored in segment header
+}
+
+// FilterConfig is conf section:
+//   "record_filter": {"topics": {"topic": {"json": [{"path": "", "op": "", "value": ""}],
+//       "regex": "", "min_size": 0, "max_size": 0, "sample": {"rate": 10, "key": "user.id"}}}}
+type FilterConfig struct {
+    Topics map[string]*FilterTopicConfig `json:"topics"`
+}
+
+type FilterTopicConfig struct {
+    JSON    []util.PredicateConfig `json:"json"`
+    Regex   string                 `json:"regex"`
+    MinSize int                    `json:"min_size"`
+    MaxSize int                    `json:"max_size"` // 0 no limit
+    Sample  SampleConfig           `json:"sample"`
+}
+
+type SampleConfig struct {
+    Rate int    `json:"rate"` // keep 1 in rate, <= 1 keep all
+    Key  string `json:"key"`
+}
+
+// NewRecordFilters builds one RecordFilter per topic
+func NewRecordFilters(c *FilterConfig) (map[string]*RecordFilter, error) {
+    ret := make(map[string]*RecordFilter)
+    for topic, conf := range c.Topics {
+        f := &RecordFilter{
+            topic: topic,
+            minSize: conf.MinSize,
+            maxSize: conf.MaxSize,
+            sampleRate: conf.Sample.Rate,
+        }
+
+        var err error
+        if f.predicates, err = util.NewPredicates(conf.JSON); err != nil {
+            return nil, fmt.Errorf("record_filter topic[%s] %s", topic, err)
+        }
+
+        if conf.Regex != "" {
+            if f.regex, err = regexp.Compile(conf.Regex); err != nil {
+                return nil, fmt.Errorf("record_filter topic[%s] regex err[%s]", topic, err)
+            }
+        }
+
+        if conf.Sample.Key != "" {
+            f.sampleKey = util.SplitPath(conf.Sample.Key)
+        }
+
+        def, _ := json.Marshal(conf)
+        f.definition = string(def)
+
+        logger.Debugf("New RecordFilter topic[%s] definition[%s]\n", topic, f.definition)
+        ret[topic] = f
+    }
+
+    return ret, nil
+}
+
+func (f *RecordFilter) Keep(body []byte) bool {
+    if len(body) < f.minSize || (f.maxSize > 0 && len(body) > f.maxSize) {
+        util.IncrStat("filter_" + f.topic + "_size_skipped", 1)
+        return false
+    }
+
+    if f.regex != nil && !f.regex.Match(body) {
+        util.IncrStat("filter_" + f.topic + "_regex_skipped", 1)
+        return false
+    }
+
+    if !util.MatchAll(f.predicates, body) {
+        util.IncrStat("filter_" + f.topic + "_json_skipped", 1)
+        return false
+    }
+
+    if !f.sample(body) {
+        util.IncrStat("filter_" + f.topic + "_sample_skipped", 1)
+        return false
+    }
+
+    util.IncrStat("filter_" + f.topic + "_kept", 1)
+    return true
+}
+
+// with key all events of a sampled entity are kept, messages without
+// the key are sampled by hash of the whole body
+func (f *RecordFilter) sample(body []byte) bool {
+    if f.sampleRate <= 1 {
+        return true
+    }
+
+    if f.sampleKey == nil {
+        return atomic.AddUint64(&f.sampleNum, 1) % uint64(f.sampleRate) == 1
+    }
+
+    h := fnv.New64a()
+    key := body
+    if doc, err := util.DecodeJSON(body); err == nil {
+        if v, ok := util.JSONGet(doc, f.sampleKey); ok {
+            key = []byte(util.JSONString(v))
+        }
+    }
+    h.Write(key)
+    return h.Sum64() % uint64(f.sampleRate) == 0
+}
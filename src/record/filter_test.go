@@ -0,0 +1,86 @@
+package record
+
+import (
+    "util"
+    "fmt"
+    "testing"
+)
+
+func testFilter(t *testing.T, conf *FilterTopicConfig) *RecordFilter {
+    fs, err := NewRecordFilters(&FilterConfig{Topics: map[string]*FilterTopicConfig{"test": conf}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    return fs["test"]
+}
+
+func TestFilterKeep(t *testing.T) {
+    f := testFilter(t, &FilterTopicConfig{
+        JSON: []util.PredicateConfig{{Path: "type", Op: "in", Value: []interface{}{"order", "refund"}}},
+        Regex: `"shop":"s\d+"`,
+        MinSize: 10,
+        MaxSize: 60,
+    })
+    for body, want := range map[string]bool{
+        `{"type":"order","shop":"s1"}`: true,
+        `{"type":"refund","shop":"s22"}`: true,
+        `{"type":"click","shop":"s1"}`: false,
+        `{"type":"order","shop":"x1"}`: false,
+        `{"type":"order","shop":"s1","pad":"` + fmt.Sprintf("%040d", 0) + `"}`: false,
+        `{}`: false,
+    } {
+        if got := f.Keep([]byte(body)); got != want {
+            t.Fatalf("%s got %v", body, got)
+        }
+    }
+}
+
+func TestFilterSampleCount(t *testing.T) {
+    f := testFilter(t, &FilterTopicConfig{Sample: SampleConfig{Rate: 4}})
+    kept := 0
+    for i := 0; i < 100; i++ {
+        if f.Keep([]byte("x")) {
+            kept++
+        }
+    }
+    if kept != 25 {
+        t.Fatalf("kept %d of 100 with rate 4", kept)
+    }
+}
+
+// a sampled key keeps all its messages, the same on every record process
+func TestFilterSampleKeyDeterministic(t *testing.T) {
+    conf := &FilterTopicConfig{Sample: SampleConfig{Rate: 10, Key: "user.id"}}
+    a, b := testFilter(t, conf), testFilter(t, conf)
+
+    kept := 0
+    for id := 0; id < 1000; id++ {
+        first := a.Keep([]byte(fmt.Sprintf(`{"user":{"id":%d},"event":"a"}`, id)))
+        if b.Keep([]byte(fmt.Sprintf(`{"event":"b","user":{"id":%d}}`, id))) != first {
+            t.Fatalf("user %d sampled differently", id)
+        }
+        if first {
+            kept++
+        }
+    }
+    if kept < 50 || kept > 150 {
+        t.Fatalf("kept %d of 1000 users with rate 10", kept)
+    }
+
+    // without the key the whole body is hashed
+    body := []byte(`{"other":1}`)
+    if a.Keep(body) != b.Keep(body) {
+        t.Fatal("body without key sampled differently")
+    }
+}
+
+func TestNewRecordFiltersInvalid(t *testing.T) {
+    for name, conf := range map[string]*FilterTopicConfig{
+        "regex": {Regex: "("},
+        "json": {JSON: []util.PredicateConfig{{Path: "a", Op: "like"}}},
+    } {
+        if _, err := NewRecordFilters(&FilterConfig{Topics: map[string]*FilterTopicConfig{"test": conf}}); err == nil {
+            t.Fatalf("invalid %s accepted", name)
+        }
+    }
+}
@@ -0,0 +1,74 @@
+package record
+
+import (
+    "util"
+    "logger"
+    "fmt"
+    "sync"
+
+    nsq      "github.com/nsqio/go-nsq"
+)
+
+// flow sets max-in-flight of a consumer from its schedule and the memory
+// level, so a memory restore never resumes a consumer out of schedule
+type flow struct {
+    owner       fmt.Stringer
+    consumer    *nsq.Consumer
+    maxInFlight int
+
+    mu          sync.Mutex
+    paused      bool // out of schedule
+    level       int  // util.MemNormal, MemThrottled or MemPaused
+    current     int
+}
+
+func newFlow(owner fmt.Stringer, consumer *nsq.Consumer, maxInFlight int) *flow {
+    return &flow{
+        owner: owner,
+        consumer: consumer,
+        maxInFlight: maxInFlight,
+        current: maxInFlight,
+    }
+}
+
+func (f *flow) isPaused() bool {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return f.paused
+}
+
+func (f *flow) setPaused(paused bool) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.paused = paused
+    f.apply()
+}
+
+// setLevel is registered by util.OnMemLevel
+func (f *flow) setLevel(level int) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.level = level
+    f.apply()
+}
+
+// throttled consumers keep a quarter of max-in-flight, at least one
+func (f *flow) apply() {
+    n := f.maxInFlight
+    switch {
+    case f.paused || f.level >= util.MemPaused:
+        n = 0
+    case f.level == util.MemThrottled:
+        if n = f.maxInFlight / 4; n < 1 {
+            n = 1
+        }
+    }
+    if n == f.current {
+        return
+    }
+
+    logger.Infof("%s max-in-flight %d -> %d, paused[%v] memory level[%d]\n",
+    f.owner, f.current, n, f.paused, f.level)
+    f.consumer.ChangeMaxInFlight(n)
+    f.current = n
+}
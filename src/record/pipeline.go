@@ -0,0 +1,215 @@
+package record
+
+import (
+    "util"
+    "common"
+    "logger"
+    "bytes"
+    "compress/gzip"
+    "runtime"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// PipelineConfig is compression pipeline conf section:
+//   "pipeline": {"enable": true, "block_size_k": 256, "workers": 0,
+//       "depth": 8, "flush_ms": 1000}
+// records are batched into blocks, every block is compressed as one gzip
+// member by a pool shared by all dirs, and written in order by a writer
+// goroutine of its dir. Multi-member gzip is read by play as one stream.
+type PipelineConfig struct {
+    Enable     bool `json:"enable"`
+    BlockSizeK int  `json:"block_size_k"` // default 256
+    Workers    int  `json:"workers"`      // compress goroutines, <= 0 means all cpus
+    Depth      int  `json:"depth"`        // blocks queued per dir, default 8
+    FlushMS    int  `json:"flush_ms"`     // max time a record waits in a block, default 1000
+}
+
+func (c *PipelineConfig) check(e *common.ConfigError) {
+    if !c.Enable {
+        return
+    }
+    if c.BlockSizeK <= 0 {
+        e.Add("pipeline.block_size_k", "must be positive")
+    }
+    if c.Depth <= 0 {
+        e.Add("pipeline.depth", "must be positive")
+    }
+    if c.FlushMS <= 0 {
+        e.Add("pipeline.flush_ms", "must be positive")
+    }
+}
+
+// block is a batch of encoded records, or a barrier if raw is nil
+type block struct {
+    raw       *bytes.Buffer
+    out       *bytes.Buffer // compressed, nil if not gz
+    data      []byte // raw after compression
+    gz        bool
+    level     int
+    first     time.Time // first record batched
+    submitted time.Time
+    done      chan struct{} // closed when data is ready
+}
+
+var blockPool = sync.Pool{
+    New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// CompressPool compresses blocks of all dirs
+type CompressPool struct {
+    jobs chan *block
+    wg   sync.WaitGroup
+}
+
+func NewCompressPool(conf *PipelineConfig) *CompressPool {
+    workers := conf.Workers
+    if workers <= 0 {
+        workers = runtime.NumCPU()
+    }
+    p := &CompressPool{jobs: make(chan *block, workers * conf.Depth)}
+    for i := 0; i < workers; i++ {
+        p.wg.Add(1)
+        go p.work()
+    }
+    logger.Infof("Compress pool start workers[%d]\n", workers)
+    return p
+}
+
+// gzip writers are kept per level and reset for every block
+func (p *CompressPool) work() {
+    defer p.wg.Done()
+    writers := make(map[int]*gzip.Writer)
+    for b := range p.jobs {
+        start := time.Now()
+        util.ObserveStat("pipeline_queue", start.Sub(b.submitted))
+        if b.gz {
+            b.out = blockPool.Get().(*bytes.Buffer)
+            w, ok := writers[b.level]
+            if ok {
+                w.Reset(b.out)
+            } else {
+                w, _ = gzip.NewWriterLevel(b.out, b.level)
+                writers[b.level] = w
+            }
+            w.Write(b.raw.Bytes())
+            w.Close()
+            b.data = b.out.Bytes()
+        } else {
+            b.data = b.raw.Bytes()
+        }
+        util.ObserveStat("pipeline_compress", time.Since(start))
+        close(b.done)
+    }
+}
+
+// Close waits running blocks, all dirs must have stopped submitting
+func (p *CompressPool) Close() {
+    close(p.jobs)
+    p.wg.Wait()
+}
+
+// EnablePipeline makes the daemon batch records instead of writing them,
+// must call before Process
+func (d *DirDaemon) EnablePipeline(pool *CompressPool, conf *PipelineConfig) {
+    d.pool = pool
+    d.blockSize = conf.BlockSizeK * 1024
+    d.flushInterval = time.Duration(conf.FlushMS) * time.Millisecond
+    d.blocks = make(chan *block, conf.Depth)
+    d.writerDone = make(chan struct{})
+    go d.writeBlocks()
+}
+
+// batch is the writer of records in pipeline mode
+type batch struct {
+    d *DirDaemon
+}
+
+func (b batch) Write(p []byte) (int, error) {
+    d := b.d
+    if d.block == nil {
+        d.block = &block{
+            raw: blockPool.Get().(*bytes.Buffer),
+            gz: d.isGz,
+            level: d.compressionLevel,
+            first: time.Now(),
+            done: make(chan struct{}),
+        }
+    }
+    d.block.raw.Write(p)
+    if d.block.raw.Len() >= d.blockSize {
+        d.submitBlock()
+    }
+    return len(p), nil
+}
+
+// submitBlock hands the current block to the pool, blocks if the dir has
+// depth blocks waiting, so a slow disk slows consuming down
+func (d *DirDaemon) submitBlock() {
+    b := d.block
+    if b == nil {
+        return
+    }
+    d.block = nil
+
+    b.submitted = time.Now()
+    util.ObserveStat("pipeline_batch", b.submitted.Sub(b.first))
+    util.AddBuffered(int64(b.raw.Len()))
+    atomic.AddInt64(&d.queued, int64(b.raw.Len()))
+    d.blocks <- b
+    d.pool.jobs <- b
+}
+
+// flushBlocks submits the current block and waits all blocks written
+func (d *DirDaemon) flushBlocks() {
+    d.submitBlock()
+    barrier := &block{done: make(chan struct{})}
+    d.blocks <- barrier
+    <- barrier.done
+}
+
+// flush a block waiting too long, called by Process
+func (d *DirDaemon) checkBlock() {
+    if d.block != nil && time.Since(d.block.first) >= d.flushInterval {
+        d.submitBlock()
+    }
+}
+
+// writeBlocks writes blocks to the current file in submit order
+func (d *DirDaemon) writeBlocks() {
+    defer close(d.writerDone)
+    for b := range d.blocks {
+        if b.raw == nil {
+            close(b.done)
+            continue
+        }
+
+        <- b.done
+        start := time.Now()
+        if _, err := d.sink.Write(b.data); err != nil {
+            logger.Fatalf("%s write block to file[%s] err[%s]\n", d, d.currentFile(), err)
+        }
+        util.ObserveStat("pipeline_write", time.Since(start))
+        util.ObserveStat("pipeline_total", time.Since(b.first))
+
+        // after filesize grows, size check never misses the block
+        atomic.AddInt64(&d.queued, -int64(b.raw.Len()))
+        util.AddBuffered(-int64(b.raw.Len()))
+        b.raw.Reset()
+        blockPool.Put(b.raw)
+        if b.out != nil {
+            b.out.Reset()
+            blockPool.Put(b.out)
+        }
+    }
+}
+
+// stopPipeline waits the writer after the last rotate
+func (d *DirDaemon) stopPipeline() {
+    if d.blocks == nil {
+        return
+    }
+    close(d.blocks)
+    <- d.writerDone
+}
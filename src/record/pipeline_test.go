@@ -0,0 +1,137 @@
+package record
+
+import (
+    "util"
+    "fmt"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+    "sync/atomic"
+    "crypto/sha256"
+    "encoding/hex"
+)
+
+// records go through blocks, the pool and the writer, and come back in
+// order from one file whatever the codec
+func TestPipelineRoundTrip(t *testing.T) {
+    pool := NewCompressPool(&PipelineConfig{Workers: 4, Depth: 2})
+    defer pool.Close()
+
+    for _, gz := range []bool{true, false} {
+        dir := t.TempDir()
+        conf := testMainConfig()
+        conf.IsGz = gz
+        conf.TimePattern = "pipe"
+        name := "backup.log.pipe_500"
+        if gz {
+            name += ".gz"
+        } else {
+            conf.FileNamePattern = "/write_dirs/topic/channel/backup.log.time-pattern_msg-num"
+        }
+        catalog := util.GetCatalog(filepath.Join(dir, util.DefaultCatalogName))
+        d := NewDirDaemon(make(chan bool), dir, "test", "", conf, catalog, nil, nil, nil, nil)
+        // blocks of 1K hold about 25 records, the last one is partial
+        d.EnablePipeline(pool, &PipelineConfig{BlockSizeK: 1, Depth: 2, FlushMS: 1000})
+
+        var want []string
+        for i := 0; i < 500; i++ {
+            body := fmt.Sprintf(`{"i":%d,"pad":"%020d"}`, i, i)
+            want = append(want, body)
+            msg := testMsg(body, int64(i + 1))
+            d.hold(msg.Message)
+            if err := d.coreProcess(msg); err != nil {
+                t.Fatal(err)
+            }
+        }
+        d.rotate()
+        d.stopPipeline()
+
+        path := filepath.Join(dir, "test", "backup", name)
+        got := readBodies(t, path)
+        if len(got) != len(want) {
+            t.Fatalf("gz %v read %d records, want %d", gz, len(got), len(want))
+        }
+        for i := range want {
+            if got[i] != want[i] {
+                t.Fatalf("gz %v record %d is %s, want %s", gz, i, got[i], want[i])
+            }
+        }
+
+        content, _ := os.ReadFile(path)
+        sum := sha256.Sum256(content)
+        entries, err := util.ReadCatalog(catalog.Path())
+        if err != nil || len(entries) != 1 {
+            t.Fatalf("entries %v err %v", entries, err)
+        }
+        if e := entries[0]; e.MsgCount != 500 || e.Checksum != hex.EncodeToString(sum[:]) {
+            t.Fatalf("gz %v entry %+v", gz, e)
+        }
+    }
+}
+
+// a block not full is submitted after flush_ms, not only at rotation
+func TestPipelineFlushInterval(t *testing.T) {
+    pool := NewCompressPool(&PipelineConfig{Workers: 1, Depth: 2})
+    defer pool.Close()
+
+    d := testDaemon(t.TempDir(), "test")
+    d.EnablePipeline(pool, &PipelineConfig{BlockSizeK: 256, Depth: 2, FlushMS: 10})
+    defer d.stopPipeline()
+
+    msg := testMsg("x", 1)
+    d.hold(msg.Message)
+    if err := d.coreProcess(msg); err != nil {
+        t.Fatal(err)
+    }
+    if d.block == nil {
+        t.Fatal("small record not batched")
+    }
+    d.checkBlock()
+    if d.block == nil {
+        t.Fatal("block submitted before flush_ms")
+    }
+    time.Sleep(20 * time.Millisecond)
+    d.checkBlock()
+    if d.block != nil {
+        t.Fatal("block not submitted after flush_ms")
+    }
+    d.rotate()
+}
+
+// blocks still in the pool count toward max_size_per_file, a slow pool
+// must not let a file grow past it
+func TestPipelineRotateSize(t *testing.T) {
+    // no workers yet, nothing submitted reaches the file
+    pool := &CompressPool{jobs: make(chan *block, 8)}
+
+    d := testDaemon(t.TempDir(), "test")
+    d.rotateSize = 4 * 1024
+    d.EnablePipeline(pool, &PipelineConfig{BlockSizeK: 1, Depth: 4, FlushMS: 1000})
+    d.updateFile()
+
+    record := make([]byte, 100)
+    written := 0
+    for !d.needsFileRotate() {
+        if written > 2 * int(d.rotateSize) {
+            t.Fatalf("%d bytes queued, no rotate", written)
+        }
+        d.writer.Write(record)
+        written += len(record)
+    }
+    if written < int(d.rotateSize) - 1024 {
+        t.Fatalf("rotate after %d bytes", written)
+    }
+    if n := atomic.LoadInt64(&d.filesize); n != 0 {
+        t.Fatalf("stalled pool wrote %d bytes", n)
+    }
+
+    pool.wg.Add(1)
+    go pool.work()
+    d.rotate()
+    d.stopPipeline()
+    pool.Close()
+    if n := atomic.LoadInt64(&d.queued); n != 0 {
+        t.Fatalf("%d bytes queued after rotate", n)
+    }
+}
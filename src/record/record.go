@@ -7,8 +7,10 @@ import (
     "os"
     "os/signal"
     "syscall"
+    "path/filepath"
+    "time"
+    "strings"
 
-    sj      "go-simplejson"
     // nsq      "github.com/nsqio/go-nsq"
 )
 
@@ -17,68 +19,154 @@ type Record struct {
     notify     chan bool // close notify
     
     writerDirs []string
-    lookupds   []string
+    connector  *util.Connector
     topics     []string
     channel    string
     // consumer   []*nsq.Consumer
 
     dirDaemons []*DirDaemon
+    dispatchers []*Dispatcher
+    retention  *Retention
+    compactor  *Compactor
+    ring       *Ring // nil if no ring topic
+    pool       *CompressPool // nil if pipeline disabled
     sig        chan os.Signal // cap systel signal
 
     wg         *sync.WaitGroup
 }
 
-func Main(ctx *sj.Json) {
-    r := NewRecord(ctx)
+func Main(conf *Config) {
+    r := NewRecord(conf)
+    if r == nil {
+        logger.Errorf("New Record is nil, check your conf\n")
+        return
+    }
     signal.Notify(r.sig, syscall.SIGINT, syscall.SIGTERM)
     r.Process()
 
     logger.Debugf("Record Main exit\n")
 }
 
-func NewRecord(ctx *sj.Json) *Record {
-    name := ctx.Get("main").Get("name").MustString("DefaultRecord")
-    writerDirs := ctx.Get("main").Get("write_dirs").MustStringArray()
-    lookupds, err := util.GetLookupdAddrs(ctx)
+// NewRecord expects a checked conf, see LoadConf
+func NewRecord(conf *Config) *Record {
+    connector, err := util.NewConnector(&conf.Main.NSQ.LookupdConfig)
+    if err != nil {
+        logger.Fatalf("Get nsq addrs err[%s]\n", err)
+        return nil
+    }
+    idcs := connector.IDCs()
+    logger.Infof("Record consume idcs%v\n", idcs)
+
+    var keyring *util.Keyring
+    if conf.Encryption.Enable {
+        if keyring, err = util.LoadKeyring(conf.Encryption.KeyFile); err != nil {
+            logger.Fatalf("Load encryption key err[%s]\n", err)
+            return nil
+        }
+    }
+    redactors, err := NewRedactors(&conf.Redaction)
+    if err != nil {
+        logger.Fatalf("Init redaction err[%s]\n", err)
+        return nil
+    }
+    filters, err := NewRecordFilters(&conf.RecordFilter)
+    if err != nil {
+        logger.Fatalf("Init record filter err[%s]\n", err)
+        return nil
+    }
+    schedules, err := NewSchedules(&conf.Schedule)
     if err != nil {
-        logger.Fatalf("Get lookup addrs err[%s]\n", err)
+        logger.Fatalf("Init schedule err[%s]\n", err)
+        return nil
     }
-    topics := ctx.Get("main").Get("nsq").Get("backup_topics").MustStringArray()
-    channel := ctx.Get("main").Get("nsq").Get("channel").MustString()
-    maxInFlight := ctx.Get("main").Get("nsq").Get("max-in-flight").MustInt()
-    timeOut := ctx.Get("main").Get("nsq").Get("timeout_sec").MustInt()
-    isGz := ctx.Get("main").Get("is_gz").MustBool(true)
-    timePattern := ctx.Get("main").Get("time-pattern").MustString("2016-01-02-13-04-05.000")
-    filenameFormat := ctx.Get("main").Get("file_name_pattern").MustString()
-    maxSizePerFile := ctx.Get("main").Get("max-size-per-file-m").MustInt(300)
-    maxSizePerFile = maxSizePerFile * 1024 * 1024
 
     record := &Record{
-        name: name,
+        name: conf.Main.Name,
         notify: make(chan bool),
         sig: make(chan os.Signal),
-        writerDirs: writerDirs,
-        lookupds: lookupds,
-        topics: topics,
-        channel: channel,
+        writerDirs: conf.Main.WriteDirs,
+        connector: connector,
+        topics: conf.Main.NSQ.BackupTopics,
+        channel: conf.Main.NSQ.Channel,
         wg: new(sync.WaitGroup),
     }
 
-    dirDaemons := make([]*DirDaemon, 0, 10)
-    for _, dir := range writerDirs {
-        for _, topic := range topics {
-            dirDaemon := NewDirDaemon(record.notify, dir, topic, channel, 
-            timePattern, filenameFormat, timeOut, maxSizePerFile, maxInFlight, 
-            isGz, lookupds)
+    if conf.Pipeline.Enable {
+        record.pool = NewCompressPool(&conf.Pipeline)
+    }
 
-            dirDaemons = append(dirDaemons, dirDaemon)
+    dirDaemons := make([]*DirDaemon, 0, 10)
+    for _, topic := range conf.Main.NSQ.BackupTopics {
+        topicMain := conf.TopicMain(topic)
+        // starts from now so sequence keeps increasing across restarts
+        seq := uint64(time.Now().UnixNano())
+
+        // every cluster has its own daemons, and dispatcher if enabled
+        for _, idc := range idcs {
+            var topicDaemons []*DirDaemon
+            for _, dir := range topicMain.WriteDirs {
+                dir = strings.Replace(dir, IDCPlaceholder, idc, -1)
+                // one catalog per write dir
+                var catalog *util.Catalog
+                if conf.Catalog.Enable {
+                    catalog = util.GetCatalog(filepath.Join(dir, conf.Catalog.FileName))
+                }
+
+                dirDaemon := NewDirDaemon(record.notify, dir, topic, idc, topicMain,
+                catalog, keyring, redactors[topic], filters[topic], schedules[topic])
+                if record.pool != nil {
+                    dirDaemon.EnablePipeline(record.pool, &conf.Pipeline)
+                }
+                if !conf.Dispatch.Enable {
+                    if err := dirDaemon.Subscribe(connector, &seq); err != nil {
+                        logger.Fatalf("New DirDaemon dir[%s] topic[%s] err[%s]\n", dir, topic, err)
+                        record.stopDaemons(dirDaemons)
+                        return nil
+                    }
+                }
+
+                topicDaemons = append(topicDaemons, dirDaemon)
+                dirDaemons = append(dirDaemons, dirDaemon)
+            }
+
+            if conf.Dispatch.Enable {
+                // schedule is kept by the dispatcher, daemons have no consumer of their own
+                for _, d := range topicDaemons {
+                    d.schedule = nil
+                }
+                dispatcher, err := NewDispatcher(record.notify, topic, topicMain,
+                conf.Dispatch.topic(topic), topicDaemons, connector, schedules[topic], &seq)
+                if err != nil {
+                    logger.Fatalf("New Dispatcher topic[%s] err[%s]\n", topic, err)
+                    record.stopDaemons(dirDaemons)
+                    return nil
+                }
+                record.dispatchers = append(record.dispatchers, dispatcher)
+            }
         }
     }
 
     record.dirDaemons = dirDaemons
+    record.retention = NewRetention(&conf.Retention, record.notify, dirDaemons)
+    record.compactor = NewCompactor(&conf.Compaction, record.notify, dirDaemons, keyring)
+    if record.ring, err = NewRing(&conf.Ring, record.notify, dirDaemons, connector,
+    &conf.Main.NSQ.Client); err != nil {
+        logger.Fatalf("Init ring err[%s]\n", err)
+        record.stopDaemons(dirDaemons)
+        return nil
+    }
     return record
 }
 
+// consumers of daemons built before a failure are already connected
+func (r *Record) stopDaemons(dirDaemons []*DirDaemon) {
+    for _, d := range dirDaemons {
+        if d.consumer != nil {
+            d.consumer.Stop()
+        }
+    }
+}
+
 func (r *Record) Process() {
     logger.Debugf("Record[%s] start processing...\n", r.name)
 
@@ -101,7 +189,41 @@ func (r *Record) Process() {
             logger.Debugf("DirDaemon[%s] end processing\n", dirDaemon)
         }(dirDaemon)
     }
+    for _, dispatcher := range r.dispatchers {
+        r.wg.Add(1)
+        go func(dispatcher *Dispatcher) {
+            defer r.wg.Done()
+            dispatcher.Process()
+        }(dispatcher)
+    }
+    r.wg.Add(1)
+    go func() {
+        defer r.wg.Done()
+        r.retention.Process()
+    }()
+    r.wg.Add(1)
+    go func() {
+        defer r.wg.Done()
+        r.compactor.Process()
+    }()
+    r.wg.Add(1)
+    go func() {
+        defer r.wg.Done()
+        r.connector.Process(r.notify)
+    }()
+
+    if r.ring != nil {
+        r.wg.Add(1)
+        go func() {
+            defer r.wg.Done()
+            r.ring.Process()
+        }()
+    }
+
     r.wg.Wait()
+    if r.pool != nil {
+        r.pool.Close()
+    }
     logger.Debugf("Record[%s] exit Process\n", r.name)
 }
 
@@ -0,0 +1,173 @@
+package record
+
+import (
+    "util"
+    "logger"
+    "fmt"
+    "strings"
+    "sort"
+    "io/ioutil"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+)
+
+const (
+    redactMask = "mask" // replace value with maskValue
+    redactHash = "hash" // replace value with hex hmac-sha256(secret, value)
+    redactDrop = "drop" // remove the field
+
+    nonJSONPass   = "pass"
+    nonJSONReject = "reject"
+
+    maskValue = "******"
+)
+
+type redactField struct {
+    name   string
+    path   []string
+    action string
+}
+
+// Redactor masks, hashes or drops json fields of a topic before the
+// body goes to disk
+type Redactor struct {
+    topic   string
+    version string // policy version, stored in segment header
+    fields  []redactField
+    nonJSON string
+    secret  []byte
+}
+
+// RedactionConfig is conf section:
+//   "redaction": {"topics": {"topic": {"version": "v1", "secret_file": "",
+//       "non_json": "pass|reject", "fields": {"user.email": "mask|hash|drop"}}}}
+type RedactionConfig struct {
+    Topics map[string]*RedactTopicConfig `json:"topics"`
+}
+
+type RedactTopicConfig struct {
+    Version    string            `json:"version"`
+    SecretFile string            `json:"secret_file"` // required by hash
+    NonJSON    string            `json:"non_json"`    // default pass
+    Fields     map[string]string `json:"fields"`
+}
+
+// NewRedactors builds one Redactor per topic
+func NewRedactors(c *RedactionConfig) (map[string]*Redactor, error) {
+    ret := make(map[string]*Redactor)
+    for topic, conf := range c.Topics {
+        r := &Redactor{
+            topic: topic,
+            version: conf.Version,
+            nonJSON: conf.NonJSON,
+        }
+        if r.nonJSON == "" {
+            r.nonJSON = nonJSONPass
+        }
+
+        if r.nonJSON != nonJSONPass && r.nonJSON != nonJSONReject {
+            return nil, fmt.Errorf("redaction topic[%s] invalid non_json[%s]", topic, r.nonJSON)
+        }
+
+        for name, action := range conf.Fields {
+            if action != redactMask && action != redactHash && action != redactDrop {
+                return nil, fmt.Errorf("redaction topic[%s] field[%s] invalid action[%s]",
+                topic, name, action)
+            }
+            r.fields = append(r.fields, redactField{
+                name: name,
+                path: util.SplitPath(name),
+                action: action,
+            })
+        }
+
+        if r.needSecret() {
+            secretFile := conf.SecretFile
+            secret, err := ioutil.ReadFile(secretFile)
+            if err != nil {
+                return nil, fmt.Errorf("redaction topic[%s] read secret_file[%s] err[%s]",
+                topic, secretFile, err)
+            }
+            r.secret = []byte(strings.TrimSpace(string(secret)))
+            if len(r.secret) == 0 {
+                return nil, fmt.Errorf("redaction topic[%s] secret_file[%s] is empty", topic, secretFile)
+            }
+        }
+
+        // fields is a map, sort so nested paths such as drop "user" and mask
+        // "user.email" apply the same way on every run of one policy version
+        sort.Slice(r.fields, func(i, j int) bool {
+            return r.fields[i].name < r.fields[j].name
+        })
+
+        logger.Debugf("New Redactor topic[%s] version[%s] fields[%v] non_json[%s]\n",
+        topic, r.version, r.fields, r.nonJSON)
+        ret[topic] = r
+    }
+
+    return ret, nil
+}
+
+func (r *Redactor) needSecret() bool {
+    for _, f := range r.fields {
+        if f.action == redactHash {
+            return true
+        }
+    }
+    return false
+}
+
+func (r *Redactor) hash(v interface{}) string {
+    mac := hmac.New(sha256.New, r.secret)
+    mac.Write([]byte(util.JSONString(v)))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Redact returns body to write, false means the message must not be
+// written(non json body rejected by policy)
+func (r *Redactor) Redact(body []byte) ([]byte, bool) {
+    doc, err := util.DecodeJSON(body)
+    if err != nil {
+        util.IncrStat("redact_" + r.topic + "_non_json", 1)
+        if r.nonJSON == nonJSONReject {
+            util.IncrStat("redact_" + r.topic + "_rejected", 1)
+            return nil, false
+        }
+        return body, true
+    }
+
+    changed := 0
+    for _, f := range r.fields {
+        v, ok := util.JSONGet(doc, f.path)
+        if !ok {
+            continue
+        }
+
+        switch f.action {
+        case redactMask:
+            ok = util.JSONSet(doc, f.path, maskValue)
+        case redactHash:
+            ok = util.JSONSet(doc, f.path, r.hash(v))
+        case redactDrop:
+            ok = util.JSONDelete(doc, f.path)
+        }
+        if ok {
+            changed++
+            util.IncrStat("redact_" + r.topic + "_" + f.action, 1)
+        }
+    }
+
+    if changed == 0 {
+        return body, true
+    }
+
+    out, err := util.EncodeJSON(doc)
+    if err != nil {
+        logger.Errorf("Redactor topic[%s] marshal err[%s]\n", r.topic, err)
+        util.IncrStat("redact_" + r.topic + "_rejected", 1)
+        return nil, false
+    }
+    util.IncrStat("redact_" + r.topic + "_messages", 1)
+    return out, true
+}
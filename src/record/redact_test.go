@@ -0,0 +1,111 @@
+package record
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+)
+
+func testRedactor(t *testing.T, conf *RedactTopicConfig) *Redactor {
+    if conf.SecretFile == "" {
+        conf.SecretFile = filepath.Join(t.TempDir(), "secret")
+        if err := os.WriteFile(conf.SecretFile, []byte("s3cret\n"), 0600); err != nil {
+            t.Fatal(err)
+        }
+    }
+    rs, err := NewRedactors(&RedactionConfig{Topics: map[string]*RedactTopicConfig{"test": conf}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    return rs["test"]
+}
+
+func redact(t *testing.T, r *Redactor, body string) string {
+    out, ok := r.Redact([]byte(body))
+    if !ok {
+        t.Fatalf("body[%s] rejected", body)
+    }
+    return string(out)
+}
+
+func hmacHex(value string) string {
+    mac := hmac.New(sha256.New, []byte("s3cret"))
+    mac.Write([]byte(value))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestRedactActions(t *testing.T) {
+    r := testRedactor(t, &RedactTopicConfig{Fields: map[string]string{
+        "user.email": "mask",
+        "user.id": "hash",
+        "token": "drop",
+        "items.1.sku": "mask",
+    }})
+
+    got := redact(t, r, `{"token":"x","user":{"email":"a@b.c","id":42},"items":[{"sku":1},{"sku":2}],"n":1.50}`)
+    want := `{"items":[{"sku":1},{"sku":"******"}],"n":1.50,"user":{"email":"******","id":"` + hmacHex("42") + `"}}`
+    if got != want {
+        t.Fatalf("got  %s\nwant %s", got, want)
+    }
+}
+
+// secret is trimmed, strings are hashed without quotes
+func TestRedactHashStable(t *testing.T) {
+    r := testRedactor(t, &RedactTopicConfig{Fields: map[string]string{"id": "hash"}})
+    for _, body := range []string{`{"id":"u1"}`, `{"id":"u1"}`} {
+        if got := redact(t, r, body); got != `{"id":"` + hmacHex("u1") + `"}` {
+            t.Fatalf("got %s", got)
+        }
+    }
+    if redact(t, r, `{"id":"u2"}`) == redact(t, r, `{"id":"u1"}`) {
+        t.Fatal("different values hashed the same")
+    }
+}
+
+func TestRedactNestedPaths(t *testing.T) {
+    r := testRedactor(t, &RedactTopicConfig{Fields: map[string]string{
+        "user": "drop",
+        "user.email": "mask",
+    }})
+    for i := 0; i < 10; i++ {
+        if got := redact(t, r, `{"user":{"email":"a@b.c"},"k":1}`); got != `{"k":1}` {
+            t.Fatalf("got %s", got)
+        }
+    }
+}
+
+func TestRedactUntouched(t *testing.T) {
+    r := testRedactor(t, &RedactTopicConfig{Fields: map[string]string{"token": "drop"}})
+    // no field changed, body is written byte for byte
+    body := `{ "a": "<b>",  "n": 1e3 }`
+    if got := redact(t, r, body); got != body {
+        t.Fatalf("got %s", got)
+    }
+}
+
+func TestRedactNonJSON(t *testing.T) {
+    pass := testRedactor(t, &RedactTopicConfig{Fields: map[string]string{"token": "drop"}})
+    if got := redact(t, pass, "plain text"); got != "plain text" {
+        t.Fatalf("got %s", got)
+    }
+
+    reject := testRedactor(t, &RedactTopicConfig{NonJSON: "reject", Fields: map[string]string{"token": "drop"}})
+    if _, ok := reject.Redact([]byte(`{"a":1} trailing`)); ok {
+        t.Fatal("non json body passed with non_json reject")
+    }
+}
+
+func TestNewRedactorsInvalid(t *testing.T) {
+    for name, conf := range map[string]*RedactTopicConfig{
+        "action": {Fields: map[string]string{"a": "encrypt"}},
+        "non_json": {NonJSON: "drop", Fields: map[string]string{"a": "mask"}},
+        "secret": {SecretFile: "/nonexistent/secret", Fields: map[string]string{"a": "hash"}},
+    } {
+        if _, err := NewRedactors(&RedactionConfig{Topics: map[string]*RedactTopicConfig{"test": conf}}); err == nil {
+            t.Fatalf("invalid %s accepted", name)
+        }
+    }
+}
@@ -0,0 +1,259 @@
+package record
+
+import (
+    "util"
+    "common"
+    "logger"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+)
+
+// Retention replaces the old cron `find -mtime +2 -delete`, it deletes
+// finished segments by per topic max age and by max total bytes per
+// write dir, always the oldest segments first.
+type Retention struct {
+    enable         bool
+    checkInterval  time.Duration
+    maxAge         time.Duration            // default for all topics, 0 no limit
+    topicMaxAge    map[string]time.Duration // per topic override
+    maxSizePerDir  int64                    // bytes, 0 no limit
+    requirePlayed  bool                     // only delete segments in play done/ dir
+
+    dirDaemons     []*DirDaemon
+    notify         chan bool
+}
+
+// one finished segment on disk
+type segmentFile struct {
+    path    string
+    topic   string
+    size    int64
+    modTime time.Time
+    catalog *util.Catalog // gets a tombstone on delete, nil if disabled
+}
+
+// RetentionConfig is conf section:
+//   "retention": {"enable": true, "check_interval_s": 300, "max_age_hour": 48,
+//       "max_size_per_dir_m": 0, "require_played": false,
+//       "topics": {"topic": {"max_age_hour": 24}}}
+type RetentionConfig struct {
+    Enable         bool                             `json:"enable"`
+    CheckIntervalS int                              `json:"check_interval_s"` // default 300
+    MaxAgeHour     int                              `json:"max_age_hour"`     // 0 no limit
+    MaxSizePerDirM int                              `json:"max_size_per_dir_m"` // 0 no limit
+    RequirePlayed  bool                             `json:"require_played"`
+    Topics         map[string]*RetentionTopicConfig `json:"topics"`
+}
+
+type RetentionTopicConfig struct {
+    MaxAgeHour int `json:"max_age_hour"`
+}
+
+func (c *RetentionConfig) check(e *common.ConfigError) {
+    if c.CheckIntervalS <= 0 {
+        e.Add("retention.check_interval_s", "must be positive")
+    }
+    if c.MaxAgeHour < 0 {
+        e.Add("retention.max_age_hour", "must not be negative")
+    }
+    if c.MaxSizePerDirM < 0 {
+        e.Add("retention.max_size_per_dir_m", "must not be negative")
+    }
+    for _, topic := range topicNames(c.Topics) {
+        if c.Topics[topic].MaxAgeHour < 0 {
+            e.Add("retention.topics." + topic + ".max_age_hour", "must not be negative")
+        }
+    }
+}
+
+func NewRetention(conf *RetentionConfig, notify chan bool, dirDaemons []*DirDaemon) *Retention {
+    r := &Retention{
+        enable: conf.Enable,
+        checkInterval: time.Duration(conf.CheckIntervalS) * time.Second,
+        maxAge: time.Duration(conf.MaxAgeHour) * time.Hour,
+        topicMaxAge: make(map[string]time.Duration),
+        maxSizePerDir: int64(conf.MaxSizePerDirM) * 1024 * 1024,
+        requirePlayed: conf.RequirePlayed,
+        dirDaemons: dirDaemons,
+        notify: notify,
+    }
+
+    for topic, tconf := range conf.Topics {
+        r.topicMaxAge[topic] = time.Duration(tconf.MaxAgeHour) * time.Hour
+    }
+
+    if r.checkInterval <= 0 {
+        r.checkInterval = 300 * time.Second
+    }
+
+    logger.Debugf("New Retention enable[%v] maxAge[%s] topicMaxAge[%v] maxSizePerDir[%d] requirePlayed[%v]\n",
+    r.enable, r.maxAge, r.topicMaxAge, r.maxSizePerDir, r.requirePlayed)
+    return r
+}
+
+func (r *Retention) Process() {
+    if !r.enable {
+        logger.Debugf("Retention disabled\n")
+        return
+    }
+
+    ticker := time.NewTicker(r.checkInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <- ticker.C:
+            r.coreProcess()
+        case <- r.notify:
+            logger.Debugf("Retention receive end cmd, exiting...\n")
+            return
+        }
+    }
+}
+
+func (r *Retention) topicAge(topic string) time.Duration {
+    if age, ok := r.topicMaxAge[topic]; ok {
+        return age
+    }
+    return r.maxAge
+}
+
+func (r *Retention) coreProcess() {
+    // group daemons by write dir, size quota is per write dir
+    byDir := make(map[string][]*DirDaemon)
+    for _, d := range r.dirDaemons {
+        byDir[d.dirname] = append(byDir[d.dirname], d)
+    }
+
+    now := time.Now()
+    for dirname, daemons := range byDir {
+        var segs []segmentFile
+        var total int64
+        for _, d := range daemons {
+            for _, seg := range d.finishedSegments() {
+                total += seg.size
+                segs = append(segs, seg)
+            }
+        }
+
+        sortOldestFirst(segs)
+
+        for _, seg := range segs {
+            age := r.topicAge(seg.topic)
+            expired := age > 0 && now.Sub(seg.modTime) > age
+            overQuota := r.maxSizePerDir > 0 && total > r.maxSizePerDir
+            if !expired && !overQuota {
+                continue
+            }
+
+            if r.requirePlayed && !isPlayed(seg.path) {
+                continue
+            }
+
+            reason := "max_age"
+            if !expired {
+                reason = "max_size"
+            }
+            if !removeSegment("retention", seg, reason) {
+                continue
+            }
+
+            total -= seg.size
+            logger.Debugf("Retention dir[%s] now total[%d]\n", dirname, total)
+        }
+    }
+}
+
+// finished segments of a daemon, both in its segment dir and in play's
+// done dir, captures are never listed
+func (d *DirDaemon) finishedSegments() []segmentFile {
+    segDir, prefix := d.segmentDir()
+    current := d.currentFile()
+
+    var ret []segmentFile
+    for _, dir := range []string{segDir, filepath.Join(segDir, "done")} {
+        dirFp, err := os.Open(dir)
+        if err != nil {
+            if !os.IsNotExist(err) {
+                logger.Errorf("%s open dir[%s] err[%s]\n", d, dir, err)
+            }
+            continue
+        }
+
+        fis, err := dirFp.Readdir(-1)
+        dirFp.Close()
+        if err != nil {
+            logger.Errorf("%s read dir[%s] err[%s]\n", d, dir, err)
+            continue
+        }
+
+        for _, fi := range fis {
+            if fi.IsDir() || !strings.HasPrefix(fi.Name(), prefix) {
+                continue
+            }
+
+            // not complete file
+            if strings.Index(fi.Name(), "msg-num") != -1 {
+                continue
+            }
+
+            path := filepath.Join(dir, fi.Name())
+            if path == filepath.Clean(current) {
+                continue
+            }
+
+            ret = append(ret, segmentFile{
+                path: path,
+                topic: d.topic,
+                size: fi.Size(),
+                modTime: fi.ModTime(),
+                catalog: d.catalog,
+            })
+        }
+    }
+
+    return ret
+}
+
+func sortOldestFirst(segs []segmentFile) {
+    sort.Slice(segs, func(i, j int) bool {
+        return segs[i].modTime.Before(segs[j].modTime)
+    })
+}
+
+// every deletion is logged and counted under who(retention, ring)
+func removeSegment(who string, seg segmentFile, reason string) bool {
+    if err := os.Remove(seg.path); err != nil {
+        logger.Errorf("%s remove[%s] err[%s]\n", who, seg.path, err)
+        return false
+    }
+
+    util.IncrStat(who + "_deleted_files", 1)
+    util.IncrStat(who + "_deleted_bytes", seg.size)
+    logger.Infof("%s delete[%s] topic[%s] size[%d] mtime[%s] reason[%s]\n",
+    who, seg.path, seg.topic, seg.size, seg.modTime, reason)
+
+    // verify, serve and play no longer look for it
+    if seg.catalog != nil {
+        if err := seg.catalog.Remove(recordedPath(seg.path), seg.topic, who + " " + reason); err != nil {
+            logger.Errorf("%s tombstone[%s] err[%s]\n", who, seg.path, err)
+        }
+    }
+    return true
+}
+
+// path of a segment as written to catalog, before play moved it to done/
+func recordedPath(path string) string {
+    if !isPlayed(path) {
+        return path
+    }
+    return filepath.Join(filepath.Dir(filepath.Dir(path)), strings.TrimSuffix(filepath.Base(path), ".done"))
+}
+
+// play moves replayed segments to done/ dir with .done suffix
+func isPlayed(path string) bool {
+    dir, name := filepath.Split(path)
+    return filepath.Base(dir) == "done" && strings.HasSuffix(name, ".done")
+}
@@ -0,0 +1,159 @@
+package record
+
+import (
+    "util"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func testMainConfig() *MainConfig {
+    conf := NewConfig().Main
+    conf.NSQ.Channel = "backup"
+    conf.FileNamePattern = "/write_dirs/topic/channel/backup.log.time-pattern_msg-num.gz"
+    return &conf
+}
+
+func testDaemon(dir, topic string) *DirDaemon {
+    return NewDirDaemon(make(chan bool), dir, topic, "", testMainConfig(), nil, nil, nil, nil, nil)
+}
+
+// writeSegment creates a finished segment of size bytes modified age ago
+func writeSegment(t *testing.T, path string, size int, age time.Duration) {
+    if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(path, make([]byte, size), 0666); err != nil {
+        t.Fatal(err)
+    }
+    mtime := time.Now().Add(-age)
+    if err := os.Chtimes(path, mtime, mtime); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func exists(path string) bool {
+    _, err := os.Stat(path)
+    return err == nil
+}
+
+func TestRetentionMaxSizeOldestFirst(t *testing.T) {
+    dir := t.TempDir()
+    d := testDaemon(dir, "test")
+    segDir := filepath.Join(dir, "test", "backup")
+    var paths []string
+    for i, age := range []time.Duration{4 * time.Hour, 3 * time.Hour, 2 * time.Hour, time.Hour} {
+        path := filepath.Join(segDir, "backup.log." + string(rune('a' + i)) + "_1.gz")
+        writeSegment(t, path, 100, age)
+        paths = append(paths, path)
+    }
+    // being written, never deleted
+    writeSegment(t, filepath.Join(segDir, "backup.log.z_msg-num.gz"), 1000, 5 * time.Hour)
+
+    // quota is in MB in conf, bytes keep the test small
+    r := NewRetention(&RetentionConfig{Enable: true, CheckIntervalS: 1}, nil, []*DirDaemon{d})
+    r.maxSizePerDir = 250
+    r.coreProcess()
+
+    for i, path := range paths {
+        if want := i >= 2; exists(path) != want {
+            t.Fatalf("segment %d exists[%v], want %v", i, exists(path), want)
+        }
+    }
+    if !exists(filepath.Join(segDir, "backup.log.z_msg-num.gz")) {
+        t.Fatal("segment being written deleted")
+    }
+}
+
+func TestRetentionRequirePlayed(t *testing.T) {
+    dir := t.TempDir()
+    d := testDaemon(dir, "test")
+    segDir := filepath.Join(dir, "test", "backup")
+    unplayed := filepath.Join(segDir, "backup.log.a_1.gz")
+    played := filepath.Join(segDir, "done", "backup.log.b_1.gz.done")
+    fresh := filepath.Join(segDir, "done", "backup.log.c_1.gz.done")
+    writeSegment(t, unplayed, 10, 72 * time.Hour)
+    writeSegment(t, played, 10, 72 * time.Hour)
+    writeSegment(t, fresh, 10, time.Hour)
+
+    conf := &RetentionConfig{
+        Enable: true,
+        CheckIntervalS: 1,
+        MaxAgeHour: 48,
+        RequirePlayed: true,
+        Topics: map[string]*RetentionTopicConfig{"other": {MaxAgeHour: 1}},
+    }
+    NewRetention(conf, nil, []*DirDaemon{d}).coreProcess()
+
+    if !exists(unplayed) {
+        t.Fatal("unplayed segment deleted")
+    }
+    if exists(played) {
+        t.Fatal("expired played segment kept")
+    }
+    if !exists(fresh) {
+        t.Fatal("fresh played segment deleted")
+    }
+}
+
+func TestRetentionTopicMaxAge(t *testing.T) {
+    dir := t.TempDir()
+    short := testDaemon(dir, "short")
+    long := testDaemon(dir, "long")
+    shortSeg := filepath.Join(dir, "short", "backup", "backup.log.a_1.gz")
+    longSeg := filepath.Join(dir, "long", "backup", "backup.log.a_1.gz")
+    writeSegment(t, shortSeg, 10, 2 * time.Hour)
+    writeSegment(t, longSeg, 10, 2 * time.Hour)
+
+    conf := &RetentionConfig{
+        Enable: true,
+        CheckIntervalS: 1,
+        MaxAgeHour: 48,
+        Topics: map[string]*RetentionTopicConfig{"short": {MaxAgeHour: 1}},
+    }
+    NewRetention(conf, nil, []*DirDaemon{short, long}).coreProcess()
+
+    if exists(shortSeg) || !exists(longSeg) {
+        t.Fatalf("short exists[%v] long exists[%v]", exists(shortSeg), exists(longSeg))
+    }
+}
+
+// deleted segments get a tombstone, catalog readers stop looking for them
+func TestRetentionCatalogTombstone(t *testing.T) {
+    dir := t.TempDir()
+    catalog := util.GetCatalog(filepath.Join(dir, util.DefaultCatalogName))
+    d := NewDirDaemon(make(chan bool), dir, "test", "", testMainConfig(), catalog, nil, nil, nil, nil)
+    segDir := filepath.Join(dir, "test", "backup")
+    expired := filepath.Join(segDir, "backup.log.a_1.gz")
+    played := filepath.Join(segDir, "backup.log.b_1.gz")
+    fresh := filepath.Join(segDir, "backup.log.c_1.gz")
+    writeSegment(t, expired, 10, 72 * time.Hour)
+    writeSegment(t, filepath.Join(segDir, "done", "backup.log.b_1.gz.done"), 10, 72 * time.Hour)
+    writeSegment(t, fresh, 10, time.Hour)
+    for _, path := range []string{expired, played, fresh} {
+        catalog.Append(&util.CatalogEntry{Path: path, Topic: "test", MsgCount: 1})
+    }
+
+    NewRetention(&RetentionConfig{Enable: true, CheckIntervalS: 1, MaxAgeHour: 48}, nil, []*DirDaemon{d}).coreProcess()
+
+    entries, err := util.ReadCatalog(catalog.Path())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(entries) != 1 || entries[0].Path != fresh {
+        t.Fatalf("catalog has %d entries", len(entries))
+    }
+
+    content, _ := os.ReadFile(catalog.Path())
+    for _, path := range []string{expired, played} {
+        tombstone := `{"path":"` + path + `","topic":"test"`
+        if !strings.Contains(string(content), tombstone) {
+            t.Fatalf("no tombstone of %s in\n%s", path, content)
+        }
+    }
+    if !strings.Contains(string(content), `"removed":"retention max_age"`) {
+        t.Fatalf("tombstone without reason\n%s", content)
+    }
+}
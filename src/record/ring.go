@@ -0,0 +1,333 @@
+package record
+
+import (
+    "util"
+    "common"
+    "logger"
+    "fmt"
+    "io"
+    "os"
+    "os/signal"
+    "syscall"
+    "regexp"
+    "sync"
+    "time"
+    "net/http"
+    "path/filepath"
+    "encoding/json"
+    nsq      "github.com/nsqio/go-nsq"
+)
+
+const captureDirName = "captures"
+
+var validCaptureName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+type ringLimit struct {
+    maxAge  time.Duration // 0 no limit
+    maxSize int64         // bytes of a topic across write dirs, 0 no limit
+}
+
+// Ring is the black box recording mode, ring topics keep only the last
+// N minutes or N MB on disk. A trigger freezes the current window into
+// <segment dir>/captures/<name>/, which neither ring nor retention touch.
+// Triggers: admin http POST /ring/freeze?name=x, SIGUSR1, or a matching
+// message on the trigger topic.
+type Ring struct {
+    limits        map[string]*ringLimit
+    daemons       map[string][]*DirDaemon // ring topic -> daemons
+    checkInterval time.Duration
+    notify        chan bool
+    sig           chan os.Signal
+
+    trigger       *nsq.Consumer
+    predicates    []*util.Predicate
+    nameField     []string
+
+    mu            sync.Mutex // freeze and trim never run together
+}
+
+// RingConfig is conf section:
+//   "ring": {"check_interval_s": 10, "trigger_signal": true,
+//       "topics": {"topic": {"max_minutes": 30, "max_size_m": 1024}},
+//       "trigger": {"topic": "", "channel": "", "match": [predicate], "name_field": ""}}
+type RingConfig struct {
+    CheckIntervalS int                         `json:"check_interval_s"` // default 10
+    TriggerSignal  bool                        `json:"trigger_signal"`   // default true
+    Topics         map[string]*RingTopicConfig `json:"topics"`
+    Trigger        RingTriggerConfig           `json:"trigger"`
+}
+
+type RingTopicConfig struct {
+    MaxMinutes int `json:"max_minutes"` // 0 no limit
+    MaxSizeM   int `json:"max_size_m"`  // 0 no limit
+}
+
+type RingTriggerConfig struct {
+    Topic     string                 `json:"topic"` // empty no trigger topic
+    Channel   string                 `json:"channel"` // default nsq_vcr_trigger
+    Match     []util.PredicateConfig `json:"match"`
+    NameField string                 `json:"name_field"`
+}
+
+func (c *RingConfig) check(e *common.ConfigError) {
+    if c.CheckIntervalS <= 0 {
+        e.Add("ring.check_interval_s", "must be positive")
+    }
+    for _, topic := range topicNames(c.Topics) {
+        limit := c.Topics[topic]
+        if limit.MaxMinutes < 0 || limit.MaxSizeM < 0 {
+            e.Add("ring.topics." + topic, "max_minutes and max_size_m must not be negative")
+        }
+        if limit.MaxMinutes == 0 && limit.MaxSizeM == 0 {
+            e.Add("ring.topics." + topic, "needs max_minutes or max_size_m")
+        }
+    }
+    if c.Trigger.Topic != "" && c.Trigger.Channel == "" {
+        e.Add("ring.trigger.channel", "required by trigger topic")
+    }
+    if _, err := util.NewPredicates(c.Trigger.Match); err != nil {
+        e.Add("ring.trigger.match", "%s", err)
+    }
+}
+
+// NewRing returns nil if no ring topic configured
+func NewRing(conf *RingConfig, notify chan bool, dirDaemons []*DirDaemon,
+    connector *util.Connector, client *util.NSQClientConfig) (*Ring, error) {
+    if len(conf.Topics) == 0 {
+        return nil, nil
+    }
+
+    r := &Ring{
+        limits: make(map[string]*ringLimit),
+        daemons: make(map[string][]*DirDaemon),
+        checkInterval: time.Duration(conf.CheckIntervalS) * time.Second,
+        notify: notify,
+        sig: make(chan os.Signal, 1),
+    }
+    if r.checkInterval <= 0 {
+        r.checkInterval = 10 * time.Second
+    }
+
+    for topic, tconf := range conf.Topics {
+        r.limits[topic] = &ringLimit{
+            maxAge: time.Duration(tconf.MaxMinutes) * time.Minute,
+            maxSize: int64(tconf.MaxSizeM) * 1024 * 1024,
+        }
+    }
+
+    for _, d := range dirDaemons {
+        if _, ok := r.limits[d.topic]; ok {
+            r.daemons[d.topic] = append(r.daemons[d.topic], d)
+        }
+    }
+
+    if conf.TriggerSignal {
+        signal.Notify(r.sig, syscall.SIGUSR1)
+    }
+
+    if conf.Trigger.Topic != "" {
+        if err := r.initTrigger(&conf.Trigger, connector, client); err != nil {
+            return nil, err
+        }
+    }
+
+    util.HandleAdmin("/ring/freeze", http.HandlerFunc(r.handleFreeze))
+    logger.Debugf("New Ring topics[%v]\n", topicNames(conf.Topics))
+    return r, nil
+}
+
+// trigger listens on every cluster consumed
+func (r *Ring) initTrigger(conf *RingTriggerConfig, connector *util.Connector,
+    client *util.NSQClientConfig) error {
+    topic := conf.Topic
+
+    var err error
+    if r.predicates, err = util.NewPredicates(conf.Match); err != nil {
+        return fmt.Errorf("ring trigger %s", err)
+    }
+    if conf.NameField != "" {
+        r.nameField = util.SplitPath(conf.NameField)
+    }
+
+    config, err := client.NewConfig()
+    if err != nil {
+        return fmt.Errorf("ring trigger nsq client err[%s]", err)
+    }
+    r.trigger, err = nsq.NewConsumer(topic, conf.Channel, config)
+    if err != nil {
+        return fmt.Errorf("ring trigger NewConsumer err[%s]", err)
+    }
+
+    r.trigger.AddHandler(nsq.HandlerFunc(func(m *nsq.Message) error {
+        if !util.MatchAll(r.predicates, m.Body) {
+            return nil
+        }
+
+        var name string
+        if r.nameField != nil {
+            if doc, err := util.DecodeJSON(m.Body); err == nil {
+                if v, ok := util.JSONGet(doc, r.nameField); ok {
+                    name = util.JSONString(v)
+                }
+            }
+        }
+
+        logger.Infof("Ring trigger topic[%s] msg[%s], freeze\n", topic, m.Body)
+        if _, _, err := r.Freeze(name); err != nil {
+            logger.Errorf("Ring trigger freeze err[%s]\n", err)
+        }
+        return nil
+    }))
+
+    if err := connector.ConnectAll(r.trigger); err != nil {
+        return fmt.Errorf("ring trigger connect err[%s]", err)
+    }
+    return nil
+}
+
+func (r *Ring) Process() {
+    ticker := time.NewTicker(r.checkInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <- ticker.C:
+            r.trim()
+        case <- r.sig:
+            logger.Infof("Ring get SIGUSR1, freeze\n")
+            if _, _, err := r.Freeze(""); err != nil {
+                logger.Errorf("Ring signal freeze err[%s]\n", err)
+            }
+        case <- r.notify:
+            logger.Debugf("Ring receive end cmd, exiting...\n")
+            signal.Stop(r.sig)
+            if r.trigger != nil {
+                r.trigger.Stop()
+                <- r.trigger.StopChan
+            }
+            return
+        }
+    }
+}
+
+// delete oldest segments of each ring topic out of the window
+func (r *Ring) trim() {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    now := time.Now()
+    for topic, daemons := range r.daemons {
+        limit := r.limits[topic]
+
+        var segs []segmentFile
+        var total int64
+        for _, d := range daemons {
+            for _, seg := range d.finishedSegments() {
+                total += seg.size
+                segs = append(segs, seg)
+            }
+        }
+
+        sortOldestFirst(segs)
+        for _, seg := range segs {
+            expired := limit.maxAge > 0 && now.Sub(seg.modTime) > limit.maxAge
+            overSize := limit.maxSize > 0 && total > limit.maxSize
+            if !expired && !overSize {
+                break
+            }
+
+            reason := "ring_max_minutes"
+            if !expired {
+                reason = "ring_max_size"
+            }
+            if removeSegment("ring", seg, reason) {
+                total -= seg.size
+            }
+        }
+    }
+}
+
+// Freeze rotates all ring daemons, then hard links their finished
+// segments into the capture, returns capture name and number of
+// captured segments
+func (r *Ring) Freeze(name string) (string, int, error) {
+    if name == "" {
+        name = "capture-" + time.Now().Format("20060102-150405")
+    }
+    if !validCaptureName.MatchString(name) {
+        return name, 0, fmt.Errorf("invalid capture name[%s]", name)
+    }
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+
+    captured := 0
+    for _, daemons := range r.daemons {
+        for _, d := range daemons {
+            if !d.Rotate() {
+                return name, captured, fmt.Errorf("%s is exiting", d)
+            }
+
+            segDir, _ := d.segmentDir()
+            captureDir := filepath.Join(segDir, captureDirName, name)
+            if err := os.MkdirAll(captureDir, 0770); err != nil {
+                return name, captured, err
+            }
+
+            for _, seg := range d.finishedSegments() {
+                dst := filepath.Join(captureDir, filepath.Base(seg.path))
+                if err := linkOrCopy(seg.path, dst); err != nil {
+                    return name, captured, fmt.Errorf("capture[%s] to [%s] err[%s]", seg.path, dst, err)
+                }
+                captured++
+            }
+        }
+    }
+
+    util.IncrStat("ring_freezes", 1)
+    logger.Infof("Ring freeze capture[%s] segments[%d]\n", name, captured)
+    return name, captured, nil
+}
+
+func linkOrCopy(src, dst string) error {
+    if _, err := os.Stat(dst); err == nil {
+        return nil
+    }
+    if err := os.Link(src, dst); err == nil {
+        return nil
+    }
+
+    in, err := os.Open(src)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+
+    out, err := os.OpenFile(dst, os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0666)
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(out, in); err != nil {
+        out.Close()
+        os.Remove(dst)
+        return err
+    }
+    return out.Close()
+}
+
+// freeze changes disk state, so GET by crawlers or prefetch never triggers it
+func (r *Ring) handleFreeze(w http.ResponseWriter, req *http.Request) {
+    if req.Method != http.MethodPost {
+        w.Header().Set("Allow", http.MethodPost)
+        http.Error(w, "method not allowed, use POST", http.StatusMethodNotAllowed)
+        return
+    }
+
+    name, captured, err := r.Freeze(req.FormValue("name"))
+
+    ret := map[string]interface{}{"name": name, "segments": captured}
+    if err != nil {
+        ret["error"] = err.Error()
+        w.WriteHeader(http.StatusInternalServerError)
+    }
+    json.NewEncoder(w).Encode(ret)
+}
@@ -0,0 +1,72 @@
+package record
+
+import (
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+    "net/http"
+    "net/http/httptest"
+)
+
+func testRing(t *testing.T, daemons ...*DirDaemon) *Ring {
+    conf := &RingConfig{CheckIntervalS: 10, Topics: map[string]*RingTopicConfig{"test": {MaxMinutes: 30}}}
+    r, err := NewRing(conf, make(chan bool), daemons, nil, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return r
+}
+
+// rotate requests are served as DirDaemon.Process does
+func serveRotate(d *DirDaemon) {
+    go func() {
+        for done := range d.rotateReq {
+            d.updateFile()
+            close(done)
+        }
+    }()
+}
+
+func freeze(r *Ring, method, name string) *httptest.ResponseRecorder {
+    w := httptest.NewRecorder()
+    r.handleFreeze(w, httptest.NewRequest(method, "/ring/freeze?name=" + name, nil))
+    return w
+}
+
+func TestRingFreezeRequiresPost(t *testing.T) {
+    r := testRing(t)
+    for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPut} {
+        w := freeze(r, method, "x")
+        if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != http.MethodPost {
+            t.Fatalf("%s got %d allow[%s]", method, w.Code, w.Header().Get("Allow"))
+        }
+    }
+
+    if w := freeze(r, http.MethodPost, "bad/name"); w.Code != http.StatusInternalServerError {
+        t.Fatalf("invalid name got %d", w.Code)
+    }
+}
+
+func TestRingFreezeCapture(t *testing.T) {
+    dir := t.TempDir()
+    d := testDaemon(dir, "test")
+    serveRotate(d)
+    seg := filepath.Join(dir, "test", "backup", "backup.log.a_1.gz")
+    writeSegment(t, seg, 10, time.Minute)
+
+    w := freeze(testRing(t, d), http.MethodPost, "incident-1")
+    if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"segments":1`) {
+        t.Fatalf("got %d %s", w.Code, w.Body)
+    }
+    if !exists(filepath.Join(dir, "test", "backup", captureDirName, "incident-1", "backup.log.a_1.gz")) {
+        t.Fatal("segment not captured")
+    }
+}
+
+// the handler is registered on the admin server, building the ring
+// again replaces it instead of panicking
+func TestNewRingTwice(t *testing.T) {
+    testRing(t)
+    testRing(t)
+}
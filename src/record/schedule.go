@@ -0,0 +1,63 @@
+package record
+
+import (
+    "util"
+    "logger"
+    "fmt"
+    "time"
+)
+
+// schedule check interval, windows are minute granularity
+const scheduleCheckInterval = 5 * time.Second
+
+// ScheduleConfig is timer recording conf section:
+//   "schedule": {"topics": {"topic": {"cron": ["* 9-11 * * 1-5"],
+//       "windows": ["2017-03-26 10:00:00/2017-03-26 12:00:00"]}}}
+// topics not configured are always recorded
+type ScheduleConfig struct {
+    Topics map[string]*ScheduleTopicConfig `json:"topics"`
+}
+
+type ScheduleTopicConfig struct {
+    Cron    []string `json:"cron"`
+    Windows []string `json:"windows"`
+}
+
+// NewSchedules builds timer recording schedule per topic
+func NewSchedules(c *ScheduleConfig) (map[string]*util.Schedule, error) {
+    ret := make(map[string]*util.Schedule)
+    for topic, conf := range c.Topics {
+        schedule, err := util.NewSchedule(conf.Cron, conf.Windows)
+        if err != nil {
+            return nil, fmt.Errorf("schedule topic[%s] %s", topic, err)
+        }
+        ret[topic] = schedule
+    }
+    return ret, nil
+}
+
+func (d *DirDaemon) checkSchedule() {
+    applySchedule(d, d.flow, d.schedule)
+}
+
+// outside schedule the consumer is paused by RDY 0, channel is kept
+// so messages pile up in nsqd until the next window
+func applySchedule(owner fmt.Stringer, f *flow, schedule *util.Schedule) {
+    if schedule == nil {
+        return
+    }
+
+    active := schedule.Active(time.Now())
+    if active == !f.isPaused() {
+        return
+    }
+
+    if active {
+        logger.Infof("%s in schedule, resume consuming\n", owner)
+        util.IncrStat("schedule_resumed", 1)
+    } else {
+        logger.Infof("%s out of schedule, pause consuming\n", owner)
+        util.IncrStat("schedule_paused", 1)
+    }
+    f.setPaused(!active)
+}
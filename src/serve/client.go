@@ -0,0 +1,507 @@
+package serve
+
+import (
+    "util"
+    "logger"
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "sync"
+    "time"
+
+    nsq      "github.com/nsqio/go-nsq"
+)
+
+const (
+    frameTypeResponse int32 = 0
+    frameTypeError    int32 = 1
+    frameTypeMessage  int32 = 2
+)
+
+var (
+    protocolMagic = []byte("  V2")
+    heartbeatBody = []byte("_heartbeat_")
+    okBody        = []byte("OK")
+)
+
+type inFlight struct {
+    msg      *nsq.Message
+    deadline time.Time
+}
+
+// one consumer connection
+type client struct {
+    server            *Server
+    conn              net.Conn
+    reader            *bufio.Reader
+
+    writeLock         sync.Mutex
+    writer            *bufio.Writer
+
+    mu                sync.Mutex
+    channel           *channel
+    readyCount        int64
+    inFlight          map[nsq.MessageID]*inFlight
+    msgTimeout        time.Duration
+    heartbeatInterval time.Duration
+    closing           bool
+
+    wake              chan bool // RDY, FIN, SUB or CLS changed send state
+    exit              chan bool
+}
+
+type identifyData struct {
+    ClientID            string `json:"client_id"`
+    Hostname            string `json:"hostname"`
+    UserAgent           string `json:"user_agent"`
+    FeatureNegotiation  bool   `json:"feature_negotiation"`
+    HeartbeatInterval   int    `json:"heartbeat_interval"`
+    MsgTimeout          int    `json:"msg_timeout"`
+}
+
+func newClient(s *Server, conn net.Conn) *client {
+    return &client{
+        server: s,
+        conn: conn,
+        reader: bufio.NewReader(conn),
+        writer: bufio.NewWriter(conn),
+        inFlight: make(map[nsq.MessageID]*inFlight),
+        msgTimeout: defaultMsgTimeout,
+        heartbeatInterval: defaultHeartbeatInterval,
+        wake: make(chan bool, 1),
+        exit: make(chan bool),
+    }
+}
+
+func (c *client) String() string {
+    return fmt.Sprintf("Client{%s}", c.conn.RemoteAddr())
+}
+
+func (c *client) process() {
+    logger.Infof("%s connected\n", c)
+    util.IncrStat("serve_connections", 1)
+
+    magic := make([]byte, len(protocolMagic))
+    if _, err := io.ReadFull(c.reader, magic); err != nil || !bytes.Equal(magic, protocolMagic) {
+        logger.Errorf("%s bad protocol magic[%q] err[%v]\n", c, magic, err)
+        c.conn.Close()
+        return
+    }
+
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        c.messagePump()
+    }()
+
+    err := c.readLoop()
+    select {
+    case <- c.server.notify:
+        // server closed the conn
+    default:
+        if err != nil && err != io.EOF {
+            logger.Errorf("%s read err[%s]\n", c, err)
+        }
+    }
+
+    close(c.exit)
+    c.conn.Close()
+    wg.Wait()
+    c.requeueAll()
+    logger.Infof("%s disconnected\n", c)
+}
+
+func (c *client) readLoop() error {
+    for {
+        line, err := c.reader.ReadSlice('\n')
+        if err != nil {
+            return err
+        }
+        line = bytes.TrimRight(line, "\r\n")
+        params := bytes.Split(line, []byte(" "))
+
+        if err := c.exec(params); err != nil {
+            c.sendError(err.Error())
+            if _, fatal := err.(fatalError); fatal {
+                return err
+            }
+        }
+    }
+}
+
+type fatalError string
+
+func (e fatalError) Error() string { return string(e) }
+
+func (c *client) exec(params [][]byte) error {
+    switch string(params[0]) {
+    case "IDENTIFY":
+        return c.identify()
+    case "SUB":
+        return c.sub(params)
+    case "RDY":
+        return c.rdy(params)
+    case "FIN":
+        return c.fin(params)
+    case "REQ":
+        return c.req(params)
+    case "TOUCH":
+        return c.touch(params)
+    case "NOP":
+        return nil
+    case "CLS":
+        c.mu.Lock()
+        c.closing = true
+        c.mu.Unlock()
+        c.signal()
+        return c.sendResponse([]byte("CLOSE_WAIT"))
+    case "AUTH":
+        return fatalError("E_AUTH_DISABLED AUTH disabled")
+    case "PUB", "MPUB", "DPUB":
+        return fatalError("E_INVALID archive is read only")
+    }
+    return fatalError(fmt.Sprintf("E_INVALID invalid command %q", params[0]))
+}
+
+func (c *client) identify() error {
+    var size int32
+    if err := binary.Read(c.reader, binary.BigEndian, &size); err != nil {
+        return fatalError("E_BAD_BODY IDENTIFY failed to read body size")
+    }
+    if size <= 0 || size > 1024 * 1024 {
+        return fatalError(fmt.Sprintf("E_BAD_BODY IDENTIFY invalid body size %d", size))
+    }
+    body := make([]byte, size)
+    if _, err := io.ReadFull(c.reader, body); err != nil {
+        return fatalError("E_BAD_BODY IDENTIFY failed to read body")
+    }
+
+    var data identifyData
+    if err := json.Unmarshal(body, &data); err != nil {
+        return fatalError("E_BAD_BODY IDENTIFY failed to decode JSON body")
+    }
+
+    c.mu.Lock()
+    switch {
+    case data.HeartbeatInterval == -1:
+        c.heartbeatInterval = 0
+    case data.HeartbeatInterval >= 1000:
+        c.heartbeatInterval = time.Duration(data.HeartbeatInterval) * time.Millisecond
+    }
+    if data.MsgTimeout >= 1000 {
+        c.msgTimeout = time.Duration(data.MsgTimeout) * time.Millisecond
+    }
+    heartbeat, msgTimeout := c.heartbeatInterval, c.msgTimeout
+    c.mu.Unlock()
+    c.signal()
+
+    logger.Infof("%s IDENTIFY client_id[%s] hostname[%s] user_agent[%s] heartbeat[%s] msg_timeout[%s]\n",
+    c, data.ClientID, data.Hostname, data.UserAgent, heartbeat, msgTimeout)
+
+    if !data.FeatureNegotiation {
+        return c.sendResponse(okBody)
+    }
+
+    resp, _ := json.Marshal(map[string]interface{}{
+        "max_rdy_count": maxRdyCount,
+        "version": "nsq_vcr",
+        "max_msg_timeout": int64(15 * time.Minute / time.Millisecond),
+        "msg_timeout": int64(msgTimeout / time.Millisecond),
+        "tls_v1": false,
+        "deflate": false,
+        "snappy": false,
+        "sample_rate": 0,
+        "auth_required": false,
+        "output_buffer_size": 16 * 1024,
+        "output_buffer_timeout": 250,
+    })
+    return c.sendResponse(resp)
+}
+
+func (c *client) sub(params [][]byte) error {
+    if len(params) < 3 {
+        return fatalError("E_INVALID SUB insufficient number of parameters")
+    }
+    topic, channel := string(params[1]), string(params[2])
+    if topic != c.server.topic {
+        return fatalError(fmt.Sprintf("E_BAD_TOPIC SUB topic name %q is not served", topic))
+    }
+    if channel == "" {
+        return fatalError("E_BAD_CHANNEL SUB channel name is empty")
+    }
+
+    c.mu.Lock()
+    if c.channel != nil {
+        c.mu.Unlock()
+        return fatalError("E_INVALID cannot SUB twice")
+    }
+    c.channel = c.server.getChannel(channel)
+    c.mu.Unlock()
+    c.signal()
+
+    logger.Infof("%s SUB topic[%s] channel[%s]\n", c, topic, channel)
+    return c.sendResponse(okBody)
+}
+
+func (c *client) rdy(params [][]byte) error {
+    count := int64(1)
+    if len(params) > 1 {
+        n, err := strconv.ParseInt(string(params[1]), 10, 64)
+        if err != nil {
+            return fatalError(fmt.Sprintf("E_INVALID RDY could not parse count %s", params[1]))
+        }
+        count = n
+    }
+    if count < 0 || count > maxRdyCount {
+        return fatalError(fmt.Sprintf("E_INVALID RDY count %d out of range 0-%d", count, maxRdyCount))
+    }
+
+    c.mu.Lock()
+    c.readyCount = count
+    c.mu.Unlock()
+    c.signal()
+    return nil
+}
+
+func (c *client) parseID(cmd string, params [][]byte) (nsq.MessageID, error) {
+    var id nsq.MessageID
+    if len(params) < 2 || len(params[1]) != len(id) {
+        return id, fatalError(fmt.Sprintf("E_INVALID %s invalid message ID", cmd))
+    }
+    copy(id[:], params[1])
+    return id, nil
+}
+
+func (c *client) fin(params [][]byte) error {
+    id, err := c.parseID("FIN", params)
+    if err != nil {
+        return err
+    }
+
+    c.mu.Lock()
+    _, ok := c.inFlight[id]
+    delete(c.inFlight, id)
+    c.mu.Unlock()
+
+    if !ok {
+        return fmt.Errorf("E_FIN_FAILED FIN %s failed", id[:])
+    }
+    util.IncrStat("serve_finished", 1)
+    c.signal()
+    return nil
+}
+
+func (c *client) req(params [][]byte) error {
+    id, err := c.parseID("REQ", params)
+    if err != nil {
+        return err
+    }
+    if len(params) < 3 {
+        return fatalError("E_INVALID REQ insufficient number of parameters")
+    }
+    ms, err := strconv.ParseInt(string(params[2]), 10, 64)
+    if err != nil || ms < 0 {
+        return fatalError(fmt.Sprintf("E_INVALID REQ could not parse timeout %s", params[2]))
+    }
+
+    c.mu.Lock()
+    f, ok := c.inFlight[id]
+    delete(c.inFlight, id)
+    ch := c.channel
+    c.mu.Unlock()
+
+    if !ok {
+        return fmt.Errorf("E_REQ_FAILED REQ %s failed", id[:])
+    }
+    util.IncrStat("serve_requeued", 1)
+    ch.requeueAfter(f.msg, time.Duration(ms) * time.Millisecond, c.server.notify)
+    c.signal()
+    return nil
+}
+
+func (c *client) touch(params [][]byte) error {
+    id, err := c.parseID("TOUCH", params)
+    if err != nil {
+        return err
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    f, ok := c.inFlight[id]
+    if !ok {
+        return fmt.Errorf("E_TOUCH_FAILED TOUCH %s failed", id[:])
+    }
+    f.deadline = time.Now().Add(c.msgTimeout)
+    return nil
+}
+
+func (c *client) signal() {
+    select {
+    case c.wake <- true:
+    default:
+    }
+}
+
+// channel to receive from, nil if RDY exhausted or not subscribed
+func (c *client) sendState() (*channel, time.Duration) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if c.channel == nil || c.closing || int64(len(c.inFlight)) >= c.readyCount {
+        return nil, c.heartbeatInterval
+    }
+    return c.channel, c.heartbeatInterval
+}
+
+// messagePump sends messages while RDY allows, heartbeats and times out
+// in flight messages
+func (c *client) messagePump() {
+    timeoutTicker := time.NewTicker(time.Second)
+    defer timeoutTicker.Stop()
+
+    var heartbeat *time.Ticker
+    var heartbeatInterval time.Duration
+    defer func() {
+        if heartbeat != nil {
+            heartbeat.Stop()
+        }
+    }()
+
+    for {
+        ch, interval := c.sendState()
+        if interval != heartbeatInterval {
+            if heartbeat != nil {
+                heartbeat.Stop()
+                heartbeat = nil
+            }
+            if interval > 0 {
+                heartbeat = time.NewTicker(interval)
+            }
+            heartbeatInterval = interval
+        }
+        var heartbeatC <-chan time.Time
+        if heartbeat != nil {
+            heartbeatC = heartbeat.C
+        }
+
+        var queue, requeue chan *nsq.Message
+        if ch != nil {
+            queue, requeue = ch.queue, ch.requeue
+
+            // requeued messages first
+            select {
+            case msg := <- requeue:
+                if !c.sendMessage(ch, msg) {
+                    return
+                }
+                continue
+            default:
+            }
+        }
+
+        select {
+        case msg := <- requeue:
+            if !c.sendMessage(ch, msg) {
+                return
+            }
+        case msg := <- queue:
+            if !c.sendMessage(ch, msg) {
+                return
+            }
+        case <- heartbeatC:
+            if err := c.sendResponse(heartbeatBody); err != nil {
+                return
+            }
+        case <- timeoutTicker.C:
+            c.timeoutInFlight()
+        case <- c.wake:
+        case <- c.exit:
+            return
+        }
+    }
+}
+
+func (c *client) sendMessage(ch *channel, msg *nsq.Message) bool {
+    msg.Attempts++
+    msg.Timestamp = time.Now().UnixNano()
+
+    c.mu.Lock()
+    c.inFlight[msg.ID] = &inFlight{msg: msg, deadline: time.Now().Add(c.msgTimeout)}
+    c.mu.Unlock()
+
+    var buf bytes.Buffer
+    if _, err := msg.WriteTo(&buf); err != nil {
+        logger.Errorf("%s encode message err[%s]\n", c, err)
+        return false
+    }
+    if err := c.sendFrame(frameTypeMessage, buf.Bytes()); err != nil {
+        return false
+    }
+    util.IncrStat("serve_sent", 1)
+    return true
+}
+
+func (c *client) timeoutInFlight() {
+    now := time.Now()
+    var expired []*nsq.Message
+
+    c.mu.Lock()
+    for id, f := range c.inFlight {
+        if now.After(f.deadline) {
+            expired = append(expired, f.msg)
+            delete(c.inFlight, id)
+        }
+    }
+    ch := c.channel
+    c.mu.Unlock()
+
+    for _, msg := range expired {
+        logger.Debugf("%s message[%s] timed out, requeue\n", c, msg.ID[:])
+        util.IncrStat("serve_timeout", 1)
+        ch.requeueAfter(msg, 0, c.server.notify)
+    }
+}
+
+// messages of a gone client go to other clients of the channel
+func (c *client) requeueAll() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    for id, f := range c.inFlight {
+        delete(c.inFlight, id)
+        // requeue chan may be full, never block the closing client
+        go c.channel.requeueAfter(f.msg, 0, c.server.notify)
+    }
+}
+
+func (c *client) sendResponse(data []byte) error {
+    return c.sendFrame(frameTypeResponse, data)
+}
+
+func (c *client) sendError(msg string) {
+    logger.Errorf("%s %s\n", c, msg)
+    c.sendFrame(frameTypeError, []byte(msg))
+}
+
+func (c *client) sendFrame(frameType int32, data []byte) error {
+    c.writeLock.Lock()
+    defer c.writeLock.Unlock()
+
+    var header [8]byte
+    binary.BigEndian.PutUint32(header[:4], uint32(len(data) + 4))
+    binary.BigEndian.PutUint32(header[4:], uint32(frameType))
+
+    if _, err := c.writer.Write(header[:]); err != nil {
+        return err
+    }
+    if _, err := c.writer.Write(data); err != nil {
+        return err
+    }
+    return c.writer.Flush()
+}
@@ -0,0 +1,233 @@
+package serve
+
+import (
+    "util"
+    "util/segment"
+    "logger"
+    "fmt"
+    "io"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    nsq      "github.com/nsqio/go-nsq"
+)
+
+const (
+    defaultMsgTimeout        = 60 * time.Second
+    defaultHeartbeatInterval = 30 * time.Second
+    maxRdyCount              = 2500
+)
+
+// Server speaks the nsqd tcp protocol(V2) for one topic backed by
+// recorded segments, so any nsq consumer can subscribe to an archive
+// without nsqd. Every channel gets all messages of the archive, clients
+// of the same channel share them like nsqd.
+type Server struct {
+    addr     string
+    topic    string
+    segments []string // replay order
+    keyring  *util.Keyring
+    rate     int  // msgs per second per channel, 0 max speed
+    loop     bool // replay again after the last segment
+
+    listener net.Listener
+    mu       sync.Mutex
+    channels map[string]*channel
+    clients  map[*client]bool
+    msgID    uint64
+
+    notify   chan bool
+    closed   sync.Once
+    wg       sync.WaitGroup
+}
+
+type channel struct {
+    name    string
+    queue   chan *nsq.Message // read from segments
+    requeue chan *nsq.Message // REQ or timeout, delivered first
+}
+
+func NewServer(addr, topic string, segments []string, keyring *util.Keyring,
+    rate int, loop bool) *Server {
+    return &Server{
+        addr: addr,
+        topic: topic,
+        segments: segments,
+        keyring: keyring,
+        rate: rate,
+        loop: loop,
+        channels: make(map[string]*channel),
+        clients: make(map[*client]bool),
+        notify: make(chan bool),
+    }
+}
+
+func (s *Server) String() string {
+    return fmt.Sprintf("Server{%s}/topic{%s}", s.addr, s.topic)
+}
+
+// Serve blocks until Close
+func (s *Server) Serve() error {
+    listener, err := net.Listen("tcp", s.addr)
+    if err != nil {
+        logger.Errorf("%s listen err[%s]\n", s, err)
+        return err
+    }
+    s.listener = listener
+    logger.Infof("%s start serving %d segments\n", s, len(s.segments))
+
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            select {
+            case <- s.notify:
+                s.wg.Wait()
+                return nil
+            default:
+            }
+            logger.Errorf("%s accept err[%s]\n", s, err)
+            return err
+        }
+
+        c := newClient(s, conn)
+        s.mu.Lock()
+        s.clients[c] = true
+        s.mu.Unlock()
+
+        s.wg.Add(1)
+        go func() {
+            defer s.wg.Done()
+            c.process()
+
+            s.mu.Lock()
+            delete(s.clients, c)
+            s.mu.Unlock()
+        }()
+    }
+}
+
+// Close stops accepting and drops connected clients, it may be called
+// more than once
+func (s *Server) Close() {
+    s.closed.Do(func() {
+        close(s.notify)
+        if s.listener != nil {
+            s.listener.Close()
+        }
+
+        s.mu.Lock()
+        for c := range s.clients {
+            c.conn.Close()
+        }
+        s.mu.Unlock()
+    })
+}
+
+func (s *Server) nextID() nsq.MessageID {
+    var id nsq.MessageID
+    copy(id[:], fmt.Sprintf("%016x", atomic.AddUint64(&s.msgID, 1)))
+    return id
+}
+
+// channel is created on first SUB, its reader starts at once
+func (s *Server) getChannel(name string) *channel {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if ch, ok := s.channels[name]; ok {
+        return ch
+    }
+
+    ch := &channel{
+        name: name,
+        queue: make(chan *nsq.Message),
+        requeue: make(chan *nsq.Message, maxRdyCount),
+    }
+    s.channels[name] = ch
+
+    s.wg.Add(1)
+    go func() {
+        defer s.wg.Done()
+        s.readSegments(ch)
+    }()
+    return ch
+}
+
+func (s *Server) readSegments(ch *channel) {
+    var tick <-chan time.Time
+    if s.rate > 0 {
+        ticker := time.NewTicker(time.Second / time.Duration(s.rate))
+        defer ticker.Stop()
+        tick = ticker.C
+    }
+
+    for {
+        for _, path := range s.segments {
+            if !s.readSegment(ch, path, tick) {
+                return
+            }
+        }
+
+        if !s.loop {
+            break
+        }
+        logger.Infof("%s channel[%s] replay archive again\n", s, ch.name)
+    }
+
+    logger.Infof("%s channel[%s] archive drained\n", s, ch.name)
+}
+
+// false means server closing
+func (s *Server) readSegment(ch *channel, path string, tick <-chan time.Time) bool {
+    file, err := segment.Open(path, s.keyring)
+    if err != nil {
+        logger.Errorf("%s open segment[%s] err[%s], skip\n", s, path, err)
+        return true
+    }
+    defer file.Close()
+
+    for {
+        rec, err := file.Next()
+        if err != nil {
+            if err != io.EOF {
+                logger.Errorf("%s read segment[%s] err[%s], skip rest\n", s, path, err)
+            }
+            return true
+        }
+
+        if tick != nil {
+            select {
+            case <- tick:
+            case <- s.notify:
+                return false
+            }
+        }
+
+        msg := nsq.NewMessage(s.nextID(), rec.Body)
+        select {
+        case ch.queue <- msg:
+        case <- s.notify:
+            return false
+        }
+    }
+}
+
+// requeue after delay, like nsqd deferred messages
+func (ch *channel) requeueAfter(msg *nsq.Message, delay time.Duration, notify chan bool) {
+    if delay <= 0 {
+        select {
+        case ch.requeue <- msg:
+        case <- notify:
+        }
+        return
+    }
+
+    time.AfterFunc(delay, func() {
+        select {
+        case ch.requeue <- msg:
+        case <- notify:
+        }
+    })
+}
@@ -0,0 +1,221 @@
+package serve
+
+import (
+    "util/segment"
+    "bufio"
+    "bytes"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+    "encoding/binary"
+
+    nsq      "github.com/nsqio/go-nsq"
+)
+
+func writeSegment(t *testing.T, path string, bodies ...string) {
+    fp, err := os.Create(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer fp.Close()
+    w := segment.NewWriter(fp, segment.NewHeader(segment.FlagCRC, map[string]string{"topic": "test"}))
+    if err := w.WriteHeader(); err != nil {
+        t.Fatal(err)
+    }
+    for _, body := range bodies {
+        if _, err := w.Write(&segment.Record{Body: []byte(body)}); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+// testConn is the consumer side of a client served over a pipe
+type testConn struct {
+    t    *testing.T
+    conn net.Conn
+    r    *bufio.Reader
+}
+
+func connect(t *testing.T, s *Server) *testConn {
+    server, conn := net.Pipe()
+    c := newClient(s, server)
+    s.mu.Lock()
+    s.clients[c] = true
+    s.mu.Unlock()
+    s.wg.Add(1)
+    go func() {
+        defer s.wg.Done()
+        c.process()
+    }()
+
+    tc := &testConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+    tc.send("  V2")
+    return tc
+}
+
+func (tc *testConn) send(format string, args ...interface{}) {
+    tc.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+    if _, err := fmt.Fprintf(tc.conn, format, args...); err != nil {
+        tc.t.Fatal(err)
+    }
+}
+
+func (tc *testConn) identify(body string) {
+    tc.send("IDENTIFY\n")
+    var size [4]byte
+    binary.BigEndian.PutUint32(size[:], uint32(len(body)))
+    tc.send("%s%s", size[:], body)
+}
+
+func (tc *testConn) frame() (int32, []byte) {
+    tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    var header [8]byte
+    if _, err := io.ReadFull(tc.r, header[:]); err != nil {
+        tc.t.Fatal(err)
+    }
+    data := make([]byte, binary.BigEndian.Uint32(header[:4]) - 4)
+    if _, err := io.ReadFull(tc.r, data); err != nil {
+        tc.t.Fatal(err)
+    }
+    return int32(binary.BigEndian.Uint32(header[4:])), data
+}
+
+func (tc *testConn) expect(frameType int32, prefix string) []byte {
+    gotType, data := tc.frame()
+    if gotType != frameType || !strings.HasPrefix(string(data), prefix) {
+        tc.t.Fatalf("got frame %d[%s], want %d[%s...]", gotType, data, frameType, prefix)
+    }
+    return data
+}
+
+func (tc *testConn) message() *nsq.Message {
+    msg, err := nsq.DecodeMessage(tc.expect(frameTypeMessage, ""))
+    if err != nil {
+        tc.t.Fatal(err)
+    }
+    return msg
+}
+
+func testServer(t *testing.T, bodies ...string) *Server {
+    path := filepath.Join(t.TempDir(), "backup.log.a_3")
+    writeSegment(t, path, bodies...)
+    s := NewServer("127.0.0.1:0", "test", []string{path}, nil, 0, false)
+    t.Cleanup(func() {
+        s.Close()
+        s.wg.Wait()
+    })
+    return s
+}
+
+func subscribe(t *testing.T, s *Server, channel string) *testConn {
+    tc := connect(t, s)
+    tc.identify(`{"feature_negotiation": true, "heartbeat_interval": -1, "msg_timeout": 1000}`)
+    if data := tc.expect(frameTypeResponse, "{"); !bytes.Contains(data, []byte(`"msg_timeout":1000`)) {
+        t.Fatalf("identify response %s", data)
+    }
+    tc.send("SUB test %s\n", channel)
+    tc.expect(frameTypeResponse, "OK")
+    return tc
+}
+
+func TestServeFinInOrder(t *testing.T) {
+    s := testServer(t, "a", "b", "c")
+    tc := subscribe(t, s, "ch")
+
+    // nothing is sent before RDY
+    tc.send("RDY 1\n")
+    for _, want := range []string{"a", "b", "c"} {
+        msg := tc.message()
+        if string(msg.Body) != want || msg.Attempts != 1 {
+            t.Fatalf("got %s attempts %d, want %s", msg.Body, msg.Attempts, want)
+        }
+        tc.send("FIN %s\n", msg.ID[:])
+    }
+
+    // FIN of an unknown id is not fatal
+    tc.send("FIN %s\n", strings.Repeat("0", 16))
+    tc.expect(frameTypeError, "E_FIN_FAILED")
+    tc.send("NOP\n")
+}
+
+func TestServeReq(t *testing.T) {
+    s := testServer(t, "a", "b")
+    tc := subscribe(t, s, "ch")
+    tc.send("RDY 1\n")
+
+    first := tc.message()
+    tc.send("REQ %s 0\n", first.ID[:])
+    // requeued messages go before the rest of the archive
+    again := tc.message()
+    if again.ID != first.ID || again.Attempts != 2 {
+        t.Fatalf("got %s attempts %d after REQ", again.Body, again.Attempts)
+    }
+    tc.send("FIN %s\n", again.ID[:])
+    if msg := tc.message(); string(msg.Body) != "b" {
+        t.Fatalf("got %s", msg.Body)
+    }
+}
+
+func TestServeTimeoutRequeue(t *testing.T) {
+    s := testServer(t, "a")
+    tc := subscribe(t, s, "ch")
+    tc.send("RDY 1\n")
+
+    first := tc.message()
+    start := time.Now()
+    again := tc.message()
+    if again.ID != first.ID || again.Attempts != 2 {
+        t.Fatalf("got %s attempts %d after timeout", again.Body, again.Attempts)
+    }
+    if time.Since(start) < time.Second {
+        t.Fatalf("requeued after %s, msg_timeout is 1s", time.Since(start))
+    }
+}
+
+// clients of one channel share messages, every channel gets all of them
+func TestServeChannels(t *testing.T) {
+    s := testServer(t, "a", "b")
+    one, two := subscribe(t, s, "one"), subscribe(t, s, "two")
+    one.send("RDY 2\n")
+    two.send("RDY 2\n")
+    for _, tc := range []*testConn{one, two} {
+        if a, b := tc.message(), tc.message(); string(a.Body) != "a" || string(b.Body) != "b" {
+            t.Fatalf("got %s %s", a.Body, b.Body)
+        }
+    }
+}
+
+func TestServeFatalErrors(t *testing.T) {
+    s := testServer(t, "a")
+    for cmd, want := range map[string]string{
+        "SUB other ch\n": "E_BAD_TOPIC",
+        "PUB test\n": "E_INVALID",
+        "RDY 99999\n": "E_INVALID",
+        "BOGUS\n": "E_INVALID",
+    } {
+        tc := connect(t, s)
+        tc.send("%s", cmd)
+        tc.expect(frameTypeError, want)
+        // fatal errors close the connection
+        tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+        if _, err := tc.r.ReadByte(); err != io.EOF {
+            t.Fatalf("%q conn not closed, err[%v]", cmd, err)
+        }
+    }
+}
+
+func TestServeCloseTwice(t *testing.T) {
+    s := testServer(t, "a")
+    tc := subscribe(t, s, "ch")
+    s.Close()
+    s.Close()
+    tc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if _, err := tc.r.ReadByte(); err != io.EOF {
+        t.Fatalf("client not dropped, err[%v]", err)
+    }
+}
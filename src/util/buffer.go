@@ -0,0 +1,34 @@
+package util
+
+import (
+    "sync"
+)
+
+// buffers above this are left to gc, a huge msg must not pin memory
+const maxPooledBuffer = 1024 * 1024
+
+// Buffer is a pooled byte slice of the hot paths, B is valid until Release
+type Buffer struct {
+    B []byte
+}
+
+var bufferPool = sync.Pool{
+    New: func() interface{} { return &Buffer{B: make([]byte, 0, 4096)} },
+}
+
+// GetBuffer returns a buffer of len n
+func GetBuffer(n int) *Buffer {
+    b := bufferPool.Get().(*Buffer)
+    if cap(b.B) < n {
+        b.B = make([]byte, n)
+    }
+    b.B = b.B[:n]
+    return b
+}
+
+func (b *Buffer) Release() {
+    if b == nil || cap(b.B) > maxPooledBuffer {
+        return
+    }
+    bufferPool.Put(b)
+}
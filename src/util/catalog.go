@@ -0,0 +1,217 @@
+package util
+
+import (
+    "logger"
+    "os"
+    "io"
+    "bufio"
+    "sync"
+    "sort"
+    "time"
+    "path/filepath"
+    "encoding/json"
+)
+
+const DefaultCatalogName = "catalog.jsonl"
+
+// manifest of one finished segment, one json line in catalog
+type CatalogEntry struct {
+    Path            string `json:"path"`
+    Topic           string `json:"topic"`
+    Channel         string `json:"channel"`
+    IDC             string `json:"idc,omitempty"` // cluster recorded from
+    FirstTime       int64  `json:"first_time"` // first msg timestamp, unix nano
+    LastTime        int64  `json:"last_time"`  // last msg timestamp, unix nano
+    FirstSeq        uint64 `json:"first_seq,omitempty"` // receive sequence, 0 if not recorded
+    LastSeq         uint64 `json:"last_seq,omitempty"`
+    MsgCount        uint64 `json:"msg_count"`
+    RawBytes        int64  `json:"raw_bytes"`        // before compression
+    CompressedBytes int64  `json:"compressed_bytes"` // size on disk
+    Codec           string `json:"codec"`
+    Checksum        string `json:"checksum"` // sha256 of file on disk
+    KeyID           string `json:"key_id,omitempty"` // encryption key, empty if plaintext
+    CreateTime      int64  `json:"create_time"` // finish time, unix nano
+    Replaces        []string `json:"replaces,omitempty"` // inputs merged by compaction
+    Removed         string   `json:"removed,omitempty"`  // tombstone, path was deleted for this reason
+}
+
+// append-only json lines index, one per write dir
+type Catalog struct {
+    path string
+    mu   sync.Mutex
+}
+
+var (
+    catalogs    = make(map[string]*Catalog)
+    catalogLock sync.Mutex
+)
+
+// daemons writing to the same write dir share one Catalog
+func GetCatalog(path string) *Catalog {
+    path = filepath.Clean(path)
+    catalogLock.Lock()
+    defer catalogLock.Unlock()
+
+    if c, ok := catalogs[path]; ok {
+        return c
+    }
+    c := &Catalog{path: path}
+    catalogs[path] = c
+    return c
+}
+
+func (c *Catalog) Path() string {
+    return c.path
+}
+
+func (c *Catalog) Append(e *CatalogEntry) error {
+    line, err := json.Marshal(e)
+    if err != nil {
+        return err
+    }
+    line = append(line, '\n')
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if err := os.MkdirAll(filepath.Dir(c.path), 0770); err != nil {
+        logger.Errorf("Create catalog dir[%s] err[%s]\n", filepath.Dir(c.path), err)
+        return err
+    }
+
+    fp, err := os.OpenFile(c.path, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0666)
+    if err != nil {
+        logger.Errorf("Open catalog[%s] err[%s]\n", c.path, err)
+        return err
+    }
+    defer fp.Close()
+
+    if _, err := fp.Write(line); err != nil {
+        logger.Errorf("Write catalog[%s] err[%s]\n", c.path, err)
+        return err
+    }
+    return nil
+}
+
+// Remove appends a tombstone of path, the segment deleted from disk, e.g.
+// by retention. path is as recorded, not its done/ name.
+func (c *Catalog) Remove(path, topic, reason string) error {
+    return c.Append(&CatalogEntry{Path: path, Topic: topic, Removed: reason, CreateTime: time.Now().UnixNano()})
+}
+
+// ReadCatalog loads every entry, a broken line(e.g. half written when
+// crash) is skipped, so are merged and removed segments
+func ReadCatalog(path string) ([]*CatalogEntry, error) {
+    fp, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer fp.Close()
+
+    var ret []*CatalogEntry
+    reader := bufio.NewReader(fp)
+    for {
+        line, err := reader.ReadBytes('\n')
+        if len(line) > 0 {
+            var e CatalogEntry
+            if jerr := json.Unmarshal(line, &e); jerr != nil {
+                logger.Errorf("Catalog[%s] skip invalid line[%s] err[%s]\n", path, line, jerr)
+            } else {
+                ret = append(ret, &e)
+            }
+        }
+
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return dropReplaced(ret), err
+        }
+    }
+
+    return dropReplaced(ret), nil
+}
+
+// the catalog is append-only, entries merged by compaction are hidden by
+// the later entry replacing them, deleted ones by a later tombstone, which
+// is never returned itself
+func dropReplaced(entries []*CatalogEntry) []*CatalogEntry {
+    replacedAt := make(map[string]int)
+    for i, e := range entries {
+        for _, path := range e.Replaces {
+            replacedAt[path] = i
+        }
+        if e.Removed != "" {
+            replacedAt[e.Path] = i
+        }
+    }
+    if len(replacedAt) == 0 {
+        return entries
+    }
+
+    var ret []*CatalogEntry
+    for i, e := range entries {
+        if e.Removed != "" {
+            continue
+        }
+        if at, ok := replacedAt[e.Path]; ok && at > i {
+            continue
+        }
+        ret = append(ret, e)
+    }
+    return ret
+}
+
+// QueryCatalogs returns entries of topic which overlap [from, to],
+// empty topic means all topics, zero from/to means no bound.
+// Result sorted by first msg time.
+func QueryCatalogs(paths []string, topic string, from, to int64) ([]*CatalogEntry, error) {
+    var ret []*CatalogEntry
+    for _, path := range paths {
+        entries, err := ReadCatalog(path)
+        if err != nil {
+            logger.Errorf("Read catalog[%s] err[%s]\n", path, err)
+            return nil, err
+        }
+
+        for _, e := range entries {
+            if topic != "" && e.Topic != topic {
+                continue
+            }
+            if from != 0 && e.LastTime < from {
+                continue
+            }
+            if to != 0 && e.FirstTime > to {
+                continue
+            }
+            ret = append(ret, e)
+        }
+    }
+
+    sort.SliceStable(ret, func(i, j int) bool {
+        return ret[i].FirstTime < ret[j].FirstTime
+    })
+    return ret, nil
+}
+
+// FindCatalog looks for catalog named name in dir and its parents,
+// return "" if not found
+func FindCatalog(dir, name string) string {
+    dir, err := filepath.Abs(dir)
+    if err != nil {
+        return ""
+    }
+
+    for {
+        path := filepath.Join(dir, name)
+        if fi, err := os.Stat(path); err == nil && !fi.IsDir() {
+            return path
+        }
+
+        parent := filepath.Dir(dir)
+        if parent == dir {
+            return ""
+        }
+        dir = parent
+    }
+}
@@ -0,0 +1,72 @@
+package util
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func entryPaths(entries []*CatalogEntry) string {
+    var ret []string
+    for _, e := range entries {
+        ret = append(ret, e.Path)
+    }
+    return strings.Join(ret, ",")
+}
+
+func TestDropReplaced(t *testing.T) {
+    e := func(path string, replaces ...string) *CatalogEntry {
+        return &CatalogEntry{Path: path, Replaces: replaces}
+    }
+    cases := []struct {
+        entries []*CatalogEntry
+        want    string
+    }{
+        {[]*CatalogEntry{e("a"), e("b")}, "a,b"},
+        {[]*CatalogEntry{e("a"), e("b"), e("c"), e("a2", "a", "b")}, "c,a2"},
+        // a later segment reusing the name of a merged input is kept
+        {[]*CatalogEntry{e("a"), e("m", "a"), e("a")}, "m,a"},
+        // merges of merges
+        {[]*CatalogEntry{e("a"), e("b"), e("m1", "a", "b"), e("c"), e("m2", "m1", "c")}, "m2"},
+        // replacing a path never written, e.g. catalog line lost
+        {[]*CatalogEntry{e("a"), e("m", "x", "a")}, "m"},
+        // a merge line written before its inputs, never by compaction
+        {[]*CatalogEntry{e("m", "a"), e("a")}, "m,a"},
+        // deleted by retention, tombstones are never returned
+        {[]*CatalogEntry{e("a"), e("b"), {Path: "a", Removed: "retention max_age"}}, "b"},
+        {[]*CatalogEntry{e("m", "a", "b"), {Path: "m", Removed: "ring ring_max_size"}, e("m")}, "m"},
+        {nil, ""},
+    }
+    for i, c := range cases {
+        if got := entryPaths(dropReplaced(c.entries)); got != c.want {
+            t.Fatalf("case %d: got [%s], want [%s]", i, got, c.want)
+        }
+    }
+}
+
+// a broken line from a crash is skipped, replaced entries are hidden
+func TestReadCatalog(t *testing.T) {
+    path := filepath.Join(t.TempDir(), DefaultCatalogName)
+    c := GetCatalog(path)
+    if GetCatalog(path + "/.") != c {
+        t.Fatal("same catalog path got two Catalogs")
+    }
+    c.Append(&CatalogEntry{Path: "a"})
+    c.Append(&CatalogEntry{Path: "b"})
+    fp, err := os.OpenFile(path, os.O_WRONLY | os.O_APPEND, 0666)
+    if err != nil {
+        t.Fatal(err)
+    }
+    fp.WriteString("{\"path\": \"half\n")
+    fp.Close()
+    c.Append(&CatalogEntry{Path: "m", Replaces: []string{"a", "b"}})
+
+    entries, err := ReadCatalog(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := entryPaths(entries); got != "m" {
+        t.Fatalf("read [%s]", got)
+    }
+}
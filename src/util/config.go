@@ -0,0 +1,109 @@
+package util
+
+import (
+    "common"
+    "fmt"
+)
+
+// conf sections shared by record and play
+
+type LookupdConfig struct {
+    LookupdConf      string              `json:"lookupd_conf"`       // default DefaultNSQConf
+    LookupdCategory  int                 `json:"lookupd_category"`   // IDCFromHost, GLOBAL or IDCSpecified
+    IDCSpecified     string              `json:"idc_specified"`      // required by IDCSpecified
+    IDCs             []string            `json:"idcs"`               // consume these idc sections, or ["all"], empty uses category
+    IDCResolver      []IDCResolverConfig `json:"idc_resolver"`       // finds idc of IDCFromHost, default hostname third label
+
+    Connect          string              `json:"connect"`            // lookupd(default) or nsqd, by nsqd_address of nsq.json
+    NSQDTCPAddrs     []string            `json:"nsqd_tcp_addrs"`     // connect these nsqd only, nsq.json is not read
+    RefreshIntervalS int                 `json:"refresh_interval_s"` // re-read nsq.json, 0 never
+}
+
+func (c *LookupdConfig) Check(path string, e *common.ConfigError) {
+    switch c.LookupdCategory {
+    case IDCFromHost, GLOBAL:
+    case IDCSpecified:
+        if c.IDCSpecified == "" {
+            e.Add(path + ".idc_specified", "required by lookupd_category %d", IDCSpecified)
+        }
+    default:
+        e.Add(path + ".lookupd_category", "%d out of range %d-%d", c.LookupdCategory,
+        IDCFromHost, IDCSpecified)
+    }
+
+    if _, err := NewIDCResolver(c.IDCResolver); err != nil {
+        e.Add(path + ".idc_resolver", "%s", err)
+    }
+
+    switch c.Connect {
+    case "", ConnectLookupd, ConnectNSQD:
+    default:
+        e.Add(path + ".connect", "invalid connect[%s], want %s or %s", c.Connect, ConnectLookupd, ConnectNSQD)
+    }
+    for i, addr := range c.NSQDTCPAddrs {
+        if addr == "" {
+            e.Add(fmt.Sprintf("%s.nsqd_tcp_addrs[%d]", path, i), "empty addr")
+        }
+    }
+    if c.RefreshIntervalS < 0 {
+        e.Add(path + ".refresh_interval_s", "must not be negative")
+    }
+
+    for i, idc := range c.IDCs {
+        if idc == "" {
+            e.Add(fmt.Sprintf("%s.idcs[%d]", path, i), "empty idc")
+        } else if idc == AllIDCs && len(c.IDCs) > 1 {
+            e.Add(path + ".idcs", "%s must be the only item", AllIDCs)
+        }
+    }
+}
+
+// MultiCluster is true if more than one cluster may be consumed
+func (c *LookupdConfig) MultiCluster() bool {
+    return len(c.IDCs) > 1 || (len(c.IDCs) == 1 && c.IDCs[0] == AllIDCs)
+}
+
+// GCConfig is kept for old confs, see MemoryConfig
+type GCConfig struct {
+    MaxMemM        int `json:"max_mem_m"`        // soft memory limit if memory.limit_m is 0
+    CheckIntervalS int `json:"check_interval_s"` // ignored, go gc follows the limit
+}
+
+type RuntimeConfig struct {
+    MaxProc int `json:"max_proc"` // <= 0 means all cpus
+}
+
+type AdminConfig struct {
+    HTTPAddr string `json:"http_addr"` // empty disables admin http
+}
+
+// MiscConfig is embedded by record and play conf
+type MiscConfig struct {
+    Log     common.LogConfig `json:"log"`
+    GC      GCConfig         `json:"gc"`
+    Memory  MemoryConfig     `json:"memory"`
+    Runtime RuntimeConfig    `json:"runtime"`
+    Admin   AdminConfig      `json:"admin"`
+}
+
+func DefaultMiscConfig() MiscConfig {
+    return MiscConfig{
+        GC: GCConfig{CheckIntervalS: 20},
+        Memory: MemoryConfig{HighPercent: 80, LowPercent: 50, CheckIntervalMS: 200},
+    }
+}
+
+func (c *MiscConfig) Check(e *common.ConfigError) {
+    c.Log.Check(e)
+    if c.GC.MaxMemM < 0 {
+        e.Add("gc.max_mem_m", "must not be negative")
+    }
+    c.Memory.Check("memory", e)
+}
+
+// PredicateConfig is one item of predicate arrays, see Predicate
+type PredicateConfig struct {
+    Path  string      `json:"path"`
+    Op    string      `json:"op"`
+    Value interface{} `json:"value"`
+}
@@ -0,0 +1,211 @@
+package util
+
+import (
+    "logger"
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+
+    nsq      "github.com/nsqio/go-nsq"
+)
+
+const (
+    ConnectLookupd = "lookupd"
+    ConnectNSQD    = "nsqd"
+
+    // cluster name of nsqd_tcp_addrs
+    DirectIDC = "direct"
+)
+
+// Connector connects consumers to the cluster of their idc, by lookupd or
+// straight to nsqd, and keeps them following changes of nsq.json
+type Connector struct {
+    conf      *LookupdConfig
+    direct    bool // consumers connect to nsqd
+    interval  time.Duration
+
+    mu        sync.Mutex
+    clusters  map[string][]string // idc -> lookupd or nsqd addrs
+    consumers map[string][]*nsq.Consumer
+}
+
+func NewConnector(conf *LookupdConfig) (*Connector, error) {
+    c := &Connector{
+        conf: conf,
+        direct: conf.Connect == ConnectNSQD || len(conf.NSQDTCPAddrs) > 0,
+        interval: time.Duration(conf.RefreshIntervalS) * time.Second,
+        consumers: make(map[string][]*nsq.Consumer),
+    }
+
+    var err error
+    if c.clusters, err = c.read(); err != nil {
+        return nil, err
+    }
+    logger.Infof("%s clusters%v\n", c, c.clusters)
+    return c, nil
+}
+
+// addrs of every cluster to consume
+func (c *Connector) read() (map[string][]string, error) {
+    if len(c.conf.NSQDTCPAddrs) > 0 {
+        return map[string][]string{DirectIDC: c.conf.NSQDTCPAddrs}, nil
+    }
+    if c.direct {
+        return GetClusterAddrs(c.conf, nsqdSections)
+    }
+    return GetClusterAddrs(c.conf, lookupdSections)
+}
+
+func (c *Connector) String() string {
+    mode := ConnectLookupd
+    if c.direct {
+        mode = ConnectNSQD
+    }
+    return fmt.Sprintf("Connector{%s}", mode)
+}
+
+// IDCs are the clusters found at start, in order
+func (c *Connector) IDCs() []string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    var ret []string
+    for idc := range c.clusters {
+        ret = append(ret, idc)
+    }
+    sort.Strings(ret)
+    return ret
+}
+
+// Connect connects consumer to the cluster of idc, later changes of the
+// cluster are applied to it
+func (c *Connector) Connect(idc string, consumer *nsq.Consumer) error {
+    c.mu.Lock()
+    addrs, ok := c.clusters[idc]
+    if ok {
+        c.consumers[idc] = append(c.consumers[idc], consumer)
+    }
+    c.mu.Unlock()
+
+    if !ok {
+        return fmt.Errorf("%s has no idc[%s]", c, idc)
+    }
+    if c.direct {
+        return consumer.ConnectToNSQDs(addrs)
+    }
+    return consumer.ConnectToNSQLookupds(addrs)
+}
+
+// ConnectAll connects consumer to every cluster
+func (c *Connector) ConnectAll(consumer *nsq.Consumer) error {
+    for _, idc := range c.IDCs() {
+        if err := c.Connect(idc, consumer); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Process re-reads nsq.json every refresh_interval_s until notified
+func (c *Connector) Process(notify chan bool) {
+    if c.interval <= 0 {
+        return
+    }
+
+    ticker := time.NewTicker(c.interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <- ticker.C:
+            c.refresh()
+        case <- notify:
+            logger.Debugf("%s exit\n", c)
+            return
+        }
+    }
+}
+
+// new clusters need a restart, a read failure keeps the old addrs
+func (c *Connector) refresh() {
+    clusters, err := c.read()
+    if err != nil {
+        logger.Warnf("%s refresh err[%s], keep old addrs\n", c, err)
+        IncrStat("connector_refresh_failed", 1)
+        return
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    for idc := range clusters {
+        if _, ok := c.clusters[idc]; !ok {
+            logger.Warnf("%s new idc[%s] is ignored until restart\n", c, idc)
+        }
+    }
+
+    for idc, old := range c.clusters {
+        addrs, ok := clusters[idc]
+        if !ok {
+            logger.Warnf("%s idc[%s] is gone, keep old addrs%v\n", c, idc, old)
+            continue
+        }
+
+        added, removed := diffAddrs(old, addrs)
+        if len(added) == 0 && len(removed) == 0 {
+            continue
+        }
+        logger.Infof("%s idc[%s] add%v remove%v\n", c, idc, added, removed)
+        for _, consumer := range c.consumers[idc] {
+            c.apply(consumer, added, removed)
+        }
+        c.clusters[idc] = addrs
+        IncrStat("connector_refreshed", 1)
+    }
+}
+
+func (c *Connector) apply(consumer *nsq.Consumer, added, removed []string) {
+    for _, addr := range added {
+        var err error
+        if c.direct {
+            err = consumer.ConnectToNSQD(addr)
+        } else {
+            err = consumer.ConnectToNSQLookupd(addr)
+        }
+        if err != nil && err != nsq.ErrAlreadyConnected {
+            logger.Errorf("%s connect [%s] err[%s]\n", c, addr, err)
+        }
+    }
+    // added first, lookupd refuses to remove its last address
+    for _, addr := range removed {
+        var err error
+        if c.direct {
+            err = consumer.DisconnectFromNSQD(addr)
+        } else {
+            err = consumer.DisconnectFromNSQLookupd(addr)
+        }
+        if err != nil && err != nsq.ErrNotConnected {
+            logger.Errorf("%s disconnect [%s] err[%s]\n", c, addr, err)
+        }
+    }
+}
+
+func diffAddrs(old, cur []string) ([]string, []string) {
+    oldSet := make(map[string]bool)
+    for _, addr := range old {
+        oldSet[addr] = true
+    }
+    curSet := make(map[string]bool)
+    var added, removed []string
+    for _, addr := range cur {
+        curSet[addr] = true
+        if !oldSet[addr] {
+            added = append(added, addr)
+        }
+    }
+    for _, addr := range old {
+        if !curSet[addr] {
+            removed = append(removed, addr)
+        }
+    }
+    return added, removed
+}
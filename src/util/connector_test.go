@@ -0,0 +1,179 @@
+package util
+
+import (
+    "encoding/json"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    nsq      "github.com/nsqio/go-nsq"
+)
+
+func writeNSQJSON(t *testing.T, path string, lookupds, nsqds []string) {
+    content, _ := json.Marshal(map[string]map[string][]string{
+        lookupdSections: {"idc1": lookupds},
+        nsqdSections: {"idc1": nsqds},
+    })
+    // renamed in place like a config push, never read half written
+    if err := os.WriteFile(path + ".tmp", content, 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Rename(path + ".tmp", path); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// lookupd answering no producers, counts lookups
+func testLookupd(t *testing.T, lookups *int32) string {
+    s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        atomic.AddInt32(lookups, 1)
+        w.Write([]byte(`{"channels": [], "producers": []}`))
+    }))
+    t.Cleanup(s.Close)
+    return strings.TrimPrefix(s.URL, "http://")
+}
+
+func testConsumer(t *testing.T) *nsq.Consumer {
+    consumer, err := nsq.NewConsumer("test", "vcr", nsq.NewConfig())
+    if err != nil {
+        t.Fatal(err)
+    }
+    consumer.SetLogger(nil, nsq.LogLevelError)
+    consumer.AddHandler(nsq.HandlerFunc(func(*nsq.Message) error { return nil }))
+    t.Cleanup(consumer.Stop)
+    return consumer
+}
+
+func TestConnectorRefresh(t *testing.T) {
+    var lookups int32
+    a, b, c := testLookupd(t, &lookups), testLookupd(t, &lookups), testLookupd(t, &lookups)
+    nsqJSON := filepath.Join(t.TempDir(), "nsq.json")
+    writeNSQJSON(t, nsqJSON, []string{a, b}, nil)
+
+    conn, err := NewConnector(&LookupdConfig{LookupdConf: nsqJSON, LookupdCategory: IDCSpecified,
+        IDCSpecified: "idc1", RefreshIntervalS: 1})
+    if err != nil {
+        t.Fatal(err)
+    }
+    consumer := testConsumer(t)
+    if err := conn.ConnectAll(consumer); err != nil {
+        t.Fatal(err)
+    }
+
+    conn.interval = 10 * time.Millisecond
+    notify := make(chan bool)
+    done := make(chan struct{})
+    go func() {
+        conn.Process(notify)
+        close(done)
+    }()
+
+    writeNSQJSON(t, nsqJSON, []string{b, c}, nil)
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        conn.mu.Lock()
+        addrs := conn.clusters["idc1"]
+        conn.mu.Unlock()
+        if reflect.DeepEqual(addrs, []string{b, c}) {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("addrs %v not refreshed", addrs)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+
+    // a broken push keeps the addrs in use
+    os.WriteFile(nsqJSON, []byte("{"), 0644)
+    time.Sleep(50 * time.Millisecond)
+    close(notify)
+    <- done
+
+    if reflect.DeepEqual(conn.clusters["idc1"], []string{b, c}) == false {
+        t.Fatalf("addrs %v after broken nsq.json", conn.clusters["idc1"])
+    }
+    // the consumer follows: a is dropped, c is added
+    if err := consumer.DisconnectFromNSQLookupd(a); err != nsq.ErrNotConnected {
+        t.Fatalf("removed lookupd still connected err[%v]", err)
+    }
+    if err := consumer.DisconnectFromNSQLookupd(c); err != nil {
+        t.Fatalf("added lookupd not connected err[%v]", err)
+    }
+}
+
+// nsqd mode connects nsqd_address of nsq.json and never asks lookupd
+func TestConnectorNSQDMode(t *testing.T) {
+    var lookups int32
+    lookupd := testLookupd(t, &lookups)
+
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    accepted := make(chan struct{}, 1)
+    go func() {
+        conn, err := ln.Accept()
+        if err != nil {
+            return
+        }
+        accepted <- struct{}{}
+        conn.Close()
+    }()
+
+    nsqJSON := filepath.Join(t.TempDir(), "nsq.json")
+    writeNSQJSON(t, nsqJSON, []string{lookupd}, []string{ln.Addr().String()})
+    conn, err := NewConnector(&LookupdConfig{LookupdConf: nsqJSON, LookupdCategory: IDCSpecified,
+        IDCSpecified: "idc1", Connect: ConnectNSQD})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if conn.String() != "Connector{nsqd}" || !reflect.DeepEqual(conn.IDCs(), []string{"idc1"}) {
+        t.Fatalf("%s idcs %v", conn, conn.IDCs())
+    }
+
+    // the fake nsqd hangs up in the handshake, only the dial matters
+    conn.Connect("idc1", testConsumer(t))
+    select {
+    case <- accepted:
+    case <- time.After(5 * time.Second):
+        t.Fatal("nsqd not dialed")
+    }
+    if n := atomic.LoadInt32(&lookups); n != 0 {
+        t.Fatalf("lookupd queried %d times", n)
+    }
+    if err := conn.Connect("idc2", testConsumer(t)); err == nil {
+        t.Fatal("unknown idc connected")
+    }
+}
+
+// nsqd_tcp_addrs never read nsq.json
+func TestConnectorDirectAddrs(t *testing.T) {
+    conn, err := NewConnector(&LookupdConfig{LookupdConf: "/nonexistent/nsq.json",
+        NSQDTCPAddrs: []string{"127.0.0.1:4150"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(conn.IDCs(), []string{DirectIDC}) || conn.String() != "Connector{nsqd}" {
+        t.Fatalf("%s idcs %v", conn, conn.IDCs())
+    }
+
+    if _, err := NewConnector(&LookupdConfig{LookupdConf: "/nonexistent/nsq.json",
+        LookupdCategory: GLOBAL}); err == nil {
+        t.Fatal("missing nsq.json got no err")
+    }
+}
+
+func TestDiffAddrs(t *testing.T) {
+    added, removed := diffAddrs([]string{"a", "b", "c"}, []string{"c", "d", "b"})
+    if !reflect.DeepEqual(added, []string{"d"}) || !reflect.DeepEqual(removed, []string{"a"}) {
+        t.Fatalf("added %v removed %v", added, removed)
+    }
+}
@@ -0,0 +1,283 @@
+package util
+
+import (
+    "logger"
+    "fmt"
+    "io"
+    "errors"
+    "io/ioutil"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "crypto/hkdf"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "encoding/binary"
+)
+
+// encrypted segment(after compression) format:
+//   header: magic(4) version(1) keyIDLen(1) keyID salt(32)
+//   chunk:  final(1) len(4, bigendian) aes-256-gcm sealed data
+// every segment is sealed by its own subkey, HKDF-SHA256 of the key and
+// the random salt, so nonces never repeat under one key however many
+// segments a long-lived key seals. Nonce of chunk n is n(12 bytes
+// bigendian), aad is header + n + final, so reordered, dropped,
+// truncated or appended chunks are detected.
+const (
+    EncryptMagic   = "NVCE"
+    EncryptVersion = 2
+
+    encryptChunkSize = 64 * 1024
+    encryptSaltSize  = 32
+    subkeyInfo       = "nsq_vcr segment"
+)
+
+var (
+    ErrNoKeyring   = errors.New("segment is encrypted but no key file configured")
+    ErrKeyNotFound = errors.New("key id not found in key file")
+    ErrDecrypt     = errors.New("decrypt failed, wrong key or corrupted data")
+
+    // shared with util/segment, errors.Is works on any layer of a segment
+    ErrTruncated     = errors.New("segment truncated")
+    ErrInvalidHeader = errors.New("invalid segment header")
+)
+
+// key file format:
+//   {"current": "k2", "keys": {"k1": "hex of 32 bytes", "k2": "..."}}
+// new segments use current key, old keys stay for reading
+type Keyring struct {
+    current string
+    keys    map[string][]byte
+}
+
+func LoadKeyring(path string) (*Keyring, error) {
+    content, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("read key file[%s] err[%s]", path, err)
+    }
+
+    var conf struct {
+        Current string            `json:"current"`
+        Keys    map[string]string `json:"keys"`
+    }
+    if err := json.Unmarshal(content, &conf); err != nil {
+        return nil, fmt.Errorf("parse key file[%s] err[%s]", path, err)
+    }
+
+    k := &Keyring{current: conf.Current, keys: make(map[string][]byte)}
+    for id, hexKey := range conf.Keys {
+        if id == "" || len(id) > 255 {
+            return nil, fmt.Errorf("key file[%s] invalid key id[%s]", path, id)
+        }
+        key, err := hex.DecodeString(hexKey)
+        if err != nil || len(key) != 32 {
+            return nil, fmt.Errorf("key file[%s] key[%s] must be 64 hex chars(AES-256)", path, id)
+        }
+        k.keys[id] = key
+    }
+
+    if _, ok := k.keys[k.current]; !ok {
+        return nil, fmt.Errorf("key file[%s] current key[%s] not found", path, k.current)
+    }
+
+    logger.Debugf("Load key file[%s] success, current key[%s], %d keys\n", path, k.current, len(k.keys))
+    return k, nil
+}
+
+func (k *Keyring) CurrentID() string {
+    return k.current
+}
+
+// aead of the segment subkey derived from salt
+func (k *Keyring) aead(id string, salt []byte) (cipher.AEAD, error) {
+    key, ok := k.keys[id]
+    if !ok {
+        return nil, fmt.Errorf("%w: [%s]", ErrKeyNotFound, id)
+    }
+    key, err := hkdf.Key(sha256.New, key, salt, subkeyInfo, len(key))
+    if err != nil {
+        return nil, err
+    }
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+func chunkNonce(n uint64) []byte {
+    nonce := make([]byte, 12)
+    binary.BigEndian.PutUint64(nonce[4:], n)
+    return nonce
+}
+
+func chunkAAD(header []byte, n uint64, final byte) []byte {
+    aad := make([]byte, len(header) + 9)
+    copy(aad, header)
+    binary.BigEndian.PutUint64(aad[len(header):], n)
+    aad[len(aad) - 1] = final
+    return aad
+}
+
+type encryptWriter struct {
+    w      io.Writer
+    aead   cipher.AEAD
+    header []byte
+    n      uint64
+    buf    []byte
+}
+
+// NewEncryptWriter writes header at once, Close must be called to
+// write the final chunk
+func NewEncryptWriter(w io.Writer, k *Keyring) (io.WriteCloser, error) {
+    salt := make([]byte, encryptSaltSize)
+    if _, err := rand.Read(salt); err != nil {
+        return nil, err
+    }
+    aead, err := k.aead(k.current, salt)
+    if err != nil {
+        return nil, err
+    }
+
+    header := make([]byte, 0, 6 + len(k.current) + encryptSaltSize)
+    header = append(header, EncryptMagic...)
+    header = append(header, EncryptVersion, byte(len(k.current)))
+    header = append(header, k.current...)
+    header = append(header, salt...)
+    if _, err := w.Write(header); err != nil {
+        return nil, err
+    }
+
+    return &encryptWriter{
+        w: w,
+        aead: aead,
+        header: header,
+        buf: make([]byte, 0, encryptChunkSize),
+    }, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+    written := 0
+    for len(p) > 0 {
+        n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+        e.buf = e.buf[:len(e.buf) + n]
+        p = p[n:]
+        written += n
+        if len(e.buf) == cap(e.buf) {
+            if err := e.seal(0); err != nil {
+                return written, err
+            }
+        }
+    }
+    return written, nil
+}
+
+func (e *encryptWriter) seal(final byte) error {
+    sealed := e.aead.Seal(nil, chunkNonce(e.n), e.buf, chunkAAD(e.header, e.n, final))
+    var head [5]byte
+    head[0] = final
+    binary.BigEndian.PutUint32(head[1:], uint32(len(sealed)))
+    if _, err := e.w.Write(head[:]); err != nil {
+        return err
+    }
+    if _, err := e.w.Write(sealed); err != nil {
+        return err
+    }
+    e.n++
+    e.buf = e.buf[:0]
+    return nil
+}
+
+func (e *encryptWriter) Close() error {
+    return e.seal(1)
+}
+
+type decryptReader struct {
+    r      io.Reader
+    aead   cipher.AEAD
+    keyID  string
+    header []byte
+    n      uint64
+    plain  []byte
+    done   bool
+    err    error // sticky, stream position is lost after an error
+}
+
+// NewDecryptReader reads header from r, which must start with EncryptMagic
+func NewDecryptReader(r io.Reader, k *Keyring) (io.Reader, string, error) {
+    fixed := make([]byte, 6)
+    if _, err := io.ReadFull(r, fixed); err != nil {
+        return nil, "", ErrTruncated
+    }
+    if string(fixed[:4]) != EncryptMagic || fixed[4] != EncryptVersion {
+        return nil, "", fmt.Errorf("%w: bad encryption header", ErrInvalidHeader)
+    }
+
+    rest := make([]byte, int(fixed[5]) + encryptSaltSize)
+    if _, err := io.ReadFull(r, rest); err != nil {
+        return nil, "", ErrTruncated
+    }
+    keyID := string(rest[:fixed[5]])
+    if k == nil {
+        return nil, keyID, ErrNoKeyring
+    }
+
+    aead, err := k.aead(keyID, rest[fixed[5]:])
+    if err != nil {
+        return nil, keyID, err
+    }
+    return &decryptReader{r: r, aead: aead, keyID: keyID, header: append(fixed, rest...)}, keyID, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+    for len(d.plain) == 0 {
+        if d.done {
+            return 0, io.EOF
+        }
+        if d.err != nil {
+            return 0, d.err
+        }
+        d.err = d.open()
+    }
+
+    n := copy(p, d.plain)
+    d.plain = d.plain[n:]
+    return n, nil
+}
+
+func (d *decryptReader) open() error {
+    var head [5]byte
+    if _, err := io.ReadFull(d.r, head[:]); err != nil {
+        // stream must end with a final chunk
+        return ErrTruncated
+    }
+
+    sealedLen := binary.BigEndian.Uint32(head[1:])
+    if head[0] > 1 || sealedLen > encryptChunkSize + uint32(d.aead.Overhead()) {
+        return fmt.Errorf("%w: chunk %d", ErrDecrypt, d.n)
+    }
+
+    sealed := make([]byte, sealedLen)
+    if _, err := io.ReadFull(d.r, sealed); err != nil {
+        return ErrTruncated
+    }
+
+    plain, err := d.aead.Open(sealed[:0], chunkNonce(d.n), sealed, chunkAAD(d.header, d.n, head[0]))
+    if err != nil {
+        return fmt.Errorf("%w: key id [%s] chunk %d", ErrDecrypt, d.keyID, d.n)
+    }
+
+    d.n++
+    d.plain = plain
+    d.done = head[0] == 1
+    if d.done {
+        // the final chunk is authenticated as last, anything after it is not
+        var extra [1]byte
+        if n, _ := d.r.Read(extra[:]); n > 0 {
+            d.plain, d.done = nil, false
+            return fmt.Errorf("%w: data after final chunk %d", ErrDecrypt, d.n - 1)
+        }
+    }
+    return nil
+}
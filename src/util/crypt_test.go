@@ -0,0 +1,159 @@
+package util
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "testing"
+)
+
+func testKeyring(current string, ids ...string) *Keyring {
+    k := &Keyring{current: current, keys: make(map[string][]byte)}
+    for i, id := range ids {
+        k.keys[id] = bytes.Repeat([]byte{byte(i + 1)}, 32)
+    }
+    return k
+}
+
+func encrypt(t *testing.T, k *Keyring, plain []byte) []byte {
+    var buf bytes.Buffer
+    w, err := NewEncryptWriter(&buf, k)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := w.Write(plain); err != nil {
+        t.Fatal(err)
+    }
+    if err := w.Close(); err != nil {
+        t.Fatal(err)
+    }
+    return buf.Bytes()
+}
+
+func decrypt(data []byte, k *Keyring) ([]byte, error) {
+    r, _, err := NewDecryptReader(bytes.NewReader(data), k)
+    if err != nil {
+        return nil, err
+    }
+    return io.ReadAll(r)
+}
+
+// plain spans several chunks plus a partial one
+func testPlain() []byte {
+    plain := make([]byte, 2 * encryptChunkSize + 100)
+    for i := range plain {
+        plain[i] = byte(i * 7)
+    }
+    return plain
+}
+
+func TestCryptRoundTrip(t *testing.T) {
+    k := testKeyring("k1", "k1")
+    for _, plain := range [][]byte{nil, []byte("hello"), testPlain()} {
+        got, err := decrypt(encrypt(t, k, plain), k)
+        if err != nil {
+            t.Fatalf("len %d err[%s]", len(plain), err)
+        }
+        if !bytes.Equal(got, plain) {
+            t.Fatalf("len %d round trip mismatch", len(plain))
+        }
+    }
+}
+
+func TestCryptOldKeyAfterRotate(t *testing.T) {
+    data := encrypt(t, testKeyring("k1", "k1", "k2"), []byte("hello"))
+    r, keyID, err := NewDecryptReader(bytes.NewReader(data), testKeyring("k2", "k1", "k2"))
+    if err != nil || keyID != "k1" {
+        t.Fatalf("keyID[%s] err[%v]", keyID, err)
+    }
+    if got, err := io.ReadAll(r); err != nil || string(got) != "hello" {
+        t.Fatalf("got[%s] err[%v]", got, err)
+    }
+}
+
+func TestCryptSegmentsUseDistinctSalts(t *testing.T) {
+    k := testKeyring("k1", "k1")
+    header := 6 + len("k1")
+    a, b := encrypt(t, k, []byte("same")), encrypt(t, k, []byte("same"))
+    if bytes.Equal(a[header:header + encryptSaltSize], b[header:header + encryptSaltSize]) {
+        t.Fatal("two segments got the same salt")
+    }
+    if bytes.Equal(a[header + encryptSaltSize:], b[header + encryptSaltSize:]) {
+        t.Fatal("same plain sealed to the same chunks under one key")
+    }
+}
+
+func TestCryptWrongKey(t *testing.T) {
+    data := encrypt(t, testKeyring("k1", "k1"), []byte("hello"))
+
+    other := testKeyring("k1", "k1")
+    other.keys["k1"] = bytes.Repeat([]byte{9}, 32)
+    if _, err := decrypt(data, other); !errors.Is(err, ErrDecrypt) {
+        t.Fatalf("wrong key err[%v]", err)
+    }
+    if _, err := decrypt(data, testKeyring("k2", "k2")); !errors.Is(err, ErrKeyNotFound) {
+        t.Fatalf("unknown key err[%v]", err)
+    }
+    if _, err := decrypt(data, nil); !errors.Is(err, ErrNoKeyring) {
+        t.Fatalf("no keyring err[%v]", err)
+    }
+}
+
+func TestCryptTruncated(t *testing.T) {
+    k := testKeyring("k1", "k1")
+    data := encrypt(t, k, testPlain())
+    header := 6 + len("k1") + encryptSaltSize
+    chunk := 5 + encryptChunkSize + 16
+
+    for _, n := range []int{
+        3,                          // in magic
+        header - 1,                 // in salt
+        header + 2,                 // in chunk head
+        header + chunk / 2,         // in chunk data
+        header + chunk,             // whole chunks dropped
+        len(data) - 1,              // in final chunk
+    } {
+        if _, err := decrypt(data[:n], k); err == nil {
+            t.Fatalf("truncated at %d of %d decrypted", n, len(data))
+        }
+    }
+}
+
+func TestCryptTrailingBytes(t *testing.T) {
+    k := testKeyring("k1", "k1")
+    data := encrypt(t, k, []byte("hello"))
+
+    // a whole second segment appended is rejected as well as garbage
+    for _, extra := range [][]byte{{0}, encrypt(t, k, []byte("more"))} {
+        _, err := decrypt(append(append([]byte{}, data...), extra...), k)
+        if !errors.Is(err, ErrDecrypt) {
+            t.Fatalf("trailing %d bytes err[%v]", len(extra), err)
+        }
+    }
+}
+
+func TestCryptTampered(t *testing.T) {
+    k := testKeyring("k1", "k1")
+    data := encrypt(t, k, testPlain())
+    header := 6 + len("k1")
+    for _, i := range []int{header, header + encryptSaltSize + 10, len(data) - 1} {
+        bad := append([]byte{}, data...)
+        bad[i] ^= 1
+        if _, err := decrypt(bad, k); !errors.Is(err, ErrDecrypt) {
+            t.Fatalf("flipped byte %d err[%v]", i, err)
+        }
+    }
+}
+
+// only the salted version is read, any other version is a bad header
+func TestCryptVersion(t *testing.T) {
+    k := testKeyring("k1", "k1")
+    data := encrypt(t, k, []byte("hello"))
+    for _, version := range []byte{0, 1, EncryptVersion + 1} {
+        bad := append([]byte{}, data...)
+        bad[4] = version
+        if _, err := decrypt(bad, k); !errors.Is(err, ErrInvalidHeader) {
+            t.Fatalf("version %d err[%v]", version, err)
+        }
+    }
+}
@@ -5,31 +5,27 @@ import (
     "logger"
     "common"
 
-    sj      "go-simplejson"
     gcom    "github.com/guyannanfei25/go_common"
 )
 
-func InitMisc(ctx *sj.Json) error {
-    if err := common.InitLog(ctx); err != nil {
+func InitMisc(pidFile string, conf *MiscConfig) error {
+    if err := common.InitLog(&conf.Log); err != nil {
         logger.Errorf("InitLog err[%s], please Check!!!\n", err)
         return err;
     }
 
-    pidFile := ctx.Get("main").Get("pid_file").MustString()
     if err := gcom.InitPidFile(pidFile); err != nil {
         logger.Errorf("InitPidFile err[%s]\n", err)
         return err
     }
 
-    maxProc := ctx.Get("runtime").Get("max_proc").MustInt()
-    gcom.InitRunProcs(maxProc)
+    gcom.InitRunProcs(conf.Runtime.MaxProc)
 
-    // gc info
-    // if use mem > max_mem M will force gc
-    max_mem := ctx.Get("gc").Get("max_mem_m").MustInt()
-    // check mem interval seconds
-    check_interval := ctx.Get("gc").Get("check_interval_s").MustInt()
-    go gcom.IntervalGC(max_mem, check_interval)
+    // soft memory limit and governor of buffered msgs
+    initMemory(&conf.Memory, &conf.GC)
+
+    // admin http, metrics exported at /debug/vars
+    StartAdmin(conf.Admin.HTTPAddr)
 
     return nil
 }
@@ -0,0 +1,237 @@
+package util
+
+import (
+    "logger"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "os"
+    "regexp"
+    "sort"
+    "strings"
+)
+
+const (
+    DefaultIDCEnv  = "NSQ_IDC"
+    DefaultIDCFile = "/etc/idc"
+)
+
+// IDCResolver finds the idc of the running host, "" with nil error means
+// the strategy does not apply here
+type IDCResolver interface {
+    Resolve() (string, error)
+    String() string
+}
+
+// IDCResolverConfig is one strategy of lookupd idc_resolver, strategies are
+// tried in order and the first idc found wins:
+//   "idc_resolver": [{"type": "env", "env": "NSQ_IDC"},
+//       {"type": "file", "file": "/etc/idc"},
+//       {"type": "cidr", "cidrs": {"10.1.0.0/16": "idc1"}},
+//       {"type": "hostname", "pattern": "^[^.]+\\.[^.]+\\.([^.]+)"}]
+type IDCResolverConfig struct {
+    Type    string            `json:"type"`    // hostname, env, file or cidr
+    Pattern string            `json:"pattern"` // hostname, idc is the first capture group, default third label
+    Env     string            `json:"env"`     // env, default DefaultIDCEnv
+    File    string            `json:"file"`    // file, default DefaultIDCFile
+    CIDRs   map[string]string `json:"cidrs"`   // cidr, local address -> idc, most specific wins
+}
+
+// third dot-separated label, the old hostname rule
+const defaultHostnamePattern = `^[^.]+\.[^.]+\.([^.]+)`
+
+// NewIDCResolver builds a chain of confs, hostname rule if confs is empty
+func NewIDCResolver(confs []IDCResolverConfig) (IDCResolver, error) {
+    if len(confs) == 0 {
+        confs = []IDCResolverConfig{{Type: "hostname"}}
+    }
+
+    chain := &chainResolver{}
+    for i, conf := range confs {
+        r, err := newResolver(&conf)
+        if err != nil {
+            return nil, fmt.Errorf("idc_resolver[%d] %s", i, err)
+        }
+        chain.resolvers = append(chain.resolvers, r)
+    }
+    if len(chain.resolvers) == 1 {
+        return chain.resolvers[0], nil
+    }
+    return chain, nil
+}
+
+func newResolver(conf *IDCResolverConfig) (IDCResolver, error) {
+    switch conf.Type {
+    case "hostname":
+        pattern := conf.Pattern
+        if pattern == "" {
+            pattern = defaultHostnamePattern
+        }
+        re, err := regexp.Compile(pattern)
+        if err != nil {
+            return nil, fmt.Errorf("pattern[%s] err[%s]", pattern, err)
+        }
+        if re.NumSubexp() < 1 {
+            return nil, fmt.Errorf("pattern[%s] has no capture group", pattern)
+        }
+        return &hostnameResolver{pattern: re}, nil
+    case "env":
+        env := conf.Env
+        if env == "" {
+            env = DefaultIDCEnv
+        }
+        return &envResolver{env: env}, nil
+    case "file":
+        file := conf.File
+        if file == "" {
+            file = DefaultIDCFile
+        }
+        return &fileResolver{file: file}, nil
+    case "cidr":
+        if len(conf.CIDRs) == 0 {
+            return nil, fmt.Errorf("cidr needs cidrs")
+        }
+        r := &cidrResolver{}
+        for cidr, idc := range conf.CIDRs {
+            _, ipNet, err := net.ParseCIDR(cidr)
+            if err != nil {
+                return nil, fmt.Errorf("cidrs[%s] %s", cidr, err)
+            }
+            if idc == "" {
+                return nil, fmt.Errorf("cidrs[%s] empty idc", cidr)
+            }
+            r.nets = append(r.nets, ipNet)
+            r.idcs = append(r.idcs, idc)
+        }
+        return r, nil
+    }
+    return nil, fmt.Errorf("invalid type[%s], want hostname env file or cidr", conf.Type)
+}
+
+type hostnameResolver struct {
+    pattern *regexp.Regexp
+}
+
+func (r *hostnameResolver) Resolve() (string, error) {
+    hostname, err := os.Hostname()
+    if err != nil {
+        return "", err
+    }
+    if m := r.pattern.FindStringSubmatch(hostname); m != nil {
+        return m[1], nil
+    }
+    logger.Debugf("hostname[%s] not match %s\n", hostname, r.pattern)
+    return "", nil
+}
+
+func (r *hostnameResolver) String() string {
+    return fmt.Sprintf("hostname{%s}", r.pattern)
+}
+
+type envResolver struct {
+    env string
+}
+
+func (r *envResolver) Resolve() (string, error) {
+    return strings.TrimSpace(os.Getenv(r.env)), nil
+}
+
+func (r *envResolver) String() string {
+    return fmt.Sprintf("env{%s}", r.env)
+}
+
+// first line of file
+type fileResolver struct {
+    file string
+}
+
+func (r *fileResolver) Resolve() (string, error) {
+    content, err := ioutil.ReadFile(r.file)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return "", nil
+        }
+        return "", err
+    }
+    lines := strings.SplitN(string(content), "\n", 2)
+    return strings.TrimSpace(lines[0]), nil
+}
+
+func (r *fileResolver) String() string {
+    return fmt.Sprintf("file{%s}", r.file)
+}
+
+type cidrResolver struct {
+    nets []*net.IPNet
+    idcs []string
+}
+
+func (r *cidrResolver) Resolve() (string, error) {
+    addrs, err := net.InterfaceAddrs()
+    if err != nil {
+        return "", err
+    }
+    return r.match(addrs), nil
+}
+
+// the longest prefix wins, then the smaller idc so result is stable
+func (r *cidrResolver) match(addrs []net.Addr) string {
+    best, bestOnes := "", -1
+    for _, addr := range addrs {
+        ipNet, ok := addr.(*net.IPNet)
+        if !ok {
+            continue
+        }
+        for i, n := range r.nets {
+            if !n.Contains(ipNet.IP) {
+                continue
+            }
+            ones, _ := n.Mask.Size()
+            if ones > bestOnes || (ones == bestOnes && r.idcs[i] < best) {
+                best, bestOnes = r.idcs[i], ones
+            }
+        }
+    }
+    return best
+}
+
+func (r *cidrResolver) String() string {
+    var cidrs []string
+    for _, n := range r.nets {
+        cidrs = append(cidrs, n.String())
+    }
+    sort.Strings(cidrs)
+    return fmt.Sprintf("cidr{%s}", strings.Join(cidrs, ","))
+}
+
+// chainResolver tries resolvers in order, errors only stop the failed one.
+// If none found an idc, the last error is returned.
+type chainResolver struct {
+    resolvers []IDCResolver
+}
+
+func (r *chainResolver) Resolve() (string, error) {
+    var lastErr error
+    for _, resolver := range r.resolvers {
+        idc, err := resolver.Resolve()
+        if err != nil {
+            logger.Warnf("idc resolver %s err[%s], try next\n", resolver, err)
+            lastErr = err
+            continue
+        }
+        if idc != "" {
+            logger.Infof("idc resolver %s matched\n", resolver)
+            return idc, nil
+        }
+        logger.Debugf("idc resolver %s found nothing, try next\n", resolver)
+    }
+    return "", lastErr
+}
+
+func (r *chainResolver) String() string {
+    var names []string
+    for _, resolver := range r.resolvers {
+        names = append(names, resolver.String())
+    }
+    return "chain{" + strings.Join(names, ",") + "}"
+}
@@ -0,0 +1,122 @@
+package util
+
+import (
+    "errors"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+type stubResolver struct {
+    idc   string
+    err   error
+    calls int
+}
+
+func (r *stubResolver) Resolve() (string, error) {
+    r.calls++
+    return r.idc, r.err
+}
+
+func (r *stubResolver) String() string {
+    return "stub{" + r.idc + "}"
+}
+
+func TestChainResolver(t *testing.T) {
+    errA, errB := errors.New("a failed"), errors.New("b failed")
+    cases := []struct {
+        stubs []*stubResolver
+        idc   string
+        err   error
+        calls int // resolvers tried
+    }{
+        // an error falls through to the next
+        {[]*stubResolver{{err: errA}, {idc: "idc2"}, {idc: "idc3"}}, "idc2", nil, 2},
+        // nothing found falls through too
+        {[]*stubResolver{{}, {err: errA}, {idc: "idc3"}}, "idc3", nil, 3},
+        {[]*stubResolver{{idc: "idc1"}, {err: errA}}, "idc1", nil, 1},
+        // all failing returns the last error
+        {[]*stubResolver{{err: errA}, {}, {err: errB}, {}}, "", errB, 4},
+        {[]*stubResolver{{}, {}}, "", nil, 2},
+    }
+    for i, c := range cases {
+        chain := &chainResolver{}
+        for _, stub := range c.stubs {
+            chain.resolvers = append(chain.resolvers, stub)
+        }
+        idc, err := chain.Resolve()
+        if idc != c.idc || err != c.err {
+            t.Fatalf("case %d: got %s err[%v], want %s err[%v]", i, idc, err, c.idc, c.err)
+        }
+        calls := 0
+        for _, stub := range c.stubs {
+            calls += stub.calls
+        }
+        if calls != c.calls {
+            t.Fatalf("case %d: %d resolvers tried, want %d", i, calls, c.calls)
+        }
+    }
+}
+
+func TestNewIDCResolver(t *testing.T) {
+    dir := t.TempDir()
+    file := filepath.Join(dir, "idc")
+    os.WriteFile(file, []byte(" idc_file \nother\n"), 0644)
+    os.Setenv("NSQ_VCR_TEST_IDC", "")
+
+    r, err := NewIDCResolver([]IDCResolverConfig{
+        {Type: "env", Env: "NSQ_VCR_TEST_IDC"},
+        {Type: "file", File: filepath.Join(dir, "none")},
+        {Type: "file", File: file},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if idc, err := r.Resolve(); idc != "idc_file" || err != nil {
+        t.Fatalf("%s got %s err[%v]", r, idc, err)
+    }
+    os.Setenv("NSQ_VCR_TEST_IDC", "idc_env")
+    defer os.Unsetenv("NSQ_VCR_TEST_IDC")
+    if idc, _ := r.Resolve(); idc != "idc_env" {
+        t.Fatalf("%s got %s", r, idc)
+    }
+
+    for _, confs := range [][]IDCResolverConfig{
+        {{Type: "dns"}},
+        {{Type: "hostname", Pattern: "[a-z]+"}},
+        {{Type: "cidr"}},
+        {{Type: "env"}, {Type: "cidr", CIDRs: map[string]string{"10.0.0.0/33": "x"}}},
+    } {
+        if _, err := NewIDCResolver(confs); err == nil {
+            t.Fatalf("confs %+v got no err", confs)
+        }
+    }
+}
+
+func TestCIDRMatch(t *testing.T) {
+    r, err := newResolver(&IDCResolverConfig{Type: "cidr", CIDRs: map[string]string{
+        "10.0.0.0/8": "wide", "10.1.0.0/16": "idc1", "10.2.0.0/16": "idc2"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := func(s string) net.Addr {
+        ip, n, _ := net.ParseCIDR(s)
+        return &net.IPNet{IP: ip, Mask: n.Mask}
+    }
+    cases := []struct {
+        addrs []net.Addr
+        want  string
+    }{
+        {[]net.Addr{addr("10.1.2.3/24")}, "idc1"},
+        {[]net.Addr{addr("10.9.2.3/24")}, "wide"},
+        {[]net.Addr{addr("127.0.0.1/8"), addr("10.9.0.1/24"), addr("10.2.0.1/24")}, "idc2"},
+        {[]net.Addr{addr("10.2.0.1/24"), addr("10.1.0.1/24")}, "idc1"},
+        {[]net.Addr{addr("192.168.0.1/24")}, ""},
+    }
+    for i, c := range cases {
+        if got := r.(*cidrResolver).match(c.addrs); got != c.want {
+            t.Fatalf("case %d: got %s, want %s", i, got, c.want)
+        }
+    }
+}
@@ -0,0 +1,129 @@
+package util
+
+import (
+    "io"
+    "bytes"
+    "errors"
+    "strconv"
+    "strings"
+    "encoding/json"
+)
+
+// json field path is dot separated, array elements are addressed by
+// index, e.g. "user.email" or "items.0.id"
+func SplitPath(path string) []string {
+    return strings.Split(path, ".")
+}
+
+// DecodeJSON keeps numbers as json.Number so they are written back unchanged
+func DecodeJSON(body []byte) (interface{}, error) {
+    dec := json.NewDecoder(bytes.NewReader(body))
+    dec.UseNumber()
+    var doc interface{}
+    if err := dec.Decode(&doc); err != nil {
+        return nil, err
+    }
+    if _, err := dec.Token(); err != io.EOF {
+        return nil, errors.New("invalid json: trailing data")
+    }
+    return doc, nil
+}
+
+// EncodeJSON is json.Marshal without html escaping, so untouched
+// strings keep their original form
+func EncodeJSON(doc interface{}) ([]byte, error) {
+    var buf bytes.Buffer
+    enc := json.NewEncoder(&buf)
+    enc.SetEscapeHTML(false)
+    if err := enc.Encode(doc); err != nil {
+        return nil, err
+    }
+    return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func child(node interface{}, key string) (interface{}, bool) {
+    switch n := node.(type) {
+    case map[string]interface{}:
+        v, ok := n[key]
+        return v, ok
+    case []interface{}:
+        idx, err := strconv.Atoi(key)
+        if err != nil || idx < 0 || idx >= len(n) {
+            return nil, false
+        }
+        return n[idx], true
+    }
+    return nil, false
+}
+
+func JSONGet(doc interface{}, path []string) (interface{}, bool) {
+    node := doc
+    for _, key := range path {
+        var ok bool
+        if node, ok = child(node, key); !ok {
+            return nil, false
+        }
+    }
+    return node, true
+}
+
+// JSONSet replaces value of an existing field or adds a key to an
+// existing object, parent must exist
+func JSONSet(doc interface{}, path []string, v interface{}) bool {
+    if len(path) == 0 {
+        return false
+    }
+    parent, ok := JSONGet(doc, path[:len(path) - 1])
+    if !ok {
+        return false
+    }
+
+    key := path[len(path) - 1]
+    switch p := parent.(type) {
+    case map[string]interface{}:
+        p[key] = v
+        return true
+    case []interface{}:
+        idx, err := strconv.Atoi(key)
+        if err != nil || idx < 0 || idx >= len(p) {
+            return false
+        }
+        p[idx] = v
+        return true
+    }
+    return false
+}
+
+// JSONDelete removes a field of an object, array elements are set to null
+func JSONDelete(doc interface{}, path []string) bool {
+    if len(path) == 0 {
+        return false
+    }
+    parent, ok := JSONGet(doc, path[:len(path) - 1])
+    if !ok {
+        return false
+    }
+
+    key := path[len(path) - 1]
+    switch p := parent.(type) {
+    case map[string]interface{}:
+        if _, ok := p[key]; !ok {
+            return false
+        }
+        delete(p, key)
+        return true
+    case []interface{}:
+        return JSONSet(doc, path, nil)
+    }
+    return false
+}
+
+// JSONString is the text form of a value used for matching and hashing,
+// strings without quotes, others as json
+func JSONString(v interface{}) string {
+    if s, ok := v.(string); ok {
+        return s
+    }
+    b, _ := json.Marshal(v)
+    return string(b)
+}
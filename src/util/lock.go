@@ -0,0 +1,61 @@
+package util
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "syscall"
+)
+
+var ErrSegmentLocked = errors.New("segment is locked by another reader")
+
+// SegmentLock keeps play and compaction off the same segment. Play holds
+// a shared lock from opening a segment until it is moved to done,
+// compaction holds exclusive locks on its inputs until they are removed.
+// Locks are flock(2) advisory locks, released if the process dies.
+type SegmentLock struct {
+    fp *os.File
+}
+
+// LockSegment locks path, shared waits for an exclusive holder, exclusive
+// never waits and fails with ErrSegmentLocked. A segment moved or removed
+// meanwhile fails with an os.ErrNotExist error, it is not at path anymore.
+func LockSegment(path string, exclusive bool) (*SegmentLock, error) {
+    fp, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+
+    how := syscall.LOCK_SH
+    if exclusive {
+        how = syscall.LOCK_EX | syscall.LOCK_NB
+    }
+    if err := syscall.Flock(int(fp.Fd()), how); err != nil {
+        fp.Close()
+        if err == syscall.EWOULDBLOCK {
+            return nil, fmt.Errorf("%w: [%s]", ErrSegmentLocked, path)
+        }
+        return nil, fmt.Errorf("lock segment[%s] err[%s]", path, err)
+    }
+
+    // the holder before us may have moved it to done or merged it
+    locked, err := fp.Stat()
+    if err == nil {
+        var current os.FileInfo
+        if current, err = os.Stat(path); err == nil && !os.SameFile(locked, current) {
+            err = &os.PathError{Op: "lock", Path: path, Err: os.ErrNotExist}
+        }
+    }
+    if err != nil {
+        fp.Close()
+        return nil, err
+    }
+    return &SegmentLock{fp: fp}, nil
+}
+
+// Unlock releases the lock, closing the file releases it
+func (l *SegmentLock) Unlock() {
+    if l != nil {
+        l.fp.Close()
+    }
+}
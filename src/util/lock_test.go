@@ -0,0 +1,77 @@
+package util
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestLockSegment(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "a_1")
+    os.WriteFile(path, []byte("x"), 0644)
+
+    // readers share, compaction is refused while any reads
+    a, err := LockSegment(path, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    b, err := LockSegment(path, false)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := LockSegment(path, true); !errors.Is(err, ErrSegmentLocked) {
+        t.Fatalf("exclusive while shared err[%v]", err)
+    }
+    a.Unlock()
+    if _, err := LockSegment(path, true); !errors.Is(err, ErrSegmentLocked) {
+        t.Fatalf("exclusive while shared err[%v]", err)
+    }
+    b.Unlock()
+
+    ex, err := LockSegment(path, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := LockSegment(path, true); !errors.Is(err, ErrSegmentLocked) {
+        t.Fatalf("exclusive twice err[%v]", err)
+    }
+    ex.Unlock()
+
+    if _, err := LockSegment(path + ".none", false); !os.IsNotExist(err) {
+        t.Fatalf("missing segment err[%v]", err)
+    }
+}
+
+// a reader waiting for compaction finds the segment merged away
+func TestLockSegmentGoneWhileWaiting(t *testing.T) {
+    dir := t.TempDir()
+    path := filepath.Join(dir, "a_1")
+    os.WriteFile(path, []byte("x"), 0644)
+
+    ex, err := LockSegment(path, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    done := make(chan error)
+    go func() {
+        lock, err := LockSegment(path, false)
+        lock.Unlock()
+        done <- err
+    }()
+
+    select {
+    case err := <- done:
+        t.Fatalf("shared lock not blocked, err[%v]", err)
+    case <- time.After(50 * time.Millisecond):
+    }
+    // merged, and another file took the name
+    os.Remove(path)
+    os.WriteFile(path, []byte("y"), 0644)
+    ex.Unlock()
+
+    if err := <- done; !os.IsNotExist(err) {
+        t.Fatalf("replaced segment err[%v]", err)
+    }
+}
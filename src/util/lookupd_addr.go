@@ -3,11 +3,8 @@ package util
 import (
 	"common"
 	"logger"
-	"os"
-	"strings"
-    "fmt"
-
-	sj "go-simplejson"
+	"sort"
+	"fmt"
 )
 
 const (
@@ -16,54 +13,138 @@ const (
 	IDCSpecified        // use some specified idc
 )
 
-// return lookupds due to different category
-func GetLookupdAddrs(ctx *sj.Json) ([]string, error) {
-	var lookupdAddrs []string
-	lookupdConf := ctx.Get("main").Get("nsq").Get("lookupd_conf").MustString("/tmp/data/nsqlog/nsq.json")
-	category := ctx.Get("main").Get("nsq").Get("lookupd_category").MustInt(0)
-	idc := ctx.Get("main").Get("nsq").Get("idc_specified").MustString()
+// AllIDCs in idcs means every lookupd section of nsq.json except global
+const AllIDCs = "all"
 
-	lookupdJson, err := common.ReadConf(lookupdConf)
-	if err != nil {
-		logger.Errorf("Get Lookupd addr err[%s]\n", err)
-		return nil, err
+const DefaultNSQConf = "/tmp/data/nsqlog/nsq.json"
+
+// nsq.json sections, keyed by idc
+const (
+	lookupdSections = "nsqloopupd_address"
+	nsqdSections    = "nsqd_address"
+)
+
+func nsqConfPath(path string) string {
+	if path == "" {
+		return DefaultNSQConf
 	}
+	return path
+}
 
+// idc section due to different category
+func (c *LookupdConfig) section() (string, error) {
 	var idcSection string
-	switch category {
+	switch c.LookupdCategory {
 	case IDCFromHost:
-		idcSection = GetIDCFromHost()
+		resolver, err := NewIDCResolver(c.IDCResolver)
+		if err != nil {
+			return "", err
+		}
+		if idcSection, err = resolver.Resolve(); err != nil {
+			return "", fmt.Errorf("idc resolver %s err[%s]", resolver, err)
+		}
+		logger.Infof("idc resolver %s got idc[%s]\n", resolver, idcSection)
 	case GLOBAL:
 		idcSection = "global"
 	case IDCSpecified:
-		idcSection = idc
+		idcSection = c.IDCSpecified
 	}
 
 	if idcSection == "" {
-		logger.Errorf("lookupd conf[%s], idc category[%d], but get idc empty", lookupdConf, category)
-		return nil, fmt.Errorf("lookupd conf[%s], idc category[%d], but get idc empty", lookupdConf, category)
+		return "", fmt.Errorf("lookupd conf[%s], idc category[%d], but get idc empty",
+			nsqConfPath(c.LookupdConf), c.LookupdCategory)
 	}
+	return idcSection, nil
+}
 
-	lookupdAddrs = lookupdJson.Get("nsqloopupd_address").Get(idcSection).MustStringArray()
-	logger.Debugf("Get lookupd addr[%v] from conf[%s], lookupd idc is [%s]",
-		lookupdAddrs, lookupdConf, idcSection)
+// return lookupds due to different category
+func GetLookupdAddrs(conf *LookupdConfig) ([]string, error) {
+	idcSection, err := conf.section()
+	if err != nil {
+		logger.Errorf("%s\n", err)
+		return nil, err
+	}
+	return readSection(nsqConfPath(conf.LookupdConf), lookupdSections, idcSection)
+}
 
-	return lookupdAddrs, nil
+// GetClusterAddrs returns addrs in section name(nsqloopupd_address or
+// nsqd_address) of every cluster to consume keyed by idc, one cluster of
+// lookupd_category if idcs is not set
+func GetClusterAddrs(conf *LookupdConfig, name string) (map[string][]string, error) {
+	lookupdConf := nsqConfPath(conf.LookupdConf)
+	idcs := conf.IDCs
+	if len(idcs) == 0 {
+		idcSection, err := conf.section()
+		if err != nil {
+			return nil, err
+		}
+		idcs = []string{idcSection}
+	} else if len(idcs) == 1 && idcs[0] == AllIDCs {
+		var err error
+		if idcs, err = allSections(lookupdConf, name); err != nil {
+			return nil, err
+		}
+	}
+
+	ret := make(map[string][]string)
+	for _, idc := range idcs {
+		addrs, err := readSection(lookupdConf, name, idc)
+		if err != nil {
+			return nil, err
+		}
+		ret[idc] = addrs
+	}
+	return ret, nil
 }
 
-func GetIDCFromHost() string {
-	hostname, err := os.Hostname()
+// GetNSQDAddrs returns nsqd of an idc from nsqd_address of nsq.json
+func GetNSQDAddrs(nsqConf, idc string) ([]string, error) {
+	return readSection(nsqConfPath(nsqConf), nsqdSections, idc)
+}
+
+func readSection(nsqConf, name, idc string) ([]string, error) {
+	nsqJson, err := common.ReadConf(nsqConf)
 	if err != nil {
-		logger.Errorf("Get machine Hostname err[%s]\n", err)
-		return ""
+		logger.Errorf("Get %s err[%s]\n", name, err)
+		return nil, err
 	}
 
-	fields := strings.Split(hostname, ".")
-	if len(fields) < 3 {
-		logger.Errorf("hostname[%s] Split by . fields[%v] < 3\n", hostname, fields)
+	addrs := nsqJson.Get(name).Get(idc).MustStringArray()
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("conf[%s] has no %s of idc[%s]", nsqConf, name, idc)
+	}
+	logger.Debugf("Get %s[%v] from conf[%s], idc is [%s]\n", name, addrs, nsqConf, idc)
+	return addrs, nil
+}
+
+func allSections(nsqConf, name string) ([]string, error) {
+	nsqJson, err := common.ReadConf(nsqConf)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	for idc := range nsqJson.Get(name).MustMap() {
+		if idc != "global" {
+			ret = append(ret, idc)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("conf[%s] has no idc in %s", nsqConf, name)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// idc by the default hostname rule, third dot-separated label
+func GetIDCFromHost() string {
+	resolver, _ := NewIDCResolver(nil)
+	idc, err := resolver.Resolve()
+	if err != nil {
+		logger.Errorf("Get machine Hostname err[%s]\n", err)
 		return ""
 	}
 
-	logger.Debugf("Get From hostname[%s] idc[%s]\n", hostname, fields[2])
-	return fields[2]
+	logger.Debugf("Get idc[%s] by %s\n", idc, resolver)
+	return idc
 }
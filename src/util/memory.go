@@ -0,0 +1,241 @@
+package util
+
+import (
+    "common"
+    "logger"
+    "expvar"
+    "fmt"
+    "runtime/debug"
+    "runtime/metrics"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// memory levels, intake is cut down as level goes up
+const (
+    MemNormal    = iota
+    MemThrottled // usage above high_percent, consumers take less
+    MemPaused    // usage above budget, intake stops
+)
+
+var memLevelNames = []string{"normal", "throttled", "paused"}
+
+// MemoryConfig is memory conf section:
+//   "memory": {"limit_m": 700, "budget_m": 256, "high_percent": 80,
+//       "low_percent": 50, "check_interval_ms": 200}
+// limit_m is the go runtime soft memory limit, the governor watches heap
+// against it and buffered msg bytes against budget_m
+type MemoryConfig struct {
+    LimitM          int `json:"limit_m"`           // 0 means gc.max_mem_m, both 0 no limit
+    BudgetM         int `json:"budget_m"`          // buffered msg bytes, 0 not watched
+    HighPercent     int `json:"high_percent"`      // throttle above, default 80
+    LowPercent      int `json:"low_percent"`       // restore below, default 50
+    CheckIntervalMS int `json:"check_interval_ms"` // default 200
+}
+
+func (c *MemoryConfig) Check(path string, e *common.ConfigError) {
+    if c.LimitM < 0 {
+        e.Add(path + ".limit_m", "must not be negative")
+    }
+    if c.BudgetM < 0 {
+        e.Add(path + ".budget_m", "must not be negative")
+    }
+    if c.HighPercent <= 0 || c.HighPercent > 100 {
+        e.Add(path + ".high_percent", "must be in (0, 100]")
+    }
+    if c.LowPercent <= 0 || c.LowPercent >= c.HighPercent {
+        e.Add(path + ".low_percent", "must be positive and less than high_percent")
+    }
+    if c.CheckIntervalMS <= 0 {
+        e.Add(path + ".check_interval_ms", "must be positive")
+    }
+}
+
+// governor of the process, nil if memory is not watched
+var memGovernor *governor
+
+type governor struct {
+    limit    int64 // soft memory limit in bytes, 0 none
+    budget   int64 // buffered bytes, 0 none
+    high     int   // percent
+    low      int
+    interval time.Duration
+
+    buffered int64 // atomic
+
+    mu        sync.Mutex
+    level     int
+    resume    chan struct{} // closed when level goes below paused
+    listeners []func(level int)
+
+    sample   []metrics.Sample
+    levelVar expvar.Int
+    bufVar   expvar.Int
+}
+
+// initMemory sets the soft memory limit and starts the governor, memory
+// above the limit makes go gc harder instead of forced gc every interval
+func initMemory(conf *MemoryConfig, gc *GCConfig) {
+    limitM := conf.LimitM
+    if limitM == 0 {
+        limitM = gc.MaxMemM
+    }
+    g := &governor{
+        limit: int64(limitM) * 1024 * 1024,
+        budget: int64(conf.BudgetM) * 1024 * 1024,
+        high: conf.HighPercent,
+        low: conf.LowPercent,
+        interval: time.Duration(conf.CheckIntervalMS) * time.Millisecond,
+        resume: make(chan struct{}),
+        sample: []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}},
+    }
+    close(g.resume)
+
+    if g.limit > 0 {
+        debug.SetMemoryLimit(g.limit)
+    }
+    if g.limit == 0 && g.budget == 0 {
+        logger.Infof("memory governor disabled, no limit_m nor budget_m\n")
+        return
+    }
+
+    stats.Set("memory_level", &g.levelVar)
+    stats.Set("memory_buffered_bytes", &g.bufVar)
+    logger.Infof("%s start\n", g)
+    memGovernor = g
+    go g.process()
+}
+
+func (g *governor) String() string {
+    return fmt.Sprintf("memory governor{limit[%d] budget[%d] high[%d%%] low[%d%%]}",
+    g.limit, g.budget, g.high, g.low)
+}
+
+func (g *governor) process() {
+    ticker := time.NewTicker(g.interval)
+    defer ticker.Stop()
+    for range ticker.C {
+        g.check()
+    }
+}
+
+// usage percent of the fuller one of heap and buffer
+func (g *governor) usage() int64 {
+    buffered := atomic.LoadInt64(&g.buffered)
+    g.bufVar.Set(buffered)
+
+    var usage int64
+    if g.budget > 0 {
+        usage = buffered * 100 / g.budget
+    }
+    if g.limit > 0 {
+        metrics.Read(g.sample)
+        if g.sample[0].Value.Kind() == metrics.KindUint64 {
+            heap := int64(g.sample[0].Value.Uint64())
+            if u := heap * 100 / g.limit; u > usage {
+                usage = u
+            }
+        }
+    }
+    return usage
+}
+
+// level goes up as soon as usage passes a mark, and back to normal only
+// below low_percent, so intake does not flap around high_percent
+func (g *governor) check() {
+    usage := g.usage()
+
+    g.mu.Lock()
+    level := g.level
+    switch {
+    case usage >= 100:
+        level = MemPaused
+    case usage >= int64(g.high):
+        if level < MemThrottled {
+            level = MemThrottled
+        }
+    case usage < int64(g.low):
+        level = MemNormal
+    }
+    if level == g.level {
+        g.mu.Unlock()
+        return
+    }
+
+    logger.Infof("%s usage[%d%%] level %s -> %s\n", g, usage,
+    memLevelNames[g.level], memLevelNames[level])
+    if level == MemPaused {
+        g.resume = make(chan struct{})
+    } else if g.level == MemPaused {
+        close(g.resume)
+    }
+    g.level = level
+    listeners := g.listeners
+    g.mu.Unlock()
+
+    g.levelVar.Set(int64(level))
+    IncrStat("memory_" + memLevelNames[level], 1)
+    for _, f := range listeners {
+        f(level)
+    }
+}
+
+// AddBuffered counts n bytes of msgs held in memory, negative when released
+func AddBuffered(n int64) {
+    if memGovernor != nil {
+        atomic.AddInt64(&memGovernor.buffered, n)
+    }
+}
+
+// OnMemLevel calls f with the current level and then on every change
+func OnMemLevel(f func(level int)) {
+    g := memGovernor
+    if g == nil {
+        return
+    }
+
+    g.mu.Lock()
+    g.listeners = append(g.listeners, f)
+    level := g.level
+    g.mu.Unlock()
+    f(level)
+}
+
+// MemLevel is the current level, MemNormal if memory is not watched
+func MemLevel() int {
+    g := memGovernor
+    if g == nil {
+        return MemNormal
+    }
+
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    return g.level
+}
+
+// WaitMemory blocks while memory is paused, false if notified. Throttled
+// callers go on and slow down by MemLevel themselves.
+func WaitMemory(notify chan bool) bool {
+    g := memGovernor
+    if g == nil {
+        return true
+    }
+
+    g.mu.Lock()
+    resume := g.resume
+    g.mu.Unlock()
+
+    select {
+    case <- resume:
+        return true
+    default:
+    }
+    logger.Debugf("%s wait for memory\n", g)
+    select {
+    case <- resume:
+        return true
+    case <- notify:
+        return false
+    }
+}
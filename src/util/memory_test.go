@@ -0,0 +1,117 @@
+package util
+
+import (
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func testGovernor() *governor {
+    g := &governor{budget: 1000, high: 80, low: 50, resume: make(chan struct{})}
+    close(g.resume)
+    return g
+}
+
+func TestGovernorHysteresis(t *testing.T) {
+    g := testGovernor()
+    var changes []int
+    g.listeners = append(g.listeners, func(level int) { changes = append(changes, level) })
+
+    for _, step := range []struct {
+        buffered int64
+        want     int
+    }{
+        {100, MemNormal},
+        {790, MemNormal},
+        {800, MemThrottled},
+        {600, MemThrottled}, // between low and high, no flapping
+        {1000, MemPaused},
+        {850, MemPaused},    // above high is not enough to leave paused
+        {500, MemPaused},
+        {499, MemNormal},
+        {900, MemThrottled},
+        {200, MemNormal},
+    } {
+        atomic.StoreInt64(&g.buffered, step.buffered)
+        g.check()
+        if g.level != step.want {
+            t.Fatalf("buffered %d level %s, want %s", step.buffered, memLevelNames[g.level], memLevelNames[step.want])
+        }
+    }
+
+    want := []int{MemThrottled, MemPaused, MemNormal, MemThrottled, MemNormal}
+    if len(changes) != len(want) {
+        t.Fatalf("listeners got %v, want %v", changes, want)
+    }
+    for i := range want {
+        if changes[i] != want[i] {
+            t.Fatalf("listeners got %v, want %v", changes, want)
+        }
+    }
+}
+
+func TestWaitMemory(t *testing.T) {
+    g := testGovernor()
+    memGovernor = g
+    defer func() { memGovernor = nil }()
+
+    notify := make(chan bool)
+    if !WaitMemory(notify) {
+        t.Fatal("normal level blocked")
+    }
+
+    AddBuffered(900)
+    g.check()
+    if !WaitMemory(notify) || MemLevel() != MemThrottled {
+        t.Fatalf("throttled level %d blocked", MemLevel())
+    }
+
+    AddBuffered(100)
+    g.check()
+    done := make(chan bool)
+    go func() { done <- WaitMemory(notify) }()
+    select {
+    case <- done:
+        t.Fatal("paused level did not block")
+    case <- time.After(50 * time.Millisecond):
+    }
+
+    AddBuffered(-600)
+    g.check()
+    select {
+    case ok := <- done:
+        if !ok {
+            t.Fatal("resumed wait returned false")
+        }
+    case <- time.After(time.Second):
+        t.Fatal("leaving paused did not resume waiters")
+    }
+
+    AddBuffered(600)
+    g.check()
+    if MemLevel() != MemPaused {
+        t.Fatalf("level %d, want paused", MemLevel())
+    }
+    go func() { done <- WaitMemory(notify) }()
+    close(notify)
+    if <- done {
+        t.Fatal("notified wait returned true")
+    }
+}
+
+func TestOnMemLevel(t *testing.T) {
+    OnMemLevel(func(int) { t.Fatal("called without governor") })
+
+    g := testGovernor()
+    g.level = MemThrottled
+    memGovernor = g
+    defer func() { memGovernor = nil }()
+
+    var got []int
+    OnMemLevel(func(level int) { got = append(got, level) })
+    atomic.StoreInt64(&g.buffered, 0)
+    g.check()
+    if len(got) != 2 || got[0] != MemThrottled || got[1] != MemNormal {
+        t.Fatalf("levels %v", got)
+    }
+}
@@ -0,0 +1,18 @@
+package util
+
+import (
+    "testing"
+)
+
+// a play msg from read to publish, body and msg both come from pools
+func BenchmarkMessage(b *testing.B) {
+    b.ReportAllocs()
+    for i := 0; i < b.N; i++ {
+        buf := GetBuffer(512)
+        msg := NewMessage("t", buf.B, buf)
+        if len(msg.RawBytes()) != 512 {
+            b.Fatal("bad body")
+        }
+        msg.Release()
+    }
+}
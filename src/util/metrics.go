@@ -0,0 +1,67 @@
+package util
+
+import (
+    "logger"
+    "expvar"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// all counters live under one expvar map, so they can be fetched
+// from http://admin_addr/debug/vars
+var stats = expvar.NewMap("nsq_vcr")
+
+func IncrStat(name string, delta int64) {
+    stats.Add(name, delta)
+}
+
+// admin http handlers by exact path, registering a path again replaces
+// its handler so components built twice never panic like
+// http.DefaultServeMux does
+var admin = &adminMux{handlers: map[string]http.Handler{"/debug/vars": expvar.Handler()}}
+
+type adminMux struct {
+    mu       sync.RWMutex
+    handlers map[string]http.Handler
+}
+
+func (m *adminMux) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+    m.mu.RLock()
+    h, ok := m.handlers[req.URL.Path]
+    m.mu.RUnlock()
+    if !ok {
+        http.NotFound(w, req)
+        return
+    }
+    h.ServeHTTP(w, req)
+}
+
+// HandleAdmin registers handler of path on the admin http server
+func HandleAdmin(path string, handler http.Handler) {
+    admin.mu.Lock()
+    admin.handlers[path] = handler
+    admin.mu.Unlock()
+}
+
+// StartAdmin serves expvar and handlers registered by HandleAdmin,
+// empty addr means disabled
+func StartAdmin(addr string) {
+    if addr == "" {
+        return
+    }
+
+    go func() {
+        logger.Debugf("Admin http server listen on[%s]\n", addr)
+        if err := http.ListenAndServe(addr, admin); err != nil {
+            logger.Errorf("Admin http server[%s] err[%s]\n", addr, err)
+        }
+    }()
+}
+
+// ObserveStat adds a latency sample as name_count and name_us, the
+// average is name_us / name_count
+func ObserveStat(name string, d time.Duration) {
+    stats.Add(name + "_count", 1)
+    stats.Add(name + "_us", int64(d / time.Microsecond))
+}
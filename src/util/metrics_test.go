@@ -0,0 +1,33 @@
+package util
+
+import (
+    "testing"
+    "net/http"
+    "net/http/httptest"
+)
+
+func adminGet(path string) *httptest.ResponseRecorder {
+    w := httptest.NewRecorder()
+    admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+    return w
+}
+
+func TestHandleAdmin(t *testing.T) {
+    for _, body := range []string{"first", "second"} {
+        body := body
+        HandleAdmin("/test/admin", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+            w.Write([]byte(body))
+        }))
+        if got := adminGet("/test/admin").Body.String(); got != body {
+            t.Fatalf("got %s, want %s", got, body)
+        }
+    }
+
+    IncrStat("test_admin", 1)
+    if w := adminGet("/debug/vars"); w.Code != http.StatusOK {
+        t.Fatalf("/debug/vars got %d", w.Code)
+    }
+    if w := adminGet("/test/none"); w.Code != http.StatusNotFound {
+        t.Fatalf("unknown path got %d", w.Code)
+    }
+}
@@ -0,0 +1,164 @@
+package util
+
+import (
+    "common"
+    "fmt"
+    "io/ioutil"
+    "time"
+    "crypto/tls"
+    "crypto/x509"
+
+    nsq      "github.com/nsqio/go-nsq"
+)
+
+// NSQClientConfig is options of nsq connections, shared by record
+// consumers and play producers:
+//   "client": {"tls": {"enable": true, "cert_file": "", "key_file": "", "ca_file": "",
+//       "insecure_skip_verify": false, "server_name": "", "min_version": "tls1.2"},
+//       "auth_secret": "", "snappy": false, "deflate": false, "deflate_level": 6,
+//       "client_id": "", "hostname": "", "user_agent": "",
+//       "heartbeat_interval_ms": 30000, "msg_timeout_ms": 0}
+// zero values keep go-nsq defaults
+type NSQClientConfig struct {
+    TLS                 NSQTLSConfig `json:"tls"`
+    AuthSecret          string       `json:"auth_secret"`
+    Snappy              bool         `json:"snappy"`
+    Deflate             bool         `json:"deflate"`
+    DeflateLevel        int          `json:"deflate_level"` // 1-9, default 6
+    ClientID            string       `json:"client_id"`     // default short hostname
+    Hostname            string       `json:"hostname"`
+    UserAgent           string       `json:"user_agent"`
+    HeartbeatIntervalMS int          `json:"heartbeat_interval_ms"` // default 30000, -1 disables
+    MsgTimeoutMS        int          `json:"msg_timeout_ms"`        // default nsqd msg timeout
+}
+
+type NSQTLSConfig struct {
+    Enable             bool   `json:"enable"`
+    CertFile           string `json:"cert_file"` // client cert, with key_file
+    KeyFile            string `json:"key_file"`
+    CAFile             string `json:"ca_file"`   // default system roots
+    InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+    ServerName         string `json:"server_name"`
+    MinVersion         string `json:"min_version"` // tls1.0 tls1.1 tls1.2 or tls1.3, default tls1.2
+}
+
+var tlsVersions = map[string]uint16{
+    "tls1.0": tls.VersionTLS10,
+    "tls1.1": tls.VersionTLS11,
+    "tls1.2": tls.VersionTLS12,
+    "tls1.3": tls.VersionTLS13,
+}
+
+// Check builds the options, so unreadable tls material is reported here
+func (c *NSQClientConfig) Check(path string, e *common.ConfigError) {
+    problems := len(e.Problems)
+    if c.Snappy && c.Deflate {
+        e.Add(path, "snappy and deflate are exclusive")
+    }
+    if c.DeflateLevel < 0 || c.DeflateLevel > 9 {
+        e.Add(path + ".deflate_level", "must be 1-9")
+    }
+    if c.HeartbeatIntervalMS < -1 {
+        e.Add(path + ".heartbeat_interval_ms", "must be -1, 0 or positive")
+    }
+    if c.MsgTimeoutMS < 0 {
+        e.Add(path + ".msg_timeout_ms", "must not be negative")
+    }
+    if c.TLS.Enable {
+        if _, err := c.TLS.load(); err != nil {
+            e.Add(path + ".tls", "%s", err)
+            return
+        }
+    }
+    // go-nsq would report the same options again
+    if len(e.Problems) > problems {
+        return
+    }
+    if _, err := c.NewConfig(); err != nil {
+        e.Add(path, "%s", err)
+    }
+}
+
+// NewConfig returns go-nsq config of the options, nil conf means defaults
+func (c *NSQClientConfig) NewConfig() (*nsq.Config, error) {
+    config := nsq.NewConfig()
+    if c == nil {
+        return config, nil
+    }
+
+    if c.TLS.Enable {
+        tlsConfig, err := c.TLS.load()
+        if err != nil {
+            return nil, err
+        }
+        config.TlsV1 = true
+        config.TlsConfig = tlsConfig
+    }
+
+    config.AuthSecret = c.AuthSecret
+    config.Snappy = c.Snappy
+    config.Deflate = c.Deflate
+    if c.DeflateLevel != 0 {
+        config.DeflateLevel = c.DeflateLevel
+    }
+    if c.ClientID != "" {
+        config.ClientID = c.ClientID
+    }
+    if c.Hostname != "" {
+        config.Hostname = c.Hostname
+    }
+    if c.UserAgent != "" {
+        config.UserAgent = c.UserAgent
+    }
+    if c.HeartbeatIntervalMS != 0 {
+        config.HeartbeatInterval = time.Duration(c.HeartbeatIntervalMS) * time.Millisecond
+    }
+    if c.MsgTimeoutMS != 0 {
+        config.MsgTimeout = time.Duration(c.MsgTimeoutMS) * time.Millisecond
+    }
+
+    if err := config.Validate(); err != nil {
+        return nil, err
+    }
+    return config, nil
+}
+
+func (c *NSQTLSConfig) load() (*tls.Config, error) {
+    tlsConfig := &tls.Config{
+        InsecureSkipVerify: c.InsecureSkipVerify,
+        ServerName: c.ServerName,
+        MinVersion: tls.VersionTLS12,
+    }
+
+    if c.MinVersion != "" {
+        version, ok := tlsVersions[c.MinVersion]
+        if !ok {
+            return nil, fmt.Errorf("invalid min_version[%s], want tls1.0 tls1.1 tls1.2 or tls1.3", c.MinVersion)
+        }
+        tlsConfig.MinVersion = version
+    }
+
+    if (c.CertFile == "") != (c.KeyFile == "") {
+        return nil, fmt.Errorf("cert_file and key_file must be set together")
+    }
+    if c.CertFile != "" {
+        cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+        if err != nil {
+            return nil, fmt.Errorf("load cert_file[%s] key_file[%s] err[%s]", c.CertFile, c.KeyFile, err)
+        }
+        tlsConfig.Certificates = []tls.Certificate{cert}
+    }
+
+    if c.CAFile != "" {
+        pem, err := ioutil.ReadFile(c.CAFile)
+        if err != nil {
+            return nil, fmt.Errorf("read ca_file[%s] err[%s]", c.CAFile, err)
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("ca_file[%s] has no pem certificate", c.CAFile)
+        }
+        tlsConfig.RootCAs = pool
+    }
+    return tlsConfig, nil
+}
@@ -0,0 +1,141 @@
+package util
+
+import (
+    "common"
+    "math/big"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/pem"
+)
+
+// writeCert writes a self signed cert and its key, the cert is also a ca
+func writeCert(t *testing.T, dir string) (string, string) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tmpl := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        NotBefore: time.Now().Add(-time.Hour),
+        NotAfter: time.Now().Add(time.Hour),
+        IsCA: true,
+        BasicConstraintsValid: true,
+        DNSNames: []string{"nsqd.test"},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    keyDer, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+    os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+    os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+    return certFile, keyFile
+}
+
+// every bad option fails at conf check, not at first connect
+func TestNSQClientCheck(t *testing.T) {
+    dir := t.TempDir()
+    certFile, keyFile := writeCert(t, dir)
+    garbage := filepath.Join(dir, "garbage.pem")
+    os.WriteFile(garbage, []byte("not a pem"), 0600)
+
+    cases := []struct {
+        conf NSQClientConfig
+        path string
+        want string
+    }{
+        {NSQClientConfig{Snappy: true, Deflate: true}, "client", "exclusive"},
+        {NSQClientConfig{HeartbeatIntervalMS: -2}, "client.heartbeat_interval_ms", "-1, 0 or positive"},
+        {NSQClientConfig{MsgTimeoutMS: -1}, "client.msg_timeout_ms", "negative"},
+        {NSQClientConfig{Deflate: true, DeflateLevel: 10}, "client.deflate_level", "1-9"},
+        {NSQClientConfig{TLS: NSQTLSConfig{Enable: true, MinVersion: "ssl3"}}, "client.tls", "invalid min_version"},
+        {NSQClientConfig{TLS: NSQTLSConfig{Enable: true, CertFile: certFile}}, "client.tls", "set together"},
+        {NSQClientConfig{TLS: NSQTLSConfig{Enable: true, CertFile: certFile, KeyFile: filepath.Join(dir, "none.key")}},
+            "client.tls", "load cert_file"},
+        {NSQClientConfig{TLS: NSQTLSConfig{Enable: true, CertFile: garbage, KeyFile: keyFile}}, "client.tls", "load cert_file"},
+        {NSQClientConfig{TLS: NSQTLSConfig{Enable: true, CAFile: filepath.Join(dir, "none.pem")}}, "client.tls", "read ca_file"},
+        {NSQClientConfig{TLS: NSQTLSConfig{Enable: true, CAFile: garbage}}, "client.tls", "no pem certificate"},
+    }
+    for i, c := range cases {
+        e := &common.ConfigError{}
+        c.conf.Check("client", e)
+        if len(e.Problems) != 1 || !strings.HasPrefix(e.Problems[0], c.path + ": ") ||
+            !strings.Contains(e.Problems[0], c.want) {
+            t.Fatalf("case %d: problems %q, want %s: ...%s", i, e.Problems, c.path, c.want)
+        }
+        if _, err := c.conf.NewConfig(); err == nil && c.path == "client.tls" {
+            t.Fatalf("case %d: NewConfig got no err", i)
+        }
+    }
+
+    // tls material not read while disabled
+    e := &common.ConfigError{}
+    (&NSQClientConfig{TLS: NSQTLSConfig{CAFile: garbage}}).Check("client", e)
+    if len(e.Problems) != 0 {
+        t.Fatalf("disabled tls problems %q", e.Problems)
+    }
+}
+
+func TestNSQClientNewConfig(t *testing.T) {
+    certFile, keyFile := writeCert(t, t.TempDir())
+    c := &NSQClientConfig{
+        TLS: NSQTLSConfig{Enable: true, CertFile: certFile, KeyFile: keyFile, CAFile: certFile,
+            ServerName: "nsqd.test", MinVersion: "tls1.3"},
+        AuthSecret: "secret",
+        Deflate: true,
+        DeflateLevel: 3,
+        ClientID: "vcr",
+        Hostname: "host.test",
+        UserAgent: "nsq_vcr/test",
+        HeartbeatIntervalMS: 5000,
+        MsgTimeoutMS: 20000,
+    }
+    e := &common.ConfigError{}
+    c.Check("client", e)
+    if len(e.Problems) != 0 {
+        t.Fatalf("problems %q", e.Problems)
+    }
+
+    config, err := c.NewConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    tc := config.TlsConfig
+    if !config.TlsV1 || tc == nil || len(tc.Certificates) != 1 || tc.RootCAs == nil ||
+        tc.ServerName != "nsqd.test" || tc.MinVersion != tls.VersionTLS13 || tc.InsecureSkipVerify {
+        t.Fatalf("tls config %+v", tc)
+    }
+    if config.AuthSecret != "secret" || !config.Deflate || config.DeflateLevel != 3 || config.Snappy {
+        t.Fatalf("auth or compression not set %+v", config)
+    }
+    if config.ClientID != "vcr" || config.Hostname != "host.test" || config.UserAgent != "nsq_vcr/test" {
+        t.Fatalf("identify not set %+v", config)
+    }
+    if config.HeartbeatInterval != 5 * time.Second || config.MsgTimeout != 20 * time.Second {
+        t.Fatalf("heartbeat[%s] msg timeout[%s]", config.HeartbeatInterval, config.MsgTimeout)
+    }
+
+    // defaults of go-nsq are kept
+    var none *NSQClientConfig
+    config, err = none.NewConfig()
+    if err != nil || config.TlsV1 || config.Deflate || config.HeartbeatInterval != 30 * time.Second {
+        t.Fatalf("default config %+v err[%v]", config, err)
+    }
+    config, err = (&NSQClientConfig{}).NewConfig()
+    if err != nil || config.TlsConfig != nil || config.MsgTimeout != 0 {
+        t.Fatalf("zero config %+v err[%v]", config, err)
+    }
+}
@@ -0,0 +1,138 @@
+package util
+
+import (
+    "fmt"
+    "regexp"
+    "strconv"
+)
+
+// Predicate on a json field, ops:
+//   eq, ne, in, not_in: compare text form of field value
+//   exists, not_exists
+//   regex: text form of field value matches
+//   gt, ge, lt, le: numeric compare
+type Predicate struct {
+    Path  string      `json:"path"`
+    Op    string      `json:"op"`
+    Value interface{} `json:"value,omitempty"`
+
+    path  []string
+    text  string
+    set   map[string]bool
+    num   float64
+    re    *regexp.Regexp
+}
+
+func NewPredicate(path, op string, value interface{}) (*Predicate, error) {
+    p := &Predicate{Path: path, Op: op, Value: value, path: SplitPath(path)}
+    if path == "" {
+        return nil, fmt.Errorf("predicate op[%s] has empty path", op)
+    }
+
+    switch op {
+    case "eq", "ne":
+        p.text = JSONString(value)
+    case "in", "not_in":
+        values, ok := value.([]interface{})
+        if !ok {
+            return nil, fmt.Errorf("predicate[%s] op[%s] value must be array", path, op)
+        }
+        p.set = make(map[string]bool)
+        for _, v := range values {
+            p.set[JSONString(v)] = true
+        }
+    case "exists", "not_exists":
+    case "regex":
+        re, err := regexp.Compile(JSONString(value))
+        if err != nil {
+            return nil, fmt.Errorf("predicate[%s] regex err[%s]", path, err)
+        }
+        p.re = re
+    case "gt", "ge", "lt", "le":
+        num, err := strconv.ParseFloat(JSONString(value), 64)
+        if err != nil {
+            return nil, fmt.Errorf("predicate[%s] op[%s] value must be number", path, op)
+        }
+        p.num = num
+    default:
+        return nil, fmt.Errorf("predicate[%s] unknown op[%s]", path, op)
+    }
+
+    return p, nil
+}
+
+// NewPredicates parses conf array like [{"path": "", "op": "", "value": ""}]
+func NewPredicates(confs []PredicateConfig) ([]*Predicate, error) {
+    var ret []*Predicate
+    for _, conf := range confs {
+        p, err := NewPredicate(conf.Path, conf.Op, conf.Value)
+        if err != nil {
+            return nil, err
+        }
+        ret = append(ret, p)
+    }
+    return ret, nil
+}
+
+func (p *Predicate) Match(doc interface{}) bool {
+    v, ok := JSONGet(doc, p.path)
+    switch p.Op {
+    case "exists":
+        return ok
+    case "not_exists":
+        return !ok
+    case "ne":
+        return !ok || JSONString(v) != p.text
+    case "not_in":
+        return !ok || !p.set[JSONString(v)]
+    }
+
+    if !ok {
+        return false
+    }
+
+    text := JSONString(v)
+    switch p.Op {
+    case "eq":
+        return text == p.text
+    case "in":
+        return p.set[text]
+    case "regex":
+        return p.re.MatchString(text)
+    }
+
+    num, err := strconv.ParseFloat(text, 64)
+    if err != nil {
+        return false
+    }
+    switch p.Op {
+    case "gt":
+        return num > p.num
+    case "ge":
+        return num >= p.num
+    case "lt":
+        return num < p.num
+    case "le":
+        return num <= p.num
+    }
+    return false
+}
+
+// MatchAll reports whether all predicates match, non json body never
+// matches when there is any predicate
+func MatchAll(predicates []*Predicate, body []byte) bool {
+    if len(predicates) == 0 {
+        return true
+    }
+
+    doc, err := DecodeJSON(body)
+    if err != nil {
+        return false
+    }
+    for _, p := range predicates {
+        if !p.Match(doc) {
+            return false
+        }
+    }
+    return true
+}
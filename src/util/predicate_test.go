@@ -0,0 +1,88 @@
+package util
+
+import (
+    "testing"
+    "encoding/json"
+)
+
+func TestPredicateOps(t *testing.T) {
+    body := []byte(`{"user":{"id":42,"name":"bob"},"tags":["a","b"],"price":"9.5","ok":true,"nil":null}`)
+    cases := []struct {
+        conf string
+        want bool
+    }{
+        {`{"path": "user.id", "op": "eq", "value": 42}`, true},
+        {`{"path": "user.id", "op": "eq", "value": "42"}`, true},
+        {`{"path": "user.name", "op": "eq", "value": "alice"}`, false},
+        {`{"path": "user.name", "op": "ne", "value": "alice"}`, true},
+        {`{"path": "user.none", "op": "ne", "value": "alice"}`, true},
+        {`{"path": "user.name", "op": "in", "value": ["alice", "bob"]}`, true},
+        {`{"path": "user.none", "op": "in", "value": ["alice", "bob"]}`, false},
+        {`{"path": "user.name", "op": "not_in", "value": ["alice"]}`, true},
+        {`{"path": "user.name", "op": "not_in", "value": ["bob"]}`, false},
+        {`{"path": "tags.1", "op": "eq", "value": "b"}`, true},
+        {`{"path": "tags.2", "op": "exists"}`, false},
+        {`{"path": "nil", "op": "exists"}`, true},
+        {`{"path": "user.none", "op": "not_exists"}`, true},
+        {`{"path": "user.name", "op": "regex", "value": "^b.b$"}`, true},
+        {`{"path": "ok", "op": "eq", "value": true}`, true},
+        {`{"path": "user.id", "op": "gt", "value": 41}`, true},
+        {`{"path": "user.id", "op": "ge", "value": 42}`, true},
+        {`{"path": "user.id", "op": "lt", "value": 42}`, false},
+        {`{"path": "price", "op": "le", "value": "9.5"}`, true},
+        {`{"path": "user.name", "op": "gt", "value": 1}`, false},
+        {`{"path": "user.none", "op": "lt", "value": 1}`, false},
+    }
+
+    for _, c := range cases {
+        var conf PredicateConfig
+        if err := json.Unmarshal([]byte(c.conf), &conf); err != nil {
+            t.Fatal(err)
+        }
+        predicates, err := NewPredicates([]PredicateConfig{conf})
+        if err != nil {
+            t.Fatalf("%s err[%s]", c.conf, err)
+        }
+        if got := MatchAll(predicates, body); got != c.want {
+            t.Fatalf("%s got %v", c.conf, got)
+        }
+    }
+}
+
+func TestMatchAll(t *testing.T) {
+    predicates, err := NewPredicates([]PredicateConfig{
+        {Path: "a", Op: "eq", Value: "1"},
+        {Path: "b", Op: "exists"},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    for body, want := range map[string]bool{
+        `{"a":1,"b":0}`: true,
+        `{"a":1}`: false,
+        `{"a":2,"b":0}`: false,
+        `not json`: false,
+        `{"a":1,"b":0} {}`: false,
+    } {
+        if got := MatchAll(predicates, []byte(body)); got != want {
+            t.Fatalf("%s got %v", body, got)
+        }
+    }
+    if !MatchAll(nil, []byte("not json")) {
+        t.Fatal("no predicates must match anything")
+    }
+}
+
+func TestNewPredicateInvalid(t *testing.T) {
+    for _, c := range []PredicateConfig{
+        {Path: "", Op: "eq", Value: 1},
+        {Path: "a", Op: "like", Value: 1},
+        {Path: "a", Op: "in", Value: "x"},
+        {Path: "a", Op: "regex", Value: "("},
+        {Path: "a", Op: "gt", Value: "x"},
+    } {
+        if _, err := NewPredicate(c.Path, c.Op, c.Value); err == nil {
+            t.Fatalf("%+v accepted", c)
+        }
+    }
+}
@@ -0,0 +1,157 @@
+package util
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const ScheduleTimeLayout = "2006-01-02 15:04:05"
+
+// Schedule is active when any cron expression matches current minute
+// or now is inside any explicit window.
+// cron: "minute hour day-of-month month day-of-week", each field is
+// *, n, a-b, */step, a-b/step or a comma list of them, e.g.
+// "* 9-11 * * 1-5" means 09:00-11:59 on weekdays.
+// window: "2006-01-02 15:04:05/2006-01-02 18:00:00" in local time.
+type Schedule struct {
+    crons   []*cronExpr
+    windows [][2]time.Time
+}
+
+type cronExpr struct {
+    text   string
+    fields [5]map[int]bool
+    any    [5]bool
+}
+
+var cronRanges = [5][2]int{
+    {0, 59}, // minute
+    {0, 23}, // hour
+    {1, 31}, // day of month
+    {1, 12}, // month
+    {0, 7},  // day of week, 0 and 7 are sunday
+}
+
+func NewSchedule(crons, windows []string) (*Schedule, error) {
+    s := &Schedule{}
+    for _, text := range crons {
+        c, err := parseCron(text)
+        if err != nil {
+            return nil, err
+        }
+        s.crons = append(s.crons, c)
+    }
+
+    for _, text := range windows {
+        parts := strings.Split(text, "/")
+        if len(parts) != 2 {
+            return nil, fmt.Errorf("invalid window[%s], want start/end", text)
+        }
+        start, err := time.ParseInLocation(ScheduleTimeLayout, strings.TrimSpace(parts[0]), time.Local)
+        if err != nil {
+            return nil, fmt.Errorf("invalid window[%s] start err[%s]", text, err)
+        }
+        end, err := time.ParseInLocation(ScheduleTimeLayout, strings.TrimSpace(parts[1]), time.Local)
+        if err != nil {
+            return nil, fmt.Errorf("invalid window[%s] end err[%s]", text, err)
+        }
+        if !end.After(start) {
+            return nil, fmt.Errorf("invalid window[%s] end before start", text)
+        }
+        s.windows = append(s.windows, [2]time.Time{start, end})
+    }
+
+    if len(s.crons) == 0 && len(s.windows) == 0 {
+        return nil, fmt.Errorf("schedule has neither cron nor windows")
+    }
+    return s, nil
+}
+
+func (s *Schedule) Active(now time.Time) bool {
+    for _, w := range s.windows {
+        if !now.Before(w[0]) && now.Before(w[1]) {
+            return true
+        }
+    }
+    for _, c := range s.crons {
+        if c.match(now) {
+            return true
+        }
+    }
+    return false
+}
+
+func parseCron(text string) (*cronExpr, error) {
+    fields := strings.Fields(text)
+    if len(fields) != 5 {
+        return nil, fmt.Errorf("invalid cron[%s], want 5 fields", text)
+    }
+
+    c := &cronExpr{text: text}
+    for i, field := range fields {
+        c.any[i] = field == "*"
+        c.fields[i] = make(map[int]bool)
+        for _, item := range strings.Split(field, ",") {
+            if err := c.parseItem(i, item); err != nil {
+                return nil, fmt.Errorf("invalid cron[%s] field[%s] err[%s]", text, field, err)
+            }
+        }
+    }
+
+    // sunday can be written as 7
+    if c.fields[4][7] {
+        c.fields[4][0] = true
+    }
+    return c, nil
+}
+
+func (c *cronExpr) parseItem(i int, item string) error {
+    lo, hi := cronRanges[i][0], cronRanges[i][1]
+    step := 1
+    if idx := strings.Index(item, "/"); idx != -1 {
+        var err error
+        if step, err = strconv.Atoi(item[idx + 1:]); err != nil || step <= 0 {
+            return fmt.Errorf("bad step[%s]", item)
+        }
+        item = item[:idx]
+    }
+
+    start, end := lo, hi
+    if item != "*" {
+        bounds := strings.SplitN(item, "-", 2)
+        var err error
+        if start, err = strconv.Atoi(bounds[0]); err != nil {
+            return fmt.Errorf("bad value[%s]", item)
+        }
+        end = start
+        if len(bounds) == 2 {
+            if end, err = strconv.Atoi(bounds[1]); err != nil {
+                return fmt.Errorf("bad value[%s]", item)
+            }
+        }
+    }
+
+    if start < lo || end > hi || start > end {
+        return fmt.Errorf("value[%s] out of range %d-%d", item, lo, hi)
+    }
+    for v := start; v <= end; v += step {
+        c.fields[i][v] = true
+    }
+    return nil
+}
+
+func (c *cronExpr) match(t time.Time) bool {
+    if !c.fields[0][t.Minute()] || !c.fields[1][t.Hour()] || !c.fields[3][int(t.Month())] {
+        return false
+    }
+
+    // like cron, restricted day of month and day of week are or-ed
+    dom := c.fields[2][t.Day()]
+    dow := c.fields[4][int(t.Weekday())]
+    if !c.any[2] && !c.any[4] {
+        return dom || dow
+    }
+    return dom && dow
+}
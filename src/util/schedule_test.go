@@ -0,0 +1,118 @@
+package util
+
+import (
+    "testing"
+    "time"
+)
+
+func at(value string) time.Time {
+    t, err := time.ParseInLocation(ScheduleTimeLayout, value, time.Local)
+    if err != nil {
+        panic(err)
+    }
+    return t
+}
+
+func TestScheduleCron(t *testing.T) {
+    // 2017-03-27 is a monday
+    cases := []struct {
+        cron string
+        now  string
+        want bool
+    }{
+        {"* 9-11 * * 1-5", "2017-03-27 09:00:00", true},
+        {"* 9-11 * * 1-5", "2017-03-27 11:59:59", true},
+        {"* 9-11 * * 1-5", "2017-03-27 12:00:00", false},
+        {"* 9-11 * * 1-5", "2017-03-26 10:00:00", false},
+        {"*/15 * * * *", "2017-03-27 10:45:00", true},
+        {"*/15 * * * *", "2017-03-27 10:46:00", false},
+        {"0-30/10 * * * *", "2017-03-27 10:20:00", true},
+        {"0-30/10 * * * *", "2017-03-27 10:40:00", false},
+        {"0,30 8 * * *", "2017-03-27 08:30:00", true},
+        {"0,30 8 * * *", "2017-03-27 08:31:00", false},
+        {"* * * 3 *", "2017-03-27 08:31:00", true},
+        {"* * * 4 *", "2017-03-27 08:31:00", false},
+        {"* * * * 7", "2017-03-26 08:00:00", true},
+        {"* * * * 0", "2017-03-26 08:00:00", true},
+        // restricted day of month and day of week are or-ed like cron
+        {"* * 1 * 1", "2017-03-27 08:00:00", true},
+        {"* * 27 * 0", "2017-03-27 08:00:00", true},
+        {"* * 1 * 0", "2017-03-27 08:00:00", false},
+        // only one restricted, it alone decides
+        {"* * 1 * *", "2017-03-27 08:00:00", false},
+        {"* * */2 * 1", "2017-03-27 08:00:00", true},
+    }
+
+    for _, c := range cases {
+        s, err := NewSchedule([]string{c.cron}, nil)
+        if err != nil {
+            t.Fatalf("cron[%s] err[%s]", c.cron, err)
+        }
+        if got := s.Active(at(c.now)); got != c.want {
+            t.Fatalf("cron[%s] at %s got %v", c.cron, c.now, got)
+        }
+    }
+}
+
+func TestScheduleWindow(t *testing.T) {
+    s, err := NewSchedule(nil, []string{
+        "2017-03-26 10:00:00/2017-03-26 12:00:00",
+        " 2017-03-27 23:00:00 / 2017-03-28 01:00:00 ",
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    for now, want := range map[string]bool{
+        "2017-03-26 09:59:59": false,
+        "2017-03-26 10:00:00": true,
+        "2017-03-26 11:59:59": true,
+        "2017-03-26 12:00:00": false,
+        "2017-03-28 00:30:00": true,
+    } {
+        if got := s.Active(at(now)); got != want {
+            t.Fatalf("at %s got %v", now, got)
+        }
+    }
+}
+
+func TestScheduleCronOrWindow(t *testing.T) {
+    s, err := NewSchedule([]string{"0 3 * * *"}, []string{"2017-03-26 10:00:00/2017-03-26 12:00:00"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !s.Active(at("2017-03-27 03:00:00")) || !s.Active(at("2017-03-26 11:00:00")) || s.Active(at("2017-03-27 11:00:00")) {
+        t.Fatal("cron and windows must be or-ed")
+    }
+}
+
+func TestScheduleInvalid(t *testing.T) {
+    for _, cron := range []string{
+        "* * * *",
+        "60 * * * *",
+        "* 24 * * *",
+        "* * 0 * *",
+        "* * * 13 *",
+        "* * * * 8",
+        "5-1 * * * *",
+        "*/0 * * * *",
+        "a * * * *",
+        "1-x * * * *",
+    } {
+        if _, err := NewSchedule([]string{cron}, nil); err == nil {
+            t.Fatalf("cron[%s] accepted", cron)
+        }
+    }
+    for _, window := range []string{
+        "2017-03-26 10:00:00",
+        "2017-03-26 10:00/2017-03-26 12:00:00",
+        "2017-03-26 12:00:00/2017-03-26 10:00:00",
+        "2017-03-26 10:00:00/2017-03-26 10:00:00",
+    } {
+        if _, err := NewSchedule(nil, []string{window}); err == nil {
+            t.Fatalf("window[%s] accepted", window)
+        }
+    }
+    if _, err := NewSchedule(nil, nil); err == nil {
+        t.Fatal("empty schedule accepted")
+    }
+}
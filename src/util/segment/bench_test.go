@@ -0,0 +1,67 @@
+package segment
+
+import (
+    "bytes"
+    "io"
+    "testing"
+)
+
+var benchBody = bytes.Repeat([]byte(`{"k":"v"}`), 50)
+
+// the record hot path, framing onto the compression layer
+func BenchmarkWriter(b *testing.B) {
+    for _, flags := range []byte{0, FlagCRC | FlagTimestamp | FlagSequence} {
+        b.Run(flagsName(flags), func(b *testing.B) {
+            w := NewWriter(io.Discard, NewHeader(flags, nil))
+            rec := &Record{Timestamp: 1, Seq: 1, Body: benchBody}
+            b.SetBytes(int64(len(benchBody)))
+            b.ReportAllocs()
+            for i := 0; i < b.N; i++ {
+                if _, err := w.Write(rec); err != nil {
+                    b.Fatal(err)
+                }
+            }
+        })
+    }
+}
+
+// the play hot path, every record is released after use like play does
+func BenchmarkReader(b *testing.B) {
+    var buf bytes.Buffer
+    w := NewWriter(&buf, NewHeader(FlagCRC, nil))
+    w.WriteHeader()
+    for i := 0; i < 1000; i++ {
+        w.Write(&Record{Body: benchBody})
+    }
+    data := buf.Bytes()
+
+    for _, pooled := range []bool{false, true} {
+        name := "alloc"
+        if pooled {
+            name = "pooled"
+        }
+        b.Run(name, func(b *testing.B) {
+            b.SetBytes(int64(len(benchBody)))
+            b.ReportAllocs()
+            var r *Reader
+            for i := 0; i < b.N; i++ {
+                if i % 1000 == 0 {
+                    r, _ = NewReader(bytes.NewReader(data), nil)
+                    r.SetPooled(pooled)
+                }
+                rec, err := r.Next()
+                if err != nil {
+                    b.Fatal(err)
+                }
+                rec.Release()
+            }
+        })
+    }
+}
+
+func flagsName(flags byte) string {
+    if flags == 0 {
+        return "plain"
+    }
+    return "crc_ts_seq"
+}
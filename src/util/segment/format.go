@@ -0,0 +1,199 @@
+// segment: framing of files written by record, shared by record, play,
+// serve and vcr tools
+package segment
+
+import (
+    "util"
+    "fmt"
+    "io"
+    "bufio"
+    "errors"
+    "hash/crc32"
+    "encoding/json"
+    "encoding/binary"
+)
+
+// segment data(after decompression) format:
+//   header: magic(4) version(1) flags(1) metaLen(4, bigendian) meta(json)
+//   record: len(4, bigendian) [crc32c(4) if FlagCRC]
+//           [timestamp(8) if FlagTimestamp] [seq(8) if FlagSequence] raw_data
+// len is length of raw_data, crc32c covers everything after it.
+// old segments have no header, only records without crc.
+const (
+    Magic   = "NVCR"
+    Version = 1
+
+    FlagCRC       byte = 1 << 0 // every record carries crc32c
+    FlagTimestamp byte = 1 << 1 // every record carries nsq timestamp, unix nano
+    FlagSequence  byte = 1 << 2 // every record carries receive sequence of its topic
+
+    fixedHeaderLen       = 10
+    lenSize              = 4
+    maxRecordMetaLen     = 4 + 8 + 8
+    DefaultMaxRecordSize = 64 * 1024 * 1024
+)
+
+var (
+    ErrTruncated      = util.ErrTruncated
+    ErrCRCMismatch    = errors.New("record crc mismatch")
+    ErrRecordTooLarge = errors.New("record too large")
+    ErrInvalidHeader  = util.ErrInvalidHeader
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type Header struct {
+    Version byte
+    Flags   byte
+    Meta    map[string]string
+}
+
+func NewHeader(flags byte, meta map[string]string) *Header {
+    return &Header{
+        Version: Version,
+        Flags: flags,
+        Meta: meta,
+    }
+}
+
+func (h *Header) Encode() []byte {
+    meta, _ := json.Marshal(h.Meta)
+    buf := make([]byte, fixedHeaderLen + len(meta))
+    copy(buf, Magic)
+    buf[4] = h.Version
+    buf[5] = h.Flags
+    binary.BigEndian.PutUint32(buf[6:10], uint32(len(meta)))
+    copy(buf[fixedHeaderLen:], meta)
+    return buf
+}
+
+// flags of records, 0 for old segment without header
+func (h *Header) flags() byte {
+    if h == nil {
+        return 0
+    }
+    return h.Flags
+}
+
+func (h *Header) HasCRC() bool {
+    return h.flags() & FlagCRC != 0
+}
+
+func (h *Header) HasTimestamp() bool {
+    return h.flags() & FlagTimestamp != 0
+}
+
+func (h *Header) HasSequence() bool {
+    return h.flags() & FlagSequence != 0
+}
+
+// ReadHeader returns nil header for old segment without header
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+    h, _, err := readHeader(r)
+    return h, err
+}
+
+// header and its size
+func readHeader(r *bufio.Reader) (*Header, int64, error) {
+    magic, err := r.Peek(len(Magic))
+    if err != nil {
+        if err == io.EOF {
+            // empty or short data is handled by record reading
+            return nil, 0, nil
+        }
+        return nil, 0, err
+    }
+    if string(magic) != Magic {
+        return nil, 0, nil
+    }
+
+    var fixed [fixedHeaderLen]byte
+    if _, err := io.ReadFull(r, fixed[:]); err != nil {
+        return nil, 0, ErrTruncated
+    }
+
+    h := &Header{Version: fixed[4], Flags: fixed[5]}
+    if h.Version != Version {
+        return nil, 0, fmt.Errorf("%w: unsupported version %d", ErrInvalidHeader, h.Version)
+    }
+    if h.Flags &^ (FlagCRC | FlagTimestamp | FlagSequence) != 0 {
+        return nil, 0, fmt.Errorf("%w: unsupported flags %#x", ErrInvalidHeader, h.Flags)
+    }
+
+    metaLen := binary.BigEndian.Uint32(fixed[6:10])
+    if metaLen > DefaultMaxRecordSize {
+        return nil, 0, fmt.Errorf("%w: meta len %d", ErrInvalidHeader, metaLen)
+    }
+    meta := make([]byte, metaLen)
+    if _, err := io.ReadFull(r, meta); err != nil {
+        return nil, 0, ErrTruncated
+    }
+    if err := json.Unmarshal(meta, &h.Meta); err != nil {
+        return nil, 0, fmt.Errorf("%w: meta %s", ErrInvalidHeader, err)
+    }
+
+    return h, int64(fixedHeaderLen + metaLen), nil
+}
+
+// Record is one message in a segment, Timestamp and Seq are 0 if the
+// segment does not carry them
+type Record struct {
+    Timestamp int64
+    Seq       uint64
+    Body      []byte
+    Offset    int64 // of the record in decompressed data, set by Reader
+    buf       *util.Buffer // pooled backing of Body, see Reader.SetPooled
+}
+
+// Release gives a pooled Body back, Body must not be used after
+func (r *Record) Release() {
+    r.buf.Release()
+    r.buf = nil
+}
+
+// TakeBuffer hands the pooled backing of Body to the caller, who must
+// release it after Body is used, nil if Body is not pooled
+func (r *Record) TakeBuffer() *util.Buffer {
+    buf := r.buf
+    r.buf = nil
+    return buf
+}
+
+// bytes between len and raw data
+func recordMetaLen(flags byte) int {
+    n := 0
+    if flags & FlagCRC != 0 {
+        n += 4
+    }
+    if flags & FlagTimestamp != 0 {
+        n += 8
+    }
+    if flags & FlagSequence != 0 {
+        n += 8
+    }
+    return n
+}
+
+// EncodeRecord frames a record according to flags
+func EncodeRecord(flags byte, rec *Record) []byte {
+    buf := make([]byte, lenSize + recordMetaLen(flags) + len(rec.Body))
+    binary.BigEndian.PutUint32(buf[:lenSize], uint32(len(rec.Body)))
+    pos := lenSize
+    if flags & FlagCRC != 0 {
+        pos += 4
+    }
+    crcStart := pos
+    if flags & FlagTimestamp != 0 {
+        binary.BigEndian.PutUint64(buf[pos:], uint64(rec.Timestamp))
+        pos += 8
+    }
+    if flags & FlagSequence != 0 {
+        binary.BigEndian.PutUint64(buf[pos:], rec.Seq)
+        pos += 8
+    }
+    copy(buf[pos:], rec.Body)
+    if flags & FlagCRC != 0 {
+        binary.BigEndian.PutUint32(buf[lenSize:lenSize + 4], crc32.Checksum(buf[crcStart:], crcTable))
+    }
+    return buf
+}
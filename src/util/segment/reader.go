@@ -0,0 +1,175 @@
+package segment
+
+import (
+    "util"
+    "fmt"
+    "io"
+    "os"
+    "bufio"
+    "compress/gzip"
+    "hash/crc32"
+    "encoding/binary"
+)
+
+const (
+    CodecNone = "none"
+    CodecGzip = "gzip"
+)
+
+// Reader reads records of a segment stream, encryption and gzip are
+// detected by magic bytes, so renamed files(e.g. .done) can be read too
+type Reader struct {
+    Header  *Header // nil for old segment
+    Codec   string
+    KeyID   string // not empty if encrypted
+    gz      *gzip.Reader
+    reader  *bufio.Reader
+    maxSize uint32
+    offset  int64 // of the next record
+    pooled  bool
+    head    [lenSize]byte // reused, escapes through io.ReadFull
+}
+
+// keyring can be nil if no encrypted segment expected
+func NewReader(r io.Reader, keyring *util.Keyring) (*Reader, error) {
+    s := &Reader{
+        Codec: CodecNone,
+        reader: bufio.NewReader(r),
+        maxSize: DefaultMaxRecordSize,
+    }
+    if magic, _ := s.reader.Peek(len(util.EncryptMagic)); string(magic) == util.EncryptMagic {
+        plain, keyID, err := util.NewDecryptReader(s.reader, keyring)
+        s.KeyID = keyID
+        if err != nil {
+            return nil, err
+        }
+        s.reader = bufio.NewReader(plain)
+    }
+
+    magic, err := s.reader.Peek(2)
+    if err != nil && err != io.EOF {
+        return nil, err
+    }
+    if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+        if s.gz, err = gzip.NewReader(s.reader); err != nil {
+            return nil, err
+        }
+        s.Codec = CodecGzip
+        s.reader = bufio.NewReader(s.gz)
+    }
+
+    if s.Header, s.offset, err = readHeader(s.reader); err != nil {
+        s.Close()
+        return nil, err
+    }
+    return s, nil
+}
+
+// SetMaxRecordSize rejects larger records as ErrRecordTooLarge, 0 no limit
+func (s *Reader) SetMaxRecordSize(n uint32) {
+    s.maxSize = n
+}
+
+// SetPooled reads bodies into pooled buffers, every record must then be
+// released by Record.Release or TakeBuffer
+func (s *Reader) SetPooled(pooled bool) {
+    s.pooled = pooled
+}
+
+// Offset of the next record in decompressed data
+func (s *Reader) Offset() int64 {
+    return s.offset
+}
+
+// Next returns io.EOF when all records read. Errors are sticky in
+// practice, framing is lost after a broken record.
+func (s *Reader) Next() (*Record, error) {
+    flags := s.Header.flags()
+
+    if n, err := io.ReadFull(s.reader, s.head[:]); err != nil {
+        if err == io.EOF && n == 0 {
+            return nil, io.EOF
+        }
+        if err == io.ErrUnexpectedEOF {
+            return nil, ErrTruncated
+        }
+        return nil, err
+    }
+
+    msgLen := binary.BigEndian.Uint32(s.head[:])
+    if s.maxSize > 0 && msgLen > s.maxSize {
+        return nil, fmt.Errorf("%w: %d > %d at offset %d", ErrRecordTooLarge, msgLen, s.maxSize, s.offset)
+    }
+
+    // meta and body are read at once so crc can cover both
+    var buf *util.Buffer
+    var data []byte
+    if n := recordMetaLen(flags) + int(msgLen); s.pooled {
+        buf = util.GetBuffer(n)
+        data = buf.B
+    } else {
+        data = make([]byte, n)
+    }
+    if _, err := io.ReadFull(s.reader, data); err != nil {
+        buf.Release()
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            return nil, ErrTruncated
+        }
+        return nil, err
+    }
+
+    rec := &Record{Offset: s.offset, buf: buf}
+    pos := 0
+    if flags & FlagCRC != 0 {
+        if binary.BigEndian.Uint32(data[:4]) != crc32.Checksum(data[4:], crcTable) {
+            buf.Release()
+            return nil, fmt.Errorf("%w at offset %d", ErrCRCMismatch, s.offset)
+        }
+        pos += 4
+    }
+    if flags & FlagTimestamp != 0 {
+        rec.Timestamp = int64(binary.BigEndian.Uint64(data[pos:]))
+        pos += 8
+    }
+    if flags & FlagSequence != 0 {
+        rec.Seq = binary.BigEndian.Uint64(data[pos:])
+        pos += 8
+    }
+    rec.Body = data[pos:]
+    s.offset += int64(lenSize + len(data))
+    return rec, nil
+}
+
+func (s *Reader) Close() error {
+    if s.gz != nil {
+        return s.gz.Close()
+    }
+    return nil
+}
+
+// File is a Reader of a segment file on disk
+type File struct {
+    *Reader
+    Path string
+    fp   *os.File
+}
+
+// keyring can be nil if no encrypted segment expected
+func Open(path string, keyring *util.Keyring) (*File, error) {
+    fp, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+
+    r, err := NewReader(fp, keyring)
+    if err != nil {
+        fp.Close()
+        return nil, err
+    }
+    return &File{Reader: r, Path: path, fp: fp}, nil
+}
+
+func (f *File) Close() error {
+    f.Reader.Close()
+    return f.fp.Close()
+}
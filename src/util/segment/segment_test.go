@@ -0,0 +1,202 @@
+package segment
+
+import (
+    "util"
+    "bytes"
+    "compress/flate"
+    "compress/gzip"
+    "errors"
+    "io"
+    "testing"
+)
+
+var allFlags = []byte{0, FlagCRC, FlagCRC | FlagTimestamp | FlagSequence, FlagTimestamp | FlagSequence}
+
+func encodeSegment(t testing.TB, flags byte, gz bool, bodies [][]byte) []byte {
+    var buf bytes.Buffer
+    var out io.Writer = &buf
+    var zw *gzip.Writer
+    if gz {
+        zw = gzip.NewWriter(&buf)
+        out = zw
+    }
+
+    w := NewWriter(out, NewHeader(flags, map[string]string{"topic": "t"}))
+    if err := w.WriteHeader(); err != nil {
+        t.Fatal(err)
+    }
+    for i, body := range bodies {
+        if _, err := w.Write(&Record{Timestamp: int64(i + 1), Seq: uint64(i + 100), Body: body}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if zw != nil {
+        zw.Close()
+    }
+    return buf.Bytes()
+}
+
+// errors of malformed data must be the typed ones, never a panic
+func knownErr(err error) bool {
+    var corrupt flate.CorruptInputError
+    if errors.As(err, &corrupt) {
+        return true
+    }
+    return errors.Is(err, ErrTruncated) || errors.Is(err, ErrCRCMismatch) ||
+        errors.Is(err, ErrRecordTooLarge) || errors.Is(err, ErrInvalidHeader) ||
+        errors.Is(err, util.ErrNoKeyring) || errors.Is(err, io.ErrUnexpectedEOF) ||
+        errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum)
+}
+
+func TestRoundTrip(t *testing.T) {
+    bodies := [][]byte{[]byte("a"), {}, []byte(`{"k":1}`), bytes.Repeat([]byte("x"), 5000)}
+    for _, flags := range allFlags {
+        for _, gz := range []bool{false, true} {
+            data := encodeSegment(t, flags, gz, bodies)
+            r, err := NewReader(bytes.NewReader(data), nil)
+            if err != nil {
+                t.Fatalf("flags[%#x] gz[%v] %s", flags, gz, err)
+            }
+            if gz != (r.Codec == CodecGzip) || r.Header.Flags != flags || r.Header.Meta["topic"] != "t" {
+                t.Fatalf("flags[%#x] gz[%v] bad header %+v codec %s", flags, gz, r.Header, r.Codec)
+            }
+
+            offset := r.Offset()
+            for i, body := range bodies {
+                rec, err := r.Next()
+                if err != nil {
+                    t.Fatalf("flags[%#x] gz[%v] record %d %s", flags, gz, i, err)
+                }
+                if !bytes.Equal(rec.Body, body) || rec.Offset != offset {
+                    t.Fatalf("flags[%#x] gz[%v] record %d got %d bytes at %d", flags, gz, i, len(rec.Body), rec.Offset)
+                }
+                if r.Header.HasSequence() && rec.Seq != uint64(i + 100) {
+                    t.Fatalf("flags[%#x] record %d seq %d", flags, i, rec.Seq)
+                }
+                offset = r.Offset()
+            }
+            if _, err := r.Next(); err != io.EOF {
+                t.Fatalf("flags[%#x] gz[%v] want EOF got %v", flags, gz, err)
+            }
+        }
+    }
+}
+
+func TestOldSegment(t *testing.T) {
+    var buf bytes.Buffer
+    w := NewWriter(&buf, nil)
+    w.WriteHeader()
+    w.Write(&Record{Body: []byte("old")})
+
+    r, err := NewReader(&buf, nil)
+    if err != nil || r.Header != nil {
+        t.Fatalf("header %v err %v", r, err)
+    }
+    if rec, err := r.Next(); err != nil || string(rec.Body) != "old" || rec.Offset != 0 {
+        t.Fatalf("got %v err %v", rec, err)
+    }
+}
+
+func TestMaxRecordSize(t *testing.T) {
+    data := encodeSegment(t, FlagCRC, false, [][]byte{make([]byte, 100)})
+    r, _ := NewReader(bytes.NewReader(data), nil)
+    r.SetMaxRecordSize(99)
+    if _, err := r.Next(); !errors.Is(err, ErrRecordTooLarge) {
+        t.Fatalf("want ErrRecordTooLarge got %v", err)
+    }
+
+    w := NewWriter(io.Discard, nil)
+    w.SetMaxRecordSize(99)
+    if _, err := w.Write(&Record{Body: make([]byte, 100)}); !errors.Is(err, ErrRecordTooLarge) {
+        t.Fatalf("want ErrRecordTooLarge got %v", err)
+    }
+}
+
+func TestCorrupted(t *testing.T) {
+    data := encodeSegment(t, FlagCRC, false, [][]byte{[]byte("hello")})
+    data[len(data) - 1] ^= 0xff
+    r, _ := NewReader(bytes.NewReader(data), nil)
+    if _, err := r.Next(); !errors.Is(err, ErrCRCMismatch) {
+        t.Fatalf("want ErrCRCMismatch got %v", err)
+    }
+
+    data = encodeSegment(t, FlagCRC, false, [][]byte{[]byte("hello")})
+    r, _ = NewReader(bytes.NewReader(data[:len(data) - 1]), nil)
+    if _, err := r.Next(); !errors.Is(err, ErrTruncated) {
+        t.Fatalf("want ErrTruncated got %v", err)
+    }
+}
+
+// readAll drains data, it must end in EOF or a known error and every
+// record must lie inside the decoded data
+func readAll(t *testing.T, data []byte) {
+    r, err := NewReader(bytes.NewReader(data), nil)
+    if err != nil {
+        if !knownErr(err) {
+            t.Fatalf("NewReader unexpected err %v", err)
+        }
+        return
+    }
+    defer r.Close()
+    r.SetMaxRecordSize(1 << 20)
+
+    last := int64(-1)
+    for {
+        offset := r.Offset()
+        rec, err := r.Next()
+        if err == io.EOF {
+            return
+        }
+        if err != nil {
+            if !knownErr(err) {
+                t.Fatalf("Next unexpected err %v", err)
+            }
+            return
+        }
+        if rec.Offset != offset || rec.Offset <= last || r.Offset() <= rec.Offset {
+            t.Fatalf("bad offset %d after %d, next %d", rec.Offset, last, r.Offset())
+        }
+        last = rec.Offset
+    }
+}
+
+func FuzzReader(f *testing.F) {
+    for _, flags := range allFlags {
+        f.Add(encodeSegment(f, flags, false, [][]byte{[]byte("a"), []byte(`{"k":1}`)}))
+        f.Add(encodeSegment(f, flags, true, [][]byte{[]byte("a"), []byte(`{"k":1}`)}))
+    }
+    f.Add([]byte{})
+    f.Add([]byte(Magic))
+    f.Add([]byte(util.EncryptMagic))
+    f.Add([]byte{0x1f, 0x8b})
+    f.Add([]byte{0, 0, 0, 5, 'h', 'e'})
+
+    f.Fuzz(readAll)
+}
+
+func FuzzRoundTrip(f *testing.F) {
+    f.Add(FlagCRC, []byte("hello"), []byte(""))
+    f.Add(byte(0), []byte(""), []byte(`{"k":1}`))
+    f.Add(FlagCRC | FlagTimestamp | FlagSequence, []byte("a"), []byte("b"))
+
+    f.Fuzz(func(t *testing.T, flags byte, a, b []byte) {
+        flags &= FlagCRC | FlagTimestamp | FlagSequence
+        data := encodeSegment(t, flags, false, [][]byte{a, b})
+        r, err := NewReader(bytes.NewReader(data), nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for i, body := range [][]byte{a, b} {
+            rec, err := r.Next()
+            if err != nil || !bytes.Equal(rec.Body, body) {
+                t.Fatalf("record %d got %v err %v", i, rec, err)
+            }
+            if r.Header.HasTimestamp() && rec.Timestamp != int64(i + 1) {
+                t.Fatalf("record %d timestamp %d", i, rec.Timestamp)
+            }
+        }
+        if _, err := r.Next(); err != io.EOF {
+            t.Fatalf("want EOF got %v", err)
+        }
+    })
+}
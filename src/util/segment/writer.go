@@ -0,0 +1,87 @@
+package segment
+
+import (
+    "fmt"
+    "io"
+    "hash/crc32"
+    "encoding/binary"
+)
+
+// Writer frames records onto w, compression and encryption are layers
+// of w, e.g. gzip.Writer over util.NewEncryptWriter over the file
+type Writer struct {
+    w       io.Writer
+    header  *Header
+    flags   byte
+    maxSize uint32
+    offset  int64 // bytes written, header included
+    head    [lenSize + maxRecordMetaLen]byte // reused, body is never copied
+}
+
+// NewWriter writes records in format of h, call WriteHeader first on a
+// new segment. Nil h writes records of an old segment without header.
+func NewWriter(w io.Writer, h *Header) *Writer {
+    return &Writer{
+        w: w,
+        header: h,
+        flags: h.flags(),
+        maxSize: DefaultMaxRecordSize,
+    }
+}
+
+func (w *Writer) WriteHeader() error {
+    if w.header == nil {
+        return nil
+    }
+    n, err := w.w.Write(w.header.Encode())
+    w.offset += int64(n)
+    return err
+}
+
+// SetMaxRecordSize limits body of records, 0 no limit
+func (w *Writer) SetMaxRecordSize(n uint32) {
+    w.maxSize = n
+}
+
+// Write returns the offset of rec, Timestamp and Seq are ignored if the
+// header does not carry them
+func (w *Writer) Write(rec *Record) (int64, error) {
+    if w.maxSize > 0 && uint64(len(rec.Body)) > uint64(w.maxSize) {
+        return 0, fmt.Errorf("%w: %d > %d", ErrRecordTooLarge, len(rec.Body), w.maxSize)
+    }
+
+    offset := w.offset
+    head := w.head[:lenSize + recordMetaLen(w.flags)]
+    binary.BigEndian.PutUint32(head, uint32(len(rec.Body)))
+    pos := lenSize
+    if w.flags & FlagCRC != 0 {
+        pos += 4
+    }
+    crcStart := pos
+    if w.flags & FlagTimestamp != 0 {
+        binary.BigEndian.PutUint64(head[pos:], uint64(rec.Timestamp))
+        pos += 8
+    }
+    if w.flags & FlagSequence != 0 {
+        binary.BigEndian.PutUint64(head[pos:], rec.Seq)
+        pos += 8
+    }
+    if w.flags & FlagCRC != 0 {
+        crc := crc32.Update(crc32.Checksum(head[crcStart:], crcTable), crcTable, rec.Body)
+        binary.BigEndian.PutUint32(head[lenSize:], crc)
+    }
+
+    n, err := w.w.Write(head)
+    w.offset += int64(n)
+    if err != nil {
+        return offset, err
+    }
+    n, err = w.w.Write(rec.Body)
+    w.offset += int64(n)
+    return offset, err
+}
+
+// Offset is bytes written so far, before compression
+func (w *Writer) Offset() int64 {
+    return w.offset
+}
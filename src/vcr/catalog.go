@@ -0,0 +1,78 @@
+package vcr
+
+import (
+    "util"
+    "flag"
+    "fmt"
+    "os"
+    "path/filepath"
+    "encoding/json"
+)
+
+func init() {
+    register("catalog", "list segments of a topic in a time range from catalogs", runCatalog)
+}
+
+// catalog files of write dirs, fallback to search parents
+func catalogPaths(dirs []string, name string) []string {
+    var ret []string
+    for _, dir := range dirs {
+        path := filepath.Join(dir, name)
+        if _, err := os.Stat(path); err != nil {
+            if path = util.FindCatalog(dir, name); path == "" {
+                fmt.Fprintf(os.Stderr, "No catalog[%s] found for dir[%s]\n", name, dir)
+                continue
+            }
+        }
+        ret = append(ret, path)
+    }
+    return ret
+}
+
+// querySegments finds segments from catalogs of write dirs
+func querySegments(dirs []string, catalogName, topic, from, to string) ([]*util.CatalogEntry, error) {
+    fromNs, err := parseTime(from)
+    if err != nil {
+        return nil, err
+    }
+    toNs, err := parseTime(to)
+    if err != nil {
+        return nil, err
+    }
+
+    return util.QueryCatalogs(catalogPaths(dirs, catalogName), topic, fromNs, toNs)
+}
+
+func runCatalog(args []string) int {
+    fs := flag.NewFlagSet("catalog", flag.ExitOnError)
+    dirs := fs.String("dirs", "", "write dirs, comma separated")
+    catalogName := fs.String("catalog_name", util.DefaultCatalogName, "catalog file name in write dir")
+    topic := fs.String("topic", "", "topic, empty means all")
+    from := fs.String("from", "", "start time, e.g. 2006-01-02 15:04:05")
+    to := fs.String("to", "", "end time, e.g. 2006-01-02 15:04:05")
+    existOnly := fs.Bool("exist", false, "only list segments still in place")
+    fs.Parse(args)
+
+    if *dirs == "" {
+        fmt.Fprintf(os.Stderr, "-dirs is required\n")
+        fs.Usage()
+        return -1
+    }
+
+    entries, err := querySegments(splitList(*dirs), *catalogName, *topic, *from, *to)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Query catalog err[%s]\n", err)
+        return -2
+    }
+
+    enc := json.NewEncoder(os.Stdout)
+    for _, e := range entries {
+        if *existOnly {
+            if _, err := os.Stat(e.Path); err != nil {
+                continue
+            }
+        }
+        enc.Encode(e)
+    }
+    return 0
+}
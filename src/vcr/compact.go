@@ -0,0 +1,81 @@
+package vcr
+
+import (
+    "util"
+    "compact"
+    "flag"
+    "fmt"
+    "os"
+    "time"
+)
+
+func init() {
+    register("compact", "merge small segments of a topic in a time bucket", runCompact)
+}
+
+func runCompact(args []string) int {
+    fs := flag.NewFlagSet("compact", flag.ExitOnError)
+    dirs := fs.String("dirs", "", "write dirs, comma separated")
+    catalogName := fs.String("catalog_name", util.DefaultCatalogName, "catalog file name in write dir")
+    topics := fs.String("topic", "", "topics, comma separated, empty means all")
+    bucket := fs.Duration("bucket", time.Hour, "segments whose first msg is in one bucket are merged")
+    minAge := fs.Duration("min_age", 2 * time.Hour, "only segments finished longer ago")
+    maxSizeM := fs.Int("max_size_m", 300, "max size of a merged segment, 0 no limit")
+    minFiles := fs.Int("min_files", 2, "buckets with fewer segments are left alone")
+    dryRun := fs.Bool("dry_run", false, "only print what would be merged")
+    keyFile := fs.String("key_file", "", "key file to decrypt and encrypt encrypted segments")
+    fs.Parse(args)
+
+    if *dirs == "" {
+        fmt.Fprintf(os.Stderr, "-dirs is required\n")
+        fs.Usage()
+        return -1
+    }
+
+    keyring, err := loadKeyring(*keyFile)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n", err)
+        return -1
+    }
+
+    opts := &compact.Options{
+        Topics: splitList(*topics),
+        Bucket: *bucket,
+        MinAge: *minAge,
+        MaxBytes: int64(*maxSizeM) * 1024 * 1024,
+        MinFiles: *minFiles,
+        Keyring: keyring,
+        DryRun: *dryRun,
+    }
+
+    ret := 0
+    var merged, inputs int
+    for _, path := range catalogPaths(splitList(*dirs), *catalogName) {
+        results, err := compact.Compact(util.GetCatalog(path), opts)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Compact catalog[%s] err[%s]\n", path, err)
+            ret = 1
+            continue
+        }
+
+        for _, r := range results {
+            first := r.Inputs[0].Path
+            switch {
+            case r.Err != nil:
+                fmt.Printf("FAILED\t%s\t%d\t%s\n", first, len(r.Inputs), r.Err)
+                ret = 1
+            case r.Skipped != nil:
+                fmt.Printf("SKIPPED\t%s\t%d\t%s\n", first, len(r.Inputs), r.Skipped)
+            case r.Output == nil:
+                fmt.Printf("PLAN\t%s\t%d\n", first, len(r.Inputs))
+            default:
+                fmt.Printf("MERGED\t%s\t%d\t%s\t%d\n", first, len(r.Inputs), r.Output.Path, r.Output.MsgCount)
+                merged++
+                inputs += len(r.Inputs)
+            }
+        }
+    }
+
+    fmt.Fprintf(os.Stderr, "merged %d segments into %d\n", inputs, merged)
+    return ret
+}
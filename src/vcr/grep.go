@@ -0,0 +1,313 @@
+package vcr
+
+import (
+    "util"
+    "util/segment"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "regexp"
+    "runtime"
+    "strings"
+    "compress/gzip"
+    "encoding/json"
+)
+
+func init() {
+    register("grep", "search records of a topic in a time range by regex or json predicates", runGrep)
+}
+
+// grepQuery is what a record must match
+type grepQuery struct {
+    regex      *regexp.Regexp
+    predicates []*util.Predicate
+    from       int64 // unix nano, 0 no limit, records without timestamp always pass
+    to         int64
+}
+
+func (q *grepQuery) match(rec *segment.Record) bool {
+    if rec.Timestamp != 0 {
+        if (q.from != 0 && rec.Timestamp < q.from) || (q.to != 0 && rec.Timestamp > q.to) {
+            return false
+        }
+    }
+    if q.regex != nil && !q.regex.Match(rec.Body) {
+        return false
+    }
+    return util.MatchAll(q.predicates, rec.Body)
+}
+
+// grepMatch is a matched record, or the read error of its segment
+type grepMatch struct {
+    index  int
+    rec    *segment.Record
+    header *segment.Header
+    err    error
+}
+
+// grepSegment sends matches of path to out in order, then closes out
+func grepSegment(path string, keyring *util.Keyring, q *grepQuery, out chan<- *grepMatch) {
+    defer close(out)
+
+    file, err := segment.Open(path, keyring)
+    if err != nil {
+        out <- &grepMatch{err: err}
+        return
+    }
+    defer file.Close()
+    file.SetPooled(true)
+
+    for index := 0; ; index++ {
+        rec, err := file.Next()
+        if err == io.EOF {
+            return
+        }
+        if err != nil {
+            out <- &grepMatch{err: fmt.Errorf("record %d: %s", index, err)}
+            return
+        }
+        if !q.match(rec) {
+            rec.Release()
+            continue
+        }
+        out <- &grepMatch{index: index, rec: rec, header: file.Header}
+    }
+}
+
+// grepSegments decodes segments by workers goroutines, results[i] gets
+// matches of paths[i]. Segments are taken in order, so the lowest one not
+// drained is always being read and draining results in order never blocks.
+func grepSegments(paths []string, keyring *util.Keyring, q *grepQuery, workers int) []chan *grepMatch {
+    results := make([]chan *grepMatch, len(paths))
+    for i := range results {
+        results[i] = make(chan *grepMatch, 256)
+    }
+
+    next := make(chan int, len(paths))
+    for i := range paths {
+        next <- i
+    }
+    close(next)
+
+    for w := 0; w < workers; w++ {
+        go func() {
+            for i := range next {
+                grepSegment(paths[i], keyring, q, results[i])
+            }
+        }()
+    }
+    return results
+}
+
+// grepOutput writes matches as a segment play can replay, the file is
+// named with msg-num until closed so play skips it meanwhile
+type grepOutput struct {
+    path  string
+    temp  string
+    fp    *os.File
+    gz    *gzip.Writer
+    w     *segment.Writer
+    query string // stored as record_filter in header
+    count int
+}
+
+func newGrepOutput(path, query string) (*grepOutput, error) {
+    o := &grepOutput{path: path, temp: path + ".msg-num", query: query}
+    fp, err := os.Create(o.temp)
+    if err != nil {
+        return nil, err
+    }
+    o.fp = fp
+    if strings.HasSuffix(path, ".gz") {
+        o.gz = gzip.NewWriter(fp)
+    }
+    return o, nil
+}
+
+// header is taken from the first match, create_time is kept so play
+// shifts timestamps the same way as for the original segment
+func (o *grepOutput) write(m *grepMatch) error {
+    if o.w == nil {
+        meta := map[string]string{"record_filter": o.query}
+        var flags byte
+        if m.header != nil {
+            for k, v := range m.header.Meta {
+                if k != "record_filter" {
+                    meta[k] = v
+                }
+            }
+            flags = m.header.Flags
+        }
+
+        var w io.Writer = o.fp
+        if o.gz != nil {
+            w = o.gz
+        }
+        o.w = segment.NewWriter(w, segment.NewHeader(flags | segment.FlagCRC, meta))
+        if err := o.w.WriteHeader(); err != nil {
+            return err
+        }
+    }
+
+    o.count++
+    _, err := o.w.Write(m.rec)
+    return err
+}
+
+// Close renames the segment with msg count like record does, it is
+// removed if nothing matched
+func (o *grepOutput) Close() error {
+    if o.gz != nil {
+        o.gz.Close()
+    }
+    if err := o.fp.Close(); err != nil {
+        return err
+    }
+    if o.count == 0 {
+        return os.Remove(o.temp)
+    }
+    return util.AtomicRename(o.temp, o.path)
+}
+
+func runGrep(args []string) int {
+    fs := flag.NewFlagSet("grep", flag.ExitOnError)
+    dirs := fs.String("dirs", "", "write dirs, comma separated, segments are found by catalog")
+    files := fs.String("files", "", "segment files, comma separated, instead of catalog")
+    catalogName := fs.String("catalog_name", util.DefaultCatalogName, "catalog file name in write dir")
+    topic := fs.String("topic", "", "topic to search, required with -dirs")
+    from := fs.String("from", "", "start time, e.g. 2006-01-02 15:04:05")
+    to := fs.String("to", "", "end time, e.g. 2006-01-02 15:04:05")
+    regex := fs.String("regex", "", "regex on message body")
+    predicates := fs.String("json", "", `json field predicates all to match, e.g. [{"path": "order.id", "op": "eq", "value": 123}]`)
+    workers := fs.Int("workers", 0, "segments decoded in parallel, <= 0 means all cpus")
+    limit := fs.Int("limit", 0, "stop after n matches, 0 no limit")
+    count := fs.Bool("count", false, "only print the number of matches")
+    out := fs.String("out", "", "also write matches to this segment, gzip if it ends with .gz")
+    keyFile := fs.String("key_file", "", "key file to decrypt encrypted segments")
+    fs.Parse(args)
+
+    if *dirs == "" && *files == "" {
+        fmt.Fprintf(os.Stderr, "one of -dirs, -files is required\n")
+        fs.Usage()
+        return -1
+    }
+    if *dirs != "" && *topic == "" {
+        fmt.Fprintf(os.Stderr, "-topic is required with -dirs\n")
+        return -1
+    }
+
+    q := &grepQuery{}
+    var err error
+    if q.from, err = parseTime(*from); err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n", err)
+        return -1
+    }
+    if q.to, err = parseTime(*to); err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n", err)
+        return -1
+    }
+    if *regex != "" {
+        if q.regex, err = regexp.Compile(*regex); err != nil {
+            fmt.Fprintf(os.Stderr, "Regex err[%s]\n", err)
+            return -1
+        }
+    }
+    if *predicates != "" {
+        var confs []util.PredicateConfig
+        if err := json.Unmarshal([]byte(*predicates), &confs); err != nil {
+            fmt.Fprintf(os.Stderr, "Parse -json err[%s]\n", err)
+            return -1
+        }
+        if q.predicates, err = util.NewPredicates(confs); err != nil {
+            fmt.Fprintf(os.Stderr, "%s\n", err)
+            return -1
+        }
+    }
+
+    keyring, err := loadKeyring(*keyFile)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n", err)
+        return -1
+    }
+
+    paths := splitList(*files)
+    if len(paths) == 0 {
+        entries, err := querySegments(splitList(*dirs), *catalogName, *topic, *from, *to)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Query catalog err[%s]\n", err)
+            return -2
+        }
+        for _, e := range entries {
+            path, ok := resolveSegment(e.Path)
+            if !ok {
+                fmt.Fprintf(os.Stderr, "Segment[%s] in catalog is gone, skip\n", e.Path)
+                continue
+            }
+            paths = append(paths, path)
+        }
+    }
+    if len(paths) == 0 {
+        fmt.Fprintf(os.Stderr, "No segment to search\n")
+        return -2
+    }
+
+    var output *grepOutput
+    if *out != "" {
+        def, _ := json.Marshal(map[string]string{"regex": *regex, "json": *predicates, "from": *from, "to": *to})
+        if output, err = newGrepOutput(*out, string(def)); err != nil {
+            fmt.Fprintf(os.Stderr, "Create output err[%s]\n", err)
+            return -2
+        }
+    }
+
+    if *workers <= 0 {
+        *workers = runtime.NumCPU()
+    }
+    results := grepSegments(paths, keyring, q, *workers)
+
+    ret, matched := 0, 0
+    enc := json.NewEncoder(os.Stdout)
+    enc.SetEscapeHTML(false)
+drain:
+    for i, result := range results {
+        for m := range result {
+            if m.err != nil {
+                fmt.Fprintf(os.Stderr, "Read segment[%s] err[%s]\n", paths[i], m.err)
+                ret = 1
+                continue
+            }
+
+            matched++
+            if !*count {
+                enc.Encode(newRecordLine(paths[i], m.index, m.rec))
+            }
+            if output != nil {
+                if err := output.write(m); err != nil {
+                    fmt.Fprintf(os.Stderr, "Write output err[%s]\n", err)
+                    m.rec.Release()
+                    return -2
+                }
+            }
+            m.rec.Release()
+
+            if *limit > 0 && matched >= *limit {
+                break drain
+            }
+        }
+    }
+    // after limit, workers still running are left blocked, the process exits
+
+    if *count {
+        fmt.Printf("%d\n", matched)
+    }
+    if output != nil {
+        if err := output.Close(); err != nil {
+            fmt.Fprintf(os.Stderr, "Close output err[%s]\n", err)
+            return -2
+        }
+        fmt.Fprintf(os.Stderr, "wrote %d records to %s\n", output.count, output.path)
+    }
+    fmt.Fprintf(os.Stderr, "segments %d, matches %d\n", len(paths), matched)
+    return ret
+}
@@ -0,0 +1,141 @@
+package vcr
+
+import (
+    "util"
+    "util/segment"
+    "fmt"
+    "os"
+    "path/filepath"
+    "reflect"
+    "regexp"
+    "testing"
+)
+
+func TestGrepQueryMatch(t *testing.T) {
+    predicates, err := util.NewPredicates([]util.PredicateConfig{{Path: "order.id", Op: "ge", Value: 10}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    q := &grepQuery{regex: regexp.MustCompile(`"shop":"s1"`), predicates: predicates, from: 100, to: 200}
+
+    for _, c := range []struct {
+        ts   int64
+        body string
+        want bool
+    }{
+        {150, `{"order":{"id":10},"shop":"s1"}`, true},
+        {100, `{"order":{"id":10},"shop":"s1"}`, true},
+        {200, `{"order":{"id":10},"shop":"s1"}`, true},
+        {99, `{"order":{"id":10},"shop":"s1"}`, false},
+        {201, `{"order":{"id":10},"shop":"s1"}`, false},
+        {0, `{"order":{"id":10},"shop":"s1"}`, true}, // no timestamp recorded
+        {150, `{"order":{"id":9},"shop":"s1"}`, false},
+        {150, `{"order":{"id":10},"shop":"s2"}`, false},
+        {150, `"shop":"s1" not json`, false},
+    } {
+        if got := q.match(&segment.Record{Timestamp: c.ts, Body: []byte(c.body)}); got != c.want {
+            t.Fatalf("ts %d body %s got %v", c.ts, c.body, got)
+        }
+    }
+
+    if !(&grepQuery{}).match(&segment.Record{Timestamp: 1, Body: []byte("x")}) {
+        t.Fatal("empty query must match anything")
+    }
+}
+
+// matches come back per segment in order whatever the workers
+func TestGrepSegmentsOrder(t *testing.T) {
+    dir := t.TempDir()
+    var paths, want []string
+    for i := 0; i < 8; i++ {
+        path := filepath.Join(dir, fmt.Sprintf("seg_%d", i))
+        var bodies []string
+        for j := 0; j < 50; j++ {
+            bodies = append(bodies, fmt.Sprintf(`{"seg":%d,"n":%d}`, i, j))
+            if j % 7 == 0 {
+                want = append(want, fmt.Sprintf("%d:%d", i, j))
+            }
+        }
+        writeRecords(t, path, bodies...)
+        paths = append(paths, path)
+    }
+    // broken segment reports its error in its place
+    paths = append(paths[:4], append([]string{filepath.Join(dir, "missing")}, paths[4:]...)...)
+
+    predicates, _ := util.NewPredicates([]util.PredicateConfig{{Path: "n", Op: "regex", Value: "^(0|7|14|21|28|35|42|49)$"}})
+    for _, workers := range []int{1, 3, 16} {
+        var got []string
+        errs := 0
+        for i, result := range grepSegments(paths, nil, &grepQuery{predicates: predicates}, workers) {
+            for m := range result {
+                if m.err != nil {
+                    if filepath.Base(paths[i]) != "missing" {
+                        t.Fatalf("segment %s err[%s]", paths[i], m.err)
+                    }
+                    errs++
+                    continue
+                }
+                var seg, n int
+                fmt.Sscanf(string(m.rec.Body), `{"seg":%d,"n":%d}`, &seg, &n)
+                got = append(got, fmt.Sprintf("%d:%d", seg, n))
+                m.rec.Release()
+            }
+        }
+        if errs != 1 || !reflect.DeepEqual(got, want) {
+            t.Fatalf("workers %d errs %d got %v", workers, errs, got)
+        }
+    }
+}
+
+func TestGrepOutput(t *testing.T) {
+    dir := t.TempDir()
+    src := filepath.Join(dir, "a_3")
+    writeRecords(t, src, "x1", "y", "x2")
+
+    out := filepath.Join(dir, "out.gz")
+    o, err := newGrepOutput(out, `{"regex":"x"}`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for m := range grepSegments([]string{src}, nil, &grepQuery{regex: regexp.MustCompile("x")}, 1)[0] {
+        if err := o.write(m); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := o.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    file, err := segment.Open(out, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+    if file.Codec != "gzip" || file.Header.Meta["record_filter"] != `{"regex":"x"}` || file.Header.Meta["topic"] != "t" ||
+        !file.Header.HasTimestamp() {
+        t.Fatalf("codec %s header %+v", file.Codec, file.Header)
+    }
+    for _, want := range []string{"x1", "x2"} {
+        rec, err := file.Next()
+        if err != nil || string(rec.Body) != want {
+            t.Fatalf("got %v err %v, want %s", rec, err, want)
+        }
+    }
+    if _, err := os.Stat(out + ".msg-num"); !os.IsNotExist(err) {
+        t.Fatal("temp output left")
+    }
+
+    // nothing matched, nothing left
+    empty := filepath.Join(dir, "empty")
+    if o, err = newGrepOutput(empty, "{}"); err != nil {
+        t.Fatal(err)
+    }
+    if err := o.Close(); err != nil {
+        t.Fatal(err)
+    }
+    for _, path := range []string{empty, empty + ".msg-num"} {
+        if _, err := os.Stat(path); !os.IsNotExist(err) {
+            t.Fatalf("%s exists", path)
+        }
+    }
+}
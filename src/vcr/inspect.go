@@ -0,0 +1,293 @@
+package vcr
+
+import (
+    "util"
+    "util/segment"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "strings"
+    "time"
+    "path/filepath"
+    "unicode/utf8"
+    "encoding/json"
+    "encoding/base64"
+)
+
+func init() {
+    register("inspect", "print records or stats of segments as json lines", runInspect)
+}
+
+// recordLine is one record printed by inspect and grep
+type recordLine struct {
+    Path       string  `json:"path"`
+    Index      int     `json:"index"`  // record number in segment, from 0
+    Offset     int64   `json:"offset"` // in decompressed data, see inspect -offset
+    Timestamp  int64   `json:"timestamp,omitempty"`
+    Time       string  `json:"time,omitempty"`
+    Seq        uint64  `json:"seq,omitempty"`
+    Size       int     `json:"size"`
+    Body       *string `json:"body,omitempty"`        // utf-8 bodies
+    BodyBase64 string  `json:"body_base64,omitempty"` // binary bodies
+}
+
+func newRecordLine(path string, index int, rec *segment.Record) *recordLine {
+    line := &recordLine{
+        Path: path,
+        Index: index,
+        Offset: rec.Offset,
+        Timestamp: rec.Timestamp,
+        Seq: rec.Seq,
+        Size: len(rec.Body),
+    }
+    if rec.Timestamp != 0 {
+        line.Time = time.Unix(0, rec.Timestamp).Format(time.RFC3339Nano)
+    }
+    if utf8.Valid(rec.Body) {
+        body := string(rec.Body)
+        line.Body = &body
+    } else {
+        line.BodyBase64 = base64.StdEncoding.EncodeToString(rec.Body)
+    }
+    return line
+}
+
+// segmentStats is the summary of one segment
+type segmentStats struct {
+    Path      string            `json:"path"`
+    FileSize  int64             `json:"file_size"`
+    Codec     string            `json:"codec"`
+    KeyID     string            `json:"key_id,omitempty"`
+    Version   byte              `json:"version,omitempty"` // 0 for old segment without header
+    Flags     []string          `json:"flags,omitempty"`
+    Meta      map[string]string `json:"meta,omitempty"`
+    Finalized bool              `json:"finalized"` // renamed by rotate and read to a clean end
+    Records   int               `json:"records"`
+    Bytes     int64             `json:"bytes"` // bodies
+    SizeMin   int               `json:"size_min"`
+    SizeAvg   int64             `json:"size_avg"`
+    SizeP50   int               `json:"size_p50"`
+    SizeP90   int               `json:"size_p90"`
+    SizeP99   int               `json:"size_p99"`
+    SizeMax   int               `json:"size_max"`
+    FirstTime string            `json:"first_time,omitempty"`
+    LastTime  string            `json:"last_time,omitempty"`
+    Span      string            `json:"span,omitempty"`
+    FirstSeq  uint64            `json:"first_seq,omitempty"`
+    LastSeq   uint64            `json:"last_seq,omitempty"`
+    Error     string            `json:"error,omitempty"`
+}
+
+func headerFlags(h *segment.Header) []string {
+    var ret []string
+    if h.HasCRC() {
+        ret = append(ret, "crc")
+    }
+    if h.HasTimestamp() {
+        ret = append(ret, "timestamp")
+    }
+    if h.HasSequence() {
+        ret = append(ret, "seq")
+    }
+    return ret
+}
+
+func inspectStats(path string, keyring *util.Keyring) *segmentStats {
+    st := &segmentStats{Path: path}
+    if fi, err := os.Stat(path); err == nil {
+        st.FileSize = fi.Size()
+    }
+
+    file, err := segment.Open(path, keyring)
+    if err != nil {
+        st.Error = err.Error()
+        return st
+    }
+    defer file.Close()
+    st.Codec, st.KeyID = file.Codec, file.KeyID
+    if file.Header != nil {
+        st.Version = file.Header.Version
+        st.Flags = headerFlags(file.Header)
+        st.Meta = file.Header.Meta
+    }
+    file.SetPooled(true)
+
+    var sizes []int
+    var first, last int64
+    for {
+        rec, err := file.Next()
+        if err == io.EOF {
+            // being written until rotate renames msg-num
+            st.Finalized = !strings.Contains(filepath.Base(path), "msg-num")
+            break
+        }
+        if err != nil {
+            st.Error = fmt.Sprintf("record %d: %s", len(sizes), err)
+            break
+        }
+
+        sizes = append(sizes, len(rec.Body))
+        st.Bytes += int64(len(rec.Body))
+        if rec.Timestamp != 0 {
+            if first == 0 || rec.Timestamp < first {
+                first = rec.Timestamp
+            }
+            if rec.Timestamp > last {
+                last = rec.Timestamp
+            }
+        }
+        if rec.Seq != 0 {
+            if st.FirstSeq == 0 {
+                st.FirstSeq = rec.Seq
+            }
+            st.LastSeq = rec.Seq
+        }
+        rec.Release()
+    }
+
+    st.Records = len(sizes)
+    if len(sizes) > 0 {
+        sort.Ints(sizes)
+        st.SizeMin, st.SizeMax = sizes[0], sizes[len(sizes) - 1]
+        st.SizeAvg = st.Bytes / int64(len(sizes))
+        st.SizeP50 = sizes[len(sizes) * 50 / 100]
+        st.SizeP90 = sizes[len(sizes) * 90 / 100]
+        st.SizeP99 = sizes[len(sizes) * 99 / 100]
+    }
+    if first != 0 {
+        st.FirstTime = time.Unix(0, first).Format(time.RFC3339Nano)
+        st.LastTime = time.Unix(0, last).Format(time.RFC3339Nano)
+        st.Span = time.Duration(last - first).String()
+    }
+    return st
+}
+
+// inspectOptions select records of every segment, limit counts all segments
+type inspectOptions struct {
+    head   int
+    tail   int
+    offset int64
+    limit  int
+}
+
+// inspectRecords prints records of path, false if limit is reached
+func inspectRecords(path string, keyring *util.Keyring, opts *inspectOptions,
+    printed *int, enc *json.Encoder) (bool, error) {
+    file, err := segment.Open(path, keyring)
+    if err != nil {
+        return true, err
+    }
+    defer file.Close()
+
+    var ring []*recordLine // last tail records
+    for index, taken := 0, 0; ; index++ {
+        rec, err := file.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            err = fmt.Errorf("record %d: %s", index, err)
+            // what is read before the broken record is still printed
+            for _, line := range ring {
+                if !printLine(line, opts, printed, enc) {
+                    return false, err
+                }
+            }
+            return true, err
+        }
+        if rec.Offset < opts.offset {
+            continue
+        }
+
+        line := newRecordLine(path, index, rec)
+        taken++
+        if opts.tail > 0 {
+            if len(ring) == opts.tail {
+                ring = ring[1:]
+            }
+            ring = append(ring, line)
+            continue
+        }
+        if !printLine(line, opts, printed, enc) {
+            return false, nil
+        }
+        if opts.head > 0 && taken >= opts.head {
+            return true, nil
+        }
+    }
+
+    for _, line := range ring {
+        if !printLine(line, opts, printed, enc) {
+            return false, nil
+        }
+    }
+    return true, nil
+}
+
+func printLine(line *recordLine, opts *inspectOptions, printed *int, enc *json.Encoder) bool {
+    if opts.limit > 0 && *printed >= opts.limit {
+        return false
+    }
+    enc.Encode(line)
+    *printed++
+    return true
+}
+
+func runInspect(args []string) int {
+    fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+    files := fs.String("files", "", "segment files, comma separated, or give them as arguments")
+    stats := fs.Bool("stats", false, "print a summary of every segment instead of records")
+    head := fs.Int("head", 0, "only the first n records of every segment")
+    tail := fs.Int("tail", 0, "only the last n records of every segment")
+    offset := fs.Int64("offset", 0, "skip records before this offset of every segment")
+    limit := fs.Int("limit", 0, "print at most n records in total, 0 no limit")
+    keyFile := fs.String("key_file", "", "key file to decrypt encrypted segments")
+    fs.Parse(args)
+
+    paths := append(splitList(*files), fs.Args()...)
+    if len(paths) == 0 {
+        fmt.Fprintf(os.Stderr, "segment files are required\n")
+        fs.Usage()
+        return -1
+    }
+    if *head > 0 && *tail > 0 {
+        fmt.Fprintf(os.Stderr, "-head and -tail are exclusive\n")
+        return -1
+    }
+
+    keyring, err := loadKeyring(*keyFile)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n", err)
+        return -1
+    }
+
+    ret := 0
+    enc := json.NewEncoder(os.Stdout)
+    enc.SetEscapeHTML(false)
+    if *stats {
+        for _, path := range paths {
+            st := inspectStats(path, keyring)
+            if st.Error != "" {
+                ret = 1
+            }
+            enc.Encode(st)
+        }
+        return ret
+    }
+
+    opts := &inspectOptions{head: *head, tail: *tail, offset: *offset, limit: *limit}
+    printed := 0
+    for _, path := range paths {
+        more, err := inspectRecords(path, keyring, opts, &printed, enc)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Read segment[%s] err[%s]\n", path, err)
+            ret = 1
+        }
+        if !more {
+            break
+        }
+    }
+    return ret
+}
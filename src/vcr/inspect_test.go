@@ -0,0 +1,161 @@
+package vcr
+
+import (
+    "util/segment"
+    "bytes"
+    "fmt"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "encoding/json"
+)
+
+// writeRecords writes a segment with timestamps and seqs, record i has
+// timestamp i+1 seconds and seq i+100
+func writeRecords(t *testing.T, path string, bodies ...string) {
+    fp, err := os.Create(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer fp.Close()
+    flags := segment.FlagCRC | segment.FlagTimestamp | segment.FlagSequence
+    w := segment.NewWriter(fp, segment.NewHeader(flags, map[string]string{"topic": "t"}))
+    if err := w.WriteHeader(); err != nil {
+        t.Fatal(err)
+    }
+    for i, body := range bodies {
+        rec := &segment.Record{Timestamp: int64(i + 1) * 1e9, Seq: uint64(i + 100), Body: []byte(body)}
+        if _, err := w.Write(rec); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+func inspect(t *testing.T, opts *inspectOptions, paths ...string) ([]*recordLine, []error) {
+    var buf bytes.Buffer
+    enc := json.NewEncoder(&buf)
+    printed := 0
+    var errs []error
+    for _, path := range paths {
+        more, err := inspectRecords(path, nil, opts, &printed, enc)
+        if err != nil {
+            errs = append(errs, err)
+        }
+        if !more {
+            break
+        }
+    }
+
+    var ret []*recordLine
+    dec := json.NewDecoder(&buf)
+    for dec.More() {
+        line := &recordLine{}
+        if err := dec.Decode(line); err != nil {
+            t.Fatal(err)
+        }
+        ret = append(ret, line)
+    }
+    return ret, errs
+}
+
+func indexes(lines []*recordLine) []string {
+    var ret []string
+    for _, line := range lines {
+        ret = append(ret, fmt.Sprintf("%s:%d", filepath.Base(line.Path), line.Index))
+    }
+    return ret
+}
+
+func TestInspectStats(t *testing.T) {
+    dir := t.TempDir()
+    path := filepath.Join(dir, "backup.log.a_4")
+    writeRecords(t, path, "a", "bb", "cccc", "dddddddd")
+
+    st := inspectStats(path, nil)
+    if st.Error != "" || !st.Finalized || st.Codec != "none" || st.Records != 4 || st.Bytes != 15 {
+        t.Fatalf("stats %+v", st)
+    }
+    if st.SizeMin != 1 || st.SizeMax != 8 || st.SizeAvg != 3 || st.SizeP50 != 4 || st.SizeP99 != 8 {
+        t.Fatalf("sizes %+v", st)
+    }
+    if st.FirstSeq != 100 || st.LastSeq != 103 || st.Span != "3s" {
+        t.Fatalf("keys %+v", st)
+    }
+    if !reflect.DeepEqual(st.Flags, []string{"crc", "timestamp", "seq"}) || st.Meta["topic"] != "t" {
+        t.Fatalf("header %+v", st)
+    }
+
+    // still being written
+    open := filepath.Join(dir, "backup.log.b_msg-num")
+    writeRecords(t, open, "a")
+    if st := inspectStats(open, nil); st.Finalized {
+        t.Fatal("msg-num segment finalized")
+    }
+
+    content, _ := os.ReadFile(path)
+    broken := filepath.Join(dir, "backup.log.c_4")
+    os.WriteFile(broken, content[:len(content) - 3], 0644)
+    if st := inspectStats(broken, nil); st.Finalized || st.Records != 3 || !strings.HasPrefix(st.Error, "record 3:") {
+        t.Fatalf("truncated stats %+v", st)
+    }
+}
+
+func TestInspectSelect(t *testing.T) {
+    dir := t.TempDir()
+    a, b := filepath.Join(dir, "a_3"), filepath.Join(dir, "b_3")
+    writeRecords(t, a, "a0", "a1", "a2")
+    writeRecords(t, b, "b0", "b1", "b2")
+
+    all, _ := inspect(t, &inspectOptions{}, a)
+    cases := []struct {
+        opts *inspectOptions
+        want []string
+    }{
+        {&inspectOptions{}, []string{"a_3:0", "a_3:1", "a_3:2", "b_3:0", "b_3:1", "b_3:2"}},
+        {&inspectOptions{head: 1}, []string{"a_3:0", "b_3:0"}},
+        {&inspectOptions{tail: 2}, []string{"a_3:1", "a_3:2", "b_3:1", "b_3:2"}},
+        {&inspectOptions{offset: all[1].Offset}, []string{"a_3:1", "a_3:2", "b_3:1", "b_3:2"}},
+        {&inspectOptions{offset: all[1].Offset, head: 1}, []string{"a_3:1", "b_3:1"}},
+        {&inspectOptions{limit: 4}, []string{"a_3:0", "a_3:1", "a_3:2", "b_3:0"}},
+        {&inspectOptions{tail: 2, limit: 3}, []string{"a_3:1", "a_3:2", "b_3:1"}},
+    }
+    for _, c := range cases {
+        lines, errs := inspect(t, c.opts, a, b)
+        if errs != nil || !reflect.DeepEqual(indexes(lines), c.want) {
+            t.Fatalf("opts %+v got %v errs %v", *c.opts, indexes(lines), errs)
+        }
+    }
+}
+
+func TestInspectRecordLine(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "a_2")
+    writeRecords(t, path, "héllo", "\xff\x00bin")
+
+    lines, _ := inspect(t, &inspectOptions{}, path)
+    if len(lines) != 2 {
+        t.Fatalf("lines %d", len(lines))
+    }
+    if l := lines[0]; l.Body == nil || *l.Body != "héllo" || l.BodyBase64 != "" || l.Size != 6 || l.Seq != 100 || l.Timestamp != 1e9 {
+        t.Fatalf("utf-8 line %+v", l)
+    }
+    if l := lines[1]; l.Body != nil || l.BodyBase64 != "/wBiaW4=" || l.Size != 5 {
+        t.Fatalf("binary line %+v", l)
+    }
+}
+
+// records before a broken one are still printed with the error
+func TestInspectBroken(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "a_3")
+    writeRecords(t, path, "a0", "a1", "a2")
+    content, _ := os.ReadFile(path)
+    os.WriteFile(path, content[:len(content) - 1], 0644)
+
+    for _, opts := range []*inspectOptions{{}, {tail: 5}} {
+        lines, errs := inspect(t, opts, path)
+        if len(lines) != 2 || len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "record 2:") {
+            t.Fatalf("opts %+v lines %v errs %v", *opts, indexes(lines), errs)
+        }
+    }
+}
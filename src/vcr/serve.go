@@ -0,0 +1,99 @@
+package vcr
+
+import (
+    "util"
+    "logger"
+    "serve"
+    "flag"
+    "fmt"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "syscall"
+)
+
+func init() {
+    register("serve", "serve recorded segments of a topic as a fake nsqd", runServe)
+}
+
+// catalog keeps the original path, play may have moved it to done/
+func resolveSegment(path string) (string, bool) {
+    if _, err := os.Stat(path); err == nil {
+        return path, true
+    }
+    dir, name := filepath.Split(path)
+    done := filepath.Join(dir, "done", name + ".done")
+    if _, err := os.Stat(done); err == nil {
+        return done, true
+    }
+    return "", false
+}
+
+func runServe(args []string) int {
+    fs := flag.NewFlagSet("serve", flag.ExitOnError)
+    addr := fs.String("addr", "127.0.0.1:4150", "tcp address to listen, consumers connect to it as nsqd")
+    dirs := fs.String("dirs", "", "write dirs, comma separated, segments are found by catalog")
+    files := fs.String("files", "", "segment files in replay order, comma separated, instead of catalog")
+    catalogName := fs.String("catalog_name", util.DefaultCatalogName, "catalog file name in write dir")
+    topic := fs.String("topic", "", "topic to serve")
+    from := fs.String("from", "", "start time, e.g. 2006-01-02 15:04:05")
+    to := fs.String("to", "", "end time, e.g. 2006-01-02 15:04:05")
+    rate := fs.Int("rate", 0, "messages per second per channel, 0 means max speed")
+    loop := fs.Bool("loop", false, "replay the archive again after the last segment")
+    keyFile := fs.String("key_file", "", "key file to decrypt encrypted segments")
+    verbose := fs.Bool("v", false, "log connections and protocol errors")
+    fs.Parse(args)
+
+    if *topic == "" || (*dirs == "" && *files == "") {
+        fmt.Fprintf(os.Stderr, "-topic and one of -dirs, -files are required\n")
+        fs.Usage()
+        return -1
+    }
+
+    keyring, err := loadKeyring(*keyFile)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n", err)
+        return -1
+    }
+
+    segments := splitList(*files)
+    if len(segments) == 0 {
+        entries, err := querySegments(splitList(*dirs), *catalogName, *topic, *from, *to)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Query catalog err[%s]\n", err)
+            return -2
+        }
+        for _, e := range entries {
+            path, ok := resolveSegment(e.Path)
+            if !ok {
+                fmt.Fprintf(os.Stderr, "Segment[%s] in catalog is gone, skip\n", e.Path)
+                continue
+            }
+            segments = append(segments, path)
+        }
+    }
+    if len(segments) == 0 {
+        fmt.Fprintf(os.Stderr, "No segment to serve\n")
+        return -2
+    }
+
+    if *verbose {
+        logger.SetLevel(logger.INFO)
+    }
+
+    server := serve.NewServer(*addr, *topic, segments, keyring, *rate, *loop)
+
+    sigChan := make(chan os.Signal, 1)
+    signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+    go func() {
+        <- sigChan
+        server.Close()
+    }()
+
+    fmt.Fprintf(os.Stderr, "serving topic[%s] segments[%d] on %s\n", *topic, len(segments), *addr)
+    if err := server.Serve(); err != nil {
+        fmt.Fprintf(os.Stderr, "Serve err[%s]\n", err)
+        return -2
+    }
+    return 0
+}
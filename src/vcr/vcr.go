@@ -0,0 +1,93 @@
+package vcr
+
+import (
+    "util"
+    "logger"
+    "fmt"
+    "os"
+    "sort"
+    "strings"
+    "time"
+)
+
+type command struct {
+    usage string
+    run   func(args []string) int
+}
+
+var commands = map[string]*command{}
+
+func register(name, usage string, run func(args []string) int) {
+    commands[name] = &command{usage: usage, run: run}
+}
+
+func Usage() {
+    fmt.Fprintf(os.Stderr, "Usage: vcr command [options]\n\ncommands:\n")
+    var names []string
+    for name := range commands {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+    }
+    fmt.Fprintf(os.Stderr, "\nrun vcr command -h for command options\n")
+}
+
+func Main(args []string) int {
+    if len(args) < 1 {
+        Usage()
+        return -1
+    }
+
+    cmd, ok := commands[args[0]]
+    if !ok {
+        fmt.Fprintf(os.Stderr, "Unknown command[%s]\n", args[0])
+        Usage()
+        return -1
+    }
+
+    // cli output goes to stdout, only show errors from logger
+    logger.SetLevel(logger.ERROR)
+    return cmd.run(args[1:])
+}
+
+// comma separated list flag value
+func splitList(s string) []string {
+    var ret []string
+    for _, field := range strings.Split(s, ",") {
+        if field = strings.TrimSpace(field); field != "" {
+            ret = append(ret, field)
+        }
+    }
+    return ret
+}
+
+var timeLayouts = []string{
+    "2006-01-02 15:04:05",
+    "2006-01-02T15:04:05",
+    "2006-01-02 15:04",
+    "2006-01-02",
+}
+
+// parse local time flag to unix nano, empty means no bound
+func parseTime(s string) (int64, error) {
+    if s == "" {
+        return 0, nil
+    }
+
+    for _, layout := range timeLayouts {
+        if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+            return t.UnixNano(), nil
+        }
+    }
+    return 0, fmt.Errorf("invalid time[%s], use format like %s", s, timeLayouts[0])
+}
+
+// empty key file means no encrypted segments expected
+func loadKeyring(keyFile string) (*util.Keyring, error) {
+    if keyFile == "" {
+        return nil, nil
+    }
+    return util.LoadKeyring(keyFile)
+}
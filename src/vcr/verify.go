@@ -0,0 +1,232 @@
+package vcr
+
+import (
+    "util"
+    "util/segment"
+    "flag"
+    "fmt"
+    "io"
+    "errors"
+    "os"
+    "strings"
+    "path/filepath"
+    "crypto/sha256"
+    "encoding/hex"
+)
+
+func init() {
+    register("verify", "check segments for corruption, truncation and checksum mismatch", runVerify)
+}
+
+const (
+    statusOK        = "OK"
+    statusCorrupt   = "CORRUPT"
+    statusTruncated = "TRUNCATED"
+    statusMismatch  = "MISMATCH"
+    statusMissing   = "MISSING"
+    statusNoKey     = "NOKEY"
+)
+
+type verifyResult struct {
+    path    string
+    status  string
+    records uint64
+    detail  string
+}
+
+// catalog entries keyed by segmentKey, names carry no topic or dir, so
+// base names of topics or disks rotating in the same second collide
+func catalogByPath(dirs []string, catalogName string) map[string]*util.CatalogEntry {
+    ret := make(map[string]*util.CatalogEntry)
+    for _, path := range catalogPaths(dirs, catalogName) {
+        entries, err := util.ReadCatalog(path)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "Read catalog[%s] err[%s]\n", path, err)
+            continue
+        }
+        for _, e := range entries {
+            ret[segmentKey(e.Path)] = e
+        }
+    }
+    return ret
+}
+
+// segmentKey is the cleaned absolute path a segment was recorded at,
+// play moves it to done/<name>.done
+func segmentKey(path string) string {
+    abs, err := filepath.Abs(path)
+    if err != nil {
+        abs = filepath.Clean(path)
+    }
+    dir, name := filepath.Split(abs)
+    dir = filepath.Clean(dir)
+    if filepath.Base(dir) == "done" && strings.HasSuffix(name, ".done") {
+        return filepath.Join(filepath.Dir(dir), strings.TrimSuffix(name, ".done"))
+    }
+    return abs
+}
+
+func fileChecksum(path string) (string, error) {
+    fp, err := os.Open(path)
+    if err != nil {
+        return "", err
+    }
+    defer fp.Close()
+
+    h := sha256.New()
+    if _, err := io.Copy(h, fp); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func readErrStatus(err error) string {
+    if errors.Is(err, segment.ErrTruncated) || errors.Is(err, io.ErrUnexpectedEOF) {
+        return statusTruncated
+    }
+    if errors.Is(err, util.ErrNoKeyring) || errors.Is(err, util.ErrKeyNotFound) {
+        return statusNoKey
+    }
+    return statusCorrupt
+}
+
+func verifySegment(path string, entry *util.CatalogEntry, keyring *util.Keyring) *verifyResult {
+    ret := &verifyResult{path: path, status: statusOK}
+
+    file, err := segment.Open(path, keyring)
+    if err != nil {
+        ret.status = readErrStatus(err)
+        ret.detail = err.Error()
+        return ret
+    }
+    defer file.Close()
+
+    for {
+        _, err := file.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            ret.status = readErrStatus(err)
+            ret.detail = fmt.Sprintf("record %d: %s", ret.records, err)
+            return ret
+        }
+        ret.records++
+    }
+
+    if entry == nil {
+        ret.detail = "not in catalog"
+        return ret
+    }
+
+    if entry.MsgCount != ret.records {
+        ret.status = statusMismatch
+        ret.detail = fmt.Sprintf("catalog msg_count %d, got %d", entry.MsgCount, ret.records)
+        return ret
+    }
+
+    if entry.Checksum != "" {
+        checksum, err := fileChecksum(path)
+        if err != nil {
+            ret.status = statusCorrupt
+            ret.detail = err.Error()
+            return ret
+        }
+        if checksum != entry.Checksum {
+            ret.status = statusMismatch
+            ret.detail = fmt.Sprintf("catalog sha256 %s, got %s", entry.Checksum, checksum)
+            return ret
+        }
+    }
+
+    return ret
+}
+
+// walk dirs for finished segments, skip catalog and files being written
+func listArchive(dirs []string, catalogName string) ([]string, error) {
+    var ret []string
+    for _, dir := range dirs {
+        err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+            if err != nil {
+                return err
+            }
+            if fi.IsDir() || fi.Name() == catalogName {
+                return nil
+            }
+            if strings.Index(fi.Name(), "msg-num") != -1 {
+                return nil
+            }
+            ret = append(ret, path)
+            return nil
+        })
+        if err != nil {
+            return nil, err
+        }
+    }
+    return ret, nil
+}
+
+func runVerify(args []string) int {
+    fs := flag.NewFlagSet("verify", flag.ExitOnError)
+    dirs := fs.String("dirs", "", "write dirs, comma separated")
+    catalogName := fs.String("catalog_name", util.DefaultCatalogName, "catalog file name in write dir")
+    quiet := fs.Bool("quiet", false, "only print bad segments")
+    missing := fs.Bool("missing", false, "report catalog entries whose file is gone")
+    keyFile := fs.String("key_file", "", "key file to decrypt encrypted segments")
+    fs.Parse(args)
+
+    if *dirs == "" {
+        fmt.Fprintf(os.Stderr, "-dirs is required\n")
+        fs.Usage()
+        return -1
+    }
+
+    keyring, err := loadKeyring(*keyFile)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "%s\n", err)
+        return -1
+    }
+
+    dirList := splitList(*dirs)
+    entries := catalogByPath(dirList, *catalogName)
+    paths, err := listArchive(dirList, *catalogName)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Walk archive err[%s]\n", err)
+        return -2
+    }
+
+    var bad int
+    counts := make(map[string]int)
+    seen := make(map[string]bool)
+    report := func(r *verifyResult) {
+        counts[r.status]++
+        if r.status == statusOK {
+            if *quiet {
+                return
+            }
+        } else {
+            bad++
+        }
+        fmt.Printf("%s\t%s\t%d\t%s\n", r.status, r.path, r.records, r.detail)
+    }
+
+    for _, path := range paths {
+        key := segmentKey(path)
+        seen[key] = true
+        report(verifySegment(path, entries[key], keyring))
+    }
+
+    if *missing {
+        for key, e := range entries {
+            if !seen[key] {
+                report(&verifyResult{path: e.Path, status: statusMissing, detail: "in catalog but not on disk"})
+            }
+        }
+    }
+
+    fmt.Fprintf(os.Stderr, "verified %d segments: %v\n", len(paths), counts)
+    if bad > 0 {
+        return 1
+    }
+    return 0
+}
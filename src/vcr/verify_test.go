@@ -0,0 +1,71 @@
+package vcr
+
+import (
+    "util"
+    "util/segment"
+    "io"
+    "os"
+    "path/filepath"
+    "testing"
+    "crypto/sha256"
+    "encoding/hex"
+)
+
+// writeTestSegment writes bodies as a plain segment and returns its sha256
+func writeTestSegment(t *testing.T, path string, bodies ...string) string {
+    if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+        t.Fatal(err)
+    }
+    fp, err := os.Create(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    h := sha256.New()
+    w := segment.NewWriter(io.MultiWriter(fp, h), segment.NewHeader(segment.FlagCRC, map[string]string{"topic": "t"}))
+    if err := w.WriteHeader(); err != nil {
+        t.Fatal(err)
+    }
+    for _, body := range bodies {
+        if _, err := w.Write(&segment.Record{Body: []byte(body)}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    fp.Close()
+    return hex.EncodeToString(h.Sum(nil))
+}
+
+func TestSegmentKey(t *testing.T) {
+    cases := map[string]string{
+        "/data1/a/b/x_5.gz": "/data1/a/b/x_5.gz",
+        "/data1/a/b/done/x_5.gz.done": "/data1/a/b/x_5.gz",
+        "/data1/a/b/./done/../x_5.gz": "/data1/a/b/x_5.gz",
+        "/data1/a/done/x_5.gz": "/data1/a/done/x_5.gz", // not played, a dir named done
+    }
+    for path, want := range cases {
+        if got := segmentKey(path); got != want {
+            t.Fatalf("segmentKey(%s) = %s, want %s", path, got, want)
+        }
+    }
+}
+
+// two topics rotating in the same second have the same base name
+func TestVerifySameBaseName(t *testing.T) {
+    dir := t.TempDir()
+    a := filepath.Join(dir, "a", "backup", "backup.log.2017_1")
+    b := filepath.Join(dir, "b", "backup", "done", "backup.log.2017_1.done")
+    sumA := writeTestSegment(t, a, "x")
+    sumB := writeTestSegment(t, b, "y")
+
+    catalog := util.GetCatalog(filepath.Join(dir, util.DefaultCatalogName))
+    catalog.Append(&util.CatalogEntry{Path: a, Topic: "a", MsgCount: 1, Checksum: sumA})
+    catalog.Append(&util.CatalogEntry{Path: filepath.Join(dir, "b", "backup", "backup.log.2017_1"),
+        Topic: "b", MsgCount: 1, Checksum: sumB})
+
+    entries := catalogByPath([]string{dir}, util.DefaultCatalogName)
+    for _, path := range []string{a, b} {
+        r := verifySegment(path, entries[segmentKey(path)], nil)
+        if r.status != statusOK || r.detail != "" {
+            t.Fatalf("%s status %s detail %s", path, r.status, r.detail)
+        }
+    }
+}